@@ -0,0 +1,223 @@
+// Package event maps uploads to the event they belong to and holds each
+// event's settings. The original wedding is the default event: its uploads
+// stay directly under uploads/ and its routes keep working without an /e/
+// prefix. Every other event has its own uploads/{event}/ prefix, routes
+// under /e/{event}/ and, unless configured otherwise, its own face collection.
+package event
+
+import (
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+// Default is the ID of the event that predates multi-event support
+const Default = "default"
+
+// Settings are cached this long, so a changed timezone or name applies
+// within minutes without a lookup per request
+const cacheTTL = 5 * time.Minute
+
+// Event IDs appear in keys and URLs, so they are lowercase slugs
+var idPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,39}$`)
+
+// Valid reports whether id can be used as an event ID
+func Valid(id string) bool {
+	return idPattern.MatchString(id)
+}
+
+// UploadPrefix is the key prefix of an event's uploads
+func UploadPrefix(id string) string {
+	if id == Default {
+		return "uploads/"
+	}
+	return "uploads/" + id + "/"
+}
+
+// FromKey returns the event an upload key belongs to. Keys directly under
+// uploads/ belong to the default event.
+func FromKey(key string) string {
+	rest := strings.TrimPrefix(key, "uploads/")
+	if id, _, ok := strings.Cut(rest, "/"); ok && Valid(id) {
+		return id
+	}
+	return Default
+}
+
+// Settings configure one event. Empty fields fall back to the deployment's
+// environment, so the default event needs no item in the events table.
+type Settings struct {
+	EventID string `json:"eventId"`
+	Name    string `json:"name,omitempty"`
+	// IANA timezone assumed for capture times without an offset
+	Timezone string `json:"timezone,omitempty"`
+	// Rekognition collection for the event's faces
+	CollectionID string `json:"collectionId,omitempty"`
+	CreatedAt    int64  `json:"createdAt,omitempty"`
+	UpdatedAt    int64  `json:"updatedAt,omitempty"`
+}
+
+// UploadPrefix is the key prefix of the event's uploads
+func (s *Settings) UploadPrefix() string {
+	return UploadPrefix(s.EventID)
+}
+
+// Owns reports whether an upload key belongs to the event
+func (s *Settings) Owns(key string) bool {
+	return strings.HasPrefix(key, "uploads/") && FromKey(key) == s.EventID
+}
+
+// BasePath is the URL path the event's routes live under
+func (s *Settings) BasePath() string {
+	if s.EventID == Default {
+		return ""
+	}
+	return "/e/" + s.EventID
+}
+
+// Location is the event's timezone, falling back to EVENT_TIMEZONE and then UTC
+func (s *Settings) Location() *time.Location {
+	name := s.Timezone
+	if name == "" {
+		name = os.Getenv("EVENT_TIMEZONE")
+	}
+	if name == "" {
+		return time.UTC
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		log.Printf("Invalid timezone %q for event %s, using UTC: %v", name, s.EventID, err)
+		return time.UTC
+	}
+	return loc
+}
+
+// BaseCollection is the face collection of the default event, from
+// FACE_COLLECTION_ID. Both lambdas derive the other events' collections from
+// it, so the app searches the collections the metadata lambda indexes into.
+func BaseCollection() string {
+	if id := os.Getenv("FACE_COLLECTION_ID"); id != "" {
+		return id
+	}
+	return "wedding-faces"
+}
+
+// Collection is the face collection for the event. The default event uses
+// the base collection; other events get their own beside it.
+func (s *Settings) Collection(base string) string {
+	if s.CollectionID != "" {
+		return s.CollectionID
+	}
+	if s.EventID == Default {
+		return base
+	}
+	return base + "-" + s.EventID
+}
+
+// CollectionUser returns the event among events, other than except, whose
+// faces are indexed into collectionID. Events must not share a collection:
+// face search would then match guests of another event.
+func CollectionUser(events []Settings, base, collectionID, except string) (string, bool) {
+	for _, settings := range events {
+		if settings.EventID != except && settings.Collection(base) == collectionID {
+			return settings.EventID, true
+		}
+	}
+	return "", false
+}
+
+type cacheEntry struct {
+	settings *Settings
+	loaded   time.Time
+}
+
+var (
+	cacheMu sync.Mutex
+	cache   = make(map[string]cacheEntry)
+)
+
+// Load reads an event's settings, returning nil for an event that doesn't
+// exist. The default event always exists. Results are cached briefly.
+func Load(client *dynamodb.DynamoDB, tableName, id string) (*Settings, error) {
+	cacheMu.Lock()
+	entry, ok := cache[id]
+	cacheMu.Unlock()
+	if ok && time.Since(entry.loaded) < cacheTTL {
+		return entry.settings, nil
+	}
+
+	settings, err := get(client, tableName, id)
+	if err != nil {
+		return nil, err
+	}
+	cacheMu.Lock()
+	cache[id] = cacheEntry{settings: settings, loaded: time.Now()}
+	cacheMu.Unlock()
+	return settings, nil
+}
+
+// LoadOrDefault reads an event's settings like Load, but an event missing
+// from the table, or a failed lookup, gets the deployment defaults instead
+func LoadOrDefault(client *dynamodb.DynamoDB, tableName, id string) *Settings {
+	settings, err := Load(client, tableName, id)
+	if err != nil {
+		log.Printf("Error loading settings for event %s, using defaults: %v", id, err)
+	}
+	if settings == nil {
+		return &Settings{EventID: id}
+	}
+	return settings
+}
+
+// Location is the timezone of an event, for capture times and date filters
+// given without an offset
+func Location(client *dynamodb.DynamoDB, tableName, id string) *time.Location {
+	return LoadOrDefault(client, tableName, id).Location()
+}
+
+// Forget drops an event from the cache after its settings change
+func Forget(id string) {
+	cacheMu.Lock()
+	delete(cache, id)
+	cacheMu.Unlock()
+}
+
+func get(client *dynamodb.DynamoDB, tableName, id string) (*Settings, error) {
+	if !Valid(id) {
+		return nil, nil
+	}
+	fallback := &Settings{EventID: id}
+	if tableName == "" {
+		// Without an events table only the default event exists
+		if id == Default {
+			return fallback, nil
+		}
+		return nil, nil
+	}
+
+	result, err := client.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(tableName),
+		Key:       map[string]*dynamodb.AttributeValue{"eventId": {S: aws.String(id)}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Item) == 0 {
+		if id == Default {
+			return fallback, nil
+		}
+		return nil, nil
+	}
+	var settings Settings
+	if err := dynamodbattribute.UnmarshalMap(result.Item, &settings); err != nil {
+		return nil, err
+	}
+	return &settings, nil
+}
@@ -0,0 +1,89 @@
+package event
+
+import "testing"
+
+func TestFromKey(t *testing.T) {
+	tests := []struct {
+		key, want string
+	}{
+		{"uploads/1718491327-IMG_4821.JPG", Default},
+		{"uploads/reunion/1718491327-IMG_4821.JPG", "reunion"},
+		{"uploads/reunion-2024/1718491327-IMG_4821.JPG", "reunion-2024"},
+		// Not a valid event ID, so a file of the default event
+		{"uploads/Reunion/1718491327-IMG_4821.JPG", Default},
+	}
+	for _, tt := range tests {
+		if got := FromKey(tt.key); got != tt.want {
+			t.Errorf("FromKey(%q) = %q, want %q", tt.key, got, tt.want)
+		}
+	}
+}
+
+// Every upload belongs to exactly one event, even where one event's ID is a
+// prefix of another's or the default event's prefix contains the others
+func TestOwnsKeepsEventsApart(t *testing.T) {
+	events := []*Settings{{EventID: Default}, {EventID: "reunion"}, {EventID: "reunion-2024"}}
+	keys := map[string]string{
+		"uploads/1718491327-IMG_4821.JPG":              Default,
+		"uploads/reunion/1718491327-IMG_4821.JPG":      "reunion",
+		"uploads/reunion-2024/1718491327-IMG_4821.JPG": "reunion-2024",
+	}
+	for key, owner := range keys {
+		for _, ev := range events {
+			if got, want := ev.Owns(key), ev.EventID == owner; got != want {
+				t.Errorf("event %s: Owns(%q) = %t, want %t", ev.EventID, key, got, want)
+			}
+		}
+	}
+	for _, ev := range events {
+		if ev.Owns("derivatives/" + ev.UploadPrefix() + "IMG_4821.JPG") {
+			t.Errorf("event %s owns a key outside uploads/", ev.EventID)
+		}
+	}
+}
+
+func TestCollectionsAreSeparate(t *testing.T) {
+	const base = "wedding-faces"
+	events := []Settings{{EventID: Default}, {EventID: "reunion"}, {EventID: "reunion-2024"}}
+	seen := make(map[string]string)
+	for _, ev := range events {
+		collectionID := ev.Collection(base)
+		if other, ok := seen[collectionID]; ok {
+			t.Errorf("events %s and %s share collection %s", other, ev.EventID, collectionID)
+		}
+		seen[collectionID] = ev.EventID
+	}
+}
+
+func TestCollectionUser(t *testing.T) {
+	const base = "wedding-faces"
+	events := []Settings{{EventID: Default}, {EventID: "reunion"}, {EventID: "party", CollectionID: "party-faces"}}
+	tests := []struct {
+		collectionID, except string
+		want                 string
+	}{
+		{"wedding-faces", "reunion", Default},
+		{"wedding-faces-reunion", "party", "reunion"},
+		{"party-faces", "reunion", "party"},
+		// An event keeps its own collection
+		{"wedding-faces-reunion", "reunion", ""},
+		{"wedding-faces-v7", "reunion", ""},
+	}
+	for _, tt := range tests {
+		got, ok := CollectionUser(events, base, tt.collectionID, tt.except)
+		if got != tt.want || ok != (tt.want != "") {
+			t.Errorf("CollectionUser(%q, except %q) = %q, %t, want %q", tt.collectionID, tt.except, got, ok, tt.want)
+		}
+	}
+}
+
+func TestBaseCollection(t *testing.T) {
+	t.Setenv("FACE_COLLECTION_ID", "")
+	if got := BaseCollection(); got != "wedding-faces" {
+		t.Errorf("default BaseCollection = %q", got)
+	}
+	t.Setenv("FACE_COLLECTION_ID", "wedding-faces-v7")
+	if got := BaseCollection(); got != "wedding-faces-v7" {
+		t.Errorf("BaseCollection = %q, want FACE_COLLECTION_ID", got)
+	}
+}
@@ -0,0 +1,172 @@
+// Package imaging holds the decode, resize and orientation helpers shared by
+// the metadata lambda's renditions and the app's on-demand resizing endpoint.
+package imaging
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+
+	"github.com/rwcarlsen/goexif/exif"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// MaxPixels caps the images Decode accepts. A decoded image takes several
+// bytes per pixel, so a small file that declares huge dimensions could
+// otherwise exhaust a lambda's memory. 100 megapixels is above any phone
+// or camera guests are likely to bring.
+const MaxPixels = 100_000_000
+
+// ErrTooLarge is returned for images with more than MaxPixels pixels
+var ErrTooLarge = errors.New("image too large to decode")
+
+// CheckSize rejects an image whose header declares more than MaxPixels pixels
+func CheckSize(config image.Config) error {
+	if int64(config.Width)*int64(config.Height) > MaxPixels {
+		return fmt.Errorf("%w: %dx%d", ErrTooLarge, config.Width, config.Height)
+	}
+	return nil
+}
+
+// Decode is image.Decode that reads the header first and refuses images
+// CheckSize rejects before allocating any pixels.
+func Decode(r io.Reader) (image.Image, string, error) {
+	var header bytes.Buffer
+	config, format, err := image.DecodeConfig(io.TeeReader(r, &header))
+	if err != nil {
+		return nil, format, err
+	}
+	if err := CheckSize(config); err != nil {
+		return nil, format, err
+	}
+	return image.Decode(io.MultiReader(&header, r))
+}
+
+// Orientation reads the EXIF Orientation tag (1-8), returning 1 when the
+// image has no EXIF data or the tag is missing.
+func Orientation(r io.Reader) int {
+	x, err := exif.Decode(r)
+	if err != nil {
+		return 1
+	}
+	tag, err := x.Get(exif.Orientation)
+	if err != nil {
+		return 1
+	}
+	val, err := tag.Int(0)
+	if err != nil || val < 1 || val > 8 {
+		return 1
+	}
+	return val
+}
+
+// SwapsAxes reports whether an orientation rotates the image by 90 degrees,
+// so that its displayed width is its stored height.
+func SwapsAxes(orientation int) bool {
+	return orientation >= 5 && orientation <= 8
+}
+
+// Resize scales img so its longest edge is at most maxEdge. Images that
+// already fit are copied as-is rather than upscaled.
+func Resize(img image.Image, maxEdge int) *image.RGBA {
+	return Fit(img, maxEdge, maxEdge, false)
+}
+
+// Fit scales img into a width x height box without upscaling. A zero width
+// or height leaves that dimension unconstrained. With cover set and both
+// dimensions given, the image fills the box and the overflow is cropped
+// evenly from both sides; otherwise the whole image is contained in it.
+func Fit(img image.Image, width, height int, cover bool) *image.RGBA {
+	b := img.Bounds()
+	srcW, srcH := b.Dx(), b.Dy()
+	src := b
+
+	if cover && width > 0 && height > 0 {
+		// Crop the source to the target aspect ratio before scaling
+		if srcW*height > srcH*width {
+			cropW := srcH * width / height
+			src.Min.X += (srcW - cropW) / 2
+			src.Max.X = src.Min.X + cropW
+		} else {
+			cropH := srcW * height / width
+			src.Min.Y += (srcH - cropH) / 2
+			src.Max.Y = src.Min.Y + cropH
+		}
+		srcW, srcH = src.Dx(), src.Dy()
+	}
+
+	dstW, dstH := srcW, srcH
+	if width > 0 && dstW > width {
+		dstH = max(1, dstH*width/dstW)
+		dstW = width
+	}
+	if height > 0 && dstH > height {
+		dstW = max(1, dstW*height/dstH)
+		dstH = height
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dstW, dstH))
+	if dstW == srcW && dstH == srcH {
+		draw.Draw(dst, dst.Bounds(), img, src.Min, draw.Src)
+	} else {
+		draw.CatmullRom.Scale(dst, dst.Bounds(), img, src, draw.Src, nil)
+	}
+	return dst
+}
+
+// ApplyOrientation transforms src according to the EXIF Orientation tag
+// (1-8) so that the result displays upright without EXIF support.
+func ApplyOrientation(src *image.RGBA, orientation int) *image.RGBA {
+	if orientation < 2 || orientation > 8 {
+		return src
+	}
+
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	dw, dh := w, h
+	if SwapsAxes(orientation) {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // mirror horizontal
+				dx, dy = w-1-x, y
+			case 3: // rotate 180
+				dx, dy = w-1-x, h-1-y
+			case 4: // mirror vertical
+				dx, dy = x, h-1-y
+			case 5: // transpose
+				dx, dy = y, x
+			case 6: // rotate 90 CW
+				dx, dy = h-1-y, x
+			case 7: // transverse
+				dx, dy = h-1-y, w-1-x
+			case 8: // rotate 270 CW
+				dx, dy = y, w-1-x
+			}
+			si := src.PixOffset(src.Bounds().Min.X+x, src.Bounds().Min.Y+y)
+			di := dst.PixOffset(dx, dy)
+			copy(dst.Pix[di:di+4], src.Pix[si:si+4])
+		}
+	}
+
+	return dst
+}
+
+// EncodeJPEG encodes img as a JPEG at the given quality
+func EncodeJPEG(img image.Image, quality int) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,50 @@
+package imaging
+
+import (
+	"bytes"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"testing"
+)
+
+func TestDecode(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 4, 3))); err != nil {
+		t.Fatal(err)
+	}
+	img, format, err := Decode(bytes.NewReader(buf.Bytes()))
+	if err != nil || format != "png" || img.Bounds().Dx() != 4 || img.Bounds().Dy() != 3 {
+		t.Fatalf("Decode = %v, %q, %v", img.Bounds(), format, err)
+	}
+}
+
+func TestDecodeRejectsHugeDimensions(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 1, 1))); err != nil {
+		t.Fatal(err)
+	}
+	// Rewrite the IHDR size to 20000x20000 and fix up its checksum, so the
+	// header declares 400 megapixels while the file stays tiny
+	data := buf.Bytes()
+	ihdr := data[8:33]
+	copy(ihdr[8:12], []byte{0, 0, 0x4e, 0x20})
+	copy(ihdr[12:16], []byte{0, 0, 0x4e, 0x20})
+	sum := crc32.ChecksumIEEE(ihdr[4:21])
+	copy(ihdr[21:25], []byte{byte(sum >> 24), byte(sum >> 16), byte(sum >> 8), byte(sum)})
+
+	if _, _, err := Decode(bytes.NewReader(data)); !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("Decode error = %v, want ErrTooLarge", err)
+	}
+}
+
+func TestCheckSize(t *testing.T) {
+	if err := CheckSize(image.Config{Width: 8192, Height: 6144}); err != nil {
+		t.Errorf("50 megapixels rejected: %v", err)
+	}
+	// Large enough to overflow 32-bit multiplication
+	if err := CheckSize(image.Config{Width: 70000, Height: 70000}); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("4.9 gigapixels accepted: %v", err)
+	}
+}
@@ -0,0 +1,200 @@
+// Package schema versions the items in the photo metadata table. Every item
+// written by the metadata lambda carries schemaVersion; older items are
+// upgraded step by step through the registered migrations, lazily when read
+// by either lambda or eagerly by the metadata lambda's migrate command.
+//
+// Lazy upgrades happen after DynamoDB has filtered a scan, so a filter on an
+// attribute a migration adds must also let through items that lack it and
+// check them again once upgraded, as the app's date filters do. Run migrate
+// after deploying a new version to stop paying for that.
+package schema
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Andrew-Wichmann/wedding-photos-app/internal/event"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// CurrentVersion is the version written by the metadata lambda
+const CurrentVersion = 6
+
+// VersionAttribute holds an item's version. Items without it predate
+// versioning and are version 1.
+const VersionAttribute = "schemaVersion"
+
+// Item is a raw metadata table item
+type Item = map[string]*dynamodb.AttributeValue
+
+// Env is the configuration migrations may depend on
+type Env struct {
+	// EventLocation is the timezone capture times without an offset are taken
+	// in. Items old enough to need it all belong to the default event.
+	EventLocation *time.Location
+}
+
+// Migration upgrades an item from version From to From+1
+type Migration struct {
+	From        int
+	Description string
+	Apply       func(item Item, env Env) error
+}
+
+// Migrations lists every upgrade step in order. Add a step and bump
+// CurrentVersion whenever the shape or meaning of a stored field changes.
+var Migrations = []Migration{
+	{From: 1, Description: "add mediaType", Apply: addMediaType},
+	{From: 2, Description: "resolve dateTaken to an instant in takenAt", Apply: resolveTakenAt},
+	{From: 3, Description: "record where dateTaken came from", Apply: addDateTakenSource},
+	{From: 4, Description: "add display dimensions after orientation", Apply: addDisplayDimensions},
+	{From: 5, Description: "record the event the photo belongs to", Apply: addEventID},
+}
+
+// Version returns the schema version of an item
+func Version(item Item) int {
+	if v, ok := getInt(item, VersionAttribute); ok && v > 0 {
+		return int(v)
+	}
+	return 1
+}
+
+// Upgrade migrates an item in place to CurrentVersion, reporting whether
+// anything was applied. Items from a newer version are left alone.
+func Upgrade(item Item, env Env) (bool, error) {
+	if env.EventLocation == nil {
+		env.EventLocation = time.UTC
+	}
+	version := Version(item)
+	if version >= CurrentVersion {
+		return false, nil
+	}
+	for _, m := range Migrations {
+		if m.From < version {
+			continue
+		}
+		if m.From != version {
+			return false, fmt.Errorf("no migration from schema version %d", version)
+		}
+		if err := m.Apply(item, env); err != nil {
+			return false, fmt.Errorf("migration %d (%s): %w", m.From, m.Description, err)
+		}
+		version = m.From + 1
+		setInt(item, VersionAttribute, int64(version))
+	}
+	return true, nil
+}
+
+// Version 1 items predate mediaType. Videos among them are told apart by the
+// codec the video parser recorded, or failing that by their extension.
+var videoExtensions = map[string]bool{".mp4": true, ".mov": true, ".m4v": true, ".3gp": true, ".webm": true}
+
+func addMediaType(item Item, env Env) error {
+	if _, ok := getString(item, "mediaType"); ok {
+		return nil
+	}
+	mediaType := "photo"
+	key, _ := getString(item, "photoId")
+	if _, ok := getString(item, "videoCodec"); ok || videoExtensions[strings.ToLower(path.Ext(key))] {
+		mediaType = "video"
+	}
+	setString(item, "mediaType", mediaType)
+	return nil
+}
+
+// Before version 3, photos stored the EXIF wall-clock time labelled as UTC,
+// while videos stored the container's real UTC time
+func resolveTakenAt(item Item, env Env) error {
+	if _, ok := getInt(item, "takenAt"); ok {
+		return nil
+	}
+	dateTaken, ok := getString(item, "dateTaken")
+	if !ok {
+		return nil
+	}
+	t, err := time.Parse(time.RFC3339, dateTaken)
+	if err != nil {
+		// Unparseable dates can't be filtered on, but are kept for display
+		return nil
+	}
+
+	if mediaType, _ := getString(item, "mediaType"); mediaType == "video" {
+		t = t.In(env.EventLocation)
+	} else {
+		t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), env.EventLocation)
+	}
+	setString(item, "dateTaken", t.Format(time.RFC3339))
+	setInt(item, "takenAt", t.Unix())
+	setString(item, "timezoneSource", "event")
+	return nil
+}
+
+// Before version 4 the only sources were EXIF and video containers
+func addDateTakenSource(item Item, env Env) error {
+	if _, ok := getString(item, "dateTakenSource"); ok {
+		return nil
+	}
+	if _, ok := getString(item, "dateTaken"); !ok {
+		return nil
+	}
+	source := "exif"
+	if mediaType, _ := getString(item, "mediaType"); mediaType == "video" {
+		source = "video"
+	}
+	setString(item, "dateTakenSource", source)
+	return nil
+}
+
+func addDisplayDimensions(item Item, env Env) error {
+	width, okWidth := getInt(item, "width")
+	height, okHeight := getInt(item, "height")
+	if !okWidth || !okHeight || width == 0 || height == 0 {
+		return nil
+	}
+	orientation, _ := getInt(item, "orientation")
+	rotation, _ := getInt(item, "rotation")
+	if (orientation >= 5 && orientation <= 8) || rotation == 90 || rotation == 270 {
+		width, height = height, width
+	}
+	setInt(item, "displayWidth", width)
+	setInt(item, "displayHeight", height)
+	return nil
+}
+
+// Before version 6 there was only one event; its keys map to the default event
+func addEventID(item Item, env Env) error {
+	if _, ok := getString(item, "eventId"); ok {
+		return nil
+	}
+	key, _ := getString(item, "photoId")
+	setString(item, "eventId", event.FromKey(key))
+	return nil
+}
+
+func getString(item Item, name string) (string, bool) {
+	if av, ok := item[name]; ok && av.S != nil && *av.S != "" {
+		return *av.S, true
+	}
+	return "", false
+}
+
+func setString(item Item, name, value string) {
+	item[name] = &dynamodb.AttributeValue{S: aws.String(value)}
+}
+
+func getInt(item Item, name string) (int64, bool) {
+	if av, ok := item[name]; ok && av.N != nil {
+		if v, err := strconv.ParseFloat(*av.N, 64); err == nil {
+			return int64(v), true
+		}
+	}
+	return 0, false
+}
+
+func setInt(item Item, name string, value int64) {
+	item[name] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(value, 10))}
+}
@@ -0,0 +1,87 @@
+package schema
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// upgradeFixture is an item as stored at some schema version and what
+// Upgrade should make of it. Items use DynamoDB's JSON format.
+type upgradeFixture struct {
+	Description string `json:"description"`
+	Item        Item   `json:"item"`
+	Upgraded    bool   `json:"upgraded"`
+	Want        Item   `json:"want"`
+}
+
+func TestUpgrade(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := Env{EventLocation: loc}
+
+	paths, err := filepath.Glob(filepath.Join("testdata", "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) == 0 {
+		t.Fatal("no fixtures in testdata")
+	}
+	for _, path := range paths {
+		t.Run(strings.TrimSuffix(filepath.Base(path), ".json"), func(t *testing.T) {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var fixture upgradeFixture
+			if err := json.Unmarshal(data, &fixture); err != nil {
+				t.Fatal(err)
+			}
+
+			upgraded, err := Upgrade(fixture.Item, env)
+			if err != nil {
+				t.Fatalf("%s: %v", fixture.Description, err)
+			}
+			if upgraded != fixture.Upgraded {
+				t.Errorf("%s: upgraded = %t, want %t", fixture.Description, upgraded, fixture.Upgraded)
+			}
+			if !reflect.DeepEqual(fixture.Item, fixture.Want) {
+				got, _ := json.MarshalIndent(fixture.Item, "", "  ")
+				want, _ := json.MarshalIndent(fixture.Want, "", "  ")
+				t.Errorf("%s:\ngot:\n%s\nwant:\n%s", fixture.Description, got, want)
+			}
+		})
+	}
+}
+
+// Every version below the current one needs a fixture, so a new migration
+// can't be added without one
+func TestUpgradeFixturesCoverEveryVersion(t *testing.T) {
+	paths, err := filepath.Glob(filepath.Join("testdata", "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	covered := make(map[int]bool)
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var fixture upgradeFixture
+		if err := json.Unmarshal(data, &fixture); err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		covered[Version(fixture.Item)] = true
+	}
+	for version := 1; version <= CurrentVersion; version++ {
+		if !covered[version] {
+			t.Errorf("no fixture for schema version %d", version)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"crypto/subtle"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// isAdmin reports whether the request carries the ADMIN_TOKEN as a bearer
+// token. Admin routes are disabled entirely when no token is configured.
+func isAdmin(request events.LambdaFunctionURLRequest) bool {
+	token := os.Getenv("ADMIN_TOKEN")
+	if token == "" {
+		return false
+	}
+	// Function URLs deliver header names in lowercase
+	provided, ok := strings.CutPrefix(request.Headers["authorization"], "Bearer ")
+	if !ok {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(provided), []byte(token)) == 1
+}
+
+// requireAdmin returns the response to send when the request isn't from an
+// admin, or nil if it may proceed
+func requireAdmin(request events.LambdaFunctionURLRequest) *events.LambdaFunctionURLResponse {
+	if isAdmin(request) {
+		return nil
+	}
+	return &events.LambdaFunctionURLResponse{
+		StatusCode: 401,
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       `{"error": "Admin token required"}`,
+	}
+}
@@ -0,0 +1,882 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Andrew-Wichmann/wedding-photos-app/internal/event"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	// An album is one item, so its photo list has to fit in DynamoDB's 400KB
+	maxAlbumPhotos = 2000
+	// Album edits are read-modify-write; concurrent edits retry this often
+	// before giving up with a conflict
+	maxAlbumUpdateAttempts = 3
+)
+
+var (
+	errAlbumNotFound = errors.New("album not found")
+	errAlbumConflict = errors.New("album was changed by another request")
+)
+
+// albumRequestError is a problem with an edit that only shows once it is
+// applied to the stored album, e.g. an unknown photo
+type albumRequestError string
+
+func (e albumRequestError) Error() string { return string(e) }
+
+var errSmartAlbumPhotos = albumRequestError("Smart albums are defined by their filter; edit it instead")
+
+// Album is a curated, ordered collection of an event's photos, or a smart
+// album: a saved /gallery search that is rerun whenever the album is viewed
+type Album struct {
+	AlbumID     string `json:"albumId"`
+	EventID     string `json:"eventId"`
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+	// Photo keys in display order; always empty for smart albums. The API
+	// gives photos by their ids in the event's URLs instead, see albumView.
+	PhotoIDs []string `json:"photoIds"`
+	// /gallery query parameters defining a smart album, e.g.
+	// {"person": "Grandma", "startDate": "2025-06-14T20:00", "sort": "oldest"}
+	Filter map[string]string `json:"filter,omitempty"`
+	// Shown on the album list; the first photo when unset
+	CoverPhotoID string `json:"coverPhotoId,omitempty"`
+	// Incremented on every write, so concurrent edits don't overwrite each other
+	Revision  int64 `json:"revision"`
+	CreatedAt int64 `json:"createdAt"`
+	UpdatedAt int64 `json:"updatedAt"`
+}
+
+func (a *Album) smart() bool {
+	return len(a.Filter) > 0
+}
+
+// cover is the photo shown for the album, if it has any
+func (a *Album) cover() string {
+	if a.CoverPhotoID != "" {
+		return a.CoverPhotoID
+	}
+	if len(a.PhotoIDs) > 0 {
+		return a.PhotoIDs[0]
+	}
+	return ""
+}
+
+// AlbumSummary is an album as listed by GET /albums. Smart albums are only
+// counted when viewed, so their photoCount is 0.
+type AlbumSummary struct {
+	AlbumID      string `json:"albumId"`
+	Title        string `json:"title"`
+	Description  string `json:"description,omitempty"`
+	Smart        bool   `json:"smart,omitempty"`
+	PhotoCount   int    `json:"photoCount"`
+	CoverPhotoID string `json:"coverPhotoId,omitempty"`
+	CoverURL     string `json:"coverUrl,omitempty"`
+	UpdatedAt    int64  `json:"updatedAt"`
+}
+
+// CreateAlbumRequest is the body of POST /albums. Giving a filter instead
+// of photos creates a smart album.
+type CreateAlbumRequest struct {
+	Title        string            `json:"title"`
+	Description  string            `json:"description"`
+	PhotoIDs     []string          `json:"photoIds"`
+	Filter       map[string]string `json:"filter"`
+	CoverPhotoID string            `json:"coverPhotoId"`
+}
+
+// UpdateAlbumRequest is the body of PATCH /albums/{id}. Omitted fields are
+// left alone. photoIds reorders the album and must list exactly its photos;
+// filter replaces a smart album's filter; an empty coverPhotoId goes back
+// to the first photo.
+type UpdateAlbumRequest struct {
+	Title        *string           `json:"title"`
+	Description  *string           `json:"description"`
+	CoverPhotoID *string           `json:"coverPhotoId"`
+	PhotoIDs     []string          `json:"photoIds"`
+	Filter       map[string]string `json:"filter"`
+}
+
+// AlbumPhotosRequest is the body of POST and DELETE /albums/{id}/photos.
+// Added photos go in at position (0-based), or at the end when it's omitted.
+type AlbumPhotosRequest struct {
+	PhotoIDs []string `json:"photoIds"`
+	Position *int     `json:"position"`
+}
+
+// albumAction splits /albums/{id} or /albums/{id}/{action}
+func albumAction(path string) (albumID, action string) {
+	albumID, action, _ = strings.Cut(strings.TrimPrefix(path, "/albums/"), "/")
+	return albumID, action
+}
+
+// newAlbumID mints a random album ID
+func newAlbumID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func albumsTable() string {
+	return os.Getenv("ALBUMS_TABLE")
+}
+
+// getAlbum loads one of the event's albums, returning nil if there is no
+// such album in the event
+func getAlbum(client *dynamodb.DynamoDB, ev *event.Settings, albumID string) (*Album, error) {
+	result, err := client.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(albumsTable()),
+		Key:       map[string]*dynamodb.AttributeValue{"albumId": {S: aws.String(albumID)}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Item) == 0 {
+		return nil, nil
+	}
+	var album Album
+	if err := dynamodbattribute.UnmarshalMap(result.Item, &album); err != nil {
+		return nil, err
+	}
+	if album.EventID != ev.EventID {
+		return nil, nil
+	}
+	return &album, nil
+}
+
+// putAlbum writes an album, failing with errAlbumConflict if it changed
+// since it was read at the given revision (0 for a new album)
+func putAlbum(client *dynamodb.DynamoDB, album *Album, readRevision int64) error {
+	item, err := dynamodbattribute.MarshalMap(album)
+	if err != nil {
+		return err
+	}
+	input := &dynamodb.PutItemInput{
+		TableName: aws.String(albumsTable()),
+		Item:      item,
+	}
+	if readRevision == 0 {
+		input.ConditionExpression = aws.String("attribute_not_exists(albumId)")
+	} else {
+		input.ConditionExpression = aws.String("revision = :revision")
+		input.ExpressionAttributeValues = map[string]*dynamodb.AttributeValue{
+			":revision": {N: aws.String(strconv.FormatInt(readRevision, 10))},
+		}
+	}
+	if _, err := client.PutItem(input); err != nil {
+		if isConditionFailed(err) {
+			return errAlbumConflict
+		}
+		return err
+	}
+	return nil
+}
+
+// modifyAlbum applies edit to the stored album and writes it back, rereading
+// and reapplying if another request changed the album in between
+func modifyAlbum(client *dynamodb.DynamoDB, ev *event.Settings, albumID string, edit func(*Album) error) (*Album, error) {
+	for attempt := 0; attempt < maxAlbumUpdateAttempts; attempt++ {
+		album, err := getAlbum(client, ev, albumID)
+		if err != nil {
+			return nil, err
+		}
+		if album == nil {
+			return nil, errAlbumNotFound
+		}
+		if err := edit(album); err != nil {
+			return nil, err
+		}
+
+		readRevision := album.Revision
+		album.Revision++
+		album.UpdatedAt = time.Now().Unix()
+		err = putAlbum(client, album, readRevision)
+		if errors.Is(err, errAlbumConflict) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return album, nil
+	}
+	return nil, errAlbumConflict
+}
+
+// albumErrorResponse maps an error from modifyAlbum to a response
+func albumErrorResponse(err error) events.LambdaFunctionURLResponse {
+	var requestErr albumRequestError
+	switch {
+	case errors.As(err, &requestErr):
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 400,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       fmt.Sprintf(`{"error": %q}`, requestErr.Error()),
+		}
+	case errors.Is(err, errAlbumNotFound):
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 404,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       `{"error": "Album not found"}`,
+		}
+	case errors.Is(err, errAlbumConflict):
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 409,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       `{"error": "Album is being edited elsewhere, try again"}`,
+		}
+	}
+	log.Printf("Error updating album: %v", err)
+	return events.LambdaFunctionURLResponse{
+		StatusCode: 500,
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       `{"error": "Failed to update album"}`,
+	}
+}
+
+// albumResponse returns an album as JSON with the given status code, see
+// albumView
+func albumResponse(statusCode int, ev *event.Settings, album *Album, summaries map[string]photoSummary) (events.LambdaFunctionURLResponse, error) {
+	responseBody, _ := json.Marshal(albumView(ev, album, summaries))
+	return events.LambdaFunctionURLResponse{
+		StatusCode: statusCode,
+		Headers:    map[string]string{"Content-Type": "application/json", "Cache-Control": "no-store"},
+		Body:       string(responseBody),
+	}, nil
+}
+
+// albumPhotoKeys maps photo ids from a request (see eventKey) to upload
+// keys, rejecting ids outside the event and duplicates within the list, so
+// an album never shows another event's photos
+func albumPhotoKeys(ev *event.Settings, photoIDs []string) ([]string, error) {
+	keys := make([]string, 0, len(photoIDs))
+	for _, photoID := range photoIDs {
+		key, ok := eventKey(ev, photoID)
+		if !ok {
+			return nil, albumRequestError("unknown photo " + photoID)
+		}
+		if slices.Contains(keys, key) {
+			return nil, albumRequestError("photo " + photoID + " is listed twice")
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// checkAlbumPhotos rejects photos that have no metadata, i.e. were never
+// uploaded or have been deleted
+func checkAlbumPhotos(ev *event.Settings, keys []string, summaries map[string]photoSummary) error {
+	for _, key := range keys {
+		if _, ok := summaries[key]; !ok {
+			return albumRequestError("unknown photo " + relativeID(ev, key))
+		}
+	}
+	return nil
+}
+
+// albumView is an album as the API returns it: photos deleted since they
+// were added are left out, and photos are given by their ids in the event's
+// URLs. Without summaries every photo is kept.
+func albumView(ev *event.Settings, album *Album, summaries map[string]photoSummary) *Album {
+	exists := func(key string) bool {
+		_, ok := summaries[key]
+		return ok || summaries == nil
+	}
+	view := *album
+	view.PhotoIDs = []string{}
+	for _, key := range album.PhotoIDs {
+		if exists(key) {
+			view.PhotoIDs = append(view.PhotoIDs, relativeID(ev, key))
+		}
+	}
+	view.CoverPhotoID = ""
+	if album.CoverPhotoID != "" && exists(album.CoverPhotoID) {
+		view.CoverPhotoID = relativeID(ev, album.CoverPhotoID)
+	}
+	return &view
+}
+
+// albumSummaries loads the summaries of the event's photos, which tell the photos
+// that still exist from deleted ones
+func albumSummaries(client *dynamodb.DynamoDB, ev *event.Settings) (map[string]photoSummary, error) {
+	return scanSummaries(client, metadataTable(), ev)
+}
+
+// checkAlbumFilter rejects a smart album filter that /gallery would refuse,
+// so a saved search fails when it's saved rather than every time it's viewed
+func checkAlbumFilter(ev *event.Settings, filter map[string]string) error {
+	if !hasFilters(filter) {
+		return albumRequestError("filter needs at least one of " + strings.Join(filterParams, ", "))
+	}
+	for param, value := range filter {
+		if param == "sort" {
+			if _, ok := gallerySorts[value]; !ok {
+				return albumRequestError("unknown sort " + value)
+			}
+			continue
+		}
+		if !slices.Contains(filterParams, param) {
+			return albumRequestError("unknown filter " + param)
+		}
+	}
+	if minFaces := filter["minFaces"]; minFaces != "" {
+		if _, err := strconv.Atoi(minFaces); err != nil {
+			return albumRequestError("minFaces must be a number")
+		}
+	}
+	if _, err := buildScanInput("", filter, ev); err != nil {
+		return albumRequestError(err.Error())
+	}
+	return nil
+}
+
+// handleAlbums serves GET /albums, most recently updated first
+func handleAlbums(request events.LambdaFunctionURLRequest, ev *event.Settings) (events.LambdaFunctionURLResponse, error) {
+	sess := session.Must(session.NewSession())
+	dynamoClient := dynamodb.New(sess)
+
+	var albums []Album
+	err := dynamoClient.ScanPages(&dynamodb.ScanInput{
+		TableName:                 aws.String(albumsTable()),
+		FilterExpression:          aws.String("eventId = :eventId"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":eventId": {S: aws.String(ev.EventID)}},
+	}, func(page *dynamodb.ScanOutput, lastPage bool) bool {
+		var items []Album
+		if err := dynamodbattribute.UnmarshalListOfMaps(page.Items, &items); err == nil {
+			albums = append(albums, items...)
+		}
+		return true
+	})
+	if err != nil {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 500,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       `{"error": "Failed to list albums"}`,
+		}, nil
+	}
+
+	// Summaries are optional, so count every listed photo if the table can't be read
+	photos, err := albumSummaries(dynamoClient, ev)
+	if err != nil {
+		log.Printf("Error loading photo summaries for albums: %v", err)
+		photos = nil
+	}
+
+	summaries := make([]AlbumSummary, 0, len(albums))
+	for _, stored := range albums {
+		album := albumView(ev, &stored, photos)
+		summary := AlbumSummary{
+			AlbumID:     album.AlbumID,
+			Title:       album.Title,
+			Description: album.Description,
+			Smart:       album.smart(),
+			PhotoCount:  len(album.PhotoIDs),
+			UpdatedAt:   album.UpdatedAt,
+		}
+		if cover := album.cover(); cover != "" {
+			summary.CoverPhotoID = cover
+			summary.CoverURL = ev.BasePath() + "/img/" + cover + "?w=640"
+		}
+		summaries = append(summaries, summary)
+	}
+	sort.SliceStable(summaries, func(i, j int) bool {
+		if summaries[i].UpdatedAt != summaries[j].UpdatedAt {
+			return summaries[i].UpdatedAt > summaries[j].UpdatedAt
+		}
+		return summaries[i].AlbumID < summaries[j].AlbumID
+	})
+
+	responseBody, _ := json.Marshal(summaries)
+
+	return events.LambdaFunctionURLResponse{
+		StatusCode: 200,
+		Headers: map[string]string{
+			"Content-Type":                 "application/json",
+			"Access-Control-Allow-Origin":  "*",
+			"Access-Control-Allow-Methods": "GET, OPTIONS",
+			"Access-Control-Allow-Headers": "Content-Type",
+			"Cache-Control":                "no-cache, no-store, must-revalidate",
+		},
+		Body: string(responseBody),
+	}, nil
+}
+
+// handleGetAlbum serves GET /albums/{id}
+func handleGetAlbum(request events.LambdaFunctionURLRequest, ev *event.Settings) (events.LambdaFunctionURLResponse, error) {
+	albumID, _ := albumAction(request.RequestContext.HTTP.Path)
+
+	sess := session.Must(session.NewSession())
+	dynamoClient := dynamodb.New(sess)
+	album, err := getAlbum(dynamoClient, ev, albumID)
+	if err != nil {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 500,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       `{"error": "Failed to load album"}`,
+		}, nil
+	}
+	if album == nil {
+		return albumErrorResponse(errAlbumNotFound), nil
+	}
+	summaries, err := albumSummaries(dynamoClient, ev)
+	if err != nil {
+		log.Printf("Error loading photo summaries for album %s: %v", albumID, err)
+		summaries = nil
+	}
+	return albumResponse(200, ev, album, summaries)
+}
+
+// handleAlbumGallery serves GET /albums/{id}/gallery: the album's photos in
+// album order, in the same shape as /gallery. Photos deleted since they were
+// added no longer have metadata and are left out. A smart album runs its
+// filter through the /gallery query, and takes the same sort, limit and
+// cursor parameters; a sort given here overrides the saved one.
+func handleAlbumGallery(request events.LambdaFunctionURLRequest, ev *event.Settings) (events.LambdaFunctionURLResponse, error) {
+	albumID, _ := albumAction(request.RequestContext.HTTP.Path)
+
+	sess := session.Must(session.NewSession())
+	s3Client := s3.New(sess)
+	dynamoClient := dynamodb.New(sess)
+	bucketName := os.Getenv("S3_BUCKET")
+	tableName := os.Getenv("DYNAMODB_TABLE")
+	if tableName == "" {
+		tableName = "wedding-photo-metadata" // fallback
+	}
+
+	album, err := getAlbum(dynamoClient, ev, albumID)
+	if err != nil {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 500,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       `{"error": "Failed to load album"}`,
+		}, nil
+	}
+	if album == nil {
+		return albumErrorResponse(errAlbumNotFound), nil
+	}
+
+	var keys []string
+	var summaries map[string]photoSummary
+	var nextCursor string
+	if album.smart() {
+		params := make(map[string]string, len(album.Filter)+3)
+		for param, value := range album.Filter {
+			params[param] = value
+		}
+		for _, param := range []string{"sort", "limit", "cursor"} {
+			if value := request.QueryStringParameters[param]; value != "" {
+				params[param] = value
+			}
+		}
+		keys, summaries, err = queryGallery(s3Client, dynamoClient, bucketName, tableName, ev, params)
+		var gerr *galleryError
+		if errors.As(err, &gerr) && gerr.status == 404 {
+			// The person the album was saved for was renamed or merged away
+			keys, err = nil, nil
+		}
+		if err == nil {
+			keys, nextCursor, err = pageGallery(keys, summaries, params)
+		}
+		if err != nil {
+			return galleryErrorResponse(err), nil
+		}
+	} else {
+		// Summaries are optional, so show every listed photo if the table can't be read
+		keys = album.PhotoIDs
+		summaries, err = scanSummaries(dynamoClient, tableName, ev)
+		if err != nil {
+			summaries = nil
+		} else {
+			keys = slices.DeleteFunc(slices.Clone(keys), func(key string) bool {
+				_, ok := summaries[key]
+				return !ok
+			})
+		}
+	}
+
+	items := galleryItems(s3Client, bucketName, keys, summaries)
+	markLiked(dynamoClient, request, ev, items)
+	if items == nil {
+		items = []GalleryItem{}
+	}
+	responseBody, _ := json.Marshal(items)
+
+	return events.LambdaFunctionURLResponse{
+		StatusCode: 200,
+		Headers:    galleryHeaders(nextCursor),
+		Body:       string(responseBody),
+	}, nil
+}
+
+// handleCreateAlbum serves POST /albums
+func handleCreateAlbum(request events.LambdaFunctionURLRequest, ev *event.Settings) (events.LambdaFunctionURLResponse, error) {
+	if denied := requireAdmin(request); denied != nil {
+		return *denied, nil
+	}
+
+	var createReq CreateAlbumRequest
+	if err := json.Unmarshal([]byte(request.Body), &createReq); err != nil {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 400,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       `{"error": "Invalid JSON"}`,
+		}, nil
+	}
+	title := strings.TrimSpace(createReq.Title)
+	if title == "" {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 400,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       `{"error": "title is required"}`,
+		}, nil
+	}
+	if len(createReq.PhotoIDs) > maxAlbumPhotos {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 400,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       fmt.Sprintf(`{"error": "Albums hold at most %d photos"}`, maxAlbumPhotos),
+		}, nil
+	}
+	keys, err := albumPhotoKeys(ev, createReq.PhotoIDs)
+	if err != nil {
+		return albumErrorResponse(err), nil
+	}
+	var coverKey string
+	if createReq.CoverPhotoID != "" {
+		cover, err := albumPhotoKeys(ev, []string{createReq.CoverPhotoID})
+		if err != nil {
+			return albumErrorResponse(err), nil
+		}
+		coverKey = cover[0]
+	}
+	if createReq.Filter != nil {
+		if len(createReq.PhotoIDs) > 0 {
+			return events.LambdaFunctionURLResponse{
+				StatusCode: 400,
+				Headers:    map[string]string{"Content-Type": "application/json"},
+				Body:       `{"error": "An album takes either photoIds or a filter, not both"}`,
+			}, nil
+		}
+		if err := checkAlbumFilter(ev, createReq.Filter); err != nil {
+			return albumErrorResponse(err), nil
+		}
+	}
+	// A smart album's cover can be any of the event's photos
+	if createReq.Filter == nil && coverKey != "" && !slices.Contains(keys, coverKey) {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 400,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       `{"error": "coverPhotoId must be one of the album's photos"}`,
+		}, nil
+	}
+
+	sess := session.Must(session.NewSession())
+	dynamoClient := dynamodb.New(sess)
+	summaries, err := albumSummaries(dynamoClient, ev)
+	if err != nil {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 500,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       `{"error": "Failed to load photos"}`,
+		}, nil
+	}
+	checked := keys
+	if coverKey != "" {
+		checked = append(slices.Clone(keys), coverKey)
+	}
+	if err := checkAlbumPhotos(ev, checked, summaries); err != nil {
+		return albumErrorResponse(err), nil
+	}
+
+	now := time.Now().Unix()
+	album := &Album{
+		AlbumID:      newAlbumID(),
+		EventID:      ev.EventID,
+		Title:        title,
+		Description:  strings.TrimSpace(createReq.Description),
+		PhotoIDs:     keys,
+		Filter:       createReq.Filter,
+		CoverPhotoID: coverKey,
+		Revision:     1,
+		CreatedAt:    now,
+		UpdatedAt:    now,
+	}
+	if err := putAlbum(dynamoClient, album, 0); err != nil {
+		log.Printf("Error creating album: %v", err)
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 500,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       `{"error": "Failed to create album"}`,
+		}, nil
+	}
+	return albumResponse(201, ev, album, summaries)
+}
+
+// handleUpdateAlbum serves PATCH /albums/{id}: renaming, describing,
+// choosing the cover, reordering and changing a smart album's filter
+func handleUpdateAlbum(request events.LambdaFunctionURLRequest, ev *event.Settings) (events.LambdaFunctionURLResponse, error) {
+	if denied := requireAdmin(request); denied != nil {
+		return *denied, nil
+	}
+	albumID, _ := albumAction(request.RequestContext.HTTP.Path)
+
+	var updateReq UpdateAlbumRequest
+	if err := json.Unmarshal([]byte(request.Body), &updateReq); err != nil {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 400,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       `{"error": "Invalid JSON"}`,
+		}, nil
+	}
+	if updateReq.Title != nil && strings.TrimSpace(*updateReq.Title) == "" {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 400,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       `{"error": "title can't be empty"}`,
+		}, nil
+	}
+	if updateReq.Filter != nil {
+		if err := checkAlbumFilter(ev, updateReq.Filter); err != nil {
+			return albumErrorResponse(err), nil
+		}
+	}
+	var keys []string
+	if updateReq.PhotoIDs != nil {
+		var err error
+		if keys, err = albumPhotoKeys(ev, updateReq.PhotoIDs); err != nil {
+			return albumErrorResponse(err), nil
+		}
+	}
+	var coverKey string
+	if updateReq.CoverPhotoID != nil && *updateReq.CoverPhotoID != "" {
+		cover, err := albumPhotoKeys(ev, []string{*updateReq.CoverPhotoID})
+		if err != nil {
+			return albumErrorResponse(err), nil
+		}
+		coverKey = cover[0]
+	}
+
+	sess := session.Must(session.NewSession())
+	dynamoClient := dynamodb.New(sess)
+	summaries, err := albumSummaries(dynamoClient, ev)
+	if err != nil {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 500,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       `{"error": "Failed to load photos"}`,
+		}, nil
+	}
+	if coverKey != "" {
+		if err := checkAlbumPhotos(ev, []string{coverKey}, summaries); err != nil {
+			return albumErrorResponse(err), nil
+		}
+	}
+
+	album, err := modifyAlbum(dynamoClient, ev, albumID, func(album *Album) error {
+		if updateReq.Title != nil {
+			album.Title = strings.TrimSpace(*updateReq.Title)
+		}
+		if updateReq.Description != nil {
+			album.Description = strings.TrimSpace(*updateReq.Description)
+		}
+		if updateReq.Filter != nil {
+			if !album.smart() {
+				return albumRequestError("Only smart albums have a filter")
+			}
+			album.Filter = updateReq.Filter
+		}
+		if updateReq.PhotoIDs != nil {
+			if album.smart() {
+				return albumRequestError("Smart albums are ordered by their filter's sort")
+			}
+			// A reorder may only move the photos shown, never add or drop
+			// them; photos deleted meanwhile go
+			current := slices.DeleteFunc(slices.Clone(album.PhotoIDs), func(key string) bool {
+				_, ok := summaries[key]
+				return !ok
+			})
+			if len(keys) != len(current) {
+				return albumRequestError("photoIds must list every photo in the album exactly once")
+			}
+			for _, key := range keys {
+				if !slices.Contains(current, key) {
+					return albumRequestError("photoIds must list every photo in the album exactly once")
+				}
+			}
+			album.PhotoIDs = keys
+		}
+		if updateReq.CoverPhotoID != nil {
+			// A smart album's cover can be any of the event's photos
+			if !album.smart() && coverKey != "" && !slices.Contains(album.PhotoIDs, coverKey) {
+				return albumRequestError("coverPhotoId must be one of the album's photos")
+			}
+			album.CoverPhotoID = coverKey
+		}
+		return nil
+	})
+	if err != nil {
+		return albumErrorResponse(err), nil
+	}
+	return albumResponse(200, ev, album, summaries)
+}
+
+// handleDeleteAlbum serves DELETE /albums/{id}. The photos themselves stay.
+func handleDeleteAlbum(request events.LambdaFunctionURLRequest, ev *event.Settings) (events.LambdaFunctionURLResponse, error) {
+	if denied := requireAdmin(request); denied != nil {
+		return *denied, nil
+	}
+	albumID, _ := albumAction(request.RequestContext.HTTP.Path)
+
+	_, err := dynamodb.New(session.Must(session.NewSession())).DeleteItem(&dynamodb.DeleteItemInput{
+		TableName:                 aws.String(albumsTable()),
+		Key:                       map[string]*dynamodb.AttributeValue{"albumId": {S: aws.String(albumID)}},
+		ConditionExpression:       aws.String("eventId = :eventId"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":eventId": {S: aws.String(ev.EventID)}},
+	})
+	if err != nil {
+		if isConditionFailed(err) {
+			return albumErrorResponse(errAlbumNotFound), nil
+		}
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 500,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       `{"error": "Failed to delete album"}`,
+		}, nil
+	}
+	return events.LambdaFunctionURLResponse{StatusCode: 204}, nil
+}
+
+// handleAddAlbumPhotos serves POST /albums/{id}/photos. Photos already in
+// the album keep their place.
+func handleAddAlbumPhotos(request events.LambdaFunctionURLRequest, ev *event.Settings) (events.LambdaFunctionURLResponse, error) {
+	if denied := requireAdmin(request); denied != nil {
+		return *denied, nil
+	}
+	albumID, _ := albumAction(request.RequestContext.HTTP.Path)
+
+	photosReq, resp := parseAlbumPhotosRequest(request, ev)
+	if resp != nil {
+		return *resp, nil
+	}
+
+	sess := session.Must(session.NewSession())
+	dynamoClient := dynamodb.New(sess)
+	summaries, err := albumSummaries(dynamoClient, ev)
+	if err != nil {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 500,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       `{"error": "Failed to load photos"}`,
+		}, nil
+	}
+	if err := checkAlbumPhotos(ev, photosReq.PhotoIDs, summaries); err != nil {
+		return albumErrorResponse(err), nil
+	}
+
+	album, err := modifyAlbum(dynamoClient, ev, albumID, func(album *Album) error {
+		if album.smart() {
+			return errSmartAlbumPhotos
+		}
+		var added []string
+		for _, photoID := range photosReq.PhotoIDs {
+			if !slices.Contains(album.PhotoIDs, photoID) {
+				added = append(added, photoID)
+			}
+		}
+		if len(album.PhotoIDs)+len(added) > maxAlbumPhotos {
+			return albumRequestError(fmt.Sprintf("Albums hold at most %d photos", maxAlbumPhotos))
+		}
+		position := len(album.PhotoIDs)
+		if photosReq.Position != nil {
+			position = min(max(*photosReq.Position, 0), len(album.PhotoIDs))
+		}
+		album.PhotoIDs = slices.Insert(album.PhotoIDs, position, added...)
+		return nil
+	})
+	if err != nil {
+		return albumErrorResponse(err), nil
+	}
+	return albumResponse(200, ev, album, summaries)
+}
+
+// handleRemoveAlbumPhotos serves DELETE /albums/{id}/photos. Photos that
+// aren't in the album are ignored; removing the cover resets it.
+func handleRemoveAlbumPhotos(request events.LambdaFunctionURLRequest, ev *event.Settings) (events.LambdaFunctionURLResponse, error) {
+	if denied := requireAdmin(request); denied != nil {
+		return *denied, nil
+	}
+	albumID, _ := albumAction(request.RequestContext.HTTP.Path)
+
+	photosReq, resp := parseAlbumPhotosRequest(request, ev)
+	if resp != nil {
+		return *resp, nil
+	}
+
+	sess := session.Must(session.NewSession())
+	dynamoClient := dynamodb.New(sess)
+	album, err := modifyAlbum(dynamoClient, ev, albumID, func(album *Album) error {
+		if album.smart() {
+			return errSmartAlbumPhotos
+		}
+		album.PhotoIDs = slices.DeleteFunc(album.PhotoIDs, func(photoID string) bool {
+			return slices.Contains(photosReq.PhotoIDs, photoID)
+		})
+		if slices.Contains(photosReq.PhotoIDs, album.CoverPhotoID) {
+			album.CoverPhotoID = ""
+		}
+		return nil
+	})
+	if err != nil {
+		return albumErrorResponse(err), nil
+	}
+	summaries, err := albumSummaries(dynamoClient, ev)
+	if err != nil {
+		log.Printf("Error loading photo summaries for album %s: %v", albumID, err)
+		summaries = nil
+	}
+	return albumResponse(200, ev, album, summaries)
+}
+
+// parseAlbumPhotosRequest reads the body of the bulk photo endpoints, with
+// the photo ids mapped to upload keys, returning a response for an invalid one
+func parseAlbumPhotosRequest(request events.LambdaFunctionURLRequest, ev *event.Settings) (AlbumPhotosRequest, *events.LambdaFunctionURLResponse) {
+	var photosReq AlbumPhotosRequest
+	if err := json.Unmarshal([]byte(request.Body), &photosReq); err != nil {
+		return photosReq, &events.LambdaFunctionURLResponse{
+			StatusCode: 400,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       `{"error": "Invalid JSON"}`,
+		}
+	}
+	if len(photosReq.PhotoIDs) == 0 || len(photosReq.PhotoIDs) > maxAlbumPhotos {
+		return photosReq, &events.LambdaFunctionURLResponse{
+			StatusCode: 400,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       fmt.Sprintf(`{"error": "photoIds must list between 1 and %d photos"}`, maxAlbumPhotos),
+		}
+	}
+	keys, err := albumPhotoKeys(ev, photosReq.PhotoIDs)
+	if err != nil {
+		resp := albumErrorResponse(err)
+		return photosReq, &resp
+	}
+	photosReq.PhotoIDs = keys
+	return photosReq, nil
+}
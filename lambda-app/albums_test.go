@@ -0,0 +1,59 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/Andrew-Wichmann/wedding-photos-app/internal/event"
+)
+
+func TestAlbumPhotoKeys(t *testing.T) {
+	reunion := &event.Settings{EventID: "reunion"}
+	keys, err := albumPhotoKeys(reunion, []string{"1718491327-IMG_4821.JPG", "1718491400-IMG_4822.JPG"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"uploads/reunion/1718491327-IMG_4821.JPG", "uploads/reunion/1718491400-IMG_4822.JPG"}
+	if !reflect.DeepEqual(keys, want) {
+		t.Errorf("keys = %q, want %q", keys, want)
+	}
+
+	for _, ids := range [][]string{
+		{"../1718491327-IMG_4821.JPG"},
+		{"1718491327-IMG_4821.JPG", "1718491327-IMG_4821.JPG"},
+	} {
+		if _, err := albumPhotoKeys(reunion, ids); err == nil {
+			t.Errorf("albumPhotoKeys(%q) succeeded", ids)
+		}
+	}
+}
+
+func TestAlbumViewLeavesOutDeletedPhotos(t *testing.T) {
+	reunion := &event.Settings{EventID: "reunion"}
+	album := &Album{
+		AlbumID:      "a1",
+		EventID:      "reunion",
+		PhotoIDs:     []string{"uploads/reunion/1.jpg", "uploads/reunion/2.jpg", "uploads/reunion/3.jpg"},
+		CoverPhotoID: "uploads/reunion/2.jpg",
+	}
+	summaries := map[string]photoSummary{
+		"uploads/reunion/1.jpg": {PhotoID: "uploads/reunion/1.jpg"},
+		"uploads/reunion/3.jpg": {PhotoID: "uploads/reunion/3.jpg"},
+	}
+
+	view := albumView(reunion, album, summaries)
+	if want := []string{"1.jpg", "3.jpg"}; !reflect.DeepEqual(view.PhotoIDs, want) {
+		t.Errorf("photoIds = %q, want %q", view.PhotoIDs, want)
+	}
+	if view.cover() != "1.jpg" {
+		t.Errorf("cover = %q, want the first remaining photo", view.cover())
+	}
+	if len(album.PhotoIDs) != 3 || album.CoverPhotoID != "uploads/reunion/2.jpg" {
+		t.Errorf("albumView changed the stored album: %+v", album)
+	}
+
+	// Without summaries nothing is left out
+	if view := albumView(reunion, album, nil); len(view.PhotoIDs) != 3 || view.CoverPhotoID != "2.jpg" {
+		t.Errorf("view without summaries = %+v", view)
+	}
+}
@@ -0,0 +1,472 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/Andrew-Wichmann/wedding-photos-app/internal/event"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+const (
+	maxCommentLength       = 1000
+	defaultCommentPageSize = 50
+	maxCommentPageSize     = 100
+)
+
+// Comment is a guest's comment on a photo. Comment IDs start with the time
+// they were posted, so a photo's comments are stored oldest first. Hidden
+// comments are only shown to admins and aren't counted on the photo.
+type Comment struct {
+	PhotoID    string `json:"photoId"`
+	CommentID  string `json:"commentId"`
+	EventID    string `json:"-" dynamodbav:"eventId"`
+	GuestID    string `json:"-" dynamodbav:"guestId"`
+	AuthorName string `json:"authorName"`
+	Text       string `json:"text"`
+	CreatedAt  int64  `json:"createdAt"`
+	Hidden     bool   `json:"hidden,omitempty"`
+	// Set on the requesting guest's own comments, which they can delete
+	Mine bool `json:"mine,omitempty" dynamodbav:"-"`
+}
+
+// CommentRequest is the body of POST /photos/{id}/comments
+type CommentRequest struct {
+	Text string `json:"text"`
+}
+
+// CommentModerationRequest is the body of PATCH /photos/{id}/comments/{commentId}
+type CommentModerationRequest struct {
+	Hidden *bool `json:"hidden"`
+}
+
+// commentsAction splits a /photos/{id}/comments[/{commentId}] path,
+// reporting whether it is one
+func commentsAction(path string) (photoID, commentID string, ok bool) {
+	rest, ok := strings.CutPrefix(path, "/photos/")
+	if !ok {
+		return "", "", false
+	}
+	if photoID, ok = strings.CutSuffix(rest, "/comments"); ok {
+		return photoID, "", true
+	}
+	photoID, commentID, ok = strings.Cut(rest, "/comments/")
+	return photoID, commentID, ok && commentID != "" && !strings.Contains(commentID, "/")
+}
+
+func newCommentID(now time.Time) string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return fmt.Sprintf("%013d-%s", now.UnixMilli(), hex.EncodeToString(b))
+}
+
+func commentsTable() string {
+	return os.Getenv("COMMENTS_TABLE")
+}
+
+// commentKey is the key of a comment in the comments table
+func commentKey(photoID, commentID string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"photoId":   {S: aws.String(photoID)},
+		"commentId": {S: aws.String(commentID)},
+	}
+}
+
+// getComment loads a comment, returning nil if the photo has no such comment
+func getComment(client *dynamodb.DynamoDB, photoID, commentID string) (*Comment, error) {
+	result, err := client.GetItem(&dynamodb.GetItemInput{
+		TableName:      aws.String(commentsTable()),
+		Key:            commentKey(photoID, commentID),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil || result.Item == nil {
+		return nil, err
+	}
+	var comment Comment
+	if err := dynamodbattribute.UnmarshalMap(result.Item, &comment); err != nil {
+		return nil, err
+	}
+	return &comment, nil
+}
+
+// hiddenCondition matches a comment whose hidden flag is still as it was read
+func hiddenCondition(hidden bool) (string, map[string]*dynamodb.AttributeValue) {
+	if hidden {
+		return "hidden = :hidden", map[string]*dynamodb.AttributeValue{":hidden": {BOOL: aws.Bool(true)}}
+	}
+	return "attribute_exists(commentId) AND (attribute_not_exists(hidden) OR hidden = :hidden)",
+		map[string]*dynamodb.AttributeValue{":hidden": {BOOL: aws.Bool(false)}}
+}
+
+// commentPhoto parses the photo of a comments path, with the key of its
+// metadata item. A response is returned for invalid or unknown photos.
+func commentPhoto(client *dynamodb.DynamoDB, ev *event.Settings, path string) (string, string, map[string]*dynamodb.AttributeValue, *events.LambdaFunctionURLResponse) {
+	id, commentID, _ := commentsAction(path)
+	key, ok := eventKey(ev, id)
+	if !ok {
+		return "", "", nil, &events.LambdaFunctionURLResponse{
+			StatusCode: 400,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       `{"error": "Invalid photo id"}`,
+		}
+	}
+	if commentsTable() == "" {
+		return "", "", nil, &events.LambdaFunctionURLResponse{
+			StatusCode: 500,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       `{"error": "COMMENTS_TABLE is not configured"}`,
+		}
+	}
+	itemKey, err := metadataKey(client, metadataTable(), key)
+	if err != nil {
+		return "", "", nil, &events.LambdaFunctionURLResponse{
+			StatusCode: 500,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       `{"error": "Failed to load photo"}`,
+		}
+	}
+	return key, commentID, itemKey, nil
+}
+
+func metadataTable() string {
+	if tableName := os.Getenv("DYNAMODB_TABLE"); tableName != "" {
+		return tableName
+	}
+	return "wedding-photo-metadata" // fallback
+}
+
+// handleComments serves GET /photos/{id}/comments, oldest first. Pages hold
+// up to limit comments, with the cursor for the next page in X-Next-Cursor
+// as in /gallery. Admins also see hidden comments.
+func handleComments(request events.LambdaFunctionURLRequest, ev *event.Settings) (events.LambdaFunctionURLResponse, error) {
+	dynamoClient := dynamodb.New(session.Must(session.NewSession()))
+	key, _, itemKey, resp := commentPhoto(dynamoClient, ev, request.RequestContext.HTTP.Path)
+	if resp != nil {
+		return *resp, nil
+	}
+	if itemKey == nil {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 404,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       `{"error": "Photo not found"}`,
+		}, nil
+	}
+
+	limit := defaultCommentPageSize
+	if l := request.QueryStringParameters["limit"]; l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit < 1 || limit > maxCommentPageSize {
+			return events.LambdaFunctionURLResponse{
+				StatusCode: 400,
+				Headers:    map[string]string{"Content-Type": "application/json"},
+				Body:       fmt.Sprintf(`{"error": "limit must be between 1 and %d"}`, maxCommentPageSize),
+			}, nil
+		}
+	}
+
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(commentsTable()),
+		KeyConditionExpression: aws.String("photoId = :photoId"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":photoId": {S: aws.String(key)},
+		},
+	}
+	admin := isAdmin(request)
+	if !admin {
+		input.FilterExpression = aws.String("attribute_not_exists(hidden) OR hidden = :hidden")
+		input.ExpressionAttributeValues[":hidden"] = &dynamodb.AttributeValue{BOOL: aws.Bool(false)}
+	}
+	// The cursor is the ID of the last comment of the previous page
+	if encoded := request.QueryStringParameters["cursor"]; encoded != "" {
+		commentID, err := base64.RawURLEncoding.DecodeString(encoded)
+		if err != nil || len(commentID) == 0 {
+			return events.LambdaFunctionURLResponse{
+				StatusCode: 400,
+				Headers:    map[string]string{"Content-Type": "application/json"},
+				Body:       `{"error": "invalid cursor"}`,
+			}, nil
+		}
+		input.ExclusiveStartKey = commentKey(key, string(commentID))
+	}
+
+	// The filter applies after DynamoDB's limit, so keep reading until the
+	// page is full or the comments run out
+	comments := []Comment{}
+	var nextCursor string
+	err := dynamoClient.QueryPages(input, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+		var items []Comment
+		if err := dynamodbattribute.UnmarshalListOfMaps(page.Items, &items); err != nil {
+			return false
+		}
+		for _, comment := range items {
+			if len(comments) == limit {
+				nextCursor = base64.RawURLEncoding.EncodeToString([]byte(comments[limit-1].CommentID))
+				return false
+			}
+			comments = append(comments, comment)
+		}
+		return true
+	})
+	if err != nil {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 500,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       `{"error": "Failed to load comments"}`,
+		}, nil
+	}
+
+	if guest := readSession(request); guest != nil {
+		for i := range comments {
+			comments[i].Mine = comments[i].GuestID == guest.ID
+		}
+	}
+	responseBody, _ := json.Marshal(comments)
+	return events.LambdaFunctionURLResponse{
+		StatusCode: 200,
+		Headers:    galleryHeaders(nextCursor),
+		Body:       string(responseBody),
+	}, nil
+}
+
+// handleCreateComment serves POST /photos/{id}/comments, signed with the
+// name in the guest's session
+func handleCreateComment(request events.LambdaFunctionURLRequest, ev *event.Settings) (events.LambdaFunctionURLResponse, error) {
+	var commentReq CommentRequest
+	if err := json.Unmarshal([]byte(request.Body), &commentReq); err != nil {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 400,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       `{"error": "Invalid JSON"}`,
+		}, nil
+	}
+	text := strings.TrimSpace(commentReq.Text)
+	if text == "" || utf8.RuneCountInString(text) > maxCommentLength {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 400,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       fmt.Sprintf(`{"error": "Comments are 1-%d characters"}`, maxCommentLength),
+		}, nil
+	}
+	guest := readSession(request)
+	if guest == nil || guest.Name == "" {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 400,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       `{"error": "Set your name with PUT /session before commenting"}`,
+		}, nil
+	}
+
+	dynamoClient := dynamodb.New(session.Must(session.NewSession()))
+	key, _, itemKey, resp := commentPhoto(dynamoClient, ev, request.RequestContext.HTTP.Path)
+	if resp != nil {
+		return *resp, nil
+	}
+	// Only processed photos have an item to count comments on
+	if itemKey == nil {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 404,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       `{"error": "Photo not found"}`,
+		}, nil
+	}
+
+	now := time.Now()
+	comment := Comment{
+		PhotoID:    key,
+		CommentID:  newCommentID(now),
+		EventID:    ev.EventID,
+		GuestID:    guest.ID,
+		AuthorName: guest.Name,
+		Text:       text,
+		CreatedAt:  now.Unix(),
+	}
+	item, err := dynamodbattribute.MarshalMap(comment)
+	if err == nil {
+		_, err = writeCounted(dynamoClient, &dynamodb.TransactWriteItem{Put: &dynamodb.Put{
+			TableName:           aws.String(commentsTable()),
+			Item:                item,
+			ConditionExpression: aws.String("attribute_not_exists(commentId)"),
+		}}, metadataTable(), itemKey, "commentCount", 1)
+	}
+	if err != nil {
+		log.Printf("Error saving comment on %s: %v", key, err)
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 500,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       `{"error": "Failed to save comment"}`,
+		}, nil
+	}
+
+	comment.Mine = true
+	responseBody, _ := json.Marshal(comment)
+	return events.LambdaFunctionURLResponse{
+		StatusCode: 201,
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       string(responseBody),
+	}, nil
+}
+
+// handleDeleteComment serves DELETE /photos/{id}/comments/{commentId} for
+// the comment's author or an admin
+func handleDeleteComment(request events.LambdaFunctionURLRequest, ev *event.Settings) (events.LambdaFunctionURLResponse, error) {
+	dynamoClient := dynamodb.New(session.Must(session.NewSession()))
+	key, commentID, itemKey, resp := commentPhoto(dynamoClient, ev, request.RequestContext.HTTP.Path)
+	if resp != nil {
+		return *resp, nil
+	}
+	comment, err := getComment(dynamoClient, key, commentID)
+	if err != nil {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 500,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       `{"error": "Failed to load comment"}`,
+		}, nil
+	}
+	if comment == nil {
+		// Already gone
+		return events.LambdaFunctionURLResponse{StatusCode: 204}, nil
+	}
+	guest := readSession(request)
+	if !isAdmin(request) && (guest == nil || guest.ID != comment.GuestID) {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 403,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       `{"error": "Only the author or an admin can delete a comment"}`,
+		}, nil
+	}
+
+	// Hidden comments were already taken off the count
+	delta := -1
+	if comment.Hidden {
+		delta = 0
+	}
+	condition, values := hiddenCondition(comment.Hidden)
+	applied, err := writeCounted(dynamoClient, &dynamodb.TransactWriteItem{Delete: &dynamodb.Delete{
+		TableName:                 aws.String(commentsTable()),
+		Key:                       commentKey(key, commentID),
+		ConditionExpression:       aws.String(condition),
+		ExpressionAttributeValues: values,
+	}}, metadataTable(), itemKey, "commentCount", delta)
+	if err == nil && !applied {
+		// Hidden or unhidden since it was read
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 409,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       `{"error": "The comment was changed, please try again"}`,
+		}, nil
+	}
+	if err != nil {
+		log.Printf("Error deleting comment %s on %s: %v", commentID, key, err)
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 500,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       `{"error": "Failed to delete comment"}`,
+		}, nil
+	}
+	return events.LambdaFunctionURLResponse{StatusCode: 204}, nil
+}
+
+// handleModerateComment serves PATCH /photos/{id}/comments/{commentId} for
+// admins, hiding a comment from guests or showing it again
+func handleModerateComment(request events.LambdaFunctionURLRequest, ev *event.Settings) (events.LambdaFunctionURLResponse, error) {
+	if denied := requireAdmin(request); denied != nil {
+		return *denied, nil
+	}
+	var moderationReq CommentModerationRequest
+	if err := json.Unmarshal([]byte(request.Body), &moderationReq); err != nil || moderationReq.Hidden == nil {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 400,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       `{"error": "Body must be {\"hidden\": true|false}"}`,
+		}, nil
+	}
+	hidden := *moderationReq.Hidden
+
+	dynamoClient := dynamodb.New(session.Must(session.NewSession()))
+	key, commentID, itemKey, resp := commentPhoto(dynamoClient, ev, request.RequestContext.HTTP.Path)
+	if resp != nil {
+		return *resp, nil
+	}
+	comment, err := getComment(dynamoClient, key, commentID)
+	if err != nil {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 500,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       `{"error": "Failed to load comment"}`,
+		}, nil
+	}
+	if comment == nil {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 404,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       `{"error": "Comment not found"}`,
+		}, nil
+	}
+
+	// Visible comments are counted, so the count follows the flag. Setting
+	// the flag it already has changes nothing.
+	if comment.Hidden != hidden {
+		delta := 1
+		if hidden {
+			delta = -1
+		}
+		condition, values := hiddenCondition(comment.Hidden)
+		values[":set"] = &dynamodb.AttributeValue{BOOL: aws.Bool(hidden)}
+		applied, err := writeCounted(dynamoClient, &dynamodb.TransactWriteItem{Update: &dynamodb.Update{
+			TableName:                 aws.String(commentsTable()),
+			Key:                       commentKey(key, commentID),
+			UpdateExpression:          aws.String("SET hidden = :set"),
+			ConditionExpression:       aws.String(condition),
+			ExpressionAttributeValues: values,
+		}}, metadataTable(), itemKey, "commentCount", delta)
+		if err != nil {
+			log.Printf("Error moderating comment %s on %s: %v", commentID, key, err)
+			return events.LambdaFunctionURLResponse{
+				StatusCode: 500,
+				Headers:    map[string]string{"Content-Type": "application/json"},
+				Body:       `{"error": "Failed to update comment"}`,
+			}, nil
+		}
+		if applied {
+			comment.Hidden = hidden
+		} else {
+			// Another request changed or deleted the comment first, so
+			// report what is stored now
+			comment, err = getComment(dynamoClient, key, commentID)
+			if err != nil {
+				return events.LambdaFunctionURLResponse{
+					StatusCode: 500,
+					Headers:    map[string]string{"Content-Type": "application/json"},
+					Body:       `{"error": "Failed to load comment"}`,
+				}, nil
+			}
+			if comment == nil {
+				return events.LambdaFunctionURLResponse{
+					StatusCode: 404,
+					Headers:    map[string]string{"Content-Type": "application/json"},
+					Body:       `{"error": "Comment not found"}`,
+				}, nil
+			}
+		}
+	}
+
+	responseBody, _ := json.Marshal(comment)
+	return events.LambdaFunctionURLResponse{
+		StatusCode: 200,
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       string(responseBody),
+	}, nil
+}
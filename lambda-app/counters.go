@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// Like and comment counts are kept on each photo's metadata item so the
+// gallery can sort and badge photos without reading the other tables. The
+// metadata lambda updates only its own attributes, so it never overwrites
+// them.
+
+// metadataKey looks up the key of a photo's metadata item, which is also
+// ranged by upload time. It returns nil for photos without one.
+func metadataKey(client *dynamodb.DynamoDB, tableName, photoID string) (map[string]*dynamodb.AttributeValue, error) {
+	result, err := client.Query(&dynamodb.QueryInput{
+		TableName:              aws.String(tableName),
+		KeyConditionExpression: aws.String("photoId = :photoId"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":photoId": {S: aws.String(photoID)},
+		},
+		ProjectionExpression: aws.String("photoId, uploadedAt"),
+		ScanIndexForward:     aws.Bool(false),
+		Limit:                aws.Int64(1),
+	})
+	if err != nil || len(result.Items) == 0 {
+		return nil, err
+	}
+	return result.Items[0], nil
+}
+
+// writeCounted applies a conditional write and moves a counter on the
+// photo's metadata item by delta, both or neither. It reports false when the
+// write's condition failed, which callers treat as nothing to do. Photos
+// without a metadata item (key is nil) are written without counting.
+func writeCounted(client *dynamodb.DynamoDB, write *dynamodb.TransactWriteItem, metadataTable string, key map[string]*dynamodb.AttributeValue, counter string, delta int) (bool, error) {
+	items := []*dynamodb.TransactWriteItem{write}
+	if key != nil && delta != 0 {
+		items = append(items, &dynamodb.TransactWriteItem{Update: &dynamodb.Update{
+			TableName:                 aws.String(metadataTable),
+			Key:                       key,
+			UpdateExpression:          aws.String("ADD #counter :delta"),
+			ConditionExpression:       aws.String("attribute_exists(photoId)"),
+			ExpressionAttributeNames:  map[string]*string{"#counter": aws.String(counter)},
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":delta": {N: aws.String(fmt.Sprint(delta))}},
+		}})
+	}
+
+	_, err := client.TransactWriteItems(&dynamodb.TransactWriteItemsInput{TransactItems: items})
+	var canceled *dynamodb.TransactionCanceledException
+	if errors.As(err, &canceled) && len(canceled.CancellationReasons) > 0 &&
+		aws.StringValue(canceled.CancellationReasons[0].Code) == "ConditionalCheckFailed" {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// readCounter reads a counter back from a photo's metadata item
+func readCounter(client *dynamodb.DynamoDB, tableName string, key map[string]*dynamodb.AttributeValue, counter string) (int, error) {
+	result, err := client.GetItem(&dynamodb.GetItemInput{
+		TableName:                aws.String(tableName),
+		Key:                      key,
+		ProjectionExpression:     aws.String("#counter"),
+		ExpressionAttributeNames: map[string]*string{"#counter": aws.String(counter)},
+		ConsistentRead:           aws.Bool(true),
+	})
+	if err != nil {
+		return 0, err
+	}
+	value, ok := result.Item[counter]
+	if !ok || value.N == nil {
+		return 0, nil
+	}
+	count, err := strconv.Atoi(*value.N)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %w", counter, *value.N, err)
+	}
+	return count, nil
+}
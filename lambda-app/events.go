@@ -0,0 +1,276 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Andrew-Wichmann/wedding-photos-app/internal/event"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+// EventSettingsRequest is the body of PUT /events/{id}. Omitted fields keep
+// their current value.
+type EventSettingsRequest struct {
+	Name         *string `json:"name"`
+	Timezone     *string `json:"timezone"`
+	CollectionID *string `json:"collectionId"`
+}
+
+// PublicEventSettings is what guests see of an event at GET {event}/settings
+type PublicEventSettings struct {
+	EventID  string `json:"eventId"`
+	Name     string `json:"name,omitempty"`
+	Timezone string `json:"timezone"`
+	BasePath string `json:"basePath"`
+}
+
+// routeEvent splits the /e/{event} prefix off a request path, returning the
+// event's settings and the path within it. Paths without the prefix belong
+// to the default event. A response is returned for unknown events.
+func routeEvent(path string) (*event.Settings, string, *events.LambdaFunctionURLResponse) {
+	eventID, rest := event.Default, path
+	if trimmed, ok := strings.CutPrefix(path, "/e/"); ok {
+		eventID, rest, _ = strings.Cut(trimmed, "/")
+		rest = "/" + rest
+	}
+
+	ev, err := event.Load(dynamodb.New(session.Must(session.NewSession())), os.Getenv("EVENTS_TABLE"), eventID)
+	if err != nil {
+		log.Printf("Error loading event %s: %v", eventID, err)
+		return nil, "", &events.LambdaFunctionURLResponse{
+			StatusCode: 500,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       `{"error": "Failed to load event"}`,
+		}
+	}
+	if ev == nil {
+		return nil, "", &events.LambdaFunctionURLResponse{
+			StatusCode: 404,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       `{"error": "Event not found"}`,
+		}
+	}
+	return ev, rest, nil
+}
+
+// eventKey maps a photo id from an event's URLs (the upload key without the
+// event's upload prefix, as in /img/{id}) to its upload key. Ids that would
+// reach outside the event are rejected.
+func eventKey(ev *event.Settings, id string) (string, bool) {
+	if id == "" || strings.Contains(id, "..") {
+		return "", false
+	}
+	key := ev.UploadPrefix() + id
+	return key, ev.Owns(key)
+}
+
+// relativeID is the inverse of eventKey
+func relativeID(ev *event.Settings, key string) string {
+	return strings.TrimPrefix(key, ev.UploadPrefix())
+}
+
+// handleEventSettings serves GET {event}/settings, so the page can show the
+// event's name
+func handleEventSettings(ev *event.Settings) (events.LambdaFunctionURLResponse, error) {
+	responseBody, _ := json.Marshal(PublicEventSettings{
+		EventID:  ev.EventID,
+		Name:     ev.Name,
+		Timezone: ev.Location().String(),
+		BasePath: ev.BasePath(),
+	})
+	return events.LambdaFunctionURLResponse{
+		StatusCode: 200,
+		Headers: map[string]string{
+			"Content-Type":                "application/json",
+			"Access-Control-Allow-Origin": "*",
+			"Cache-Control":               "public, max-age=300",
+		},
+		Body: string(responseBody),
+	}, nil
+}
+
+// handleListEvents serves GET /events for admins
+func handleListEvents(request events.LambdaFunctionURLRequest) (events.LambdaFunctionURLResponse, error) {
+	if resp := requireAdmin(request); resp != nil {
+		return *resp, nil
+	}
+
+	sess := session.Must(session.NewSession())
+	dynamoClient := dynamodb.New(sess)
+
+	list, err := scanEvents(dynamoClient, os.Getenv("EVENTS_TABLE"))
+	if err != nil {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 500,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       `{"error": "Failed to list events"}`,
+		}, nil
+	}
+
+	responseBody, _ := json.Marshal(list)
+	return events.LambdaFunctionURLResponse{
+		StatusCode: 200,
+		Headers:    map[string]string{"Content-Type": "application/json", "Cache-Control": "no-store"},
+		Body:       string(responseBody),
+	}, nil
+}
+
+// scanEvents loads the settings of every event, including the default
+// event, which exists without an item
+func scanEvents(client *dynamodb.DynamoDB, tableName string) ([]event.Settings, error) {
+	list := []event.Settings{}
+	if tableName != "" {
+		err := client.ScanPages(&dynamodb.ScanInput{
+			TableName: aws.String(tableName),
+		}, func(page *dynamodb.ScanOutput, lastPage bool) bool {
+			for _, item := range page.Items {
+				var settings event.Settings
+				if err := dynamodbattribute.UnmarshalMap(item, &settings); err != nil {
+					log.Printf("Skipping unreadable event %s: %v", aws.StringValue(item["eventId"].S), err)
+					continue
+				}
+				list = append(list, settings)
+			}
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	hasDefault := false
+	for _, settings := range list {
+		hasDefault = hasDefault || settings.EventID == event.Default
+	}
+	if !hasDefault {
+		list = append([]event.Settings{{EventID: event.Default}}, list...)
+	}
+	return list, nil
+}
+
+// handlePutEvent serves PUT /events/{id}, creating the event or updating its
+// settings. New events are live at /e/{id}/ straight away.
+func handlePutEvent(request events.LambdaFunctionURLRequest) (events.LambdaFunctionURLResponse, error) {
+	if resp := requireAdmin(request); resp != nil {
+		return *resp, nil
+	}
+
+	eventID := strings.TrimPrefix(request.RequestContext.HTTP.Path, "/events/")
+	if !event.Valid(eventID) {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 400,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       `{"error": "Event IDs are 1-40 lowercase letters, digits and dashes"}`,
+		}, nil
+	}
+	var settingsReq EventSettingsRequest
+	if err := json.Unmarshal([]byte(request.Body), &settingsReq); err != nil {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 400,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       `{"error": "Invalid JSON"}`,
+		}, nil
+	}
+	if settingsReq.Timezone != nil && *settingsReq.Timezone != "" {
+		if _, err := time.LoadLocation(*settingsReq.Timezone); err != nil {
+			return events.LambdaFunctionURLResponse{
+				StatusCode: 400,
+				Headers:    map[string]string{"Content-Type": "application/json"},
+				Body:       fmt.Sprintf(`{"error": %q}`, "Unknown timezone "+*settingsReq.Timezone),
+			}, nil
+		}
+	}
+	tableName := os.Getenv("EVENTS_TABLE")
+	if tableName == "" {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 500,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       `{"error": "EVENTS_TABLE is not configured"}`,
+		}, nil
+	}
+
+	sess := session.Must(session.NewSession())
+	dynamoClient := dynamodb.New(sess)
+
+	// Each event searches only its own collection, so it can't be shared
+	list, err := scanEvents(dynamoClient, tableName)
+	if err != nil {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 500,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       `{"error": "Failed to list events"}`,
+		}, nil
+	}
+	updated := event.Settings{EventID: eventID}
+	for _, settings := range list {
+		if settings.EventID == eventID {
+			updated = settings
+		}
+	}
+	if settingsReq.CollectionID != nil {
+		updated.CollectionID = strings.TrimSpace(*settingsReq.CollectionID)
+	}
+	collectionID := updated.Collection(event.BaseCollection())
+	if other, ok := event.CollectionUser(list, event.BaseCollection(), collectionID, eventID); ok {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 409,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       fmt.Sprintf(`{"error": %q}`, "Collection "+collectionID+" is used by event "+other),
+		}, nil
+	}
+
+	now := fmt.Sprint(time.Now().Unix())
+	sets := []string{"createdAt = if_not_exists(createdAt, :now)", "updatedAt = :now"}
+	values := map[string]*dynamodb.AttributeValue{":now": {N: aws.String(now)}}
+	names := make(map[string]*string)
+	for _, field := range []struct {
+		attr  string
+		value *string
+	}{
+		{"name", settingsReq.Name},
+		{"timezone", settingsReq.Timezone},
+		{"collectionId", settingsReq.CollectionID},
+	} {
+		if field.value == nil {
+			continue
+		}
+		names["#"+field.attr] = aws.String(field.attr)
+		sets = append(sets, fmt.Sprintf("#%s = :%s", field.attr, field.attr))
+		values[":"+field.attr] = &dynamodb.AttributeValue{S: aws.String(strings.TrimSpace(*field.value))}
+	}
+	input := &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(tableName),
+		Key:                       map[string]*dynamodb.AttributeValue{"eventId": {S: aws.String(eventID)}},
+		UpdateExpression:          aws.String("SET " + strings.Join(sets, ", ")),
+		ExpressionAttributeValues: values,
+		ReturnValues:              aws.String(dynamodb.ReturnValueAllNew),
+	}
+	if len(names) > 0 {
+		input.ExpressionAttributeNames = names
+	}
+	result, err := dynamoClient.UpdateItem(input)
+	if err != nil {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 500,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       `{"error": "Failed to save event"}`,
+		}, nil
+	}
+	event.Forget(eventID)
+
+	var settings event.Settings
+	dynamodbattribute.UnmarshalMap(result.Attributes, &settings)
+	responseBody, _ := json.Marshal(settings)
+	return events.LambdaFunctionURLResponse{
+		StatusCode: 200,
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       string(responseBody),
+	}, nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Andrew-Wichmann/wedding-photos-app/internal/event"
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// Photo ids in one event's URLs can't name another event's uploads
+func TestEventKeyStaysInEvent(t *testing.T) {
+	wedding := &event.Settings{EventID: event.Default}
+	reunion := &event.Settings{EventID: "reunion"}
+	tests := []struct {
+		ev      *event.Settings
+		id      string
+		wantKey string // empty if rejected
+	}{
+		{wedding, "1718491327-IMG_4821.JPG", "uploads/1718491327-IMG_4821.JPG"},
+		{reunion, "1718491327-IMG_4821.JPG", "uploads/reunion/1718491327-IMG_4821.JPG"},
+		{wedding, "reunion/1718491327-IMG_4821.JPG", ""},
+		{reunion, "../1718491327-IMG_4821.JPG", ""},
+		{reunion, "../party/1718491327-IMG_4821.JPG", ""},
+		{reunion, "", ""},
+	}
+	for _, tt := range tests {
+		key, ok := eventKey(tt.ev, tt.id)
+		if ok != (tt.wantKey != "") || (ok && key != tt.wantKey) {
+			t.Errorf("eventKey(%s, %q) = %q, %t, want %q", tt.ev.EventID, tt.id, key, ok, tt.wantKey)
+		}
+		if ok && relativeID(tt.ev, key) != tt.id {
+			t.Errorf("relativeID(%s, %q) = %q, want %q", tt.ev.EventID, key, relativeID(tt.ev, key), tt.id)
+		}
+	}
+}
+
+func TestBuildScanInputFiltersByEvent(t *testing.T) {
+	tests := []struct {
+		ev     *event.Settings
+		filter string
+	}{
+		{&event.Settings{EventID: "reunion"}, "#eventId = :eventId"},
+		// Items from before events were recorded belong to the default event
+		{&event.Settings{EventID: event.Default}, "(attribute_not_exists(#eventId) OR #eventId = :eventId)"},
+	}
+	for _, tt := range tests {
+		for _, params := range []map[string]string{{}, {"minFaces": "2", "device": "iPhone"}} {
+			input, err := buildScanInput("metadata", params, tt.ev)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(aws.StringValue(input.FilterExpression), tt.filter) {
+				t.Errorf("event %s, %v: filter %q doesn't start with %q", tt.ev.EventID, params, aws.StringValue(input.FilterExpression), tt.filter)
+			}
+			if got := aws.StringValue(input.ExpressionAttributeValues[":eventId"].S); got != tt.ev.EventID {
+				t.Errorf("event %s, %v: :eventId = %q", tt.ev.EventID, params, got)
+			}
+		}
+	}
+}
+
+func TestPersonInEvent(t *testing.T) {
+	wedding := &event.Settings{EventID: event.Default}
+	reunion := &event.Settings{EventID: "reunion"}
+	tests := []struct {
+		person           Person
+		wedding, reunion bool
+	}{
+		{Person{PersonID: "a", EventID: "reunion"}, false, true},
+		{Person{PersonID: "b", EventID: event.Default}, true, false},
+		// Clustered before events were recorded
+		{Person{PersonID: "c"}, true, false},
+	}
+	for _, tt := range tests {
+		if got := tt.person.inEvent(wedding); got != tt.wedding {
+			t.Errorf("person %s in the default event = %t, want %t", tt.person.PersonID, got, tt.wedding)
+		}
+		if got := tt.person.inEvent(reunion); got != tt.reunion {
+			t.Errorf("person %s in reunion = %t, want %t", tt.person.PersonID, got, tt.reunion)
+		}
+	}
+}
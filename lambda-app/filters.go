@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata" // the provided.al2023 runtime ships without zoneinfo
+
+	"github.com/Andrew-Wichmann/wedding-photos-app/internal/event"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// parseFilterTime parses a startDate/endDate value into an instant. Values
+// with an offset (RFC 3339) are exact; local datetimes and plain dates are
+// taken in the event timezone. A plain date used as the end of a range
+// includes that whole day.
+func parseFilterTime(value string, loc *time.Location, endOfRange bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02T15:04:05", "2006-01-02T15:04"} {
+		if t, err := time.ParseInLocation(layout, value, loc); err == nil {
+			return t, nil
+		}
+	}
+	if t, err := time.ParseInLocation("2006-01-02", value, loc); err == nil {
+		if endOfRange {
+			return t.AddDate(0, 0, 1).Add(-time.Second), nil
+		}
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid date %q, expected YYYY-MM-DD or RFC 3339", value)
+}
+
+// Query parameters that narrow the gallery down to matching metadata
+var filterParams = []string{"faceId", "personId", "person", "minFaces", "startDate", "endDate", "device", "labels"}
+
+func hasFilters(queryParams map[string]string) bool {
+	for _, param := range filterParams {
+		if queryParams[param] != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// eventFilter returns the filter expression that keeps an event's items of
+// the metadata table, adding its names and values. Items not yet migrated
+// to record their event all belong to the default one.
+func eventFilter(ev *event.Settings, names map[string]*string, values map[string]*dynamodb.AttributeValue) string {
+	names["#eventId"] = aws.String("eventId")
+	values[":eventId"] = &dynamodb.AttributeValue{S: aws.String(ev.EventID)}
+	if ev.EventID == event.Default {
+		return "(attribute_not_exists(#eventId) OR #eventId = :eventId)"
+	}
+	return "#eventId = :eventId"
+}
+
+// buildScanInput translates the gallery filter query parameters into a
+// filtered scan of the event's part of the metadata table. The faceId,
+// labels and people filters are applied in memory instead.
+func buildScanInput(tableName string, queryParams map[string]string, ev *event.Settings) (*dynamodb.ScanInput, error) {
+	scanInput := &dynamodb.ScanInput{
+		TableName: aws.String(tableName),
+	}
+
+	var filterExpressions []string
+	expressionAttributeValues := make(map[string]*dynamodb.AttributeValue)
+	expressionAttributeNames := make(map[string]*string)
+
+	// Only the event's photos
+	filterExpressions = append(filterExpressions, eventFilter(ev, expressionAttributeNames, expressionAttributeValues))
+
+	// Filter by minimum face count
+	if minFaces := queryParams["minFaces"]; minFaces != "" {
+		if _, err := strconv.Atoi(minFaces); err == nil {
+			filterExpressions = append(filterExpressions, "#faceCount >= :minFaces")
+			expressionAttributeNames["#faceCount"] = aws.String("faceCount")
+			expressionAttributeValues[":minFaces"] = &dynamodb.AttributeValue{N: aws.String(minFaces)}
+		}
+	}
+
+	// Filter by date range, comparing UTC instants rather than date strings.
+	// Items from before takenAt existed get it when upgraded after the scan,
+	// so they are let through here and filterByDateRange decides.
+	start, end, err := dateRange(queryParams, ev.Location())
+	if err != nil {
+		return nil, err
+	}
+	if !start.IsZero() {
+		filterExpressions = append(filterExpressions, "(#takenAt >= :startTime OR attribute_not_exists(#takenAt))")
+		expressionAttributeNames["#takenAt"] = aws.String("takenAt")
+		expressionAttributeValues[":startTime"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(start.Unix(), 10))}
+	}
+	if !end.IsZero() {
+		filterExpressions = append(filterExpressions, "(#takenAt <= :endTime OR attribute_not_exists(#takenAt))")
+		expressionAttributeNames["#takenAt"] = aws.String("takenAt")
+		expressionAttributeValues[":endTime"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(end.Unix(), 10))}
+	}
+
+	// Filter by device
+	if device := queryParams["device"]; device != "" {
+		filterExpressions = append(filterExpressions, "contains(#model, :device)")
+		expressionAttributeNames["#model"] = aws.String("model")
+		expressionAttributeValues[":device"] = &dynamodb.AttributeValue{S: aws.String(device)}
+	}
+
+	scanInput.FilterExpression = aws.String(strings.Join(filterExpressions, " AND "))
+	scanInput.ExpressionAttributeValues = expressionAttributeValues
+	scanInput.ExpressionAttributeNames = expressionAttributeNames
+
+	return scanInput, nil
+}
+
+// dateRange parses the startDate and endDate parameters, leaving the
+// missing ends zero
+func dateRange(queryParams map[string]string, loc *time.Location) (start, end time.Time, err error) {
+	if startDate := queryParams["startDate"]; startDate != "" {
+		if start, err = parseFilterTime(startDate, loc, false); err != nil {
+			return start, end, err
+		}
+	}
+	if endDate := queryParams["endDate"]; endDate != "" {
+		if end, err = parseFilterTime(endDate, loc, true); err != nil {
+			return start, end, err
+		}
+	}
+	return start, end, nil
+}
+
+// filterByDateRange keeps the upgraded metadata items taken within the
+// startDate and endDate parameters. Items without a capture time are left
+// out of any date range.
+func filterByDateRange(metadata []map[string]interface{}, queryParams map[string]string, loc *time.Location) []map[string]interface{} {
+	start, end, err := dateRange(queryParams, loc)
+	if err != nil || (start.IsZero() && end.IsZero()) {
+		return metadata
+	}
+	var filtered []map[string]interface{}
+	for _, item := range metadata {
+		takenAt, ok := item["takenAt"].(float64)
+		if !ok {
+			continue
+		}
+		if (!start.IsZero() && int64(takenAt) < start.Unix()) || (!end.IsZero() && int64(takenAt) > end.Unix()) {
+			continue
+		}
+		filtered = append(filtered, item)
+	}
+	return filtered
+}
+
+// filterByFaceID keeps the metadata items containing the given face
+func filterByFaceID(metadata []map[string]interface{}, faceID string) []map[string]interface{} {
+	var filtered []map[string]interface{}
+	for _, item := range metadata {
+		if faces, ok := item["faces"].([]interface{}); ok {
+			for _, face := range faces {
+				if faceMap, ok := face.(map[string]interface{}); ok {
+					if id, ok := faceMap["faceId"].(string); ok && id == faceID {
+						filtered = append(filtered, item)
+						break
+					}
+				}
+			}
+		}
+	}
+	return filtered
+}
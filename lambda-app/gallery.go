@@ -0,0 +1,171 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Andrew-Wichmann/wedding-photos-app/internal/event"
+	"github.com/Andrew-Wichmann/wedding-photos-app/internal/schema"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// photoSummary is the part of a metadata item returned with each gallery entry
+type photoSummary struct {
+	PhotoID         string               `json:"photoId"`
+	DateTaken       string               `json:"dateTaken"`
+	DateTakenSource string               `json:"dateTakenSource"`
+	DisplayWidth    int                  `json:"displayWidth"`
+	DisplayHeight   int                  `json:"displayHeight"`
+	Renditions      map[string]Rendition `json:"renditions"`
+	CommentCount    int                  `json:"commentCount"`
+	// For sorting
+	TakenAt    int64 `json:"takenAt"`
+	UploadedAt int64 `json:"uploadedAt"`
+	LikeCount  int   `json:"likeCount"`
+}
+
+// Besides the summary fields, the projection includes what the schema
+// migrations need to fill them in for older items
+var photoSummaryAttributes = []string{"photoId", "dateTaken", "dateTakenSource", "displayWidth", "displayHeight", "renditions", "uploadedAt", "likeCount", "commentCount",
+	schema.VersionAttribute, "mediaType", "videoCodec", "takenAt", "width", "height", "orientation", "rotation"}
+
+// Capture times guessed from the filename or upload time rather than read
+// from the file, which the gallery marks as approximate
+var approximateDateSources = map[string]bool{"filename": true, "upload": true}
+
+// summariesFromItems maps photoId to the gallery summary of each metadata item
+func summariesFromItems(items []map[string]*dynamodb.AttributeValue) map[string]photoSummary {
+	byKey := make(map[string]photoSummary)
+	for _, item := range items {
+		var summary photoSummary
+		if err := dynamodbattribute.UnmarshalMap(item, &summary); err != nil {
+			log.Printf("Skipping unreadable summary of %s: %v", aws.StringValue(item["photoId"].S), err)
+			continue
+		}
+		byKey[summary.PhotoID] = summary
+	}
+	return byKey
+}
+
+// upgradeItems migrates items from older schema versions in place, so
+// readers only deal with the current shape. Faces a collection rebuild has
+// staged on an item (see lambda-metadata/collection.go) aren't the photo's
+// faces yet and are dropped.
+func upgradeItems(client *dynamodb.DynamoDB, items []map[string]*dynamodb.AttributeValue) {
+	env := schema.Env{EventLocation: event.Location(client, os.Getenv("EVENTS_TABLE"), event.Default)}
+	for _, item := range items {
+		if _, err := schema.Upgrade(item, env); err != nil {
+			log.Printf("Error upgrading metadata item: %v", err)
+		}
+		delete(item, "rebuild")
+	}
+}
+
+// scanItems runs a scan to the end; a single Scan call stops after 1MB of
+// items
+func scanItems(client *dynamodb.DynamoDB, input *dynamodb.ScanInput) ([]map[string]*dynamodb.AttributeValue, error) {
+	var items []map[string]*dynamodb.AttributeValue
+	err := client.ScanPages(input, func(page *dynamodb.ScanOutput, lastPage bool) bool {
+		items = append(items, page.Items...)
+		return true
+	})
+	return items, err
+}
+
+// scanSummaries loads the gallery summary of every photo of the event
+func scanSummaries(client *dynamodb.DynamoDB, tableName string, ev *event.Settings) (map[string]photoSummary, error) {
+	names := make(map[string]*string)
+	var projection []string
+	for _, attr := range photoSummaryAttributes {
+		names["#"+attr] = aws.String(attr)
+		projection = append(projection, "#"+attr)
+	}
+	values := make(map[string]*dynamodb.AttributeValue)
+	filter := eventFilter(ev, names, values)
+
+	byKey := make(map[string]photoSummary)
+	err := client.ScanPages(&dynamodb.ScanInput{
+		TableName:                 aws.String(tableName),
+		ProjectionExpression:      aws.String(strings.Join(projection, ", ")),
+		FilterExpression:          aws.String(filter),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+	}, func(page *dynamodb.ScanOutput, lastPage bool) bool {
+		upgradeItems(client, page.Items)
+		for key, summary := range summariesFromItems(page.Items) {
+			byKey[key] = summary
+		}
+		return true
+	})
+	return byKey, err
+}
+
+// GalleryItem is a photo as returned by /gallery and the other photo listings
+type GalleryItem struct {
+	Key          string                  `json:"key"`
+	URL          string                  `json:"url"`
+	LastModified string                  `json:"lastModified,omitempty"`
+	Size         int64                   `json:"size,omitempty"`
+	Renditions   map[string]RenditionURL `json:"renditions,omitempty"`
+	// Display size after orientation, so the page can reserve the right box
+	Width     int    `json:"width,omitempty"`
+	Height    int    `json:"height,omitempty"`
+	DateTaken string `json:"dateTaken,omitempty"`
+	// Set when the capture time was guessed from the filename or upload time
+	DateTakenApproximate bool `json:"dateTakenApproximate,omitempty"`
+	LikeCount            int  `json:"likeCount,omitempty"`
+	CommentCount         int  `json:"commentCount,omitempty"` // visible comments
+	// Set when the requesting guest has liked the photo
+	Liked bool `json:"liked,omitempty"`
+}
+
+// galleryItems builds the gallery entry for each photo key, with viewable
+// URLs for the original and its renditions
+func galleryItems(s3Client *s3.S3, bucketName string, keys []string, summaries map[string]photoSummary) []GalleryItem {
+	var items []GalleryItem
+	for _, key := range keys {
+		// Generate pre-signed URL for viewing (valid for 1 hour)
+		req, _ := s3Client.GetObjectRequest(&s3.GetObjectInput{
+			Bucket: aws.String(bucketName),
+			Key:    aws.String(key),
+		})
+		url, err := req.Presign(1 * time.Hour)
+		if err != nil {
+			continue
+		}
+
+		// Try to get object info for size and last modified
+		objInfo, err := s3Client.HeadObject(&s3.HeadObjectInput{
+			Bucket: aws.String(bucketName),
+			Key:    aws.String(key),
+		})
+
+		summary := summaries[key]
+		galleryItem := GalleryItem{
+			Key:                  key,
+			URL:                  url,
+			Renditions:           presignRenditions(s3Client, bucketName, summary.Renditions),
+			Width:                summary.DisplayWidth,
+			Height:               summary.DisplayHeight,
+			DateTaken:            summary.DateTaken,
+			DateTakenApproximate: approximateDateSources[summary.DateTakenSource],
+			LikeCount:            summary.LikeCount,
+			CommentCount:         summary.CommentCount,
+		}
+
+		if err == nil {
+			galleryItem.LastModified = objInfo.LastModified.Format(time.RFC3339)
+			if objInfo.ContentLength != nil {
+				galleryItem.Size = *objInfo.ContentLength
+			}
+		}
+
+		items = append(items, galleryItem)
+	}
+	return items
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Andrew-Wichmann/wedding-photos-app/internal/event"
+	"github.com/Andrew-Wichmann/wedding-photos-app/internal/imaging"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Only these sizes can be requested, so a crawler can't fill the bucket with
+// one derivative per pixel width. Zero leaves a dimension unconstrained.
+var allowedImageSizes = map[int]bool{
+	0: true, 160: true, 320: true, 480: true, 640: true, 800: true,
+	1024: true, 1280: true, 1600: true, 1920: true, 2048: true,
+}
+
+var allowedImageQualities = map[int]bool{
+	50: true, 60: true, 70: true, 75: true, 80: true, 85: true, 90: true,
+}
+
+const defaultImageQuality = 80
+
+// maxDerivativeSourceBytes caps the originals /img resizes. The whole file
+// is held in memory next to the decoded image.
+const maxDerivativeSourceBytes = 50 << 20
+
+// derivableContentType reports whether an upload's stored content type may
+// be an image Go can decode. Uploads set it from the browser's file type,
+// which is often missing or generic, so only types that certainly can't be
+// decoded are refused before the header is read.
+func derivableContentType(contentType string) bool {
+	contentType = strings.ToLower(contentType)
+	if strings.HasPrefix(contentType, "video/") {
+		return false
+	}
+	return contentType != "image/heic" && contentType != "image/heif"
+}
+
+type imageParams struct {
+	Width   int
+	Height  int
+	Fit     string
+	Quality int
+}
+
+func parseImageParams(queryParams map[string]string) (imageParams, error) {
+	params := imageParams{Fit: "contain", Quality: defaultImageQuality}
+
+	var err error
+	if w := queryParams["w"]; w != "" {
+		if params.Width, err = strconv.Atoi(w); err != nil || !allowedImageSizes[params.Width] {
+			return params, fmt.Errorf("w must be one of the allowed sizes")
+		}
+	}
+	if h := queryParams["h"]; h != "" {
+		if params.Height, err = strconv.Atoi(h); err != nil || !allowedImageSizes[params.Height] {
+			return params, fmt.Errorf("h must be one of the allowed sizes")
+		}
+	}
+	if params.Width == 0 && params.Height == 0 {
+		return params, fmt.Errorf("w or h is required")
+	}
+
+	if q := queryParams["q"]; q != "" {
+		if params.Quality, err = strconv.Atoi(q); err != nil || !allowedImageQualities[params.Quality] {
+			return params, fmt.Errorf("q must be one of the allowed qualities")
+		}
+	}
+
+	switch fit := queryParams["fit"]; fit {
+	case "", "contain":
+	case "cover":
+		// Cover only differs from contain when both dimensions are fixed
+		if params.Width > 0 && params.Height > 0 {
+			params.Fit = fit
+		}
+	default:
+		return params, fmt.Errorf("fit must be cover or contain")
+	}
+
+	return params, nil
+}
+
+// derivativeKey is the canonical S3 key for a resized copy of an upload, so
+// equivalent requests share one stored derivative
+func derivativeKey(id string, params imageParams) string {
+	return fmt.Sprintf("derivatives/%dx%d-%s-q%d/%s.jpg", params.Width, params.Height, params.Fit, params.Quality, id)
+}
+
+func handleImage(request events.LambdaFunctionURLRequest, ev *event.Settings) (events.LambdaFunctionURLResponse, error) {
+	originalKey, ok := eventKey(ev, strings.TrimPrefix(request.RequestContext.HTTP.Path, "/img/"))
+	if !ok {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 400,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       `{"error": "Invalid image id"}`,
+		}, nil
+	}
+
+	params, err := parseImageParams(request.QueryStringParameters)
+	if err != nil {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 400,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       fmt.Sprintf(`{"error": %q}`, err.Error()),
+		}, nil
+	}
+
+	sess := session.Must(session.NewSession())
+	s3Client := s3.New(sess)
+	bucketName := os.Getenv("S3_BUCKET")
+	// Derivatives are keyed by the upload key, so events can't share one
+	key := derivativeKey(strings.TrimPrefix(originalKey, "uploads/"), params)
+
+	// Serve the cached derivative if an earlier request already produced it
+	_, err = s3Client.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.RequestFailure); !ok || aerr.StatusCode() != 404 {
+			return events.LambdaFunctionURLResponse{
+				StatusCode: 500,
+				Headers:    map[string]string{"Content-Type": "application/json"},
+				Body:       `{"error": "Failed to look up image"}`,
+			}, nil
+		}
+
+		status, err := generateDerivative(s3Client, bucketName, originalKey, key, params)
+		if err != nil {
+			return events.LambdaFunctionURLResponse{
+				StatusCode: status,
+				Headers:    map[string]string{"Content-Type": "application/json"},
+				Body:       fmt.Sprintf(`{"error": %q}`, err.Error()),
+			}, nil
+		}
+	}
+
+	req, _ := s3Client.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(key),
+	})
+	url, err := req.Presign(1 * time.Hour)
+	if err != nil {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 500,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       `{"error": "Failed to generate image URL"}`,
+		}, nil
+	}
+
+	return events.LambdaFunctionURLResponse{
+		StatusCode: 302,
+		Headers: map[string]string{
+			"Location":                    url,
+			"Access-Control-Allow-Origin": "*",
+			"Cache-Control":               "private, max-age=3000",
+		},
+	}, nil
+}
+
+// generateDerivative resizes the original upload and stores the result under
+// key. On failure it returns the HTTP status to report alongside the error.
+func generateDerivative(client *s3.S3, bucketName, originalKey, key string, params imageParams) (int, error) {
+	result, err := client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(originalKey),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+			return 404, fmt.Errorf("image not found")
+		}
+		return 500, fmt.Errorf("failed to download original")
+	}
+	defer result.Body.Close()
+	if !derivableContentType(aws.StringValue(result.ContentType)) {
+		return 415, fmt.Errorf("image format not supported")
+	}
+	if aws.Int64Value(result.ContentLength) > maxDerivativeSourceBytes {
+		return 413, fmt.Errorf("image too large")
+	}
+
+	// The header is checked before the rest is read; the copy kept of what
+	// was read is for the EXIF orientation
+	var data bytes.Buffer
+	src, _, err := imaging.Decode(io.TeeReader(io.LimitReader(result.Body, maxDerivativeSourceBytes), &data))
+	if errors.Is(err, imaging.ErrTooLarge) {
+		return 413, fmt.Errorf("image too large")
+	}
+	if err != nil {
+		return 415, fmt.Errorf("image format not supported")
+	}
+
+	// Resize in stored orientation (with the box rotated to match) so only the
+	// small output needs to be re-oriented
+	orientation := imaging.Orientation(bytes.NewReader(data.Bytes()))
+	width, height := params.Width, params.Height
+	if imaging.SwapsAxes(orientation) {
+		width, height = height, width
+	}
+	resized := imaging.Fit(src, width, height, params.Fit == "cover")
+	out, err := imaging.EncodeJPEG(imaging.ApplyOrientation(resized, orientation), params.Quality)
+	if err != nil {
+		return 500, fmt.Errorf("failed to encode image")
+	}
+
+	_, err = client.PutObject(&s3.PutObjectInput{
+		Bucket:       aws.String(bucketName),
+		Key:          aws.String(key),
+		Body:         bytes.NewReader(out),
+		ContentType:  aws.String("image/jpeg"),
+		CacheControl: aws.String("public, max-age=31536000, immutable"),
+	})
+	if err != nil {
+		return 500, fmt.Errorf("failed to store resized image")
+	}
+
+	return 200, nil
+}
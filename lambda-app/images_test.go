@@ -0,0 +1,21 @@
+package main
+
+import "testing"
+
+func TestDerivableContentType(t *testing.T) {
+	tests := map[string]bool{
+		"image/jpeg":               true,
+		"image/png":                true,
+		"":                         true, // browsers leave it out for unknown extensions
+		"application/octet-stream": true,
+		"image/HEIC":               false,
+		"image/heif":               false,
+		"video/quicktime":          false,
+		"video/mp4":                false,
+	}
+	for contentType, want := range tests {
+		if got := derivableContentType(contentType); got != want {
+			t.Errorf("derivableContentType(%q) = %t, want %t", contentType, got, want)
+		}
+	}
+}
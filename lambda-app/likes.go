@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/Andrew-Wichmann/wedding-photos-app/internal/event"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// The likes table is keyed by photo and guest, so a guest can like a photo
+// once; the index lists a guest's likes for their favorites
+const guestLikesIndex = "guestId-index"
+
+// Like is a guest's like of a photo. The photo's like count is kept on its
+// metadata item, in the same transaction as the like.
+type Like struct {
+	PhotoID string `json:"photoId"`
+	GuestID string `json:"guestId"`
+	EventID string `json:"eventId"`
+	LikedAt int64  `json:"likedAt"`
+}
+
+// LikeResponse is the result of liking or unliking a photo
+type LikeResponse struct {
+	PhotoID   string `json:"photoId"`
+	Liked     bool   `json:"liked"`
+	LikeCount int    `json:"likeCount"`
+}
+
+// likeAction splits a /photos/{id}/like path, reporting whether it is one
+func likeAction(path string) (string, bool) {
+	id, ok := strings.CutSuffix(strings.TrimPrefix(path, "/photos/"), "/like")
+	return id, ok && strings.HasPrefix(path, "/photos/")
+}
+
+// setLike adds or removes a guest's like and moves the photo's count with
+// it. Liking twice, or unliking a photo that isn't liked, changes nothing.
+func setLike(client *dynamodb.DynamoDB, likesTable, metadataTable string, key map[string]*dynamodb.AttributeValue, like Like, liked bool) error {
+	if liked {
+		item, err := dynamodbattribute.MarshalMap(like)
+		if err != nil {
+			return err
+		}
+		_, err = writeCounted(client, &dynamodb.TransactWriteItem{Put: &dynamodb.Put{
+			TableName:           aws.String(likesTable),
+			Item:                item,
+			ConditionExpression: aws.String("attribute_not_exists(guestId)"),
+		}}, metadataTable, key, "likeCount", 1)
+		return err
+	}
+	_, err := writeCounted(client, &dynamodb.TransactWriteItem{Delete: &dynamodb.Delete{
+		TableName: aws.String(likesTable),
+		Key: map[string]*dynamodb.AttributeValue{
+			"photoId": {S: aws.String(like.PhotoID)},
+			"guestId": {S: aws.String(like.GuestID)},
+		},
+		ConditionExpression: aws.String("attribute_exists(guestId)"),
+	}}, metadataTable, key, "likeCount", -1)
+	return err
+}
+
+// guestLikes lists the photos a guest has liked in an event, most recently
+// liked first
+func guestLikes(client *dynamodb.DynamoDB, tableName string, ev *event.Settings, guestID string) ([]string, error) {
+	var photoIDs []string
+	err := client.QueryPages(&dynamodb.QueryInput{
+		TableName:              aws.String(tableName),
+		IndexName:              aws.String(guestLikesIndex),
+		KeyConditionExpression: aws.String("guestId = :guestId"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":guestId": {S: aws.String(guestID)},
+		},
+		ScanIndexForward: aws.Bool(false),
+	}, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			var like Like
+			if err := dynamodbattribute.UnmarshalMap(item, &like); err != nil {
+				log.Printf("Skipping unreadable like of %s by guest %s: %v", aws.StringValue(item["photoId"].S), guestID, err)
+				continue
+			}
+			if ev.Owns(like.PhotoID) {
+				photoIDs = append(photoIDs, like.PhotoID)
+			}
+		}
+		return true
+	})
+	return photoIDs, err
+}
+
+// markLiked flags the gallery items the requesting guest has liked. Guests
+// without a session haven't liked anything.
+func markLiked(client *dynamodb.DynamoDB, request events.LambdaFunctionURLRequest, ev *event.Settings, items []GalleryItem) {
+	guest := readSession(request)
+	tableName := os.Getenv("LIKES_TABLE")
+	if guest == nil || tableName == "" || len(items) == 0 {
+		return
+	}
+	liked, err := guestLikes(client, tableName, ev, guest.ID)
+	if err != nil {
+		log.Printf("Error loading likes for guest %s: %v", guest.ID, err)
+		return
+	}
+	likedKeys := make(map[string]bool, len(liked))
+	for _, key := range liked {
+		likedKeys[key] = true
+	}
+	for i := range items {
+		items[i].Liked = likedKeys[items[i].Key]
+	}
+}
+
+// handleLike serves POST and DELETE /photos/{id}/like for the guest's session
+func handleLike(request events.LambdaFunctionURLRequest, ev *event.Settings) (events.LambdaFunctionURLResponse, error) {
+	id, _ := likeAction(request.RequestContext.HTTP.Path)
+	key, ok := eventKey(ev, id)
+	if !ok {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 400,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       `{"error": "Invalid photo id"}`,
+		}, nil
+	}
+	likesTable := os.Getenv("LIKES_TABLE")
+	if likesTable == "" {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 500,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       `{"error": "LIKES_TABLE is not configured"}`,
+		}, nil
+	}
+	guest, cookies, err := ensureSession(request)
+	if err != nil {
+		return sessionErrorResponse(err), nil
+	}
+
+	dynamoClient := dynamodb.New(session.Must(session.NewSession()))
+	tableName := os.Getenv("DYNAMODB_TABLE")
+	if tableName == "" {
+		tableName = "wedding-photo-metadata" // fallback
+	}
+
+	// Only processed photos have an item to count likes on
+	itemKey, err := metadataKey(dynamoClient, tableName, key)
+	if err != nil {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 500,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       `{"error": "Failed to load photo"}`,
+		}, nil
+	}
+	if itemKey == nil {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 404,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       `{"error": "Photo not found"}`,
+		}, nil
+	}
+
+	liked := request.RequestContext.HTTP.Method == "POST"
+	like := Like{PhotoID: key, GuestID: guest.ID, EventID: ev.EventID, LikedAt: time.Now().Unix()}
+	if err := setLike(dynamoClient, likesTable, tableName, itemKey, like, liked); err != nil {
+		log.Printf("Error setting like on %s for guest %s: %v", key, guest.ID, err)
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 500,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       `{"error": "Failed to save like"}`,
+		}, nil
+	}
+	count, err := readCounter(dynamoClient, tableName, itemKey, "likeCount")
+	if err != nil {
+		log.Printf("Error reading like count of %s: %v", key, err)
+	}
+
+	responseBody, _ := json.Marshal(LikeResponse{PhotoID: key, Liked: liked, LikeCount: count})
+	return events.LambdaFunctionURLResponse{
+		StatusCode: 200,
+		Headers:    map[string]string{"Content-Type": "application/json", "Cache-Control": "no-store"},
+		Cookies:    cookies,
+		Body:       string(responseBody),
+	}, nil
+}
+
+// handleFavorites serves GET /favorites, the photos the guest has liked in
+// the event, most recently liked first
+func handleFavorites(request events.LambdaFunctionURLRequest, ev *event.Settings) (events.LambdaFunctionURLResponse, error) {
+	items := []GalleryItem{}
+	guest := readSession(request)
+	likesTable := os.Getenv("LIKES_TABLE")
+	if guest != nil && likesTable != "" {
+		sess := session.Must(session.NewSession())
+		s3Client := s3.New(sess)
+		dynamoClient := dynamodb.New(sess)
+		bucketName := os.Getenv("S3_BUCKET")
+		tableName := os.Getenv("DYNAMODB_TABLE")
+		if tableName == "" {
+			tableName = "wedding-photo-metadata" // fallback
+		}
+
+		keys, err := guestLikes(dynamoClient, likesTable, ev, guest.ID)
+		if err != nil {
+			return events.LambdaFunctionURLResponse{
+				StatusCode: 500,
+				Headers:    map[string]string{"Content-Type": "application/json"},
+				Body:       `{"error": "Failed to load favorites"}`,
+			}, nil
+		}
+		// Liked photos that were since removed have no summary
+		summaries, err := scanSummaries(dynamoClient, tableName, ev)
+		if err != nil {
+			summaries = nil
+		} else {
+			keys = slices.DeleteFunc(keys, func(key string) bool {
+				_, ok := summaries[key]
+				return !ok
+			})
+		}
+		for _, item := range galleryItems(s3Client, bucketName, keys, summaries) {
+			item.Liked = true
+			items = append(items, item)
+		}
+	}
+
+	responseBody, _ := json.Marshal(items)
+	return events.LambdaFunctionURLResponse{
+		StatusCode: 200,
+		Headers:    galleryHeaders(""),
+		Body:       string(responseBody),
+	}, nil
+}
@@ -6,9 +6,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
-	"strconv"
+	"path"
+	"strings"
 	"time"
 
+	"github.com/Andrew-Wichmann/wedding-photos-app/internal/event"
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go/aws"
@@ -36,20 +38,130 @@ func handler(ctx context.Context, request events.LambdaFunctionURLRequest) (even
 	path := request.RequestContext.HTTP.Path
 	method := request.RequestContext.HTTP.Method
 
+	// Events are managed outside any one event's routes
+	if method == "GET" && path == "/events" {
+		return handleListEvents(request)
+	}
+
+	if method == "PUT" && strings.HasPrefix(path, "/events/") {
+		return handlePutEvent(request)
+	}
+
+	// Everything else is scoped to an event, the default one unless the path
+	// starts with /e/{event}. Handlers see the path within the event.
+	ev, path, resp := routeEvent(path)
+	if resp != nil {
+		return *resp, nil
+	}
+	request.RequestContext.HTTP.Path = path
+
 	if method == "GET" && path == "/" {
 		return handleGET(request)
 	}
 
+	if method == "GET" && path == "/settings" {
+		return handleEventSettings(ev)
+	}
+
 	if method == "POST" && path == "/upload" {
-		return handleUpload(request)
+		return handleUpload(request, ev)
 	}
 
 	if method == "GET" && path == "/gallery" {
-		return handleGallery(request)
+		return handleGallery(request, ev)
 	}
 
 	if method == "GET" && path == "/metadata" {
-		return handleMetadata(request)
+		return handleMetadata(request, ev)
+	}
+
+	if method == "GET" && strings.HasPrefix(path, "/img/") {
+		return handleImage(request, ev)
+	}
+
+	if method == "GET" && path == "/photos/status" {
+		return handleBatchStatus(request, ev)
+	}
+
+	if method == "GET" && strings.HasPrefix(path, "/photos/") && strings.HasSuffix(path, "/status") {
+		return handleStatus(request, ev)
+	}
+
+	if _, ok := likeAction(path); ok && (method == "POST" || method == "DELETE") {
+		return handleLike(request, ev)
+	}
+
+	if _, commentID, ok := commentsAction(path); ok {
+		switch {
+		case method == "GET" && commentID == "":
+			return handleComments(request, ev)
+		case method == "POST" && commentID == "":
+			return handleCreateComment(request, ev)
+		case method == "DELETE" && commentID != "":
+			return handleDeleteComment(request, ev)
+		case method == "PATCH" && commentID != "":
+			return handleModerateComment(request, ev)
+		}
+	}
+
+	if method == "GET" && path == "/session" {
+		return handleGetSession(request)
+	}
+
+	if method == "PUT" && path == "/session" {
+		return handlePutSession(request)
+	}
+
+	if method == "GET" && path == "/favorites" {
+		return handleFavorites(request, ev)
+	}
+
+	if method == "POST" && path == "/search/selfie/upload" {
+		return handleSelfieUpload(request)
+	}
+
+	if method == "POST" && path == "/search/selfie" {
+		return handleSelfieSearch(request, ev)
+	}
+
+	if method == "GET" && path == "/people" {
+		return handlePeople(request, ev)
+	}
+
+	if strings.HasPrefix(path, "/people/") {
+		switch _, action := personAction(path); {
+		case method == "PATCH" && action == "":
+			return handleUpdatePerson(request, ev)
+		case method == "POST" && action == "merge":
+			return handleMergePeople(request, ev)
+		case method == "POST" && action == "split":
+			return handleSplitPerson(request, ev)
+		}
+	}
+
+	if method == "GET" && path == "/albums" {
+		return handleAlbums(request, ev)
+	}
+
+	if method == "POST" && path == "/albums" {
+		return handleCreateAlbum(request, ev)
+	}
+
+	if strings.HasPrefix(path, "/albums/") {
+		switch _, action := albumAction(path); {
+		case method == "GET" && action == "":
+			return handleGetAlbum(request, ev)
+		case method == "PATCH" && action == "":
+			return handleUpdateAlbum(request, ev)
+		case method == "DELETE" && action == "":
+			return handleDeleteAlbum(request, ev)
+		case method == "GET" && action == "gallery":
+			return handleAlbumGallery(request, ev)
+		case method == "POST" && action == "photos":
+			return handleAddAlbumPhotos(request, ev)
+		case method == "DELETE" && action == "photos":
+			return handleRemoveAlbumPhotos(request, ev)
+		}
 	}
 
 	return events.LambdaFunctionURLResponse{
@@ -69,7 +181,7 @@ func handleGET(request events.LambdaFunctionURLRequest) (events.LambdaFunctionUR
 	}, nil
 }
 
-func handleUpload(request events.LambdaFunctionURLRequest) (events.LambdaFunctionURLResponse, error) {
+func handleUpload(request events.LambdaFunctionURLRequest, ev *event.Settings) (events.LambdaFunctionURLResponse, error) {
 	// Parse request body
 	var uploadReq UploadRequest
 	if err := json.Unmarshal([]byte(request.Body), &uploadReq); err != nil {
@@ -93,9 +205,10 @@ func handleUpload(request events.LambdaFunctionURLRequest) (events.LambdaFunctio
 	s3Client := s3.New(sess)
 	bucketName := os.Getenv("S3_BUCKET")
 
-	// Generate unique key with timestamp
+	// Generate unique key with timestamp, under the event's prefix. Only the
+	// base name is kept so a file name can't place the upload in another event.
 	timestamp := time.Now().Unix()
-	key := fmt.Sprintf("uploads/%d-%s", timestamp, uploadReq.FileName)
+	key := fmt.Sprintf("%s%d-%s", ev.UploadPrefix(), timestamp, path.Base(uploadReq.FileName))
 
 	// Create pre-signed PUT request
 	req, _ := s3Client.PutObjectRequest(&s3.PutObjectInput{
@@ -134,7 +247,7 @@ func handleUpload(request events.LambdaFunctionURLRequest) (events.LambdaFunctio
 	}, nil
 }
 
-func handleGallery(request events.LambdaFunctionURLRequest) (events.LambdaFunctionURLResponse, error) {
+func handleGallery(request events.LambdaFunctionURLRequest, ev *event.Settings) (events.LambdaFunctionURLResponse, error) {
 	// Initialize AWS sessions
 	sess := session.Must(session.NewSession())
 	s3Client := s3.New(sess)
@@ -145,193 +258,33 @@ func handleGallery(request events.LambdaFunctionURLRequest) (events.LambdaFuncti
 		tableName = "wedding-photo-metadata" // fallback
 	}
 
-	// Parse query parameters for filtering
-	queryParams := request.QueryStringParameters
-	faceID := queryParams["faceId"]
-	minFaces := queryParams["minFaces"]
-	startDate := queryParams["startDate"]
-	endDate := queryParams["endDate"]
-	device := queryParams["device"]
-
-	// Build list of photo keys that match filters
-	var filteredPhotoKeys []string
-
-	if faceID != "" || minFaces != "" || startDate != "" || endDate != "" || device != "" {
-		// If filters are provided, query DynamoDB first
-		scanInput := &dynamodb.ScanInput{
-			TableName: aws.String(tableName),
-		}
-
-		var filterExpressions []string
-		expressionAttributeValues := make(map[string]*dynamodb.AttributeValue)
-		expressionAttributeNames := make(map[string]*string)
-
-		// Filter by minimum face count
-		if minFaces != "" {
-			if count, err := strconv.Atoi(minFaces); err == nil {
-				filterExpressions = append(filterExpressions, "#faceCount >= :minFaces")
-				expressionAttributeNames["#faceCount"] = aws.String("faceCount")
-				expressionAttributeValues[":minFaces"] = &dynamodb.AttributeValue{N: aws.String(minFaces)}
-				_ = count
-			}
-		}
-
-		// Filter by date range
-		if startDate != "" {
-			filterExpressions = append(filterExpressions, "#dateTaken >= :startDate")
-			expressionAttributeNames["#dateTaken"] = aws.String("dateTaken")
-			expressionAttributeValues[":startDate"] = &dynamodb.AttributeValue{S: aws.String(startDate)}
-		}
-		if endDate != "" {
-			filterExpressions = append(filterExpressions, "#dateTaken <= :endDate")
-			expressionAttributeNames["#dateTaken"] = aws.String("dateTaken")
-			expressionAttributeValues[":endDate"] = &dynamodb.AttributeValue{S: aws.String(endDate)}
-		}
-
-		// Filter by device
-		if device != "" {
-			filterExpressions = append(filterExpressions, "contains(#model, :device)")
-			expressionAttributeNames["#model"] = aws.String("model")
-			expressionAttributeValues[":device"] = &dynamodb.AttributeValue{S: aws.String(device)}
-		}
-
-		// Apply filters if any exist
-		if len(filterExpressions) > 0 {
-			filterExpression := filterExpressions[0]
-			for i := 1; i < len(filterExpressions); i++ {
-				filterExpression += " AND " + filterExpressions[i]
-			}
-			scanInput.FilterExpression = aws.String(filterExpression)
-			scanInput.ExpressionAttributeValues = expressionAttributeValues
-			scanInput.ExpressionAttributeNames = expressionAttributeNames
-		}
-
-		// Execute scan
-		result, err := dynamoClient.Scan(scanInput)
-		if err != nil {
-			return events.LambdaFunctionURLResponse{
-				StatusCode: 500,
-				Headers:    map[string]string{"Content-Type": "application/json"},
-				Body:       fmt.Sprintf(`{"error": "Failed to query metadata: %s"}`, err.Error()),
-			}, nil
-		}
-
-		// Unmarshal results
-		var metadata []map[string]interface{}
-		err = dynamodbattribute.UnmarshalListOfMaps(result.Items, &metadata)
-		if err != nil {
-			return events.LambdaFunctionURLResponse{
-				StatusCode: 500,
-				Headers:    map[string]string{"Content-Type": "application/json"},
-				Body:       `{"error": "Failed to parse metadata"}`,
-			}, nil
-		}
-
-		// Post-process filter by faceId (in-memory filtering)
-		if faceID != "" {
-			var filtered []map[string]interface{}
-			for _, item := range metadata {
-				if faces, ok := item["faces"].([]interface{}); ok {
-					for _, face := range faces {
-						if faceMap, ok := face.(map[string]interface{}); ok {
-							if id, ok := faceMap["faceId"].(string); ok && id == faceID {
-								filtered = append(filtered, item)
-								break
-							}
-						}
-					}
-				}
-			}
-			metadata = filtered
-		}
-
-		// Extract photo keys from filtered metadata
-		for _, item := range metadata {
-			if photoId, ok := item["photoId"].(string); ok {
-				filteredPhotoKeys = append(filteredPhotoKeys, photoId)
-			}
-		}
-	} else {
-		// No filters - list all objects from S3
-		result, err := s3Client.ListObjectsV2(&s3.ListObjectsV2Input{
-			Bucket: aws.String(bucketName),
-			Prefix: aws.String("uploads/"),
-		})
-
-		if err != nil {
-			return events.LambdaFunctionURLResponse{
-				StatusCode: 500,
-				Headers:    map[string]string{"Content-Type": "application/json"},
-				Body:       `{"error": "Failed to list files"}`,
-			}, nil
-		}
-
-		for _, obj := range result.Contents {
-			filteredPhotoKeys = append(filteredPhotoKeys, *obj.Key)
-		}
+	// Filter, then sort and page
+	keys, summaries, err := queryGallery(s3Client, dynamoClient, bucketName, tableName, ev, request.QueryStringParameters)
+	if err != nil {
+		return galleryErrorResponse(err), nil
 	}
-
-	// Build list of file URLs for filtered photos
-	type GalleryItem struct {
-		Key          string `json:"key"`
-		URL          string `json:"url"`
-		LastModified string `json:"lastModified,omitempty"`
-		Size         int64  `json:"size,omitempty"`
-	}
-
-	var items []GalleryItem
-	for _, key := range filteredPhotoKeys {
-		// Generate pre-signed URL for viewing (valid for 1 hour)
-		req, _ := s3Client.GetObjectRequest(&s3.GetObjectInput{
-			Bucket: aws.String(bucketName),
-			Key:    aws.String(key),
-		})
-		url, err := req.Presign(1 * time.Hour)
-		if err != nil {
-			continue
-		}
-
-		// Try to get object info for size and last modified
-		objInfo, err := s3Client.HeadObject(&s3.HeadObjectInput{
-			Bucket: aws.String(bucketName),
-			Key:    aws.String(key),
-		})
-
-		galleryItem := GalleryItem{
-			Key: key,
-			URL: url,
-		}
-
-		if err == nil {
-			galleryItem.LastModified = objInfo.LastModified.Format(time.RFC3339)
-			if objInfo.ContentLength != nil {
-				galleryItem.Size = *objInfo.ContentLength
-			}
-		}
-
-		items = append(items, galleryItem)
+	keys, nextCursor, err := pageGallery(keys, summaries, request.QueryStringParameters)
+	if err != nil {
+		return galleryErrorResponse(err), nil
 	}
 
+	items := galleryItems(s3Client, bucketName, keys, summaries)
+	markLiked(dynamoClient, request, ev, items)
+
 	responseBody, _ := json.Marshal(items)
 
 	return events.LambdaFunctionURLResponse{
 		StatusCode: 200,
-		Headers: map[string]string{
-			"Content-Type":                 "application/json",
-			"Access-Control-Allow-Origin":  "*",
-			"Access-Control-Allow-Methods": "GET, OPTIONS",
-			"Access-Control-Allow-Headers": "Content-Type",
-			"Cache-Control":                "no-cache, no-store, must-revalidate",
-			"Pragma":                       "no-cache",
-			"Expires":                      "0",
-		},
-		Body: string(responseBody),
+		Headers:    galleryHeaders(nextCursor),
+		Body:       string(responseBody),
 	}, nil
 }
 
-func handleMetadata(request events.LambdaFunctionURLRequest) (events.LambdaFunctionURLResponse, error) {
+func handleMetadata(request events.LambdaFunctionURLRequest, ev *event.Settings) (events.LambdaFunctionURLResponse, error) {
 	sess := session.Must(session.NewSession())
+	s3Client := s3.New(sess)
 	dynamoClient := dynamodb.New(sess)
+	bucketName := os.Getenv("S3_BUCKET")
 	tableName := os.Getenv("DYNAMODB_TABLE")
 	if tableName == "" {
 		tableName = "wedding-photo-metadata" // fallback
@@ -340,66 +293,21 @@ func handleMetadata(request events.LambdaFunctionURLRequest) (events.LambdaFunct
 	// Parse query parameters for filtering
 	queryParams := request.QueryStringParameters
 	faceID := queryParams["faceId"]
-	minFaces := queryParams["minFaces"]
-	startDate := queryParams["startDate"]
-	endDate := queryParams["endDate"]
-	device := queryParams["device"]
-
-	// Build scan input with filters
-	scanInput := &dynamodb.ScanInput{
-		TableName: aws.String(tableName),
-	}
-
-	var filterExpressions []string
-	expressionAttributeValues := make(map[string]*dynamodb.AttributeValue)
-	expressionAttributeNames := make(map[string]*string)
-
-	// Filter by faceId - we'll do this in post-processing since DynamoDB doesn't support
-	// searching within nested arrays easily without a GSI
-	// Leave this filter out of the DynamoDB query and filter in memory instead
-
-	// Filter by minimum face count
-	if minFaces != "" {
-		if count, err := strconv.Atoi(minFaces); err == nil {
-			filterExpressions = append(filterExpressions, "#faceCount >= :minFaces")
-			expressionAttributeNames["#faceCount"] = aws.String("faceCount")
-			expressionAttributeValues[":minFaces"] = &dynamodb.AttributeValue{N: aws.String(minFaces)}
-			_ = count
-		}
-	}
-
-	// Filter by date range
-	if startDate != "" {
-		filterExpressions = append(filterExpressions, "#dateTaken >= :startDate")
-		expressionAttributeNames["#dateTaken"] = aws.String("dateTaken")
-		expressionAttributeValues[":startDate"] = &dynamodb.AttributeValue{S: aws.String(startDate)}
-	}
-	if endDate != "" {
-		filterExpressions = append(filterExpressions, "#dateTaken <= :endDate")
-		expressionAttributeNames["#dateTaken"] = aws.String("dateTaken")
-		expressionAttributeValues[":endDate"] = &dynamodb.AttributeValue{S: aws.String(endDate)}
-	}
-
-	// Filter by device (Make + Model)
-	if device != "" {
-		filterExpressions = append(filterExpressions, "contains(#model, :device)")
-		expressionAttributeNames["#model"] = aws.String("model")
-		expressionAttributeValues[":device"] = &dynamodb.AttributeValue{S: aws.String(device)}
-	}
 
-	// Apply filters if any exist
-	if len(filterExpressions) > 0 {
-		filterExpression := filterExpressions[0]
-		for i := 1; i < len(filterExpressions); i++ {
-			filterExpression += " AND " + filterExpressions[i]
-		}
-		scanInput.FilterExpression = aws.String(filterExpression)
-		scanInput.ExpressionAttributeValues = expressionAttributeValues
-		scanInput.ExpressionAttributeNames = expressionAttributeNames
+	// Build scan input with filters. The faceId filter is applied in memory
+	// since DynamoDB doesn't support searching within nested arrays easily
+	// without a GSI
+	scanInput, err := buildScanInput(tableName, queryParams, ev)
+	if err != nil {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 400,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       fmt.Sprintf(`{"error": %q}`, err.Error()),
+		}, nil
 	}
 
 	// Execute scan
-	result, err := dynamoClient.Scan(scanInput)
+	items, err := scanItems(dynamoClient, scanInput)
 	if err != nil {
 		return events.LambdaFunctionURLResponse{
 			StatusCode: 500,
@@ -410,7 +318,8 @@ func handleMetadata(request events.LambdaFunctionURLRequest) (events.LambdaFunct
 
 	// Unmarshal results
 	var metadata []map[string]interface{}
-	err = dynamodbattribute.UnmarshalListOfMaps(result.Items, &metadata)
+	upgradeItems(dynamoClient, items)
+	err = dynamodbattribute.UnmarshalListOfMaps(items, &metadata)
 	if err != nil {
 		return events.LambdaFunctionURLResponse{
 			StatusCode: 500,
@@ -419,22 +328,22 @@ func handleMetadata(request events.LambdaFunctionURLRequest) (events.LambdaFunct
 		}, nil
 	}
 
-	// Post-process filter by faceId (in-memory filtering)
-	if faceID != "" {
-		var filtered []map[string]interface{}
-		for _, item := range metadata {
-			if faces, ok := item["faces"].([]interface{}); ok {
-				for _, face := range faces {
-					if faceMap, ok := face.(map[string]interface{}); ok {
-						if id, ok := faceMap["faceId"].(string); ok && id == faceID {
-							filtered = append(filtered, item)
-							break
-						}
-					}
-				}
+	// Attach viewable URLs for each rendition so clients can build a srcset
+	summaries := summariesFromItems(items)
+	for _, item := range metadata {
+		if photoID, ok := item["photoId"].(string); ok {
+			if urls := presignRenditions(s3Client, bucketName, summaries[photoID].Renditions); urls != nil {
+				item["renditionUrls"] = urls
 			}
 		}
-		metadata = filtered
+		presignFaceCrops(s3Client, bucketName, item)
+	}
+
+	metadata = filterByDateRange(metadata, queryParams, ev.Location())
+
+	// Post-process filter by faceId (in-memory filtering)
+	if faceID != "" {
+		metadata = filterByFaceID(metadata, faceID)
 	}
 
 	responseBody, _ := json.Marshal(metadata)
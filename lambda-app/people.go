@@ -0,0 +1,308 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/Andrew-Wichmann/wedding-photos-app/internal/event"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// A merged person points at the person it was merged into. Chains longer than
+// this are treated as a cycle.
+const maxMergeHops = 10
+
+// BatchGetItem reads at most 100 keys per call
+const maxAssignmentKeys = 100
+
+// Person is a cluster of faces the metadata lambda judged to be the same
+// guest. Admins can name, merge, split and ignore clusters (see people_admin.go).
+type Person struct {
+	PersonID              string   `json:"personId"`
+	Name                  string   `json:"name,omitempty"`
+	Ignored               bool     `json:"ignored,omitempty"`
+	MergedInto            string   `json:"mergedInto,omitempty"`
+	FaceIDs               []string `json:"faceIds" dynamodbav:"faceIds,stringset"`
+	PhotoIDs              []string `json:"photoIds" dynamodbav:"photoIds,stringset"`
+	RepresentativeFaceID  string   `json:"representativeFaceId"`
+	RepresentativePhotoID string   `json:"representativePhotoId"`
+	CreatedAt             int64    `json:"createdAt"`
+	UpdatedAt             int64    `json:"updatedAt"`
+	// Empty for people clustered before events were recorded
+	EventID string `json:"eventId,omitempty"`
+}
+
+// inEvent reports whether the person was clustered from the event's photos
+func (p *Person) inEvent(ev *event.Settings) bool {
+	if p.EventID == "" {
+		return ev.EventID == event.Default
+	}
+	return p.EventID == ev.EventID
+}
+
+type BoundingBox struct {
+	Width  float64 `json:"width"`
+	Height float64 `json:"height"`
+	Left   float64 `json:"left"`
+	Top    float64 `json:"top"`
+}
+
+// FaceAssignment maps an indexed face to its person. The metadata lambda
+// writes these as it clusters faces; they are the source of truth for which
+// person a face belongs to.
+type FaceAssignment struct {
+	FaceID      string      `json:"faceId"`
+	PersonID    string      `json:"personId"`
+	PhotoID     string      `json:"photoId"`
+	BoundingBox BoundingBox `json:"boundingBox"`
+	CropKey     string      `json:"cropKey,omitempty"`
+}
+
+// RepresentativeFace is the face shown for a person in the people list. The
+// URL is a thumbnail of the whole photo; the bounding box locates the face in
+// it. Faces cropped by the metadata lambda also have a square crop.
+type RepresentativeFace struct {
+	FaceID      string       `json:"faceId"`
+	PhotoID     string       `json:"photoId"`
+	URL         string       `json:"url"`
+	CropURL     string       `json:"cropUrl,omitempty"`
+	BoundingBox *BoundingBox `json:"boundingBox,omitempty"`
+}
+
+// PersonSummary is a person as listed by GET /people
+type PersonSummary struct {
+	PersonID           string              `json:"personId"`
+	Name               string              `json:"name,omitempty"`
+	Ignored            bool                `json:"ignored,omitempty"`
+	PhotoCount         int                 `json:"photoCount"`
+	FaceCount          int                 `json:"faceCount"`
+	RepresentativeFace *RepresentativeFace `json:"representativeFace,omitempty"`
+}
+
+// getPerson loads a person, returning nil if there is no such person
+func getPerson(client *dynamodb.DynamoDB, tableName, personID string) (*Person, error) {
+	result, err := client.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(tableName),
+		Key:       map[string]*dynamodb.AttributeValue{"personId": {S: aws.String(personID)}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Item) == 0 {
+		return nil, nil
+	}
+	var person Person
+	if err := dynamodbattribute.UnmarshalMap(result.Item, &person); err != nil {
+		return nil, err
+	}
+	return &person, nil
+}
+
+// resolvePerson loads a person, following merges to the surviving person
+func resolvePerson(client *dynamodb.DynamoDB, tableName, personID string) (*Person, error) {
+	for hop := 0; hop <= maxMergeHops; hop++ {
+		person, err := getPerson(client, tableName, personID)
+		if err != nil || person == nil || person.MergedInto == "" {
+			return person, err
+		}
+		personID = person.MergedInto
+	}
+	return nil, fmt.Errorf("person %s is part of a merge cycle", personID)
+}
+
+// scanPeople loads every person in the event, including merged and ignored ones
+func scanPeople(client *dynamodb.DynamoDB, tableName string, ev *event.Settings) ([]Person, error) {
+	var people []Person
+	err := client.ScanPages(&dynamodb.ScanInput{
+		TableName: aws.String(tableName),
+	}, func(page *dynamodb.ScanOutput, lastPage bool) bool {
+		var items []Person
+		if err := dynamodbattribute.UnmarshalListOfMaps(page.Items, &items); err == nil {
+			for _, person := range items {
+				if person.inEvent(ev) {
+					people = append(people, person)
+				}
+			}
+		}
+		return true
+	})
+	return people, err
+}
+
+// getAssignments loads the face assignments for the given faces, keyed by face ID
+func getAssignments(client *dynamodb.DynamoDB, tableName string, faceIDs []string) (map[string]FaceAssignment, error) {
+	found := make(map[string]FaceAssignment, len(faceIDs))
+	for start := 0; start < len(faceIDs); start += maxAssignmentKeys {
+		end := min(start+maxAssignmentKeys, len(faceIDs))
+		var keys []map[string]*dynamodb.AttributeValue
+		for _, faceID := range faceIDs[start:end] {
+			keys = append(keys, map[string]*dynamodb.AttributeValue{"faceId": {S: aws.String(faceID)}})
+		}
+		err := client.BatchGetItemPages(&dynamodb.BatchGetItemInput{
+			RequestItems: map[string]*dynamodb.KeysAndAttributes{
+				tableName: {Keys: keys},
+			},
+		}, func(page *dynamodb.BatchGetItemOutput, lastPage bool) bool {
+			var items []FaceAssignment
+			if err := dynamodbattribute.UnmarshalListOfMaps(page.Responses[tableName], &items); err == nil {
+				for _, item := range items {
+					found[item.FaceID] = item
+				}
+			}
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return found, nil
+}
+
+// handlePeople serves GET /people. Merged and empty clusters are left out, as
+// are ignored ones unless an admin asks for them with ?includeIgnored=true.
+func handlePeople(request events.LambdaFunctionURLRequest, ev *event.Settings) (events.LambdaFunctionURLResponse, error) {
+	sess := session.Must(session.NewSession())
+	s3Client := s3.New(sess)
+	dynamoClient := dynamodb.New(sess)
+	bucketName := os.Getenv("S3_BUCKET")
+	includeIgnored := request.QueryStringParameters["includeIgnored"] == "true" && isAdmin(request)
+
+	people, err := scanPeople(dynamoClient, os.Getenv("PEOPLE_TABLE"), ev)
+	if err != nil {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 500,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       `{"error": "Failed to list people"}`,
+		}, nil
+	}
+
+	var listed []Person
+	var faceIDs []string
+	for _, person := range people {
+		if person.MergedInto != "" || len(person.FaceIDs) == 0 || (person.Ignored && !includeIgnored) {
+			continue
+		}
+		listed = append(listed, person)
+		if person.RepresentativeFaceID != "" {
+			faceIDs = append(faceIDs, person.RepresentativeFaceID)
+		}
+	}
+
+	// Bounding boxes are only a nicety, so list people without them on failure
+	assignments, err := getAssignments(dynamoClient, os.Getenv("FACE_ASSIGNMENTS_TABLE"), faceIDs)
+	if err != nil {
+		assignments = nil
+	}
+
+	summaries := make([]PersonSummary, 0, len(listed))
+	for _, person := range listed {
+		summary := PersonSummary{
+			PersonID:   person.PersonID,
+			Name:       person.Name,
+			Ignored:    person.Ignored,
+			PhotoCount: len(person.PhotoIDs),
+			FaceCount:  len(person.FaceIDs),
+		}
+		if person.RepresentativeFaceID != "" && person.RepresentativePhotoID != "" {
+			face := &RepresentativeFace{
+				FaceID:  person.RepresentativeFaceID,
+				PhotoID: person.RepresentativePhotoID,
+				URL:     ev.BasePath() + "/img/" + relativeID(ev, person.RepresentativePhotoID) + "?w=320",
+			}
+			// Assignments written before bounding boxes and crops were recorded have neither
+			if assignment, ok := assignments[person.RepresentativeFaceID]; ok {
+				if assignment.BoundingBox.Width > 0 {
+					face.BoundingBox = &assignment.BoundingBox
+				}
+				if assignment.CropKey != "" {
+					face.CropURL = presignKey(s3Client, bucketName, assignment.CropKey)
+				}
+			}
+			summary.RepresentativeFace = face
+		}
+		summaries = append(summaries, summary)
+	}
+
+	// Most photographed first, so the couple and their families lead the list
+	sort.SliceStable(summaries, func(i, j int) bool {
+		if summaries[i].PhotoCount != summaries[j].PhotoCount {
+			return summaries[i].PhotoCount > summaries[j].PhotoCount
+		}
+		return summaries[i].PersonID < summaries[j].PersonID
+	})
+
+	responseBody, _ := json.Marshal(summaries)
+
+	return events.LambdaFunctionURLResponse{
+		StatusCode: 200,
+		Headers: map[string]string{
+			"Content-Type":                 "application/json",
+			"Access-Control-Allow-Origin":  "*",
+			"Access-Control-Allow-Methods": "GET, OPTIONS",
+			"Access-Control-Allow-Headers": "Content-Type",
+			"Cache-Control":                "no-cache, no-store, must-revalidate",
+		},
+		Body: string(responseBody),
+	}, nil
+}
+
+// photosOfNamedPeople returns the photos showing every one of the named
+// people. Names match case-insensitively, and a name shared by several
+// clusters matches any of them. The first name matching nobody is returned
+// as unknown.
+func photosOfNamedPeople(client *dynamodb.DynamoDB, tableName string, ev *event.Settings, names []string) (photoIDs []string, unknown string, err error) {
+	people, err := scanPeople(client, tableName, ev)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var matching map[string]bool
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		photos := make(map[string]bool)
+		found := false
+		for _, person := range people {
+			if person.MergedInto != "" || !strings.EqualFold(person.Name, name) {
+				continue
+			}
+			found = true
+			for _, photoID := range person.PhotoIDs {
+				if matching == nil || matching[photoID] {
+					photos[photoID] = true
+				}
+			}
+		}
+		if !found {
+			return nil, name, nil
+		}
+		matching = photos
+	}
+
+	for photoID := range matching {
+		photoIDs = append(photoIDs, photoID)
+	}
+	return photoIDs, "", nil
+}
+
+// filterByPhotoIDs keeps the metadata items for the given photos
+func filterByPhotoIDs(metadata []map[string]interface{}, photoIDs []string) []map[string]interface{} {
+	wanted := make(map[string]bool, len(photoIDs))
+	for _, id := range photoIDs {
+		wanted[id] = true
+	}
+	var filtered []map[string]interface{}
+	for _, item := range metadata {
+		if id, ok := item["photoId"].(string); ok && wanted[id] {
+			filtered = append(filtered, item)
+		}
+	}
+	return filtered
+}
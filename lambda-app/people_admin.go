@@ -0,0 +1,627 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Andrew-Wichmann/wedding-photos-app/internal/event"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+// UpdatePersonRequest is the body of PATCH /people/{id}. Omitted fields are
+// left alone; an empty name clears it.
+type UpdatePersonRequest struct {
+	Name    *string `json:"name"`
+	Ignored *bool   `json:"ignored"`
+}
+
+// MergePeopleRequest is the body of POST /people/{id}/merge
+type MergePeopleRequest struct {
+	Into string `json:"into"`
+}
+
+// SplitPersonRequest is the body of POST /people/{id}/split. The listed faces
+// move to a new person, optionally named.
+type SplitPersonRequest struct {
+	FaceIDs []string `json:"faceIds"`
+	Name    string   `json:"name"`
+}
+
+// personAction splits /people/{id} or /people/{id}/{action}
+func personAction(path string) (personID, action string) {
+	personID, action, _ = strings.Cut(strings.TrimPrefix(path, "/people/"), "/")
+	return personID, action
+}
+
+// personResponse returns a person as JSON with the given status code
+func personResponse(statusCode int, person *Person) (events.LambdaFunctionURLResponse, error) {
+	responseBody, _ := json.Marshal(person)
+	return events.LambdaFunctionURLResponse{
+		StatusCode: statusCode,
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       string(responseBody),
+	}, nil
+}
+
+// handleUpdatePerson serves PATCH /people/{id}, naming or ignoring a person
+func handleUpdatePerson(request events.LambdaFunctionURLRequest, ev *event.Settings) (events.LambdaFunctionURLResponse, error) {
+	if denied := requireAdmin(request); denied != nil {
+		return *denied, nil
+	}
+	personID, _ := personAction(request.RequestContext.HTTP.Path)
+
+	var updateReq UpdatePersonRequest
+	if err := json.Unmarshal([]byte(request.Body), &updateReq); err != nil {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 400,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       `{"error": "Invalid JSON"}`,
+		}, nil
+	}
+	if updateReq.Name == nil && updateReq.Ignored == nil {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 400,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       `{"error": "name or ignored is required"}`,
+		}, nil
+	}
+
+	sets := []string{"updatedAt = :now"}
+	var removes []string
+	names := make(map[string]*string)
+	values := map[string]*dynamodb.AttributeValue{
+		":now": {N: aws.String(strconv.FormatInt(time.Now().Unix(), 10))},
+	}
+	if updateReq.Name != nil {
+		names["#name"] = aws.String("name")
+		if name := strings.TrimSpace(*updateReq.Name); name != "" {
+			sets = append(sets, "#name = :name")
+			values[":name"] = &dynamodb.AttributeValue{S: aws.String(name)}
+		} else {
+			removes = append(removes, "#name")
+		}
+	}
+	if updateReq.Ignored != nil {
+		sets = append(sets, "ignored = :ignored")
+		values[":ignored"] = &dynamodb.AttributeValue{BOOL: updateReq.Ignored}
+	}
+	expression := "SET " + strings.Join(sets, ", ")
+	if len(removes) > 0 {
+		expression += " REMOVE " + strings.Join(removes, ", ")
+	}
+
+	input := &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(os.Getenv("PEOPLE_TABLE")),
+		Key:                       map[string]*dynamodb.AttributeValue{"personId": {S: aws.String(personID)}},
+		UpdateExpression:          aws.String(expression),
+		ConditionExpression:       aws.String("attribute_exists(personId)"),
+		ExpressionAttributeValues: values,
+		ReturnValues:              aws.String(dynamodb.ReturnValueAllNew),
+	}
+	if len(names) > 0 {
+		input.ExpressionAttributeNames = names
+	}
+
+	sess := session.Must(session.NewSession())
+	dynamoClient := dynamodb.New(sess)
+
+	// People of other events are out of reach of this event's routes
+	existing, err := getPerson(dynamoClient, os.Getenv("PEOPLE_TABLE"), personID)
+	if err != nil {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 500,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       `{"error": "Failed to load person"}`,
+		}, nil
+	}
+	if existing == nil || !existing.inEvent(ev) {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 404,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       `{"error": "Person not found"}`,
+		}, nil
+	}
+
+	result, err := dynamoClient.UpdateItem(input)
+	if err != nil {
+		if isConditionFailed(err) {
+			return events.LambdaFunctionURLResponse{
+				StatusCode: 404,
+				Headers:    map[string]string{"Content-Type": "application/json"},
+				Body:       `{"error": "Person not found"}`,
+			}, nil
+		}
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 500,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       `{"error": "Failed to update person"}`,
+		}, nil
+	}
+
+	var person Person
+	if err := dynamodbattribute.UnmarshalMap(result.Attributes, &person); err != nil {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 500,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       `{"error": "Failed to parse person"}`,
+		}, nil
+	}
+	return personResponse(200, &person)
+}
+
+// handleMergePeople serves POST /people/{id}/merge. The person's faces and
+// photos move to the target, and the person is left pointing at it so old
+// links keep working. The faces are moved first, which can be repeated, and
+// the two people are then updated in one transaction. Until then the source
+// keeps its faces, so a merge that fails partway is finished by rerunning it.
+func handleMergePeople(request events.LambdaFunctionURLRequest, ev *event.Settings) (events.LambdaFunctionURLResponse, error) {
+	if denied := requireAdmin(request); denied != nil {
+		return *denied, nil
+	}
+	sourceID, _ := personAction(request.RequestContext.HTTP.Path)
+
+	var mergeReq MergePeopleRequest
+	if err := json.Unmarshal([]byte(request.Body), &mergeReq); err != nil || mergeReq.Into == "" {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 400,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       `{"error": "into is required"}`,
+		}, nil
+	}
+
+	sess := session.Must(session.NewSession())
+	dynamoClient := dynamodb.New(sess)
+	peopleTable := os.Getenv("PEOPLE_TABLE")
+	assignmentsTable := os.Getenv("FACE_ASSIGNMENTS_TABLE")
+
+	source, err := getPerson(dynamoClient, peopleTable, sourceID)
+	if err != nil {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 500,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       `{"error": "Failed to load person"}`,
+		}, nil
+	}
+	target, err := resolvePerson(dynamoClient, peopleTable, mergeReq.Into)
+	if err != nil {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 500,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       `{"error": "Failed to load person"}`,
+		}, nil
+	}
+	if source == nil || target == nil || !source.inEvent(ev) || !target.inEvent(ev) {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 404,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       `{"error": "Person not found"}`,
+		}, nil
+	}
+	if source.MergedInto != "" || source.PersonID == target.PersonID {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 409,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       `{"error": "Person has already been merged"}`,
+		}, nil
+	}
+
+	assignments, err := getAssignments(dynamoClient, assignmentsTable, source.FaceIDs)
+	if err != nil {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 500,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       `{"error": "Failed to load face assignments"}`,
+		}, nil
+	}
+
+	// Repoint the assignments first, so faces indexed during the merge that
+	// match the source's faces join the target
+	for _, faceID := range source.FaceIDs {
+		if err := moveFace(dynamoClient, assignmentsTable, assignments, faceID, target.PersonID); err != nil {
+			log.Printf("Error reassigning face %s to %s: %v", faceID, target.PersonID, err)
+			return events.LambdaFunctionURLResponse{
+				StatusCode: 500,
+				Headers:    map[string]string{"Content-Type": "application/json"},
+				Body:       `{"error": "Failed to move faces"}`,
+			}, nil
+		}
+	}
+
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	targetUpdate := []string{"updatedAt = :now"}
+	var targetAdds []string
+	names := map[string]*string{}
+	values := map[string]*dynamodb.AttributeValue{":now": {N: aws.String(now)}}
+	if len(source.FaceIDs) > 0 {
+		targetAdds = append(targetAdds, "faceIds :faceIds")
+		values[":faceIds"] = &dynamodb.AttributeValue{SS: aws.StringSlice(source.FaceIDs)}
+	}
+	if len(source.PhotoIDs) > 0 {
+		targetAdds = append(targetAdds, "photoIds :photoIds")
+		values[":photoIds"] = &dynamodb.AttributeValue{SS: aws.StringSlice(source.PhotoIDs)}
+	}
+	// A name given to either cluster survives, preferring the target's
+	if source.Name != "" {
+		targetUpdate = append(targetUpdate, "#name = if_not_exists(#name, :name)")
+		names["#name"] = aws.String("name")
+		values[":name"] = &dynamodb.AttributeValue{S: aws.String(source.Name)}
+	}
+	expression := "SET " + strings.Join(targetUpdate, ", ")
+	if len(targetAdds) > 0 {
+		expression += " ADD " + strings.Join(targetAdds, ", ")
+	}
+	update := &dynamodb.Update{
+		TableName:                 aws.String(peopleTable),
+		Key:                       map[string]*dynamodb.AttributeValue{"personId": {S: aws.String(target.PersonID)}},
+		UpdateExpression:          aws.String(expression),
+		ConditionExpression:       aws.String("attribute_exists(personId) AND attribute_not_exists(mergedInto)"),
+		ExpressionAttributeValues: values,
+	}
+	if len(names) > 0 {
+		update.ExpressionAttributeNames = names
+	}
+	_, err = dynamoClient.TransactWriteItems(&dynamodb.TransactWriteItemsInput{
+		TransactItems: []*dynamodb.TransactWriteItem{
+			{Update: update},
+			{Update: &dynamodb.Update{
+				TableName:           aws.String(peopleTable),
+				Key:                 map[string]*dynamodb.AttributeValue{"personId": {S: aws.String(source.PersonID)}},
+				UpdateExpression:    aws.String("SET mergedInto = :target, updatedAt = :now REMOVE faceIds, photoIds"),
+				ConditionExpression: aws.String("attribute_not_exists(mergedInto)"),
+				ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+					":target": {S: aws.String(target.PersonID)},
+					":now":    {N: aws.String(now)},
+				},
+			}},
+		},
+	})
+	if transactionConflict(err) {
+		// Another merge got to one of the two first
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 409,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       `{"error": "Person has already been merged"}`,
+		}, nil
+	}
+	if err != nil {
+		log.Printf("Error merging %s into %s: %v", source.PersonID, target.PersonID, err)
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 500,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       `{"error": "Failed to update merged person"}`,
+		}, nil
+	}
+
+	merged, err := getPerson(dynamoClient, peopleTable, target.PersonID)
+	if err != nil || merged == nil {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 500,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       `{"error": "Failed to load person"}`,
+		}, nil
+	}
+	return personResponse(200, merged)
+}
+
+// handleSplitPerson serves POST /people/{id}/split, moving wrongly clustered
+// faces to a new person. Both people's photo sets are recomputed from the
+// face assignments. The new person is created and the faces taken from the
+// original in one transaction, and the faces are moved after. The new
+// person's ID comes from the request, so rerunning a split that failed while
+// moving faces finds the person and finishes moving them.
+func handleSplitPerson(request events.LambdaFunctionURLRequest, ev *event.Settings) (events.LambdaFunctionURLResponse, error) {
+	if denied := requireAdmin(request); denied != nil {
+		return *denied, nil
+	}
+	personID, _ := personAction(request.RequestContext.HTTP.Path)
+
+	var splitReq SplitPersonRequest
+	if err := json.Unmarshal([]byte(request.Body), &splitReq); err != nil || len(splitReq.FaceIDs) == 0 {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 400,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       `{"error": "faceIds is required"}`,
+		}, nil
+	}
+
+	sess := session.Must(session.NewSession())
+	dynamoClient := dynamodb.New(sess)
+	peopleTable := os.Getenv("PEOPLE_TABLE")
+	assignmentsTable := os.Getenv("FACE_ASSIGNMENTS_TABLE")
+
+	person, err := getPerson(dynamoClient, peopleTable, personID)
+	if err != nil {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 500,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       `{"error": "Failed to load person"}`,
+		}, nil
+	}
+	if person == nil || person.MergedInto != "" || !person.inEvent(ev) {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 404,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       `{"error": "Person not found"}`,
+		}, nil
+	}
+
+	splitID := splitPersonID(person.PersonID, splitReq.FaceIDs)
+	existing, err := getPerson(dynamoClient, peopleTable, splitID)
+	if err != nil {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 500,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       `{"error": "Failed to load person"}`,
+		}, nil
+	}
+	if existing != nil {
+		return finishSplit(dynamoClient, assignmentsTable, existing, 200)
+	}
+
+	moving := make(map[string]bool, len(splitReq.FaceIDs))
+	for _, faceID := range splitReq.FaceIDs {
+		if !slices.Contains(person.FaceIDs, faceID) {
+			return events.LambdaFunctionURLResponse{
+				StatusCode: 400,
+				Headers:    map[string]string{"Content-Type": "application/json"},
+				Body:       fmt.Sprintf(`{"error": %q}`, "face "+faceID+" does not belong to this person"),
+			}, nil
+		}
+		moving[faceID] = true
+	}
+	if len(moving) == len(person.FaceIDs) {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 400,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       `{"error": "At least one face must stay with the person"}`,
+		}, nil
+	}
+
+	assignments, err := getAssignments(dynamoClient, assignmentsTable, person.FaceIDs)
+	if err != nil {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 500,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       `{"error": "Failed to load face assignments"}`,
+		}, nil
+	}
+
+	now := time.Now().Unix()
+	split := Person{
+		PersonID:  splitID,
+		Name:      strings.TrimSpace(splitReq.Name),
+		CreatedAt: now,
+		UpdatedAt: now,
+		EventID:   person.EventID,
+	}
+	remaining := Person{PersonID: person.PersonID}
+	for _, faceID := range person.FaceIDs {
+		assignment, assigned := assignments[faceID]
+		if moving[faceID] {
+			split.FaceIDs = append(split.FaceIDs, faceID)
+			if assigned {
+				split.PhotoIDs = appendUnique(split.PhotoIDs, assignment.PhotoID)
+				if split.RepresentativeFaceID == "" {
+					split.RepresentativeFaceID, split.RepresentativePhotoID = faceID, assignment.PhotoID
+				}
+			}
+		} else {
+			remaining.FaceIDs = append(remaining.FaceIDs, faceID)
+			if assigned {
+				remaining.PhotoIDs = appendUnique(remaining.PhotoIDs, assignment.PhotoID)
+				if remaining.RepresentativeFaceID == "" {
+					remaining.RepresentativeFaceID, remaining.RepresentativePhotoID = faceID, assignment.PhotoID
+				}
+			}
+		}
+	}
+
+	// Keep the original representative face unless it was split off. Faces
+	// and photos are taken out as sets, so faces clustered into the person
+	// meanwhile stay.
+	sets := []string{"updatedAt = :now"}
+	deletes := []string{"faceIds :moved"}
+	values := map[string]*dynamodb.AttributeValue{
+		":moved": {SS: aws.StringSlice(split.FaceIDs)},
+		":now":   {N: aws.String(strconv.FormatInt(now, 10))},
+	}
+	var movedPhotos []string
+	for _, photoID := range split.PhotoIDs {
+		if !slices.Contains(remaining.PhotoIDs, photoID) {
+			movedPhotos = append(movedPhotos, photoID)
+		}
+	}
+	if len(movedPhotos) > 0 {
+		deletes = append(deletes, "photoIds :movedPhotos")
+		values[":movedPhotos"] = &dynamodb.AttributeValue{SS: aws.StringSlice(movedPhotos)}
+	}
+	if moving[person.RepresentativeFaceID] && remaining.RepresentativeFaceID != "" {
+		sets = append(sets, "representativeFaceId = :faceId", "representativePhotoId = :photoId")
+		values[":faceId"] = &dynamodb.AttributeValue{S: aws.String(remaining.RepresentativeFaceID)}
+		values[":photoId"] = &dynamodb.AttributeValue{S: aws.String(remaining.RepresentativePhotoID)}
+	}
+	expression := "SET " + strings.Join(sets, ", ") + " DELETE " + strings.Join(deletes, ", ")
+
+	item, err := dynamodbattribute.MarshalMap(split)
+	if err == nil {
+		_, err = dynamoClient.TransactWriteItems(&dynamodb.TransactWriteItemsInput{
+			TransactItems: []*dynamodb.TransactWriteItem{
+				{Put: &dynamodb.Put{
+					TableName:           aws.String(peopleTable),
+					Item:                item,
+					ConditionExpression: aws.String("attribute_not_exists(personId)"),
+				}},
+				{Update: &dynamodb.Update{
+					TableName:                 aws.String(peopleTable),
+					Key:                       map[string]*dynamodb.AttributeValue{"personId": {S: aws.String(person.PersonID)}},
+					UpdateExpression:          aws.String(expression),
+					ConditionExpression:       aws.String("attribute_exists(personId) AND attribute_not_exists(mergedInto)"),
+					ExpressionAttributeValues: values,
+				}},
+			},
+		})
+	}
+	if transactionConflict(err) {
+		// The same split ran concurrently, or the person was merged meanwhile
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 409,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       `{"error": "Person changed during the split"}`,
+		}, nil
+	}
+	if err != nil {
+		log.Printf("Error splitting %s: %v", person.PersonID, err)
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 500,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       `{"error": "Failed to create person"}`,
+		}, nil
+	}
+
+	return finishSplit(dynamoClient, assignmentsTable, &split, 201)
+}
+
+// finishSplit moves the faces of a person created by a split to it. Moving a
+// face that was already moved changes nothing.
+func finishSplit(client *dynamodb.DynamoDB, assignmentsTable string, split *Person, statusCode int) (events.LambdaFunctionURLResponse, error) {
+	assignments, err := getAssignments(client, assignmentsTable, split.FaceIDs)
+	if err != nil {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 500,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       `{"error": "Failed to load face assignments"}`,
+		}, nil
+	}
+	for _, faceID := range split.FaceIDs {
+		if err := moveFace(client, assignmentsTable, assignments, faceID, split.PersonID); err != nil {
+			log.Printf("Error reassigning face %s to %s: %v", faceID, split.PersonID, err)
+			return events.LambdaFunctionURLResponse{
+				StatusCode: 500,
+				Headers:    map[string]string{"Content-Type": "application/json"},
+				Body:       `{"error": "Failed to move faces, retry the split to finish"}`,
+			}, nil
+		}
+	}
+	return personResponse(statusCode, split)
+}
+
+// reassignFace points a face's assignment at another person. A face removed
+// since the person was loaded no longer has an assignment and is skipped.
+func reassignFace(client *dynamodb.DynamoDB, tableName, faceID, personID string) error {
+	_, err := client.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:                 aws.String(tableName),
+		Key:                       map[string]*dynamodb.AttributeValue{"faceId": {S: aws.String(faceID)}},
+		UpdateExpression:          aws.String("SET personId = :personId"),
+		ConditionExpression:       aws.String("attribute_exists(faceId)"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":personId": {S: aws.String(personID)}},
+	})
+	if isConditionFailed(err) {
+		return nil
+	}
+	return err
+}
+
+// moveFace points a face at another person, both in its assignment and in
+// the copy of the person kept with the face on its photo's metadata item
+func moveFace(client *dynamodb.DynamoDB, assignmentsTable string, assignments map[string]FaceAssignment, faceID, personID string) error {
+	if err := reassignFace(client, assignmentsTable, faceID, personID); err != nil {
+		return err
+	}
+	if assignment, ok := assignments[faceID]; ok {
+		return setFacePerson(client, metadataTable(), assignment.PhotoID, faceID, personID)
+	}
+	return nil
+}
+
+// setFacePerson updates the person recorded with a face on its photo's
+// metadata item. A photo reprocessed meanwhile has new faces and is skipped.
+func setFacePerson(client *dynamodb.DynamoDB, tableName, photoID, faceID, personID string) error {
+	key, err := metadataKey(client, tableName, photoID)
+	if err != nil || key == nil {
+		return err
+	}
+	result, err := client.GetItem(&dynamodb.GetItemInput{
+		TableName:            aws.String(tableName),
+		Key:                  key,
+		ProjectionExpression: aws.String("faces"),
+		ConsistentRead:       aws.Bool(true),
+	})
+	if err != nil {
+		return err
+	}
+	var item struct {
+		Faces []FaceAssignment `json:"faces"`
+	}
+	if err := dynamodbattribute.UnmarshalMap(result.Item, &item); err != nil {
+		return err
+	}
+	index := slices.IndexFunc(item.Faces, func(face FaceAssignment) bool { return face.FaceID == faceID })
+	if index < 0 {
+		return nil
+	}
+
+	face := fmt.Sprintf("faces[%d]", index)
+	_, err = client.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:           aws.String(tableName),
+		Key:                 key,
+		UpdateExpression:    aws.String("SET " + face + ".personId = :personId"),
+		ConditionExpression: aws.String(face + ".faceId = :faceId"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":personId": {S: aws.String(personID)},
+			":faceId":   {S: aws.String(faceID)},
+		},
+	})
+	if isConditionFailed(err) {
+		return nil
+	}
+	return err
+}
+
+// splitPersonID derives the ID of the person a split creates from the
+// person and faces split, so a rerun of the same split finds it. Clustered
+// people reuse their first face ID, so the format only needs to avoid
+// colliding.
+func splitPersonID(personID string, faceIDs []string) string {
+	faceIDs = slices.Clone(faceIDs)
+	slices.Sort(faceIDs)
+	sum := sha256.Sum256([]byte(personID + "\n" + strings.Join(slices.Compact(faceIDs), "\n")))
+	return hex.EncodeToString(sum[:16])
+}
+
+func appendUnique(values []string, value string) []string {
+	if slices.Contains(values, value) {
+		return values
+	}
+	return append(values, value)
+}
+
+func isConditionFailed(err error) bool {
+	var aerr awserr.Error
+	return errors.As(err, &aerr) && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException
+}
+
+// transactionConflict reports whether a transaction was canceled because
+// one of its conditions failed
+func transactionConflict(err error) bool {
+	var canceled *dynamodb.TransactionCanceledException
+	if !errors.As(err, &canceled) {
+		return false
+	}
+	return slices.ContainsFunc(canceled.CancellationReasons, func(reason *dynamodb.CancellationReason) bool {
+		return aws.StringValue(reason.Code) == "ConditionalCheckFailed"
+	})
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// A rerun of a split has to find the person the first run created
+func TestSplitPersonIDIsStable(t *testing.T) {
+	id := splitPersonID("person-a", []string{"face-2", "face-1"})
+	if got := splitPersonID("person-a", []string{"face-1", "face-2", "face-1"}); got != id {
+		t.Errorf("same split got %q, want %q", got, id)
+	}
+	if splitPersonID("person-b", []string{"face-1", "face-2"}) == id {
+		t.Error("splits of different people share an ID")
+	}
+	if splitPersonID("person-a", []string{"face-1"}) == id {
+		t.Error("splits of different faces share an ID")
+	}
+	if len(id) != 32 {
+		t.Errorf("ID %q is not 32 hex characters", id)
+	}
+}
+
+func TestTransactionConflict(t *testing.T) {
+	canceled := func(codes ...string) error {
+		var reasons []*dynamodb.CancellationReason
+		for _, code := range codes {
+			reasons = append(reasons, &dynamodb.CancellationReason{Code: aws.String(code)})
+		}
+		return &dynamodb.TransactionCanceledException{CancellationReasons: reasons}
+	}
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"condition failed", canceled("None", "ConditionalCheckFailed"), true},
+		{"wrapped", errors.Join(errors.New("merge"), canceled("ConditionalCheckFailed", "None")), true},
+		{"throttled", canceled("ThrottlingError", "None"), false},
+		{"other error", awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "", nil), false},
+	}
+	for _, tt := range tests {
+		if got := transactionConflict(tt.err); got != tt.want {
+			t.Errorf("%s: transactionConflict = %t, want %t", tt.name, got, tt.want)
+		}
+	}
+	if !isConditionFailed(errors.Join(errors.New("update"), awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "", nil))) {
+		t.Error("isConditionFailed missed a wrapped condition failure")
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Andrew-Wichmann/wedding-photos-app/internal/event"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Pages are capped so a single response stays well inside the Function URL
+// payload limit, with a presigned URL per rendition
+const maxGalleryPageSize = 500
+
+// gallerySort orders photos by a value from their summary, with ties
+// broken by key so pages are stable
+type gallerySort struct {
+	value      func(photoSummary) int64
+	descending bool
+}
+
+// gallerySorts are the orders the sort parameter can ask for
+var gallerySorts = map[string]gallerySort{
+	"oldest":   {value: func(s photoSummary) int64 { return s.TakenAt }},
+	"newest":   {value: func(s photoSummary) int64 { return s.TakenAt }, descending: true},
+	"uploaded": {value: func(s photoSummary) int64 { return s.UploadedAt }, descending: true},
+	"popular":  {value: func(s photoSummary) int64 { return int64(s.LikeCount) }, descending: true},
+}
+
+// galleryError is a failed gallery query, with the status to report it with
+type galleryError struct {
+	status  int
+	message string
+}
+
+func (e *galleryError) Error() string { return e.message }
+
+// galleryErrorResponse reports an error from queryGallery or pageGallery
+func galleryErrorResponse(err error) events.LambdaFunctionURLResponse {
+	status, message := 500, "Failed to query gallery"
+	var gerr *galleryError
+	if errors.As(err, &gerr) {
+		status, message = gerr.status, gerr.message
+	}
+	return events.LambdaFunctionURLResponse{
+		StatusCode: status,
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       fmt.Sprintf(`{"error": %q}`, message),
+	}
+}
+
+// queryGallery returns the keys of the event's photos matching the /gallery
+// filter parameters, along with the summaries of the photos it read. Without
+// filters every upload is listed, in key order.
+func queryGallery(s3Client *s3.S3, dynamoClient *dynamodb.DynamoDB, bucketName, tableName string, ev *event.Settings, queryParams map[string]string) ([]string, map[string]photoSummary, error) {
+	faceID := queryParams["faceId"]
+
+	var filteredPhotoKeys []string
+	var summaries map[string]photoSummary
+
+	if hasFilters(queryParams) {
+		// If filters are provided, query DynamoDB first
+		scanInput, err := buildScanInput(tableName, queryParams, ev)
+		if err != nil {
+			return nil, nil, &galleryError{400, err.Error()}
+		}
+
+		// Execute scan
+		items, err := scanItems(dynamoClient, scanInput)
+		if err != nil {
+			return nil, nil, &galleryError{500, "Failed to query metadata: " + err.Error()}
+		}
+
+		// Unmarshal results
+		var metadata []map[string]interface{}
+		upgradeItems(dynamoClient, items)
+		err = dynamodbattribute.UnmarshalListOfMaps(items, &metadata)
+		if err != nil {
+			return nil, nil, &galleryError{500, "Failed to parse metadata"}
+		}
+		summaries = summariesFromItems(items)
+		metadata = filterByDateRange(metadata, queryParams, ev.Location())
+
+		// Post-process filter by faceId (in-memory filtering)
+		if faceID != "" {
+			metadata = filterByFaceID(metadata, faceID)
+		}
+
+		// Labels are the keywords written into the file, matched
+		// case-insensitively; a photo needs every one listed
+		if labels := queryParams["labels"]; labels != "" {
+			metadata = filterByLabels(metadata, strings.Split(labels, ","))
+		}
+
+		// A person spans every face ID minted for the same guest. Links to a
+		// person that was since merged show the merged person's photos.
+		if personID := queryParams["personId"]; personID != "" {
+			person, err := resolvePerson(dynamoClient, os.Getenv("PEOPLE_TABLE"), personID)
+			if err != nil {
+				return nil, nil, &galleryError{500, "Failed to load person"}
+			}
+			if person == nil || !person.inEvent(ev) {
+				return nil, nil, &galleryError{404, "Person not found"}
+			}
+			metadata = filterByPhotoIDs(metadata, person.PhotoIDs)
+		}
+
+		// Named people, comma separated, must all appear in a photo
+		if names := queryParams["person"]; names != "" {
+			photoIDs, unknown, err := photosOfNamedPeople(dynamoClient, os.Getenv("PEOPLE_TABLE"), ev, strings.Split(names, ","))
+			if err != nil {
+				return nil, nil, &galleryError{500, "Failed to load people"}
+			}
+			if unknown != "" {
+				return nil, nil, &galleryError{404, "No person named " + unknown}
+			}
+			metadata = filterByPhotoIDs(metadata, photoIDs)
+		}
+
+		// Extract photo keys from filtered metadata
+		for _, item := range metadata {
+			if photoId, ok := item["photoId"].(string); ok {
+				filteredPhotoKeys = append(filteredPhotoKeys, photoId)
+			}
+		}
+	} else {
+		// No filters - list all of the event's objects from S3. The delimiter
+		// leaves out other events' folders under the default event's prefix.
+		err := s3Client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+			Bucket:    aws.String(bucketName),
+			Prefix:    aws.String(ev.UploadPrefix()),
+			Delimiter: aws.String("/"),
+		}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+			for _, obj := range page.Contents {
+				filteredPhotoKeys = append(filteredPhotoKeys, *obj.Key)
+			}
+			return true
+		})
+		if err != nil {
+			return nil, nil, &galleryError{500, "Failed to list files"}
+		}
+
+		// Summaries are optional, so fall back to bare originals if the table can't be read
+		summaries, err = scanSummaries(dynamoClient, tableName, ev)
+		if err != nil {
+			summaries = nil
+		}
+	}
+
+	return filteredPhotoKeys, summaries, nil
+}
+
+// galleryCursor marks the last photo of a page: its sort value and key
+type galleryCursor struct {
+	Value int64  `json:"v"`
+	Key   string `json:"k"`
+}
+
+// pageGallery applies the sort, limit and cursor parameters. Without a sort
+// the query's order is kept, or key order once paging; without a limit every
+// photo is returned. The cursor for the next page is empty on the last one.
+// Cursors hold a position rather than an offset, so photos uploaded while
+// paging don't shift the pages.
+func pageGallery(keys []string, summaries map[string]photoSummary, queryParams map[string]string) ([]string, string, error) {
+	sortName := queryParams["sort"]
+	order, ok := gallerySorts[sortName]
+	if sortName != "" && !ok {
+		var names []string
+		for name := range gallerySorts {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, "", &galleryError{400, "sort must be one of " + strings.Join(names, ", ")}
+	}
+	if order.value == nil {
+		order.value = func(photoSummary) int64 { return 0 }
+	}
+	// before reports whether the photo at one position comes before another
+	before := func(aValue int64, aKey string, bValue int64, bKey string) bool {
+		if aValue != bValue {
+			return (aValue > bValue) == order.descending
+		}
+		return aKey < bKey
+	}
+	value := func(key string) int64 { return order.value(summaries[key]) }
+
+	paging := queryParams["limit"] != "" || queryParams["cursor"] != ""
+	if sortName != "" || paging {
+		sort.SliceStable(keys, func(i, j int) bool {
+			return before(value(keys[i]), keys[i], value(keys[j]), keys[j])
+		})
+	}
+
+	if encoded := queryParams["cursor"]; encoded != "" {
+		var cursor galleryCursor
+		data, err := base64.RawURLEncoding.DecodeString(encoded)
+		if err == nil {
+			err = json.Unmarshal(data, &cursor)
+		}
+		if err != nil || cursor.Key == "" {
+			return nil, "", &galleryError{400, "invalid cursor"}
+		}
+		start := sort.Search(len(keys), func(i int) bool {
+			return before(cursor.Value, cursor.Key, value(keys[i]), keys[i])
+		})
+		keys = keys[start:]
+	}
+
+	limit := 0
+	if l := queryParams["limit"]; l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit < 1 || limit > maxGalleryPageSize {
+			return nil, "", &galleryError{400, fmt.Sprintf("limit must be between 1 and %d", maxGalleryPageSize)}
+		}
+	}
+	if limit == 0 || len(keys) <= limit {
+		return keys, "", nil
+	}
+
+	page := keys[:limit]
+	last := page[len(page)-1]
+	data, _ := json.Marshal(galleryCursor{Value: value(last), Key: last})
+	return page, base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// filterByLabels keeps the metadata items tagged with every label
+func filterByLabels(metadata []map[string]interface{}, labels []string) []map[string]interface{} {
+	var filtered []map[string]interface{}
+	for _, item := range metadata {
+		keywords, _ := item["keywords"].([]interface{})
+		matches := true
+		for _, label := range labels {
+			label = strings.TrimSpace(label)
+			found := false
+			for _, keyword := range keywords {
+				if k, ok := keyword.(string); ok && strings.EqualFold(k, label) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			filtered = append(filtered, item)
+		}
+	}
+	return filtered
+}
+
+// galleryHeaders are the headers of a gallery listing. The cursor for the
+// next page goes in a header so the body stays the plain list /gallery has
+// always returned.
+func galleryHeaders(nextCursor string) map[string]string {
+	headers := map[string]string{
+		"Content-Type":                 "application/json",
+		"Access-Control-Allow-Origin":  "*",
+		"Access-Control-Allow-Methods": "GET, OPTIONS",
+		"Access-Control-Allow-Headers": "Content-Type",
+		"Cache-Control":                "no-cache, no-store, must-revalidate",
+		"Pragma":                       "no-cache",
+		"Expires":                      "0",
+	}
+	if nextCursor != "" {
+		headers["X-Next-Cursor"] = nextCursor
+		headers["Access-Control-Expose-Headers"] = "X-Next-Cursor"
+	}
+	return headers
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+// gallerySummaries has ties on every sort value, so pages have to fall
+// back to key order to stay stable
+var gallerySummaries = map[string]photoSummary{
+	"a": {TakenAt: 300, UploadedAt: 50, LikeCount: 3},
+	"b": {TakenAt: 100, UploadedAt: 50, LikeCount: 3},
+	"c": {TakenAt: 200, UploadedAt: 50, LikeCount: 0},
+	"d": {TakenAt: 100, UploadedAt: 50, LikeCount: 1},
+	"e": {TakenAt: 300, UploadedAt: 50, LikeCount: 3},
+	"f": {TakenAt: 100, UploadedAt: 50, LikeCount: 0},
+	"g": {TakenAt: 200, UploadedAt: 60, LikeCount: 1},
+}
+
+// galleryKeys returns the keys in a scrambled query order
+func galleryKeys() []string {
+	return []string{"e", "a", "g", "c", "b", "f", "d"}
+}
+
+func encodeCursor(t *testing.T, cursor any) string {
+	t.Helper()
+	data, err := json.Marshal(cursor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func TestPageGalleryWalksEveryPhotoOnce(t *testing.T) {
+	orders := map[string][]string{
+		"":         {"a", "b", "c", "d", "e", "f", "g"},
+		"oldest":   {"b", "d", "f", "c", "g", "a", "e"},
+		"newest":   {"a", "e", "c", "g", "b", "d", "f"},
+		"uploaded": {"g", "a", "b", "c", "d", "e", "f"},
+		"popular":  {"a", "b", "e", "d", "g", "c", "f"},
+	}
+	for sortName, want := range orders {
+		for _, limit := range []int{1, 2, 3, 7, 10} {
+			t.Run(fmt.Sprintf("sort %q limit %d", sortName, limit), func(t *testing.T) {
+				var got []string
+				cursor := ""
+				for pages := 1; ; pages++ {
+					params := map[string]string{"sort": sortName, "limit": strconv.Itoa(limit), "cursor": cursor}
+					page, next, err := pageGallery(galleryKeys(), gallerySummaries, params)
+					if err != nil {
+						t.Fatalf("page %d: %v", pages, err)
+					}
+					if len(page) > limit {
+						t.Fatalf("page %d has %d photos, limit %d", pages, len(page), limit)
+					}
+					got = append(got, page...)
+					if next == "" {
+						if wantPages := (len(want) + limit - 1) / limit; pages != wantPages {
+							t.Errorf("took %d pages, want %d", pages, wantPages)
+						}
+						break
+					}
+					if pages > len(want) {
+						t.Fatal("cursor never ran out")
+					}
+					cursor = next
+				}
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("photos = %v, want %v", got, want)
+				}
+			})
+		}
+	}
+}
+
+func TestPageGalleryCursorEncoding(t *testing.T) {
+	page, next, err := pageGallery(galleryKeys(), gallerySummaries, map[string]string{"sort": "popular", "limit": "2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(page, []string{"a", "b"}) {
+		t.Fatalf("page = %v, want [a b]", page)
+	}
+
+	// The cursor is the URL-safe, unpadded JSON of the page's last photo
+	data, err := base64.RawURLEncoding.DecodeString(next)
+	if err != nil {
+		t.Fatalf("cursor %q isn't raw URL base64: %v", next, err)
+	}
+	var cursor galleryCursor
+	if err := json.Unmarshal(data, &cursor); err != nil {
+		t.Fatalf("cursor %s isn't JSON: %v", data, err)
+	}
+	if cursor != (galleryCursor{Value: 3, Key: "b"}) {
+		t.Errorf("cursor = %+v, want {Value:3 Key:b}", cursor)
+	}
+}
+
+func TestPageGalleryPhotosAddedWhilePaging(t *testing.T) {
+	params := map[string]string{"sort": "newest", "limit": "3"}
+	first, next, err := pageGallery(galleryKeys(), gallerySummaries, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A newer photo lands on the first page, which the guest has already seen
+	summaries := map[string]photoSummary{"h": {TakenAt: 400}}
+	for key, summary := range gallerySummaries {
+		summaries[key] = summary
+	}
+	params["cursor"] = next
+	second, _, err := pageGallery(append(galleryKeys(), "h"), summaries, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(first, []string{"a", "e", "c"}) || !reflect.DeepEqual(second, []string{"g", "b", "d"}) {
+		t.Errorf("pages = %v, %v, want [a e c], [g b d]", first, second)
+	}
+}
+
+func TestPageGalleryCursorPositions(t *testing.T) {
+	tests := []struct {
+		name   string
+		cursor galleryCursor
+		want   []string
+	}{
+		{name: "photo whose date changed since", cursor: galleryCursor{Value: 100, Key: "c"}, want: []string{"d", "f", "c", "g", "a", "e"}},
+		{name: "value between photos", cursor: galleryCursor{Value: 150, Key: "zzz"}, want: []string{"c", "g", "a", "e"}},
+		{name: "before the first photo", cursor: galleryCursor{Value: -1, Key: "a"}, want: []string{"b", "d", "f", "c", "g", "a", "e"}},
+		{name: "past the last photo", cursor: galleryCursor{Value: 1 << 62, Key: "a"}, want: []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params := map[string]string{"sort": "oldest", "limit": "10", "cursor": encodeCursor(t, tt.cursor)}
+			page, next, err := pageGallery(galleryKeys(), gallerySummaries, params)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(page, tt.want) || next != "" {
+				t.Errorf("pageGallery = %v, %q, want %v and no cursor", page, next, tt.want)
+			}
+		})
+	}
+}
+
+func TestPageGalleryInvalidParameters(t *testing.T) {
+	raw := func(s string) string { return base64.RawURLEncoding.EncodeToString([]byte(s)) }
+	tests := []struct {
+		name   string
+		params map[string]string
+	}{
+		{"cursor not base64", map[string]string{"cursor": "not a cursor!"}},
+		{"cursor with padding", map[string]string{"cursor": base64.URLEncoding.EncodeToString([]byte(`{"v":1,"k":"ab"}`))}},
+		{"cursor not JSON", map[string]string{"cursor": raw("a")}},
+		{"cursor value not a number", map[string]string{"cursor": raw(`{"v":"1","k":"a"}`)}},
+		{"cursor without a key", map[string]string{"cursor": raw(`{"v":1}`)}},
+		{"cursor with trailing data", map[string]string{"cursor": raw(`{"v":1,"k":"a"}{}`)}},
+		{"unknown sort", map[string]string{"sort": "random"}},
+		{"zero limit", map[string]string{"limit": "0"}},
+		{"limit over the cap", map[string]string{"limit": strconv.Itoa(maxGalleryPageSize + 1)}},
+		{"limit not a number", map[string]string{"limit": "ten"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := pageGallery(galleryKeys(), gallerySummaries, tt.params)
+			var gerr *galleryError
+			if !errors.As(err, &gerr) || gerr.status != 400 {
+				t.Fatalf("pageGallery(%v) error = %v, want a 400", tt.params, err)
+			}
+			if response := galleryErrorResponse(err); response.StatusCode != 400 {
+				t.Errorf("response status = %d, want 400", response.StatusCode)
+			}
+		})
+	}
+}
+
+func TestGalleryHeaders(t *testing.T) {
+	headers := galleryHeaders("")
+	if _, ok := headers["X-Next-Cursor"]; ok {
+		t.Errorf("last page has X-Next-Cursor %q", headers["X-Next-Cursor"])
+	}
+	if _, ok := headers["Access-Control-Expose-Headers"]; ok {
+		t.Error("last page exposes headers")
+	}
+
+	headers = galleryHeaders("eyJ2IjoxLCJrIjoiYSJ9")
+	if headers["X-Next-Cursor"] != "eyJ2IjoxLCJrIjoiYSJ9" {
+		t.Errorf("X-Next-Cursor = %q", headers["X-Next-Cursor"])
+	}
+	// Browsers only let the page read the cursor if it's exposed
+	if headers["Access-Control-Expose-Headers"] != "X-Next-Cursor" {
+		t.Errorf("Access-Control-Expose-Headers = %q", headers["Access-Control-Expose-Headers"])
+	}
+	if headers["Content-Type"] != "application/json" {
+		t.Errorf("Content-Type = %q", headers["Content-Type"])
+	}
+}
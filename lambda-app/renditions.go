@@ -0,0 +1,65 @@
+package main
+
+import (
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Rendition is a resized JPEG written by the metadata lambda
+type Rendition struct {
+	Key    string `json:"key"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+}
+
+type RenditionURL struct {
+	URL    string `json:"url"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+}
+
+// presignRenditions generates a viewable URL (valid for 1 hour) for each rendition
+func presignRenditions(client *s3.S3, bucketName string, renditions map[string]Rendition) map[string]RenditionURL {
+	if len(renditions) == 0 {
+		return nil
+	}
+
+	urls := make(map[string]RenditionURL, len(renditions))
+	for name, rendition := range renditions {
+		url := presignKey(client, bucketName, rendition.Key)
+		if url == "" {
+			continue
+		}
+		urls[name] = RenditionURL{URL: url, Width: rendition.Width, Height: rendition.Height}
+	}
+	return urls
+}
+
+// presignFaceCrops adds a viewable cropUrl to each face in a metadata item
+// that the metadata lambda cropped
+func presignFaceCrops(client *s3.S3, bucketName string, item map[string]interface{}) {
+	faces, _ := item["faces"].([]interface{})
+	for _, face := range faces {
+		if faceMap, ok := face.(map[string]interface{}); ok {
+			if cropKey, ok := faceMap["cropKey"].(string); ok && cropKey != "" {
+				faceMap["cropUrl"] = presignKey(client, bucketName, cropKey)
+			}
+		}
+	}
+}
+
+// presignKey generates a viewable URL (valid for 1 hour) for an object,
+// returning "" if it can't be signed
+func presignKey(client *s3.S3, bucketName, key string) string {
+	req, _ := client.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(key),
+	})
+	url, err := req.Presign(1 * time.Hour)
+	if err != nil {
+		return ""
+	}
+	return url
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Andrew-Wichmann/wedding-photos-app/internal/event"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/rekognition"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	// Selfies are only kept for the length of a search. The bucket's lifecycle
+	// rule expires any left behind by an abandoned upload.
+	selfiePrefix       = "selfies/"
+	selfieUploadExpiry = 5 * time.Minute
+
+	// Minimum similarity for a face in the collection to count as the guest
+	selfieMatchThreshold = 90
+	selfieMaxMatches     = 200
+
+	// Rekognition accepts at most 5MB of inline image bytes
+	maxSelfieBytes = 5 << 20
+)
+
+var errInvalidSelfie = errors.New("invalid selfie")
+
+// Rekognition only reads JPEG and PNG
+var selfieContentTypes = map[string]string{"image/jpeg": ".jpg", "image/png": ".png"}
+
+type SelfieUploadRequest struct {
+	ContentType string `json:"contentType"`
+}
+
+// SelfieSearchRequest is the body of POST /search/selfie. Either the key of
+// a selfie uploaded through /search/selfie/upload or the image itself,
+// base64 encoded (optionally as a data URL), must be given.
+type SelfieSearchRequest struct {
+	Key   string `json:"key"`
+	Image string `json:"image"`
+}
+
+// handleSelfieUpload serves POST /search/selfie/upload with a short-lived
+// URL for uploading a selfie to search with
+func handleSelfieUpload(request events.LambdaFunctionURLRequest) (events.LambdaFunctionURLResponse, error) {
+	var uploadReq SelfieUploadRequest
+	if err := json.Unmarshal([]byte(request.Body), &uploadReq); err != nil {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 400,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       `{"error": "Invalid JSON"}`,
+		}, nil
+	}
+	extension, ok := selfieContentTypes[uploadReq.ContentType]
+	if !ok {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 400,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       `{"error": "contentType must be image/jpeg or image/png"}`,
+		}, nil
+	}
+
+	sess := session.Must(session.NewSession())
+	s3Client := s3.New(sess)
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 500,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       `{"error": "Failed to generate upload URL"}`,
+		}, nil
+	}
+	key := selfiePrefix + hex.EncodeToString(id) + extension
+
+	req, _ := s3Client.PutObjectRequest(&s3.PutObjectInput{
+		Bucket:      aws.String(os.Getenv("S3_BUCKET")),
+		Key:         aws.String(key),
+		ContentType: aws.String(uploadReq.ContentType),
+	})
+	uploadURL, err := req.Presign(selfieUploadExpiry)
+	if err != nil {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 500,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       `{"error": "Failed to generate upload URL"}`,
+		}, nil
+	}
+
+	responseBody, _ := json.Marshal(UploadResponse{UploadURL: uploadURL, Key: key})
+
+	return events.LambdaFunctionURLResponse{
+		StatusCode: 200,
+		Headers: map[string]string{
+			"Content-Type":                 "application/json",
+			"Access-Control-Allow-Origin":  "*",
+			"Access-Control-Allow-Methods": "POST, OPTIONS",
+			"Access-Control-Allow-Headers": "Content-Type",
+		},
+		Body: string(responseBody),
+	}, nil
+}
+
+// handleSelfieSearch serves POST /search/selfie. It finds the faces in the
+// event's collection matching the largest face in the selfie and returns the
+// gallery of photos they, and the people they were clustered into, appear
+// in. An uploaded selfie is deleted once the search is done, whatever the outcome.
+func handleSelfieSearch(request events.LambdaFunctionURLRequest, ev *event.Settings) (events.LambdaFunctionURLResponse, error) {
+	image, key, err := parseSelfie(request)
+	if err != nil {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 400,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       `{"error": "Send a selfie key or a base64 image"}`,
+		}, nil
+	}
+	if len(image) > maxSelfieBytes {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 413,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       `{"error": "Selfie must be smaller than 5MB"}`,
+		}, nil
+	}
+
+	sess := session.Must(session.NewSession())
+	s3Client := s3.New(sess)
+	dynamoClient := dynamodb.New(sess)
+	rekognitionClient := rekognition.New(sess)
+	bucketName := os.Getenv("S3_BUCKET")
+
+	input := &rekognition.SearchFacesByImageInput{
+		CollectionId:       aws.String(ev.Collection(event.BaseCollection())),
+		FaceMatchThreshold: aws.Float64(selfieMatchThreshold),
+		MaxFaces:           aws.Int64(selfieMaxMatches),
+		Image:              &rekognition.Image{Bytes: image},
+	}
+	if key != "" {
+		defer deleteSelfie(s3Client, bucketName, key)
+		input.Image = &rekognition.Image{S3Object: &rekognition.S3Object{
+			Bucket: aws.String(bucketName),
+			Name:   aws.String(key),
+		}}
+	}
+
+	result, err := rekognitionClient.SearchFacesByImage(input)
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok {
+			switch aerr.Code() {
+			// Rekognition reports a selfie without a face as an invalid parameter
+			case rekognition.ErrCodeInvalidParameterException:
+				return events.LambdaFunctionURLResponse{
+					StatusCode: 400,
+					Headers:    map[string]string{"Content-Type": "application/json"},
+					Body:       `{"error": "No face found in the selfie"}`,
+				}, nil
+			case rekognition.ErrCodeInvalidImageFormatException, rekognition.ErrCodeImageTooLargeException:
+				return events.LambdaFunctionURLResponse{
+					StatusCode: 400,
+					Headers:    map[string]string{"Content-Type": "application/json"},
+					Body:       `{"error": "Selfie must be a JPEG or PNG under 5MB"}`,
+				}, nil
+			case rekognition.ErrCodeInvalidS3ObjectException:
+				return events.LambdaFunctionURLResponse{
+					StatusCode: 404,
+					Headers:    map[string]string{"Content-Type": "application/json"},
+					Body:       `{"error": "Selfie not found"}`,
+				}, nil
+			}
+		}
+		log.Printf("Error searching faces by image: %v", err)
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 500,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       `{"error": "Failed to search faces"}`,
+		}, nil
+	}
+
+	var faceIDs []string
+	for _, match := range result.FaceMatches {
+		if match.Face != nil && match.Face.FaceId != nil {
+			faceIDs = append(faceIDs, *match.Face.FaceId)
+		}
+	}
+
+	photoIDs, err := photosOfFaces(dynamoClient, ev, faceIDs)
+	if err != nil {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 500,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       `{"error": "Failed to look up matching photos"}`,
+		}, nil
+	}
+
+	// Summaries are optional, so fall back to bare originals if the table can't be read
+	tableName := os.Getenv("DYNAMODB_TABLE")
+	if tableName == "" {
+		tableName = "wedding-photo-metadata" // fallback
+	}
+	summaries, err := scanSummaries(dynamoClient, tableName, ev)
+	if err != nil {
+		summaries = nil
+	}
+
+	items := galleryItems(s3Client, bucketName, photoIDs, summaries)
+	if items == nil {
+		items = []GalleryItem{}
+	}
+	responseBody, _ := json.Marshal(items)
+
+	return events.LambdaFunctionURLResponse{
+		StatusCode: 200,
+		Headers: map[string]string{
+			"Content-Type":                 "application/json",
+			"Access-Control-Allow-Origin":  "*",
+			"Access-Control-Allow-Methods": "POST, OPTIONS",
+			"Access-Control-Allow-Headers": "Content-Type",
+			"Cache-Control":                "no-store",
+		},
+		Body: string(responseBody),
+	}, nil
+}
+
+// parseSelfie returns either the inline selfie image or the key of an
+// uploaded one. A raw image/* body is accepted as well as JSON.
+func parseSelfie(request events.LambdaFunctionURLRequest) (image []byte, key string, err error) {
+	body := []byte(request.Body)
+	if request.IsBase64Encoded {
+		if body, err = base64.StdEncoding.DecodeString(request.Body); err != nil {
+			return nil, "", err
+		}
+	}
+	if strings.HasPrefix(request.Headers["content-type"], "image/") {
+		return body, "", nil
+	}
+
+	var searchReq SelfieSearchRequest
+	if err := json.Unmarshal(body, &searchReq); err != nil {
+		return nil, "", err
+	}
+	if searchReq.Key != "" {
+		if !strings.HasPrefix(searchReq.Key, selfiePrefix) || strings.Contains(searchReq.Key, "..") {
+			return nil, "", errInvalidSelfie
+		}
+		return nil, searchReq.Key, nil
+	}
+
+	// Strip the "data:image/jpeg;base64," prefix of a data URL
+	encoded := searchReq.Image
+	if _, data, ok := strings.Cut(encoded, ";base64,"); ok {
+		encoded = data
+	}
+	image, err = base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(image) == 0 {
+		return nil, "", errInvalidSelfie
+	}
+	return image, "", nil
+}
+
+// photosOfFaces returns the event's photos containing the given faces,
+// widened to every photo of the people those faces were clustered into.
+// Ignored people only contribute the matched faces' own photos.
+func photosOfFaces(client *dynamodb.DynamoDB, ev *event.Settings, faceIDs []string) ([]string, error) {
+	assignments, err := getAssignments(client, os.Getenv("FACE_ASSIGNMENTS_TABLE"), faceIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	photos := make(map[string]bool)
+	personIDs := make(map[string]bool)
+	for _, assignment := range assignments {
+		photos[assignment.PhotoID] = true
+		personIDs[assignment.PersonID] = true
+	}
+	for personID := range personIDs {
+		person, err := resolvePerson(client, os.Getenv("PEOPLE_TABLE"), personID)
+		if err != nil {
+			return nil, err
+		}
+		if person == nil || person.Ignored {
+			continue
+		}
+		for _, photoID := range person.PhotoIDs {
+			photos[photoID] = true
+		}
+	}
+
+	photoIDs := make([]string, 0, len(photos))
+	for photoID := range photos {
+		// Events can share a collection, but never each other's photos
+		if ev.Owns(photoID) {
+			photoIDs = append(photoIDs, photoID)
+		}
+	}
+	// Same order as the unfiltered gallery, which lists keys from S3
+	sort.Strings(photoIDs)
+	return photoIDs, nil
+}
+
+func deleteSelfie(client *s3.S3, bucketName, key string) {
+	_, err := client.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		log.Printf("Error deleting selfie %s: %v", key, err)
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// Guests don't sign in. The first request that needs to know who they are
+// mints a session, kept in a signed cookie so the app stays stateless.
+const (
+	sessionCookie = "guest"
+	sessionMaxAge = 365 * 24 * 60 * 60
+	maxNameLength = 50
+)
+
+var errSessionsDisabled = errors.New("SESSION_SECRET is not configured")
+
+// guestSession identifies a guest across requests. The name is the one the
+// guest gave for signing their comments.
+type guestSession struct {
+	ID   string `json:"id"`
+	Name string `json:"name,omitempty"`
+}
+
+func sessionSecret() []byte {
+	return []byte(os.Getenv("SESSION_SECRET"))
+}
+
+// signSession is the HMAC of an encoded session
+func signSession(payload string) string {
+	mac := hmac.New(sha256.New, sessionSecret())
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// readSession returns the guest's session, or nil if the request doesn't
+// carry a valid one
+func readSession(request events.LambdaFunctionURLRequest) *guestSession {
+	if len(sessionSecret()) == 0 {
+		return nil
+	}
+	for _, cookie := range request.Cookies {
+		name, value, _ := strings.Cut(strings.TrimSpace(cookie), "=")
+		if name != sessionCookie {
+			continue
+		}
+		payload, signature, ok := strings.Cut(value, ".")
+		if !ok || !hmac.Equal([]byte(signature), []byte(signSession(payload))) {
+			continue
+		}
+		data, err := base64.RawURLEncoding.DecodeString(payload)
+		if err != nil {
+			continue
+		}
+		var session guestSession
+		if err := json.Unmarshal(data, &session); err != nil || session.ID == "" {
+			continue
+		}
+		return &session
+	}
+	return nil
+}
+
+// ensureSession returns the guest's session, minting one if they don't have
+// it yet. The cookie to set is returned along with a new session.
+func ensureSession(request events.LambdaFunctionURLRequest) (*guestSession, []string, error) {
+	if len(sessionSecret()) == 0 {
+		return nil, nil, errSessionsDisabled
+	}
+	if session := readSession(request); session != nil {
+		return session, nil, nil
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, nil, err
+	}
+	session := &guestSession{ID: hex.EncodeToString(id)}
+	return session, []string{session.cookie()}, nil
+}
+
+// cookie is the Set-Cookie value carrying the session
+func (s *guestSession) cookie() string {
+	data, _ := json.Marshal(s)
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	return fmt.Sprintf("%s=%s.%s; Path=/; Max-Age=%d; HttpOnly; Secure; SameSite=Lax",
+		sessionCookie, payload, signSession(payload), sessionMaxAge)
+}
+
+// sessionErrorResponse reports a session that couldn't be started
+func sessionErrorResponse(err error) events.LambdaFunctionURLResponse {
+	if errors.Is(err, errSessionsDisabled) {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 503,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       `{"error": "Guest sessions are not configured"}`,
+		}
+	}
+	return events.LambdaFunctionURLResponse{
+		StatusCode: 500,
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       `{"error": "Failed to start session"}`,
+	}
+}
+
+// SessionRequest is the body of PUT /session
+type SessionRequest struct {
+	Name string `json:"name"`
+}
+
+// SessionResponse is what a guest can see of their session
+type SessionResponse struct {
+	Name string `json:"name"`
+}
+
+// handleGetSession serves GET /session, so the page knows whether to ask
+// for the guest's name. It doesn't start a session.
+func handleGetSession(request events.LambdaFunctionURLRequest) (events.LambdaFunctionURLResponse, error) {
+	var response SessionResponse
+	if guest := readSession(request); guest != nil {
+		response.Name = guest.Name
+	}
+	responseBody, _ := json.Marshal(response)
+	return events.LambdaFunctionURLResponse{
+		StatusCode: 200,
+		Headers:    map[string]string{"Content-Type": "application/json", "Cache-Control": "no-store"},
+		Body:       string(responseBody),
+	}, nil
+}
+
+// handlePutSession serves PUT /session, setting the name the guest's
+// comments are signed with. Comments already posted keep the old name.
+func handlePutSession(request events.LambdaFunctionURLRequest) (events.LambdaFunctionURLResponse, error) {
+	var sessionReq SessionRequest
+	if err := json.Unmarshal([]byte(request.Body), &sessionReq); err != nil {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 400,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       `{"error": "Invalid JSON"}`,
+		}, nil
+	}
+	name := strings.Join(strings.Fields(sessionReq.Name), " ")
+	if name == "" || utf8.RuneCountInString(name) > maxNameLength {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 400,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       fmt.Sprintf(`{"error": "Names are 1-%d characters"}`, maxNameLength),
+		}, nil
+	}
+
+	guest, _, err := ensureSession(request)
+	if err != nil {
+		return sessionErrorResponse(err), nil
+	}
+	guest.Name = name
+
+	responseBody, _ := json.Marshal(SessionResponse{Name: guest.Name})
+	return events.LambdaFunctionURLResponse{
+		StatusCode: 200,
+		Headers:    map[string]string{"Content-Type": "application/json", "Cache-Control": "no-store"},
+		Cookies:    []string{guest.cookie()},
+		Body:       string(responseBody),
+	}, nil
+}
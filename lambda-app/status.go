@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/Andrew-Wichmann/wedding-photos-app/internal/event"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// BatchGetItem reads at most 100 keys per call
+const maxStatusIDs = 100
+
+type StageStatus struct {
+	Status    string `json:"status"`
+	Error     string `json:"error,omitempty"`
+	UpdatedAt int64  `json:"updatedAt"`
+}
+
+// PhotoStatus is written by the metadata lambda as it processes an upload.
+// Objects it hasn't picked up yet are reported as "uploaded".
+type PhotoStatus struct {
+	ID        string                 `json:"id"`
+	PhotoID   string                 `json:"photoId"`
+	Status    string                 `json:"status"`
+	Error     string                 `json:"error,omitempty"`
+	Stages    map[string]StageStatus `json:"stages,omitempty"`
+	UpdatedAt int64                  `json:"updatedAt,omitempty"`
+}
+
+// handleStatus serves GET /photos/{id}/status
+func handleStatus(request events.LambdaFunctionURLRequest, ev *event.Settings) (events.LambdaFunctionURLResponse, error) {
+	id := strings.TrimSuffix(strings.TrimPrefix(request.RequestContext.HTTP.Path, "/photos/"), "/status")
+	if _, ok := eventKey(ev, id); !ok {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 400,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       `{"error": "Invalid photo id"}`,
+		}, nil
+	}
+
+	statuses, err := lookupStatuses(ev, []string{id})
+	if err != nil {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 500,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       `{"error": "Failed to read status"}`,
+		}, nil
+	}
+	if statuses[0].Status == "missing" {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 404,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       `{"error": "Photo not found"}`,
+		}, nil
+	}
+
+	body, _ := json.Marshal(statuses[0])
+	return events.LambdaFunctionURLResponse{
+		StatusCode: 200,
+		Headers:    map[string]string{"Content-Type": "application/json", "Cache-Control": "no-store"},
+		Body:       string(body),
+	}, nil
+}
+
+// handleBatchStatus serves GET /photos/status?ids=a,b,c so the page can poll
+// every recent upload in one request
+func handleBatchStatus(request events.LambdaFunctionURLRequest, ev *event.Settings) (events.LambdaFunctionURLResponse, error) {
+	var ids []string
+	for _, id := range strings.Split(request.QueryStringParameters["ids"], ",") {
+		id = strings.TrimSpace(id)
+		if _, ok := eventKey(ev, id); ok {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 || len(ids) > maxStatusIDs {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 400,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       fmt.Sprintf(`{"error": "ids must list between 1 and %d photo ids"}`, maxStatusIDs),
+		}, nil
+	}
+
+	statuses, err := lookupStatuses(ev, ids)
+	if err != nil {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 500,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       `{"error": "Failed to read status"}`,
+		}, nil
+	}
+
+	body, _ := json.Marshal(map[string]interface{}{"statuses": statuses})
+	return events.LambdaFunctionURLResponse{
+		StatusCode: 200,
+		Headers:    map[string]string{"Content-Type": "application/json", "Cache-Control": "no-store"},
+		Body:       string(body),
+	}, nil
+}
+
+// lookupStatuses returns the status of each id (the upload key without the
+// event's upload prefix, as in /img/{id}), in the order given. Ids without a
+// status item are "uploaded" if the object exists and "missing" otherwise.
+func lookupStatuses(ev *event.Settings, ids []string) ([]PhotoStatus, error) {
+	sess := session.Must(session.NewSession())
+	dynamoClient := dynamodb.New(sess)
+	s3Client := s3.New(sess)
+	tableName := os.Getenv("STATUS_TABLE")
+	bucketName := os.Getenv("S3_BUCKET")
+
+	keys := make([]map[string]*dynamodb.AttributeValue, 0, len(ids))
+	seen := make(map[string]bool)
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			keys = append(keys, map[string]*dynamodb.AttributeValue{"photoId": {S: aws.String(ev.UploadPrefix() + id)}})
+		}
+	}
+
+	found := make(map[string]PhotoStatus)
+	err := dynamoClient.BatchGetItemPages(&dynamodb.BatchGetItemInput{
+		RequestItems: map[string]*dynamodb.KeysAndAttributes{
+			tableName: {Keys: keys},
+		},
+	}, func(page *dynamodb.BatchGetItemOutput, lastPage bool) bool {
+		var items []PhotoStatus
+		if err := dynamodbattribute.UnmarshalListOfMaps(page.Responses[tableName], &items); err == nil {
+			for _, item := range items {
+				found[item.PhotoID] = item
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]PhotoStatus, 0, len(ids))
+	for _, id := range ids {
+		key := ev.UploadPrefix() + id
+		status, ok := found[key]
+		if !ok {
+			status = PhotoStatus{PhotoID: key, Status: "uploaded"}
+			_, err := s3Client.HeadObject(&s3.HeadObjectInput{
+				Bucket: aws.String(bucketName),
+				Key:    aws.String(key),
+			})
+			if aerr, ok := err.(awserr.RequestFailure); ok && aerr.StatusCode() == 404 {
+				status.Status = "missing"
+			} else if err != nil {
+				return nil, err
+			}
+		}
+		status.ID = id
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
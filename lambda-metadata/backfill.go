@@ -0,0 +1,393 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Andrew-Wichmann/wedding-photos-app/internal/event"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// backfillResult is the outcome for one upload
+type backfillResult struct {
+	Key     string
+	Changed []string // attributes that differ from the stored item
+	Removed int      // duplicate items dropped
+	Err     error
+}
+
+type backfillSummary struct {
+	Scanned, Changed, Unchanged, Failed int
+	FieldCounts                         map[string]int
+	FailedKeys                          []string
+}
+
+// runBackfillCommand reruns pipeline stages for existing uploads, e.g.
+//
+//	backfill -stages metadata -prefix uploads/1760 -dry-run
+//
+// Progress is checkpointed after each listing page, so an interrupted run
+// resumes where it stopped unless -restart is given.
+func runBackfillCommand(args []string) error {
+	flags := flag.NewFlagSet("backfill", flag.ExitOnError)
+	prefix := flags.String("prefix", "uploads/", "only process keys with this prefix")
+	eventID := flags.String("event", "", "only process uploads of this event")
+	stageList := flags.String("stages", stageMetadata, "comma-separated stages to rerun ("+strings.Join(stages, ", ")+", all)")
+	workers := flags.Int("concurrency", defaultConcurrency, "uploads processed at once")
+	limit := flags.Int("limit", 0, "stop after this many uploads (0 for no limit)")
+	checkpointPath := flags.String("checkpoint", "backfill.checkpoint", "file recording the last completed key")
+	restart := flags.Bool("restart", false, "ignore an existing checkpoint")
+	dryRun := flags.Bool("dry-run", false, "report what would change without writing anything")
+	flags.Parse(args)
+
+	run, err := parseStages(*stageList)
+	if err != nil {
+		return err
+	}
+	bucket := os.Getenv("S3_BUCKET")
+	if bucket == "" {
+		return fmt.Errorf("S3_BUCKET is not set")
+	}
+	if *workers < 1 {
+		return fmt.Errorf("-concurrency must be at least 1")
+	}
+
+	if *eventID != "" && !event.Valid(*eventID) {
+		return fmt.Errorf("invalid event ID %q", *eventID)
+	}
+
+	p := newProcessor()
+	return p.backfill(context.Background(), backfillOptions{
+		Bucket:         bucket,
+		Prefix:         *prefix,
+		Event:          *eventID,
+		Run:            run,
+		Workers:        *workers,
+		Limit:          *limit,
+		CheckpointPath: *checkpointPath,
+		Restart:        *restart,
+		DryRun:         *dryRun,
+	})
+}
+
+// backfillOptions selects the uploads and stages a backfill reruns
+type backfillOptions struct {
+	Bucket, Prefix string
+	Event          string // only uploads of this event; empty for all
+	Run            stageSet
+	Workers        int
+	Limit          int // 0 for no limit
+	CheckpointPath string
+	Restart        bool
+	DryRun         bool
+	// Process handles each upload instead of rerunning the stages
+	Process func(ctx context.Context, key string) backfillResult
+}
+
+// backfill reruns the selected stages for every upload under the prefix,
+// checkpointing after each listing page, and prints a summary
+func (p *processor) backfill(ctx context.Context, opts backfillOptions) error {
+	startAfter := ""
+	if !opts.Restart {
+		if data, err := os.ReadFile(opts.CheckpointPath); err == nil {
+			startAfter = strings.TrimSpace(string(data))
+			fmt.Printf("Resuming after %s\n", startAfter)
+		}
+	}
+
+	process := opts.Process
+	if process == nil {
+		process = func(ctx context.Context, key string) backfillResult {
+			return p.backfillOne(ctx, opts.Bucket, key, opts.Run, opts.DryRun)
+		}
+	}
+	summary := backfillSummary{FieldCounts: make(map[string]int)}
+
+	var pageErr error
+	err := p.s3Client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket:     aws.String(opts.Bucket),
+		Prefix:     aws.String(opts.Prefix),
+		StartAfter: aws.String(startAfter),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		var keys []string
+		for _, obj := range page.Contents {
+			key := aws.StringValue(obj.Key)
+			if strings.HasSuffix(key, "/") {
+				continue
+			}
+			// The default event's prefix contains every other event's uploads
+			if opts.Event != "" && event.FromKey(key) != opts.Event {
+				continue
+			}
+			if opts.Limit > 0 && summary.Scanned+len(keys) >= opts.Limit {
+				break
+			}
+			keys = append(keys, key)
+		}
+
+		for _, result := range backfillKeys(ctx, keys, opts.Workers, process) {
+			summary.add(result, opts.DryRun)
+		}
+
+		// Only whole pages are checkpointed, since workers finish out of order
+		if !opts.DryRun && len(keys) > 0 {
+			if err := os.WriteFile(opts.CheckpointPath, []byte(keys[len(keys)-1]+"\n"), 0o644); err != nil {
+				pageErr = fmt.Errorf("failed to write checkpoint: %w", err)
+				return false
+			}
+		}
+		return opts.Limit == 0 || summary.Scanned < opts.Limit
+	})
+	if err == nil {
+		err = pageErr
+	}
+
+	summary.print(opts.DryRun)
+	if err != nil {
+		return err
+	}
+	// A completed run starts from the beginning next time
+	if !opts.DryRun && opts.Limit == 0 {
+		os.Remove(opts.CheckpointPath)
+	}
+	return nil
+}
+
+// backfillKeys processes keys with at most workers running at once
+func backfillKeys(ctx context.Context, keys []string, workers int, process func(context.Context, string) backfillResult) []backfillResult {
+	results := make([]backfillResult, len(keys))
+	sem := make(chan struct{}, workers)
+	var wg sync.WaitGroup
+	for i, key := range keys {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results[i] = process(ctx, key)
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+// backfillOne reruns the selected stages for one upload and writes the
+// result under its deterministic key, dropping any duplicate items left
+// from before uploadedAt was derived from the key
+func (p *processor) backfillOne(ctx context.Context, bucket, key string, run stageSet, dryRun bool) backfillResult {
+	result := backfillResult{Key: key}
+
+	var items []PhotoMetadata
+	err := withRetry(ctx, "read metadata for "+key, func() error {
+		var err error
+		items, err = metadataItems(p.dynamoClient, p.tableName, key)
+		return err
+	})
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	previous := newestItem(items)
+
+	reader, err := p.openUpload(ctx, bucket, key)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	metadata, err := p.buildMetadata(ctx, reader, previous, run, dryRun)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+
+	result.Changed, err = changedAttributes(previous, metadata)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	var stale []PhotoMetadata
+	for _, item := range items {
+		if item.UploadedAt != metadata.UploadedAt {
+			stale = append(stale, item)
+		}
+	}
+	result.Removed = len(stale)
+	if dryRun || (len(result.Changed) == 0 && len(stale) == 0) {
+		return result
+	}
+
+	err = withRetry(ctx, "store metadata for "+key, func() error {
+		return putMetadata(p.dynamoClient, p.tableName, metadata)
+	})
+	if err != nil && !errors.Is(err, errStaleEvent) {
+		result.Err = fmt.Errorf("store metadata: %w", err)
+		return result
+	}
+	if err == nil {
+		p.discardReplaced(bucket, metadata)
+	}
+	// Duplicates carry faces indexed by their own runs, which nothing else
+	// points at once the items are gone
+	kept := make(map[string]bool, len(metadata.Faces))
+	for _, face := range metadata.Faces {
+		kept[face.FaceID] = true
+	}
+	var orphaned []FaceDetail
+	for _, item := range stale {
+		for _, face := range item.Faces {
+			if !kept[face.FaceID] {
+				orphaned = append(orphaned, face)
+			}
+		}
+	}
+	err = withRetry(ctx, "drop duplicate faces for "+key, func() error {
+		return p.discardFaces(bucket, p.collectionFor(metadata.EventID), orphaned)
+	})
+	if err != nil {
+		result.Err = fmt.Errorf("drop duplicate faces: %w", err)
+		return result
+	}
+	for _, item := range stale {
+		if err := p.dropDuplicate(item, metadata); err != nil {
+			result.Err = fmt.Errorf("delete duplicate item: %w", err)
+			return result
+		}
+	}
+	p.finishStatus(key, statusProcessed, nil)
+	return result
+}
+
+// dropDuplicate deletes a duplicate item. Likes and comments may have been
+// counted on it, so its counts move to the kept item in the same
+// transaction, and a repeated run finds nothing left to move.
+func (p *processor) dropDuplicate(item, kept PhotoMetadata) error {
+	remove := &dynamodb.Delete{
+		TableName:           aws.String(p.tableName),
+		Key:                 itemKey(&item),
+		ConditionExpression: aws.String("attribute_exists(photoId)"),
+	}
+	if item.LikeCount == 0 && item.CommentCount == 0 {
+		_, err := p.dynamoClient.DeleteItem(&dynamodb.DeleteItemInput{TableName: remove.TableName, Key: remove.Key})
+		return err
+	}
+	_, err := p.dynamoClient.TransactWriteItems(&dynamodb.TransactWriteItemsInput{
+		TransactItems: []*dynamodb.TransactWriteItem{
+			{Update: &dynamodb.Update{
+				TableName:           aws.String(p.tableName),
+				Key:                 itemKey(&kept),
+				UpdateExpression:    aws.String("ADD likeCount :likes, commentCount :comments"),
+				ConditionExpression: aws.String("attribute_exists(photoId)"),
+				ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+					":likes":    {N: aws.String(strconv.Itoa(item.LikeCount))},
+					":comments": {N: aws.String(strconv.Itoa(item.CommentCount))},
+				},
+			}},
+			{Delete: remove},
+		},
+	})
+	var canceled *dynamodb.TransactionCanceledException
+	if errors.As(err, &canceled) && len(canceled.CancellationReasons) == 2 &&
+		aws.StringValue(canceled.CancellationReasons[1].Code) == "ConditionalCheckFailed" {
+		// Deleted by an earlier run
+		return nil
+	}
+	return err
+}
+
+// newestItem is the most recently uploaded of an upload's items, nil if
+// there are none
+func newestItem(items []PhotoMetadata) *PhotoMetadata {
+	var newest *PhotoMetadata
+	for i := range items {
+		if newest == nil || items[i].UploadedAt > newest.UploadedAt {
+			newest = &items[i]
+		}
+	}
+	return newest
+}
+
+// changedAttributes lists the top-level attributes that differ between the
+// stored item and the rebuilt metadata
+func changedAttributes(previous *PhotoMetadata, metadata PhotoMetadata) ([]string, error) {
+	after, err := dynamodbattribute.MarshalMap(metadata)
+	if err != nil {
+		return nil, err
+	}
+	before := map[string]*dynamodb.AttributeValue{}
+	if previous != nil {
+		if before, err = dynamodbattribute.MarshalMap(previous); err != nil {
+			return nil, err
+		}
+	}
+
+	var changed []string
+	for name, value := range after {
+		if !reflect.DeepEqual(before[name], value) {
+			changed = append(changed, name)
+		}
+	}
+	for name := range before {
+		if _, ok := after[name]; !ok {
+			changed = append(changed, name)
+		}
+	}
+	sort.Strings(changed)
+	return changed, nil
+}
+
+func (s *backfillSummary) add(result backfillResult, dryRun bool) {
+	s.Scanned++
+	verb := "updated"
+	if dryRun {
+		verb = "would update"
+	}
+	switch {
+	case result.Err != nil:
+		s.Failed++
+		s.FailedKeys = append(s.FailedKeys, result.Key)
+		fmt.Printf("FAILED %s: %v\n", result.Key, result.Err)
+	case len(result.Changed) > 0 || result.Removed > 0:
+		s.Changed++
+		for _, name := range result.Changed {
+			s.FieldCounts[name]++
+		}
+		fmt.Printf("%s %s: %s", verb, result.Key, strings.Join(result.Changed, ", "))
+		if result.Removed > 0 {
+			fmt.Printf(" (%d duplicate items)", result.Removed)
+		}
+		fmt.Println()
+	default:
+		s.Unchanged++
+	}
+}
+
+func (s *backfillSummary) print(dryRun bool) {
+	label := "Changed"
+	if dryRun {
+		label = "Would change"
+	}
+	fmt.Printf("\nScanned %d, %s %d, unchanged %d, failed %d\n", s.Scanned, strings.ToLower(label), s.Changed, s.Unchanged, s.Failed)
+
+	names := make([]string, 0, len(s.FieldCounts))
+	for name := range s.FieldCounts {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return s.FieldCounts[names[i]] > s.FieldCounts[names[j]] })
+	for _, name := range names {
+		fmt.Printf("  %-18s %d\n", name, s.FieldCounts[name])
+	}
+	if len(s.FailedKeys) > 0 {
+		fmt.Printf("Failed keys:\n  %s\n", strings.Join(s.FailedKeys, "\n  "))
+	}
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+
+	"github.com/Andrew-Wichmann/wedding-photos-app/internal/event"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/rekognition"
+)
+
+// Face model versions of the collections already checked, kept across warm
+// invocations so the collection is described once per container
+var (
+	collectionModelsMu sync.Mutex
+	collectionModels   = make(map[string]string)
+)
+
+// ensureCollection creates a face collection if it doesn't exist yet and
+// returns the face model version it indexes with. A collection keeps the
+// model it was created with, so moving to a newer model means rebuilding
+// into a new collection (see runRebuildCollectionCommand).
+func (p *processor) ensureCollection(collectionID string) (string, error) {
+	collectionModelsMu.Lock()
+	defer collectionModelsMu.Unlock()
+	if version, ok := collectionModels[collectionID]; ok {
+		return version, nil
+	}
+
+	var version string
+	described, err := p.rekognitionClient.DescribeCollection(&rekognition.DescribeCollectionInput{
+		CollectionId: aws.String(collectionID),
+	})
+	switch {
+	case err == nil:
+		version = aws.StringValue(described.FaceModelVersion)
+	case isNotFound(err):
+		created, err := p.rekognitionClient.CreateCollection(&rekognition.CreateCollectionInput{
+			CollectionId: aws.String(collectionID),
+		})
+		var aerr awserr.Error
+		if errors.As(err, &aerr) && aerr.Code() == rekognition.ErrCodeResourceAlreadyExistsException {
+			// Another container created it first; the next call describes it
+			return "", transient(err)
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to create face collection %s: %w", collectionID, err)
+		}
+		version = aws.StringValue(created.FaceModelVersion)
+		log.Printf("Created face collection %s with face model %s", collectionID, version)
+	default:
+		return "", fmt.Errorf("failed to describe face collection %s: %w", collectionID, err)
+	}
+
+	collectionModels[collectionID] = version
+	return version, nil
+}
+
+// FaceRebuild holds a photo's faces indexed into a new collection by
+// rebuild-collection. They are kept aside on the item, out of the gallery and
+// the people directory, until the switch makes them the photo's faces.
+type FaceRebuild struct {
+	CollectionID string       `json:"collectionId"`
+	FaceModel    string       `json:"faceModelVersion"`
+	Sequencer    string       `json:"sequencer,omitempty"` // of the upload the faces were indexed from
+	Faces        []FaceDetail `json:"faces,omitempty"`
+}
+
+// runRebuildCollectionCommand reindexes an event's photos into a new
+// collection, e.g. after Rekognition releases a newer face model. It runs in
+// two passes so guests never see a half-rebuilt collection:
+//
+//	rebuild-collection -collection wedding-faces-v7
+//	rebuild-collection -collection wedding-faces-v7 -switch
+//
+// The first pass indexes each photo into the new collection and crops its
+// new faces, staging them on the photo's item; nothing the app reads
+// changes. Then point the event at the new collection, which switches face
+// search over in one step, and run the second pass. It gives each photo its
+// staged faces, keeping them with the people of the faces they replace (so
+// names, merges and splits survive), and indexes photos uploaded or
+// reprocessed since staging. Afterwards delete the old collection.
+func runRebuildCollectionCommand(args []string) error {
+	flags := flag.NewFlagSet("rebuild-collection", flag.ExitOnError)
+	target := flags.String("collection", "", "ID of the collection to rebuild into (created if missing)")
+	eventID := flags.String("event", event.Default, "event whose photos are reindexed")
+	switchOver := flags.Bool("switch", false, "give photos their staged faces, once the event uses the new collection")
+	workers := flags.Int("concurrency", defaultConcurrency, "uploads processed at once")
+	limit := flags.Int("limit", 0, "stop after this many uploads (0 for no limit)")
+	checkpointPath := flags.String("checkpoint", "", "file recording the last completed key (default rebuild.checkpoint, or rebuild-switch.checkpoint with -switch)")
+	restart := flags.Bool("restart", false, "ignore an existing checkpoint")
+	flags.Parse(args)
+
+	if *target == "" {
+		return fmt.Errorf("-collection is required")
+	}
+	bucket := os.Getenv("S3_BUCKET")
+	if bucket == "" {
+		return fmt.Errorf("S3_BUCKET is not set")
+	}
+	if *workers < 1 {
+		return fmt.Errorf("-concurrency must be at least 1")
+	}
+	if !event.Valid(*eventID) {
+		return fmt.Errorf("invalid event ID %q", *eventID)
+	}
+	if *checkpointPath == "" {
+		*checkpointPath = "rebuild.checkpoint"
+		if *switchOver {
+			*checkpointPath = "rebuild-switch.checkpoint"
+		}
+	}
+
+	p := newProcessor()
+	current := p.collectionFor(*eventID)
+	opts := backfillOptions{
+		Bucket:         bucket,
+		Prefix:         event.UploadPrefix(*eventID),
+		Event:          *eventID,
+		Workers:        *workers,
+		Limit:          *limit,
+		CheckpointPath: *checkpointPath,
+		Restart:        *restart,
+	}
+
+	if *switchOver {
+		if current != *target {
+			return fmt.Errorf("event %s still uses %s; %s", *eventID, current, switchInstructions(*eventID, *target))
+		}
+		fmt.Printf("Switching event %s to the faces staged in %s\n", *eventID, *target)
+		opts.Process = func(ctx context.Context, key string) backfillResult {
+			return p.switchRebuild(ctx, bucket, key, *target)
+		}
+		if err := p.backfill(context.Background(), opts); err != nil {
+			return err
+		}
+		fmt.Printf("\nOnce no event uses the old collection, delete it:\n")
+		fmt.Printf("  aws rekognition delete-collection --collection-id <old collection>\n")
+		return nil
+	}
+
+	if *target == current {
+		return fmt.Errorf("%s is the current collection; rebuild into a new one", current)
+	}
+	version, err := p.ensureCollection(*target)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Staging %s for event %s in %s (face model %s)\n", current, *eventID, *target, version)
+	opts.Process = func(ctx context.Context, key string) backfillResult {
+		return p.stageRebuild(ctx, bucket, key, *target, version)
+	}
+	if err := p.backfill(context.Background(), opts); err != nil {
+		return err
+	}
+	fmt.Printf("\n%s, then run again with -switch\n", switchInstructions(*eventID, *target))
+	return nil
+}
+
+// switchInstructions says how to point an event at a collection
+func switchInstructions(eventID, collectionID string) string {
+	if eventID == event.Default {
+		return fmt.Sprintf("set FACE_COLLECTION_ID=%s (terraform variable face_collection_id) and deploy", collectionID)
+	}
+	return fmt.Sprintf("set the collectionId of event %s to %s (PUT /events/%s)", eventID, collectionID, eventID)
+}
+
+// stageRebuild indexes a photo into the new collection and crops the faces
+// found, storing them on its item as a FaceRebuild. Photos already staged
+// from the same upload are skipped, so an interrupted pass can be resumed.
+func (p *processor) stageRebuild(ctx context.Context, bucket, key, collectionID, faceModel string) backfillResult {
+	result := backfillResult{Key: key}
+	var stored *PhotoMetadata
+	err := withRetry(ctx, "read metadata for "+key, func() error {
+		items, err := metadataItems(p.dynamoClient, p.tableName, key)
+		stored = newestItem(items)
+		return err
+	})
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	// Uploads without a stored item are indexed by the switch
+	if stored == nil || stored.MediaType != "photo" {
+		return result
+	}
+	staged := stored.Rebuild
+	if staged != nil && staged.CollectionID == collectionID && staged.Sequencer == stored.Sequencer {
+		return result
+	}
+	// Faces staged from an earlier version of the upload are replaced once
+	// the new ones are stored
+	var replaced []FaceDetail
+	if staged != nil && staged.CollectionID == collectionID {
+		replaced = staged.Faces
+	}
+
+	rebuild := FaceRebuild{CollectionID: collectionID, FaceModel: faceModel, Sequencer: stored.Sequencer}
+	err = withRetry(ctx, "index faces for "+key, func() error {
+		var err error
+		rebuild.Faces, _, err = indexFaces(p.rekognitionClient, bucket, key, collectionID, replaced)
+		return err
+	})
+	if err != nil {
+		result.Err = fmt.Errorf("index faces: %w", err)
+		return result
+	}
+
+	err = withRetry(ctx, "face crops for "+key, func() error {
+		photo := *stored
+		photo.Faces = rebuild.Faces
+		return p.generateFaceCrops(bucket, key, &photo)
+	})
+	if err == nil {
+		err = withRetry(ctx, "stage faces for "+key, func() error {
+			return p.storeRebuild(stored, rebuild)
+		})
+	}
+	if isConditionFailed(err) {
+		// Reprocessed while staging; the switch indexes it again
+		if err := p.discardFaces(bucket, collectionID, rebuild.Faces); err != nil {
+			result.Err = fmt.Errorf("discard staged faces: %w", err)
+		}
+		return result
+	}
+	if err != nil {
+		if err := p.discardFaces(bucket, collectionID, rebuild.Faces); err != nil {
+			log.Printf("Error discarding faces staged for %s: %v", key, err)
+		}
+		result.Err = err
+		return result
+	}
+	if err := p.discardFaces(bucket, collectionID, replaced); err != nil {
+		log.Printf("Error deleting replaced staged faces for %s: %v", key, err)
+	}
+	result.Changed = []string{"rebuild"}
+	return result
+}
+
+// storeRebuild records staged faces on the item they were indexed for. It
+// fails the condition if the upload has been replaced since the item was read.
+func (p *processor) storeRebuild(stored *PhotoMetadata, rebuild FaceRebuild) error {
+	value, err := dynamodbattribute.Marshal(rebuild)
+	if err != nil {
+		return err
+	}
+	condition, values := sameUpload(stored)
+	values[":rebuild"] = value
+	_, err = p.dynamoClient.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:                 aws.String(p.tableName),
+		Key:                       itemKey(stored),
+		UpdateExpression:          aws.String("SET rebuild = :rebuild"),
+		ConditionExpression:       aws.String(condition),
+		ExpressionAttributeNames:  map[string]*string{"#sequencer": aws.String("sequencer")},
+		ExpressionAttributeValues: values,
+	})
+	return err
+}
+
+// switchRebuild gives a photo the faces staged for it in the event's new
+// collection. The staged faces join the people the photo's current faces are
+// in, or are clustered like new faces, before the item points at them; the
+// old faces then leave their people. Photos without staged faces, e.g.
+// uploaded during the rebuild, are reindexed into the new collection.
+func (p *processor) switchRebuild(ctx context.Context, bucket, key, collectionID string) backfillResult {
+	result := backfillResult{Key: key}
+	var stored *PhotoMetadata
+	err := withRetry(ctx, "read metadata for "+key, func() error {
+		items, err := metadataItems(p.dynamoClient, p.tableName, key)
+		stored = newestItem(items)
+		return err
+	})
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	if stored == nil {
+		return result
+	}
+	staged := stored.Rebuild
+	if staged == nil || staged.CollectionID != collectionID || staged.Sequencer != stored.Sequencer {
+		if stored.MediaType != "photo" {
+			return result
+		}
+		return p.backfillOne(ctx, bucket, key, stageSet{stageFaces: true}, false)
+	}
+
+	oldIDs := make([]string, len(stored.Faces))
+	for i, face := range stored.Faces {
+		oldIDs[i] = face.FaceID
+	}
+	var current []FaceAssignment
+	err = withRetry(ctx, "read face assignments for "+key, func() error {
+		var err error
+		current, err = p.faceAssignments(oldIDs)
+		return err
+	})
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	faces := slices.Clone(staged.Faces)
+	if err := p.assignPeople(ctx, key, faces, inheritPeople(stored.Faces, current, faces)); err != nil {
+		result.Err = fmt.Errorf("people: %w", err)
+		return result
+	}
+
+	err = withRetry(ctx, "switch faces for "+key, func() error {
+		return p.switchFaces(stored, faces, staged.FaceModel)
+	})
+	if isConditionFailed(err) {
+		// Reprocessed meanwhile, which indexed it into the new collection again
+		if err := p.discardFaces(bucket, collectionID, faces); err != nil {
+			result.Err = fmt.Errorf("discard staged faces: %w", err)
+		}
+		return result
+	}
+	if err != nil {
+		result.Err = fmt.Errorf("switch faces: %w", err)
+		return result
+	}
+
+	// The photo stays with the people who have one of its new faces
+	keep := make(map[string]bool)
+	for _, face := range faces {
+		keep[face.PersonID] = true
+	}
+	err = withRetry(ctx, "unassign replaced faces for "+key, func() error {
+		_, err := p.unassignKeeping(current, keep)
+		return err
+	})
+	if err == nil {
+		err = deleteFaceCrops(p.s3Client, bucket, stored.Faces)
+	}
+	if err != nil {
+		result.Err = fmt.Errorf("drop replaced faces: %w", err)
+		return result
+	}
+	result.Changed = []string{"faces"}
+	return result
+}
+
+// switchFaces replaces an item's faces with its staged ones, provided they
+// are still staged for the same upload
+func (p *processor) switchFaces(stored *PhotoMetadata, faces []FaceDetail, faceModel string) error {
+	condition, values := sameUpload(stored)
+	condition += " AND rebuild.collectionId = :collectionId"
+	values[":collectionId"] = &dynamodb.AttributeValue{S: aws.String(stored.Rebuild.CollectionID)}
+	values[":faceCount"] = &dynamodb.AttributeValue{N: aws.String(strconv.Itoa(len(faces)))}
+	values[":faceModel"] = &dynamodb.AttributeValue{S: aws.String(faceModel)}
+	sets, removes := "faceCount = :faceCount, faceModelVersion = :faceModel", "rebuild"
+	if len(faces) > 0 {
+		value, err := dynamodbattribute.Marshal(faces)
+		if err != nil {
+			return err
+		}
+		values[":faces"] = value
+		sets = "faces = :faces, " + sets
+	} else {
+		removes += ", faces"
+	}
+	expression := "SET " + sets + " REMOVE " + removes
+	_, err := p.dynamoClient.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:                 aws.String(p.tableName),
+		Key:                       itemKey(stored),
+		UpdateExpression:          aws.String(expression),
+		ConditionExpression:       aws.String(condition),
+		ExpressionAttributeNames:  map[string]*string{"#sequencer": aws.String("sequencer")},
+		ExpressionAttributeValues: values,
+	})
+	return err
+}
+
+// sameUpload is a condition that the item still holds the upload it was read
+// from, i.e. it exists and its sequencer hasn't changed. It refers to
+// sequencer as #sequencer.
+func sameUpload(stored *PhotoMetadata) (string, map[string]*dynamodb.AttributeValue) {
+	if stored.Sequencer == "" {
+		return "attribute_exists(photoId) AND attribute_not_exists(#sequencer)", map[string]*dynamodb.AttributeValue{}
+	}
+	return "#sequencer = :sequencer", map[string]*dynamodb.AttributeValue{
+		":sequencer": {S: aws.String(stored.Sequencer)},
+	}
+}
+
+// itemKey is the key of a stored metadata item
+func itemKey(item *PhotoMetadata) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"photoId":    {S: aws.String(item.PhotoID)},
+		"uploadedAt": {N: aws.String(strconv.FormatInt(item.UploadedAt, 10))},
+	}
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"fmt"
+)
+
+// runCommand dispatches the maintenance commands, run from a workstation as
+// `go run ./lambda-metadata <command>` with the same environment variables
+// as the deployed function
+func runCommand(args []string) error {
+	switch args[0] {
+	case "failures":
+		return runFailuresCommand(args[1:])
+	case "backfill":
+		return runBackfillCommand(args[1:])
+	case "migrate":
+		return runMigrateCommand(args[1:])
+	case "rebuild-collection":
+		return runRebuildCollectionCommand(args[1:])
+	default:
+		return fmt.Errorf("unknown command %q (available: failures, backfill, migrate, rebuild-collection)", args[0])
+	}
+}
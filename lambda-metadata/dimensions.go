@@ -0,0 +1,51 @@
+package main
+
+import (
+	"image"
+	"io"
+	"log"
+
+	"github.com/Andrew-Wichmann/wedding-photos-app/internal/imaging"
+)
+
+// readImageDimensions reads the stored pixel size from the image header.
+// PixelXDimension/PixelYDimension are missing from many PNGs and WebPs and
+// go stale when a JPEG is cropped, so the decoded size takes precedence and
+// EXIF is only kept for formats Go can't decode (e.g. HEIC). The JPEG, PNG,
+// GIF and WebP decoders are registered by the imaging package.
+func readImageDimensions(f objectReader, metadata *PhotoMetadata) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		log.Printf("Error rewinding for dimensions: %v", err)
+		return
+	}
+	config, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return
+	}
+	metadata.Width = config.Width
+	metadata.Height = config.Height
+}
+
+// decodableImage reports whether the image package can decode the object
+// within imaging.MaxPixels, i.e. whether renditions can be generated from it. The header has already
+// been fetched by readImageDimensions, so this doesn't hit S3 again.
+func decodableImage(f objectReader) bool {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return false
+	}
+	config, _, err := image.DecodeConfig(f)
+	return err == nil && imaging.CheckSize(config) == nil
+}
+
+// setDisplayDimensions stores the size the photo or video is shown at once
+// its EXIF orientation or track rotation is applied
+func setDisplayDimensions(metadata *PhotoMetadata) {
+	if metadata.Width == 0 || metadata.Height == 0 {
+		return
+	}
+	metadata.DisplayWidth = metadata.Width
+	metadata.DisplayHeight = metadata.Height
+	if imaging.SwapsAxes(metadata.Orientation) || metadata.Rotation == 90 || metadata.Rotation == 270 {
+		metadata.DisplayWidth, metadata.DisplayHeight = metadata.Height, metadata.Width
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"os"
+	"sync"
+
+	"github.com/Andrew-Wichmann/wedding-photos-app/internal/event"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// The settings lookup happens deep in metadata parsing, away from the
+// processor's clients, so it keeps its own
+var eventsClient = sync.OnceValue(func() *dynamodb.DynamoDB {
+	return dynamodb.New(session.Must(session.NewSession()))
+})
+
+// eventSettings returns the settings of the event an upload belongs to. An
+// event missing from the table, or a failed lookup, gets the deployment
+// defaults so the upload is still processed.
+func eventSettings(eventID string) *event.Settings {
+	return event.LoadOrDefault(eventsClient(), os.Getenv("EVENTS_TABLE"), eventID)
+}
+
+// collectionFor is the face collection an event's photos are indexed into
+func (p *processor) collectionFor(eventID string) string {
+	return eventSettings(eventID).Collection(p.collectionID)
+}
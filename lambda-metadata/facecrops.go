@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"log"
+	"math"
+
+	"github.com/Andrew-Wichmann/wedding-photos-app/internal/imaging"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	// Crops are square thumbnails for avatars and the people directory
+	faceCropSize    = 256
+	faceCropQuality = 85
+	// Margin added on each side of the face, as a fraction of its longer edge,
+	// so crops show some hair and chin rather than just the detected box
+	faceCropPadding = 0.3
+)
+
+// faceCropKey is where the crop of an indexed face is stored, e.g.
+// faces/0f3c2a1e-....jpg. Face IDs are unique across the collection.
+func faceCropKey(faceID string) string {
+	return "faces/" + faceID + ".jpg"
+}
+
+// faceCropSource decodes the upright image the crops are cut from. The large
+// rendition is already oriented and far smaller than most originals; without
+// one the original is decoded and oriented the same way.
+func (p *processor) faceCropSource(bucket, key string, metadata *PhotoMetadata) (image.Image, error) {
+	sourceKey := key
+	if large, ok := metadata.Renditions["large"]; ok {
+		sourceKey = large.Key
+	}
+	result, err := p.s3Client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(sourceKey),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer result.Body.Close()
+
+	body := &readErrorTracker{r: result.Body}
+	src, _, err := image.Decode(body)
+	if err != nil {
+		if body.err != nil {
+			// The download dropped rather than the image being corrupt
+			return nil, transient(fmt.Errorf("%w (read error: %v)", err, body.err))
+		}
+		return nil, err
+	}
+	if sourceKey != key {
+		return src, nil
+	}
+	// Rekognition reports bounding boxes for the image after EXIF orientation
+	largest := renditionSpecs[0].MaxEdge
+	return imaging.ApplyOrientation(imaging.Resize(src, largest), metadata.Orientation), nil
+}
+
+// faceCropRect turns a relative bounding box into a padded square in pixel
+// coordinates, shifted to stay inside the image and shrunk only if the image
+// is smaller than the square
+func faceCropRect(box BoundingBox, bounds image.Rectangle) image.Rectangle {
+	w, h := float64(bounds.Dx()), float64(bounds.Dy())
+	faceW, faceH := box.Width*w, box.Height*h
+	centerX := (box.Left + box.Width/2) * w
+	centerY := (box.Top + box.Height/2) * h
+
+	side := math.Max(faceW, faceH) * (1 + 2*faceCropPadding)
+	side = math.Min(side, math.Min(w, h))
+	left := math.Max(0, math.Min(centerX-side/2, w-side))
+	top := math.Max(0, math.Min(centerY-side/2, h-side))
+
+	rect := image.Rect(int(left), int(top), int(left+side), int(top+side))
+	return rect.Add(bounds.Min).Intersect(bounds)
+}
+
+// generateFaceCrops writes a square crop for each face and records its key
+// on the face. A face whose box falls outside the image is left without one.
+func (p *processor) generateFaceCrops(bucket, key string, metadata *PhotoMetadata) error {
+	src, err := p.faceCropSource(bucket, key, metadata)
+	if err != nil {
+		return err
+	}
+	subImager, ok := src.(interface {
+		SubImage(image.Rectangle) image.Image
+	})
+	if !ok {
+		return fmt.Errorf("cannot crop %T images", src)
+	}
+
+	written := 0
+	for i := range metadata.Faces {
+		face := &metadata.Faces[i]
+		rect := faceCropRect(face.BoundingBox, src.Bounds())
+		if rect.Empty() {
+			face.CropKey = ""
+			continue
+		}
+		crop := imaging.Fit(subImager.SubImage(rect), faceCropSize, faceCropSize, true)
+
+		data, err := imaging.EncodeJPEG(crop, faceCropQuality)
+		if err != nil {
+			return fmt.Errorf("failed to encode crop of face %s: %w", face.FaceID, err)
+		}
+		cropKey := faceCropKey(face.FaceID)
+		_, err = p.s3Client.PutObject(&s3.PutObjectInput{
+			Bucket:       aws.String(bucket),
+			Key:          aws.String(cropKey),
+			Body:         bytes.NewReader(data),
+			ContentType:  aws.String("image/jpeg"),
+			CacheControl: aws.String("public, max-age=31536000, immutable"),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to upload crop of face %s: %w", face.FaceID, err)
+		}
+		face.CropKey = cropKey
+		written++
+	}
+
+	log.Printf("Wrote %d face crops for %s", written, key)
+	return nil
+}
+
+// deleteFaceCrops removes the crops of faces that are no longer indexed.
+// Deleting a missing key succeeds.
+func deleteFaceCrops(client *s3.S3, bucket string, faces []FaceDetail) error {
+	for _, face := range faces {
+		if _, err := client.DeleteObject(&s3.DeleteObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(faceCropKey(face.FaceID)),
+		}); err != nil {
+			return fmt.Errorf("failed to delete crop of face %s: %w", face.FaceID, err)
+		}
+	}
+	return nil
+}
+
+// hasFaceCrops reports whether every face already has a crop
+func hasFaceCrops(faces []FaceDetail) bool {
+	for _, face := range faces {
+		if face.CropKey == "" {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// Failure is an object the lambda gave up on, kept until a replay succeeds
+type Failure struct {
+	PhotoID       string `json:"photoId"`
+	Bucket        string `json:"bucket"`
+	EventName     string `json:"eventName"`
+	Reason        string `json:"reason"`
+	Retryable     bool   `json:"retryable"`
+	Attempts      int    `json:"attempts"`
+	FirstFailedAt int64  `json:"firstFailedAt"`
+	LastFailedAt  int64  `json:"lastFailedAt"`
+}
+
+// recordFailure upserts the failure for a key, counting attempts across
+// redeliveries, and marks the photo failed. Errors here are only logged
+// since the event is failing anyway.
+func (p *processor) recordFailure(record events.S3EventRecord, cause error) {
+	p.finishStatus(record.S3.Object.URLDecodedKey, statusFailed, cause)
+	if p.failuresTable == "" {
+		log.Printf("FAILURES_TABLE not set, not recording failure for %s", record.S3.Object.URLDecodedKey)
+		return
+	}
+
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	_, err := p.dynamoClient.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName: aws.String(p.failuresTable),
+		Key: map[string]*dynamodb.AttributeValue{
+			"photoId": {S: aws.String(record.S3.Object.URLDecodedKey)},
+		},
+		UpdateExpression: aws.String("SET #bucket = :bucket, eventName = :eventName, reason = :reason, " +
+			"retryable = :retryable, lastFailedAt = :now, firstFailedAt = if_not_exists(firstFailedAt, :now) " +
+			"ADD attempts :one"),
+		ExpressionAttributeNames: map[string]*string{"#bucket": aws.String("bucket")},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":bucket":    {S: aws.String(record.S3.Bucket.Name)},
+			":eventName": {S: aws.String(record.EventName)},
+			":reason":    {S: aws.String(cause.Error())},
+			":retryable": {BOOL: aws.Bool(isRetryable(cause))},
+			":now":       {N: aws.String(now)},
+			":one":       {N: aws.String("1")},
+		},
+	})
+	if err != nil {
+		log.Printf("Error recording failure for %s: %v", record.S3.Object.URLDecodedKey, err)
+	}
+}
+
+// clearFailure drops the failure record once a key has been processed
+func (p *processor) clearFailure(key string) {
+	if p.failuresTable == "" {
+		return
+	}
+	_, err := p.dynamoClient.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName: aws.String(p.failuresTable),
+		Key: map[string]*dynamodb.AttributeValue{
+			"photoId": {S: aws.String(key)},
+		},
+	})
+	if err != nil {
+		log.Printf("Error clearing failure for %s: %v", key, err)
+	}
+}
+
+func (p *processor) listFailures() ([]Failure, error) {
+	if p.failuresTable == "" {
+		return nil, fmt.Errorf("FAILURES_TABLE is not set")
+	}
+
+	var failures []Failure
+	err := p.dynamoClient.ScanPages(&dynamodb.ScanInput{
+		TableName: aws.String(p.failuresTable),
+	}, func(page *dynamodb.ScanOutput, lastPage bool) bool {
+		var pageFailures []Failure
+		if err := dynamodbattribute.UnmarshalListOfMaps(page.Items, &pageFailures); err == nil {
+			failures = append(failures, pageFailures...)
+		}
+		return true
+	})
+	sort.Slice(failures, func(i, j int) bool { return failures[i].LastFailedAt < failures[j].LastFailedAt })
+	return failures, err
+}
+
+// replayFailure reprocesses a recorded failure, reading the object's current
+// state rather than trusting the stored event
+func (p *processor) replayFailure(ctx context.Context, failure Failure) error {
+	head, err := p.s3Client.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(failure.Bucket),
+		Key:    aws.String(failure.PhotoID),
+	})
+	var reqErr awserr.RequestFailure
+	missing := errors.As(err, &reqErr) && reqErr.StatusCode() == 404
+	if err != nil && !missing {
+		return fmt.Errorf("failed to check object: %w", err)
+	}
+
+	// Whatever the failed event was, the object's current state decides
+	// whether to process or remove it
+	record := events.S3EventRecord{EventName: "ObjectCreated:Replay"}
+	record.S3.Bucket.Name = failure.Bucket
+	record.S3.Object.URLDecodedKey = failure.PhotoID
+	if missing {
+		record.EventName = "ObjectRemoved:Replay"
+	} else {
+		record.S3.Object.Size = aws.Int64Value(head.ContentLength)
+	}
+	return p.processRecord(ctx, record)
+}
+
+// Lambda's on-failure destination wraps the original event
+type asyncFailureMessage struct {
+	RequestPayload events.S3Event `json:"requestPayload"`
+}
+
+// drainDeadLetterQueue reprocesses events Lambda gave up on, e.g. after
+// timeouts. Records that fail again are added to the failures table, so
+// each message is deleted once handled. Messages that can't be read are
+// logged and deleted.
+func (p *processor) drainDeadLetterQueue(ctx context.Context, queueURL string) (int, error) {
+	replayed := 0
+	for {
+		result, err := p.sqsClient.ReceiveMessage(&sqs.ReceiveMessageInput{
+			QueueUrl:            aws.String(queueURL),
+			MaxNumberOfMessages: aws.Int64(10),
+			WaitTimeSeconds:     aws.Int64(1),
+		})
+		if err != nil {
+			return replayed, fmt.Errorf("failed to receive from dead-letter queue: %w", err)
+		}
+		if len(result.Messages) == 0 {
+			return replayed, nil
+		}
+
+		for _, message := range result.Messages {
+			var payload asyncFailureMessage
+			if err := json.Unmarshal([]byte(aws.StringValue(message.Body)), &payload); err != nil {
+				// Receiving it again won't make it readable, so it is logged in
+				// full and dropped rather than redelivered on every drain
+				log.Printf("Dropping unreadable dead-letter message %s: %v: %s",
+					aws.StringValue(message.MessageId), err, aws.StringValue(message.Body))
+			}
+			for _, record := range payload.RequestPayload.Records {
+				if err := p.processRecord(ctx, record); err != nil {
+					log.Printf("Replay of %s failed: %v", record.S3.Object.URLDecodedKey, err)
+					p.recordFailure(record, err)
+					continue
+				}
+				p.clearFailure(record.S3.Object.URLDecodedKey)
+				replayed++
+			}
+			if _, err := p.sqsClient.DeleteMessage(&sqs.DeleteMessageInput{
+				QueueUrl:      aws.String(queueURL),
+				ReceiptHandle: message.ReceiptHandle,
+			}); err != nil {
+				return replayed, fmt.Errorf("failed to delete dead-letter message: %w", err)
+			}
+		}
+	}
+}
+
+// runFailuresCommand implements `failures list` and `failures replay [key...]`
+func runFailuresCommand(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: failures list | failures replay [key...]")
+	}
+	p := newProcessor()
+	ctx := context.Background()
+
+	switch args[0] {
+	case "list":
+		failures, err := p.listFailures()
+		if err != nil {
+			return err
+		}
+		for _, f := range failures {
+			fmt.Printf("%s\t%s\tattempts=%d\tretryable=%t\t%s\n",
+				time.Unix(f.LastFailedAt, 0).Format(time.RFC3339), f.PhotoID, f.Attempts, f.Retryable, f.Reason)
+		}
+		fmt.Printf("%d failures\n", len(failures))
+		return nil
+
+	case "replay":
+		if queueURL := os.Getenv("DEAD_LETTER_QUEUE_URL"); queueURL != "" {
+			replayed, err := p.drainDeadLetterQueue(ctx, queueURL)
+			fmt.Printf("Replayed %d records from the dead-letter queue\n", replayed)
+			if err != nil {
+				return err
+			}
+		}
+
+		failures, err := p.listFailures()
+		if err != nil {
+			return err
+		}
+		only := make(map[string]bool)
+		for _, key := range args[1:] {
+			only[key] = true
+		}
+
+		succeeded, failed := 0, 0
+		for _, f := range failures {
+			if len(only) > 0 && !only[f.PhotoID] {
+				continue
+			}
+			if err := p.replayFailure(ctx, f); err != nil {
+				log.Printf("Replay of %s failed: %v", f.PhotoID, err)
+				record := events.S3EventRecord{EventName: f.EventName}
+				record.S3.Bucket.Name = f.Bucket
+				record.S3.Object.URLDecodedKey = f.PhotoID
+				p.recordFailure(record, err)
+				failed++
+				continue
+			}
+			p.clearFailure(f.PhotoID)
+			succeeded++
+		}
+		fmt.Printf("Replayed %d failures, %d still failing\n", succeeded, failed)
+		return nil
+
+	default:
+		return fmt.Errorf("unknown failures command %q", args[0])
+	}
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// HEIC, HEIF and AVIF photos use the same box structure as MP4 and open with
+// the same ftyp box. The brands in that box say which one a file is.
+
+type fileKind int
+
+const (
+	kindUnknown fileKind = iota
+	kindVideo
+	kindStillImage
+)
+
+// Brands listed in ftyp boxes. Image sequences (bursts, animations) count as
+// still images: they have a primary image and no video track.
+var ftypBrandKinds = map[string]fileKind{
+	"qt  ": kindVideo, "mp41": kindVideo, "mp42": kindVideo, "mp71": kindVideo,
+	"mp4x": kindVideo, "avc1": kindVideo, "M4V ": kindVideo, "M4VH": kindVideo,
+	"M4VP": kindVideo, "f4v ": kindVideo, "mmp4": kindVideo, "MSNV": kindVideo,
+	"dash": kindVideo, "XAVC": kindVideo,
+	"heic": kindStillImage, "heix": kindStillImage, "heim": kindStillImage,
+	"heis": kindStillImage, "hevc": kindStillImage, "hevx": kindStillImage,
+	"hevm": kindStillImage, "hevs": kindStillImage, "mif1": kindStillImage,
+	"msf1": kindStillImage, "miaf": kindStillImage, "avif": kindStillImage,
+	"avis": kindStillImage,
+}
+
+func brandKind(brand string) fileKind {
+	if kind, ok := ftypBrandKinds[brand]; ok {
+		return kind
+	}
+	// isom, iso2-iso9, 3gp4-3gp6, 3g2a...
+	for _, prefix := range []string{"iso", "3gp", "3g2"} {
+		if strings.HasPrefix(brand, prefix) {
+			return kindVideo
+		}
+	}
+	return kindUnknown
+}
+
+// Upper bound on the ftyp box read; real ones list a handful of brands
+const maxFtypSize = 256
+
+// ftypKind classifies a file by the brands in its leading ftyp box. The major
+// brand decides when it is known, then the compatible brands. Files whose
+// brands are all unknown are assumed to be videos, as before brands were read.
+func ftypKind(r io.ReaderAt) (fileKind, bool) {
+	header := make([]byte, 8)
+	if _, err := r.ReadAt(header, 0); err != nil || string(header[4:8]) != "ftyp" {
+		return kindUnknown, false
+	}
+	size := int64(binary.BigEndian.Uint32(header[:4]))
+	if size < 16 {
+		return kindVideo, true
+	}
+	payload := make([]byte, min(size, maxFtypSize)-8)
+	n, err := r.ReadAt(payload, 8)
+	if err != nil && n < 4 {
+		return kindVideo, true
+	}
+	payload = payload[:n]
+
+	if kind := brandKind(string(payload[:4])); kind != kindUnknown {
+		return kind, true
+	}
+	// The minor version sits between the major and compatible brands
+	sawImage := false
+	for offset := 8; offset+4 <= len(payload); offset += 4 {
+		switch brandKind(string(payload[offset : offset+4])) {
+		case kindVideo:
+			return kindVideo, true
+		case kindStillImage:
+			sawImage = true
+		}
+	}
+	if sawImage {
+		return kindStillImage, true
+	}
+	return kindVideo, true
+}
+
+// isHEIF reports whether the file is a HEIF still image (HEIC, AVIF)
+func isHEIF(r io.ReaderAt) bool {
+	kind, ok := ftypKind(r)
+	return ok && kind == kindStillImage
+}
+
+// Upper bound on the meta box and Exif item reads. The meta box lists the
+// items and where they are, so it stays small even for tiled photos.
+const maxHEIFReadSize = 1 << 20
+
+var errNoHEIFExif = errors.New("no Exif item")
+
+// heifExif returns the TIFF-formatted EXIF data of a HEIF file. It is stored
+// as an item of type Exif, which the meta box's iinf box names and its iloc
+// box locates, prefixed with the offset of the TIFF header.
+func heifExif(r io.ReaderAt, size int64) ([]byte, error) {
+	top, err := readAtoms(r, 0, size)
+	if err != nil && len(top) == 0 {
+		return nil, err
+	}
+	meta, ok := findAtom(top, "meta")
+	if !ok {
+		return nil, fmt.Errorf("no meta box")
+	}
+	if meta.Size > maxHEIFReadSize {
+		return nil, fmt.Errorf("meta box of %d bytes is too large", meta.Size)
+	}
+	metaData, err := readAtomData(r, meta, meta.Size)
+	if err != nil {
+		return nil, err
+	}
+	// meta is a full box: version and flags come before its children
+	metaReader := bytes.NewReader(metaData)
+	children, err := readAtoms(metaReader, 4, int64(len(metaData))-4)
+	if err != nil && len(children) == 0 {
+		return nil, err
+	}
+
+	iinf, ok := findAtom(children, "iinf")
+	if !ok {
+		return nil, errNoHEIFExif
+	}
+	itemID, ok := findItemOfType(metaData[iinf.Offset:iinf.Offset+iinf.Size], "Exif")
+	if !ok {
+		return nil, errNoHEIFExif
+	}
+	iloc, ok := findAtom(children, "iloc")
+	if !ok {
+		return nil, fmt.Errorf("no iloc box")
+	}
+	loc, err := findItemLocation(metaData[iloc.Offset:iloc.Offset+iloc.Size], itemID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Construction method 1 addresses the meta box's own idat box
+	source, base := r, int64(0)
+	if loc.constructionMethod == 1 {
+		idat, ok := findAtom(children, "idat")
+		if !ok {
+			return nil, fmt.Errorf("no idat box")
+		}
+		source, base = metaReader, idat.Offset
+	} else if loc.constructionMethod != 0 {
+		return nil, fmt.Errorf("unsupported construction method %d", loc.constructionMethod)
+	}
+
+	var data []byte
+	for _, extent := range loc.extents {
+		if extent.length > maxHEIFReadSize || int64(len(data))+extent.length > maxHEIFReadSize {
+			return nil, fmt.Errorf("Exif item is too large")
+		}
+		chunk := make([]byte, extent.length)
+		if _, err := source.ReadAt(chunk, base+extent.offset); err != nil {
+			return nil, err
+		}
+		data = append(data, chunk...)
+	}
+	if len(data) < 4 {
+		return nil, fmt.Errorf("Exif item is truncated")
+	}
+	tiffOffset := 4 + int64(binary.BigEndian.Uint32(data[:4]))
+	if tiffOffset >= int64(len(data)) {
+		return nil, fmt.Errorf("Exif item is truncated")
+	}
+	return data[tiffOffset:], nil
+}
+
+// boxReader reads the big-endian fields of a box held in memory
+type boxReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (b *boxReader) uint(size int) uint64 {
+	if b.err != nil {
+		return 0
+	}
+	if size < 0 || b.pos+size > len(b.data) {
+		b.err = io.ErrUnexpectedEOF
+		return 0
+	}
+	var v uint64
+	for _, c := range b.data[b.pos : b.pos+size] {
+		v = v<<8 | uint64(c)
+	}
+	b.pos += size
+	return v
+}
+
+// findItemOfType looks through an iinf box's infe entries for an item type
+func findItemOfType(iinf []byte, itemType string) (uint32, bool) {
+	b := &boxReader{data: iinf}
+	version := b.uint(1)
+	b.uint(3) // flags
+	if version == 0 {
+		b.uint(2)
+	} else {
+		b.uint(4)
+	}
+	if b.err != nil {
+		return 0, false
+	}
+	entries, _ := readAtoms(bytes.NewReader(iinf), int64(b.pos), int64(len(iinf)-b.pos))
+	for _, entry := range entries {
+		if entry.Type != "infe" {
+			continue
+		}
+		e := &boxReader{data: iinf[entry.Offset : entry.Offset+entry.Size]}
+		infeVersion := e.uint(1)
+		e.uint(3) // flags
+		// Versions 0 and 1 predate item types
+		if infeVersion < 2 {
+			continue
+		}
+		var id uint64
+		if infeVersion == 2 {
+			id = e.uint(2)
+		} else {
+			id = e.uint(4)
+		}
+		e.uint(2) // protection index
+		typ := e.uint(4)
+		if e.err == nil && string([]byte{byte(typ >> 24), byte(typ >> 16), byte(typ >> 8), byte(typ)}) == itemType {
+			return uint32(id), true
+		}
+	}
+	return 0, false
+}
+
+type itemExtent struct {
+	offset int64
+	length int64
+}
+
+type itemLocation struct {
+	constructionMethod int
+	extents            []itemExtent
+}
+
+// findItemLocation reads an item's extents from an iloc box
+func findItemLocation(iloc []byte, itemID uint32) (itemLocation, error) {
+	b := &boxReader{data: iloc}
+	version := b.uint(1)
+	b.uint(3) // flags
+	sizes := b.uint(1)
+	offsetSize, lengthSize := int(sizes>>4), int(sizes&0xf)
+	sizes = b.uint(1)
+	baseOffsetSize, indexSize := int(sizes>>4), 0
+	if version == 1 || version == 2 {
+		indexSize = int(sizes & 0xf)
+	}
+	var count uint64
+	if version < 2 {
+		count = b.uint(2)
+	} else {
+		count = b.uint(4)
+	}
+
+	for i := uint64(0); i < count && b.err == nil; i++ {
+		var id uint64
+		if version < 2 {
+			id = b.uint(2)
+		} else {
+			id = b.uint(4)
+		}
+		var loc itemLocation
+		if version == 1 || version == 2 {
+			loc.constructionMethod = int(b.uint(2) & 0xf)
+		}
+		b.uint(2) // data reference index
+		base := int64(b.uint(baseOffsetSize))
+		extents := b.uint(2)
+		for j := uint64(0); j < extents && b.err == nil; j++ {
+			b.uint(indexSize)
+			offset := int64(b.uint(offsetSize))
+			length := int64(b.uint(lengthSize))
+			loc.extents = append(loc.extents, itemExtent{offset: base + offset, length: length})
+		}
+		if uint32(id) == itemID && b.err == nil {
+			return loc, nil
+		}
+	}
+	if b.err != nil {
+		return itemLocation{}, fmt.Errorf("malformed iloc box: %w", b.err)
+	}
+	return itemLocation{}, fmt.Errorf("no location for item %d", itemID)
+}
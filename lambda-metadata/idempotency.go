@@ -0,0 +1,310 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Andrew-Wichmann/wedding-photos-app/internal/schema"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/rekognition"
+)
+
+// errStaleEvent is returned when a newer event for the same key has already
+// been written, e.g. an old notification redelivered after an overwrite
+var errStaleEvent = errors.New("a newer event for this object has already been processed")
+
+// S3 sequencers are hex strings of varying length that compare correctly
+// once right-padded, so they are stored padded to compare in DynamoDB
+const sequencerLength = 32
+
+func normalizeSequencer(sequencer string) string {
+	if sequencer == "" || len(sequencer) >= sequencerLength {
+		return strings.ToUpper(sequencer)
+	}
+	return strings.ToUpper(sequencer) + strings.Repeat("0", sequencerLength-len(sequencer))
+}
+
+// uploadedAtFor derives the table's range key from the object rather than
+// the processing time, so every delivery of an event for the same upload
+// addresses the same item. Keys written by the app carry the upload time;
+// anything else falls back to the object's LastModified.
+func uploadedAtFor(key string, lastModified time.Time) int64 {
+	if t, ok := uploadTime(key); ok {
+		return t.Unix()
+	}
+	if !lastModified.IsZero() {
+		return lastModified.Unix()
+	}
+	return 0
+}
+
+// appAttributes are kept on the item by the app as guests like and comment
+// on the photo. putMetadata never writes them, so they survive reprocessing.
+var appAttributes = map[string]bool{"likeCount": true, "commentCount": true}
+
+// metadataAttributes are the attribute names of PhotoMetadata's fields
+var metadataAttributes = func() []string {
+	var names []string
+	t := reflect.TypeFor[PhotoMetadata]()
+	for i := 0; i < t.NumField(); i++ {
+		if !t.Field(i).IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		names = append(names, name)
+	}
+	return names
+}()
+
+// putMetadata writes the item unless the table already holds one from a
+// later event for the same object. Redelivery of the same event writes
+// identical data. The item is updated rather than replaced: attributes the
+// metadata no longer has are removed, and the app's attributes are left alone.
+func putMetadata(client *dynamodb.DynamoDB, tableName string, metadata PhotoMetadata) error {
+	metadata.SchemaVersion = schema.CurrentVersion
+	av, err := dynamodbattribute.MarshalMap(metadata)
+	if err != nil {
+		return fmt.Errorf("failed to marshal metadata: %w", err)
+	}
+
+	key := map[string]*dynamodb.AttributeValue{"photoId": av["photoId"], "uploadedAt": av["uploadedAt"]}
+	set := make(map[string]*dynamodb.AttributeValue)
+	var remove []string
+	for _, name := range metadataAttributes {
+		if key[name] != nil || appAttributes[name] {
+			continue
+		}
+		if value, ok := av[name]; ok {
+			set[name] = value
+		} else {
+			remove = append(remove, name)
+		}
+	}
+	input := updateItemInput(tableName, key, set, remove)
+	// Without a sequencer (manual reprocessing) the latest write wins
+	if metadata.Sequencer != "" {
+		input.ConditionExpression = aws.String("attribute_not_exists(photoId) OR attribute_not_exists(#sequencer) OR #sequencer <= :sequencer")
+		input.ExpressionAttributeNames["#sequencer"] = aws.String("sequencer")
+		if input.ExpressionAttributeValues == nil {
+			input.ExpressionAttributeValues = make(map[string]*dynamodb.AttributeValue)
+		}
+		input.ExpressionAttributeValues[":sequencer"] = &dynamodb.AttributeValue{S: aws.String(metadata.Sequencer)}
+	}
+
+	_, err = client.UpdateItem(input)
+	if isConditionFailed(err) {
+		return errStaleEvent
+	}
+	return err
+}
+
+// updateItemInput builds an update that sets the given attributes and
+// removes the named ones, leaving the rest of the item alone. Names and
+// values are placeholders (#a0, :a0...), so any attribute name is allowed.
+func updateItemInput(tableName string, key, set map[string]*dynamodb.AttributeValue, remove []string) *dynamodb.UpdateItemInput {
+	input := &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(tableName),
+		Key:                       key,
+		ExpressionAttributeNames:  make(map[string]*string),
+		ExpressionAttributeValues: make(map[string]*dynamodb.AttributeValue),
+	}
+	names := make([]string, 0, len(set))
+	for name := range set {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var sets, removes []string
+	for i, name := range names {
+		placeholder := fmt.Sprintf("a%d", i)
+		input.ExpressionAttributeNames["#"+placeholder] = aws.String(name)
+		input.ExpressionAttributeValues[":"+placeholder] = set[name]
+		sets = append(sets, fmt.Sprintf("#%s = :%s", placeholder, placeholder))
+	}
+	for i, name := range remove {
+		placeholder := fmt.Sprintf("#r%d", i)
+		input.ExpressionAttributeNames[placeholder] = aws.String(name)
+		removes = append(removes, placeholder)
+	}
+
+	var expression []string
+	if len(sets) > 0 {
+		expression = append(expression, "SET "+strings.Join(sets, ", "))
+	}
+	if len(removes) > 0 {
+		expression = append(expression, "REMOVE "+strings.Join(removes, ", "))
+	}
+	input.UpdateExpression = aws.String(strings.Join(expression, " "))
+	if len(input.ExpressionAttributeValues) == 0 {
+		input.ExpressionAttributeValues = nil
+	}
+	return input
+}
+
+func isConditionFailed(err error) bool {
+	var aerr awserr.Error
+	return errors.As(err, &aerr) && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException
+}
+
+// existingMetadata loads the item a previous run wrote for this photo, if any
+func existingMetadata(client *dynamodb.DynamoDB, tableName, photoID string, uploadedAt int64) (*PhotoMetadata, error) {
+	result, err := client.GetItem(&dynamodb.GetItemInput{
+		TableName:      aws.String(tableName),
+		ConsistentRead: aws.Bool(true),
+		Key: map[string]*dynamodb.AttributeValue{
+			"photoId":    {S: aws.String(photoID)},
+			"uploadedAt": {N: aws.String(fmt.Sprint(uploadedAt))},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Item) == 0 {
+		return nil, nil
+	}
+	upgradeItem(result.Item)
+	var metadata PhotoMetadata
+	if err := dynamodbattribute.UnmarshalMap(result.Item, &metadata); err != nil {
+		return nil, err
+	}
+	return &metadata, nil
+}
+
+// metadataItems loads every item stored for a photo. There is normally one,
+// but items written before uploadedAt was derived from the key can repeat.
+func metadataItems(client *dynamodb.DynamoDB, tableName, photoID string) ([]PhotoMetadata, error) {
+	var items []PhotoMetadata
+	err := client.QueryPages(&dynamodb.QueryInput{
+		TableName:                 aws.String(tableName),
+		KeyConditionExpression:    aws.String("photoId = :photoId"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":photoId": {S: aws.String(photoID)}},
+		ConsistentRead:            aws.Bool(true),
+	}, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			upgradeItem(item)
+			var metadata PhotoMetadata
+			if err := dynamodbattribute.UnmarshalMap(item, &metadata); err != nil {
+				log.Printf("Skipping unreadable metadata item %s at %s: %v", photoID, aws.StringValue(item["uploadedAt"].N), err)
+				continue
+			}
+			items = append(items, metadata)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up metadata: %w", err)
+	}
+	return items, nil
+}
+
+// externalImageID tags indexed faces with the photo they came from. Rekognition
+// only allows [a-zA-Z0-9_.\-:], so other characters are replaced and a hash
+// of the full key keeps the ID unique.
+func externalImageID(key string) string {
+	cleaned := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == '.', r == '-', r == ':':
+			return r
+		}
+		return '_'
+	}, key)
+	if len(cleaned) > 200 {
+		cleaned = cleaned[:200]
+	}
+	sum := sha256.Sum256([]byte(key))
+	return cleaned + ":" + hex.EncodeToString(sum[:8])
+}
+
+// deleteFaces removes faces from the collection by ID. Faces that are
+// already gone are skipped, so it can be repeated.
+func deleteFaces(client *rekognition.Rekognition, collectionID string, faces []FaceDetail) error {
+	var faceIDs []*string
+	for _, face := range faces {
+		faceIDs = append(faceIDs, aws.String(face.FaceID))
+	}
+	// DeleteFaces accepts at most 4096 IDs per call
+	for start := 0; start < len(faceIDs); start += 4096 {
+		end := min(start+4096, len(faceIDs))
+		_, err := client.DeleteFaces(&rekognition.DeleteFacesInput{
+			CollectionId: aws.String(collectionID),
+			FaceIds:      faceIDs[start:end],
+		})
+		if err != nil && !isNotFound(err) {
+			return fmt.Errorf("failed to delete faces: %w", err)
+		}
+	}
+	return nil
+}
+
+// deleteStrayFaces removes faces tagged with a photo's external ID that its
+// item doesn't point at. A run that indexed the photo and then stopped before
+// storing the item leaves these behind, and the next run would otherwise add
+// the same faces again.
+func deleteStrayFaces(client *rekognition.Rekognition, collectionID, externalID string, stored []FaceDetail) error {
+	known := make(map[string]bool, len(stored))
+	for _, face := range stored {
+		known[face.FaceID] = true
+	}
+	var stray []FaceDetail
+	err := client.ListFacesPages(&rekognition.ListFacesInput{
+		CollectionId: aws.String(collectionID),
+		MaxResults:   aws.Int64(4096),
+	}, func(page *rekognition.ListFacesOutput, lastPage bool) bool {
+		for _, face := range page.Faces {
+			id := aws.StringValue(face.FaceId)
+			if aws.StringValue(face.ExternalImageId) == externalID && !known[id] {
+				stray = append(stray, FaceDetail{FaceID: id})
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return fmt.Errorf("failed to list faces: %w", err)
+	}
+	if len(stray) > 0 {
+		log.Printf("Removing %d faces left by an unfinished run for %s", len(stray), externalID)
+	}
+	return deleteFaces(client, collectionID, stray)
+}
+
+// discardReplaced deletes the faces, face crops and renditions that
+// reprocessing replaced, once the stored item points at the new ones. Until
+// then a failed run leaves the photo's old ones working.
+func (p *processor) discardReplaced(bucket string, metadata PhotoMetadata) {
+	if err := p.discardFaces(bucket, p.collectionFor(metadata.EventID), metadata.replacedFaces); err != nil {
+		log.Printf("Error deleting replaced faces for %s: %v", metadata.PhotoID, err)
+	}
+	if err := deleteRenditions(p.s3Client, bucket, metadata.replacedRenditions); err != nil {
+		log.Printf("Error deleting replaced renditions for %s: %v", metadata.PhotoID, err)
+	}
+}
+
+// discardFaces undoes indexing faces that won't be stored: their people,
+// crops and collection entries go. Other faces of the photo are untouched,
+// so a newer event's faces survive a stale one's cleanup.
+func (p *processor) discardFaces(bucket, collectionID string, faces []FaceDetail) error {
+	if len(faces) == 0 {
+		return nil
+	}
+	var faceIDs []string
+	for _, face := range faces {
+		faceIDs = append(faceIDs, face.FaceID)
+	}
+	if err := p.unassignFaces(faceIDs); err != nil {
+		return err
+	}
+	if err := deleteFaceCrops(p.s3Client, bucket, faces); err != nil {
+		return err
+	}
+	return deleteFaces(p.rekognitionClient, collectionID, faces)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+)
+
+// IPTC-IIM record 2 (application record) datasets
+const (
+	iptcObjectName = 5
+	iptcKeywords   = 25
+	iptcByline     = 80
+	iptcCity       = 90
+	iptcCountry    = 101
+	iptcCopyright  = 116
+	iptcCaption    = 120
+)
+
+type IPTCData struct {
+	Title     string
+	Keywords  []string
+	Caption   string
+	Byline    string
+	Copyright string
+	City      string
+	Country   string
+}
+
+// findJPEGSegment returns the payload of the first APPn segment with the
+// given marker whose payload starts with prefix
+func findJPEGSegment(data []byte, marker byte, prefix []byte) []byte {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil
+	}
+
+	for pos := 2; pos+4 <= len(data); {
+		if data[pos] != 0xFF {
+			return nil
+		}
+		m := data[pos+1]
+		if m == 0xDA { // start of scan, no more metadata segments
+			return nil
+		}
+		length := int(binary.BigEndian.Uint16(data[pos+2 : pos+4]))
+		if length < 2 || pos+2+length > len(data) {
+			return nil
+		}
+		payload := data[pos+4 : pos+2+length]
+		if m == marker && bytes.HasPrefix(payload, prefix) {
+			return payload[len(prefix):]
+		}
+		pos += 2 + length
+	}
+
+	return nil
+}
+
+// findIPTC extracts the IPTC-NAA block from a JPEG's Photoshop APP13
+// segment, where it is stored as image resource 0x0404
+func findIPTC(data []byte) []byte {
+	resources := findJPEGSegment(data, 0xED, []byte("Photoshop 3.0\x00"))
+
+	for pos := 0; pos+8 <= len(resources); {
+		if string(resources[pos:pos+4]) != "8BIM" {
+			return nil
+		}
+		id := binary.BigEndian.Uint16(resources[pos+4 : pos+6])
+
+		// Pascal string name, padded so length byte + name is even
+		nameLen := int(resources[pos+6])
+		pos += 6 + 1 + nameLen
+		if (1+nameLen)%2 != 0 {
+			pos++
+		}
+		if pos+4 > len(resources) {
+			return nil
+		}
+		size := int(binary.BigEndian.Uint32(resources[pos : pos+4]))
+		pos += 4
+		if size < 0 || pos+size > len(resources) {
+			return nil
+		}
+		if id == 0x0404 {
+			return resources[pos : pos+size]
+		}
+		pos += size + size%2
+	}
+
+	return nil
+}
+
+func parseIPTC(block []byte) *IPTCData {
+	data := &IPTCData{}
+
+	for pos := 0; pos+5 <= len(block); {
+		if block[pos] != 0x1C {
+			break
+		}
+		record, dataset := block[pos+1], block[pos+2]
+		size := int(binary.BigEndian.Uint16(block[pos+3 : pos+5]))
+		pos += 5
+		// Extended (>32KB) datasets set the high bit; none of the fields we read use them
+		if size&0x8000 != 0 || pos+size > len(block) {
+			break
+		}
+		value := strings.TrimSpace(strings.TrimRight(string(block[pos:pos+size]), "\x00"))
+		pos += size
+
+		if record != 2 || value == "" {
+			continue
+		}
+		switch dataset {
+		case iptcObjectName:
+			data.Title = value
+		case iptcKeywords:
+			data.Keywords = append(data.Keywords, value)
+		case iptcCaption:
+			data.Caption = value
+		case iptcByline:
+			data.Byline = value
+		case iptcCopyright:
+			data.Copyright = value
+		case iptcCity:
+			data.City = value
+		case iptcCountry:
+			data.Country = value
+		}
+	}
+
+	return data
+}
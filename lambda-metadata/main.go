@@ -1,180 +1,386 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"strings"
 	"time"
 
+	"github.com/Andrew-Wichmann/wedding-photos-app/internal/event"
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
-	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
 	"github.com/aws/aws-sdk-go/service/rekognition"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sqs"
 	"github.com/rwcarlsen/goexif/exif"
 )
 
+// BoundingBox is a face's position as fractions of the image size
+type BoundingBox struct {
+	Width  float64 `json:"width"`
+	Height float64 `json:"height"`
+	Left   float64 `json:"left"`
+	Top    float64 `json:"top"`
+}
+
 type FaceDetail struct {
-	FaceID     string  `json:"faceId"`
-	Confidence float64 `json:"confidence"`
-	BoundingBox struct {
-		Width  float64 `json:"width"`
-		Height float64 `json:"height"`
-		Left   float64 `json:"left"`
-		Top    float64 `json:"top"`
-	} `json:"boundingBox"`
-	AgeRange *struct {
+	FaceID      string      `json:"faceId"`
+	PersonID    string      `json:"personId,omitempty"` // see people.go
+	Confidence  float64     `json:"confidence"`
+	BoundingBox BoundingBox `json:"boundingBox"`
+	CropKey     string      `json:"cropKey,omitempty"` // see facecrops.go
+	AgeRange    *struct {
 		Low  int64 `json:"low"`
 		High int64 `json:"high"`
 	} `json:"ageRange,omitempty"`
-	Gender     string  `json:"gender,omitempty"`
-	Smile      bool    `json:"smile,omitempty"`
-	Emotions   []string `json:"emotions,omitempty"`
+	Gender   string   `json:"gender,omitempty"`
+	Smile    bool     `json:"smile,omitempty"`
+	Emotions []string `json:"emotions,omitempty"`
 }
 
 type PhotoMetadata struct {
-	PhotoID       string       `json:"photoId"`
-	UploadedAt    int64        `json:"uploadedAt"`
-	DateTaken     string       `json:"dateTaken,omitempty"`
-	Make          string       `json:"make,omitempty"`
-	Model         string       `json:"model,omitempty"`
-	Latitude      float64      `json:"latitude,omitempty"`
-	Longitude     float64      `json:"longitude,omitempty"`
-	Altitude      float64      `json:"altitude,omitempty"`
-	FocalLength   string       `json:"focalLength,omitempty"`
-	FNumber       string       `json:"fNumber,omitempty"`
-	ExposureTime  string       `json:"exposureTime,omitempty"`
-	ISO           int          `json:"iso,omitempty"`
-	Width         int          `json:"width,omitempty"`
-	Height        int          `json:"height,omitempty"`
-	Orientation   int          `json:"orientation,omitempty"`
-	FileSize      int64        `json:"fileSize"`
-	Faces         []FaceDetail `json:"faces,omitempty"`
-	FaceCount     int          `json:"faceCount"`
+	PhotoID         string               `json:"photoId"`
+	EventID         string               `json:"eventId"`             // see internal/event
+	SchemaVersion   int                  `json:"schemaVersion"`       // see internal/schema
+	UploadedAt      int64                `json:"uploadedAt"`          // from the key, so reprocessing hits the same item
+	Sequencer       string               `json:"sequencer,omitempty"` // S3 event sequencer, padded for comparison
+	MediaType       string               `json:"mediaType"`
+	DateTaken       string               `json:"dateTaken,omitempty"`      // local time with UTC offset
+	TakenAt         int64                `json:"takenAt,omitempty"`        // UTC epoch seconds
+	TimezoneSource  string               `json:"timezoneSource,omitempty"` // offset, gps or event
+	DateTakenSource string               `json:"dateTakenSource,omitempty"`
+	Make            string               `json:"make,omitempty"`
+	Model           string               `json:"model,omitempty"`
+	Latitude        float64              `json:"latitude,omitempty"`
+	Longitude       float64              `json:"longitude,omitempty"`
+	Altitude        float64              `json:"altitude,omitempty"`
+	FocalLength     string               `json:"focalLength,omitempty"`
+	FNumber         string               `json:"fNumber,omitempty"`
+	ExposureTime    string               `json:"exposureTime,omitempty"`
+	ISO             int                  `json:"iso,omitempty"`
+	LensModel       string               `json:"lensModel,omitempty"`
+	Flash           string               `json:"flash,omitempty"`
+	WhiteBalance    string               `json:"whiteBalance,omitempty"`
+	ExposureProgram string               `json:"exposureProgram,omitempty"`
+	GPSDirection    float64              `json:"gpsDirection,omitempty"`
+	GPSSpeed        float64              `json:"gpsSpeed,omitempty"` // km/h
+	Software        string               `json:"software,omitempty"`
+	Artist          string               `json:"artist,omitempty"`
+	Copyright       string               `json:"copyright,omitempty"`
+	Title           string               `json:"title,omitempty"`
+	Description     string               `json:"description,omitempty"`
+	Keywords        []string             `json:"keywords,omitempty"`
+	Rating          int                  `json:"rating,omitempty"`
+	City            string               `json:"city,omitempty"`
+	Country         string               `json:"country,omitempty"`
+	Width           int                  `json:"width,omitempty"`
+	Height          int                  `json:"height,omitempty"`
+	DisplayWidth    int                  `json:"displayWidth,omitempty"`  // after orientation/rotation
+	DisplayHeight   int                  `json:"displayHeight,omitempty"` // after orientation/rotation
+	Orientation     int                  `json:"orientation,omitempty"`
+	Rotation        int                  `json:"rotation,omitempty"`
+	Duration        float64              `json:"duration,omitempty"`
+	VideoCodec      string               `json:"videoCodec,omitempty"`
+	FileSize        int64                `json:"fileSize"`
+	Faces           []FaceDetail         `json:"faces,omitempty"`
+	FaceCount       int                  `json:"faceCount"`
+	FaceModel       string               `json:"faceModelVersion,omitempty"` // face model the faces were indexed with, see collection.go
+	Rebuild         *FaceRebuild         `json:"rebuild,omitempty"`          // faces staged in a new collection, see collection.go
+	Renditions      map[string]Rendition `json:"renditions,omitempty"`
+	LikeCount       int                  `json:"likeCount,omitempty"`    // read only, see appAttributes
+	CommentCount    int                  `json:"commentCount,omitempty"` // read only, visible comments
+
+	// Faces and renditions that reprocessing replaced. They are deleted once
+	// the stored item no longer points at them; see discardReplaced.
+	replacedFaces      []FaceDetail
+	replacedRenditions []string
 }
 
-func handler(ctx context.Context, s3Event events.S3Event) error {
+// processor holds the clients and settings shared by every record, whether
+// it arrives in an S3 event or is replayed from the command line
+type processor struct {
+	s3Client          *s3.S3
+	dynamoClient      *dynamodb.DynamoDB
+	rekognitionClient *rekognition.Rekognition
+	sqsClient         *sqs.SQS
+	tableName         string
+	failuresTable     string
+	statusTable       string
+	peopleTable       string
+	assignmentsTable  string
+	likesTable        string
+	commentsTable     string
+	collectionID      string // base collection, see collectionFor
+}
+
+func newProcessor() *processor {
 	sess := session.Must(session.NewSession())
-	s3Client := s3.New(sess)
-	dynamoClient := dynamodb.New(sess)
-	rekognitionClient := rekognition.New(sess)
-	tableName := os.Getenv("DYNAMODB_TABLE")
-	collectionID := "wedding-faces"
-
-	for _, record := range s3Event.Records {
-		bucket := record.S3.Bucket.Name
-		key := record.S3.Object.Key
-		size := record.S3.Object.Size
-
-		log.Printf("Processing: s3://%s/%s (size: %d bytes)", bucket, key, size)
-
-		// Download file from S3
-		result, err := s3Client.GetObject(&s3.GetObjectInput{
-			Bucket: aws.String(bucket),
-			Key:    aws.String(key),
-		})
-		if err != nil {
-			log.Printf("Error downloading %s: %v", key, err)
-			continue
-		}
+	return &processor{
+		s3Client:          s3.New(sess),
+		dynamoClient:      dynamodb.New(sess),
+		rekognitionClient: rekognition.New(sess),
+		sqsClient:         sqs.New(sess),
+		tableName:         os.Getenv("DYNAMODB_TABLE"),
+		failuresTable:     os.Getenv("FAILURES_TABLE"),
+		statusTable:       os.Getenv("STATUS_TABLE"),
+		peopleTable:       os.Getenv("PEOPLE_TABLE"),
+		assignmentsTable:  os.Getenv("FACE_ASSIGNMENTS_TABLE"),
+		likesTable:        os.Getenv("LIKES_TABLE"),
+		commentsTable:     os.Getenv("COMMENTS_TABLE"),
+		collectionID:      event.BaseCollection(),
+	}
+}
 
-		// Create temp file
-		tempFile, err := os.CreateTemp("", "photo-*")
-		if err != nil {
-			log.Printf("Error creating temp file: %v", err)
-			result.Body.Close()
-			continue
+func handler(ctx context.Context, s3Event events.S3Event) error {
+	p := newProcessor()
+	results := processRecords(ctx, s3Event.Records, concurrency(), p.processRecord)
+
+	// Permanent failures are recorded and dropped. Retryable ones are recorded
+	// too, then returned so Lambda retries the event and finally sends it to
+	// the dead-letter queue. Records are idempotent, so the retry redoing
+	// the ones that succeeded is harmless.
+	succeeded, failed, skipped := 0, 0, 0
+	for _, result := range results {
+		key := result.Record.S3.Object.URLDecodedKey
+		switch {
+		case result.Skipped:
+			skipped++
+		case result.Err != nil:
+			failed++
+			log.Printf("Error processing %s after %v (retryable: %t): %v", key, result.Duration, isRetryable(result.Err), result.Err)
+			p.recordFailure(result.Record, result.Err)
+		default:
+			succeeded++
+			p.clearFailure(key)
 		}
-		tempPath := tempFile.Name()
+	}
 
-		// Copy S3 object to temp file
-		_, err = io.Copy(tempFile, result.Body)
-		result.Body.Close()
-		tempFile.Close()
-		if err != nil {
-			log.Printf("Error writing temp file: %v", err)
-			os.Remove(tempPath)
-			continue
+	log.Printf("Processed %d records: %d succeeded, %d failed, %d left for retry near the deadline",
+		len(results), succeeded, failed, skipped)
+	return retryError(results)
+}
+
+// processRecord handles a single created or removed object
+func (p *processor) processRecord(ctx context.Context, record events.S3EventRecord) error {
+	bucket := record.S3.Bucket.Name
+	// Keys in S3 events are URL-encoded, so "IMG 1.jpg" arrives as "IMG+1.jpg"
+	key := record.S3.Object.URLDecodedKey
+	size := record.S3.Object.Size
+	sequencer := normalizeSequencer(record.S3.Object.Sequencer)
+
+	// Deletions from the console or lifecycle rules would otherwise leave orphaned records
+	if strings.HasPrefix(record.EventName, "ObjectRemoved") {
+		log.Printf("Removing: s3://%s/%s", bucket, key)
+		err := withRetry(ctx, "remove "+key, func() error {
+			return removePhoto(p.s3Client, p.dynamoClient, p.rekognitionClient, bucket, key, p.tableName, p.likesTable, p.commentsTable, p.collectionFor(event.FromKey(key)), sequencer)
+		})
+		if err == nil {
+			_, err = p.unassignPhoto(key)
+		}
+		if err == nil {
+			p.deleteStatus(key)
 		}
+		return err
+	}
 
-		// Extract EXIF metadata
-		metadata := extractMetadata(tempPath, key, size)
-		os.Remove(tempPath)
+	log.Printf("Processing: s3://%s/%s (size: %d bytes)", bucket, key, size)
 
-		// Index faces with Rekognition
-		faces, err := indexFaces(rekognitionClient, bucket, key, collectionID)
-		if err != nil {
-			log.Printf("Error indexing faces for %s: %v", key, err)
-		} else {
-			metadata.Faces = faces
-			metadata.FaceCount = len(faces)
-			log.Printf("Indexed %d faces for %s", len(faces), key)
-		}
+	reader, err := p.openUpload(ctx, bucket, key)
+	if err != nil {
+		return err
+	}
 
-		// Store in DynamoDB
-		av, err := dynamodbattribute.MarshalMap(metadata)
-		if err != nil {
-			log.Printf("Error marshaling metadata: %v", err)
-			continue
+	// Reuse faces a previous run indexed for this same object rather than
+	// adding duplicates to the collection
+	var previous *PhotoMetadata
+	uploadedAt := uploadedAtFor(key, reader.lastModified)
+	err = withRetry(ctx, "read metadata for "+key, func() error {
+		var err error
+		previous, err = existingMetadata(p.dynamoClient, p.tableName, key, uploadedAt)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("read existing metadata: %w", err)
+	}
+	// Check before touching faces, people or the status, which belong to the newer event
+	if sequencer != "" && previous != nil && previous.Sequencer > sequencer {
+		log.Printf("Skipping stale event for %s: %v", key, errStaleEvent)
+		return nil
+	}
+	p.startStatus(key)
+	sameObject := previous != nil && (sequencer == "" || previous.Sequencer == sequencer)
+	collectionID := p.collectionFor(event.FromKey(key))
+
+	run := allStages()
+	var overwritten map[string]Rendition
+	if sameObject && len(previous.Faces) > 0 {
+		log.Printf("Reusing %d indexed faces for %s", len(previous.Faces), key)
+		p.setStage(key, stageFaces, stageDone, nil)
+		delete(run, stageFaces)
+		if hasFaceCrops(previous.Faces) {
+			p.setStage(key, stageFaceCrops, stageDone, nil)
+			delete(run, stageFaceCrops)
 		}
-
-		_, err = dynamoClient.PutItem(&dynamodb.PutItemInput{
-			TableName: aws.String(tableName),
-			Item:      av,
-		})
-		if err != nil {
-			log.Printf("Error storing metadata in DynamoDB: %v", err)
-			continue
+	} else {
+		if previous != nil {
+			// The object was overwritten, so the faces found in the old version go
+			err := withRetry(ctx, "drop replaced faces for "+key, func() error {
+				if err := p.discardFaces(bucket, collectionID, previous.Faces); err != nil {
+					return err
+				}
+				// So are faces a rebuild staged for it in a new collection
+				if previous.Rebuild != nil {
+					return p.discardFaces(bucket, previous.Rebuild.CollectionID, previous.Rebuild.Faces)
+				}
+				return nil
+			})
+			if err != nil {
+				return fmt.Errorf("drop replaced faces: %w", err)
+			}
+			// Its renditions stay until the new ones are stored
+			overwritten = previous.Renditions
 		}
+		previous = nil
+	}
 
-		log.Printf("Successfully processed %s", key)
+	metadata, err := p.buildMetadata(ctx, reader, previous, run, false)
+	if err != nil {
+		return err
+	}
+	metadata.replacedRenditions = append(metadata.replacedRenditions, replacedRenditions(overwritten, metadata.Renditions)...)
+	metadata.Sequencer = sequencer
+
+	// Store in DynamoDB
+	err = withRetry(ctx, "store metadata for "+key, func() error {
+		return putMetadata(p.dynamoClient, p.tableName, metadata)
+	})
+	if err != nil && run[stageFaces] {
+		// Faces indexed by this run would otherwise be left in the collection
+		// with no item pointing at them
+		if err := p.discardFaces(bucket, collectionID, metadata.Faces); err != nil {
+			log.Printf("Error discarding faces indexed for %s: %v", key, err)
+		}
+	}
+	if err == errStaleEvent {
+		// A newer event was stored while this one was processing. It may have
+		// finished before this run started over the status, so finish it here.
+		log.Printf("Skipping stale event for %s: %v", key, err)
+		p.finishStatus(key, statusProcessed, nil)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("store metadata: %w", err)
 	}
+	p.discardReplaced(bucket, metadata)
 
+	p.finishStatus(key, statusProcessed, nil)
+	log.Printf("Successfully processed %s", key)
 	return nil
 }
 
-func extractMetadata(filePath, key string, fileSize int64) PhotoMetadata {
+// renditionsFromObject streams the full object into the image decoder
+func (p *processor) renditionsFromObject(bucket, key string, orientation int) (map[string]Rendition, error) {
+	result, err := p.s3Client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer result.Body.Close()
+
+	body := &readErrorTracker{r: result.Body}
+	version := renditionVersion(aws.StringValue(result.ETag))
+	renditions, err := generateRenditions(p.s3Client, bucket, key, version, body, orientation)
+	if err != nil && body.err != nil {
+		// The download dropped rather than the image being corrupt
+		return nil, transient(fmt.Errorf("%w (read error: %v)", err, body.err))
+	}
+	return renditions, err
+}
+
+func extractMetadata(f objectReader, key string, lastModified time.Time) (PhotoMetadata, error) {
 	metadata := PhotoMetadata{
 		PhotoID:    key,
-		UploadedAt: time.Now().Unix(),
-		FileSize:   fileSize,
+		EventID:    event.FromKey(key),
+		UploadedAt: uploadedAtFor(key, lastModified),
+		MediaType:  "photo",
+		FileSize:   f.Size(),
 	}
-
-	// Open file and decode EXIF
-	f, err := os.Open(filePath)
-	if err != nil {
-		log.Printf("Error opening file for EXIF: %v", err)
-		return metadata
+	if err := readFileMetadata(f, key, &metadata); err != nil {
+		return metadata, err
 	}
-	defer f.Close()
+	if metadata.MediaType == "photo" {
+		readImageDimensions(f, &metadata)
+	}
+	setDisplayDimensions(&metadata)
 
-	x, err := exif.Decode(f)
-	if err != nil {
-		log.Printf("No EXIF data found in %s: %v", key, err)
-		return metadata
+	// Screenshots and messaging-app downloads often carry no capture time at all
+	if metadata.DateTaken == "" {
+		fallbackCaptureTime(&metadata, key)
 	}
 
-	// Extract camera info
-	if make, err := x.Get(exif.Make); err == nil {
-		if val, err := make.StringVal(); err == nil {
-			metadata.Make = val
+	return metadata, nil
+}
+
+// readFileMetadata fills metadata from the container, EXIF, XMP and IPTC
+// data embedded in the file. Missing or unreadable metadata is only logged;
+// the error is for failing to read the file itself.
+func readFileMetadata(f objectReader, key string, metadata *PhotoMetadata) error {
+	// Videos carry their metadata in MP4/QuickTime atoms rather than EXIF
+	if isQuickTime(f) {
+		metadata.MediaType = "video"
+		info, err := parseQuickTime(f, f.Size())
+		if err != nil {
+			log.Printf("No video metadata found in %s: %v", key, err)
+			return nil
 		}
+		applyVideoInfo(metadata, info)
+		return nil
+	}
+
+	// XMP and IPTC blocks live near the start of the file, so only the header is searched
+	header := make([]byte, embeddedMetadataSearchSize)
+	n, err := f.ReadAt(header, 0)
+	if err != nil && err != io.EOF {
+		// Files shorter than the header end in EOF; anything else is the download failing
+		return transient(fmt.Errorf("read header: %w", err))
 	}
+	applyEmbeddedMetadata(metadata, header[:n])
 
-	if model, err := x.Get(exif.Model); err == nil {
-		if val, err := model.StringVal(); err == nil {
-			metadata.Model = val
+	// HEIF keeps EXIF in an item of its own rather than at the start
+	var exifData io.Reader = f
+	if isHEIF(f) {
+		data, err := heifExif(f, f.Size())
+		if err != nil {
+			log.Printf("No EXIF data found in %s: %v", key, err)
+			return nil
 		}
+		exifData = bytes.NewReader(data)
+	} else if _, err := f.Seek(0, io.SeekStart); err != nil {
+		log.Printf("Error rewinding %s: %v", key, err)
+		return nil
+	}
+	x, err := exif.Decode(exifData)
+	if err != nil {
+		log.Printf("No EXIF data found in %s: %v", key, err)
+		return nil
 	}
 
+	// Extract camera info; some makers pad these to a fixed width
+	metadata.Make = exifString(x, exif.Make)
+	metadata.Model = exifString(x, exif.Model)
+
 	// Extract date/time
-	if dt, err := x.DateTime(); err == nil {
-		metadata.DateTaken = dt.Format(time.RFC3339)
+	if dt, source, ok := exifCaptureTime(x, eventSettings(metadata.EventID).Location()); ok {
+		setCaptureTime(metadata, dt, dateFromEXIF, source)
 	}
 
 	// Extract GPS coordinates
@@ -200,7 +406,8 @@ func extractMetadata(filePath, key string, fileSize int64) PhotoMetadata {
 	}
 
 	if exposureTime, err := x.Get(exif.ExposureTime); err == nil {
-		if val, err := exposureTime.Rat(0); err == nil {
+		// Some phones write 0/1 when they don't record it
+		if val, err := exposureTime.Rat(0); err == nil && val.Sign() > 0 {
 			metadata.ExposureTime = fmt.Sprintf("%d/%d", val.Num(), val.Denom())
 		}
 	}
@@ -230,13 +437,184 @@ func extractMetadata(filePath, key string, fileSize int64) PhotoMetadata {
 		}
 	}
 
-	return metadata
+	extractExtendedEXIF(x, metadata)
+	return nil
+}
+
+var exposurePrograms = map[int]string{
+	1: "Manual",
+	2: "Normal program",
+	3: "Aperture priority",
+	4: "Shutter priority",
+	5: "Creative program",
+	6: "Action program",
+	7: "Portrait mode",
+	8: "Landscape mode",
+}
+
+// Knots and mph are normalized to km/h
+var gpsSpeedUnits = map[string]float64{"K": 1, "M": 1.609344, "N": 1.852}
+
+// extractExtendedEXIF reads the lens, exposure, GPS heading and authorship tags
+func extractExtendedEXIF(x *exif.Exif, metadata *PhotoMetadata) {
+	if val := exifString(x, exif.LensModel); val != "" {
+		metadata.LensModel = val
+	}
+	if val := exifString(x, exif.Software); val != "" {
+		metadata.Software = val
+	}
+	// EXIF authorship wins over IPTC By-line and CopyrightNotice
+	if val := exifString(x, exif.Artist); val != "" {
+		metadata.Artist = val
+	}
+	if val := exifString(x, exif.Copyright); val != "" {
+		metadata.Copyright = val
+	}
+
+	if val, ok := exifInt(x, exif.Flash); ok {
+		// Bit 0 records whether the flash fired; the rest describe mode and return light
+		if val&1 == 1 {
+			metadata.Flash = "Fired"
+		} else {
+			metadata.Flash = "Did not fire"
+		}
+	}
+
+	if val, ok := exifInt(x, exif.WhiteBalance); ok {
+		if val == 1 {
+			metadata.WhiteBalance = "Manual"
+		} else {
+			metadata.WhiteBalance = "Auto"
+		}
+	}
+
+	if val, ok := exifInt(x, exif.ExposureProgram); ok {
+		metadata.ExposureProgram = exposurePrograms[val]
+	}
+
+	if val, ok := exifFloat(x, exif.GPSAltitude); ok {
+		// Ref 1 means below sea level
+		if ref, ok := exifInt(x, exif.GPSAltitudeRef); ok && ref == 1 {
+			val = -val
+		}
+		metadata.Altitude = val
+	}
+
+	if val, ok := exifFloat(x, exif.GPSImgDirection); ok {
+		metadata.GPSDirection = val
+	}
+
+	if val, ok := exifFloat(x, exif.GPSSpeed); ok {
+		factor, known := gpsSpeedUnits[exifString(x, exif.GPSSpeedRef)]
+		if !known {
+			factor = 1 // K is the EXIF default
+		}
+		metadata.GPSSpeed = val * factor
+	}
 }
 
-func indexFaces(client *rekognition.Rekognition, bucket, key, collectionID string) ([]FaceDetail, error) {
+func exifString(x *exif.Exif, field exif.FieldName) string {
+	tag, err := x.Get(field)
+	if err != nil {
+		return ""
+	}
+	val, err := tag.StringVal()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimRight(val, "\x00"))
+}
+
+func exifInt(x *exif.Exif, field exif.FieldName) (int, bool) {
+	tag, err := x.Get(field)
+	if err != nil {
+		return 0, false
+	}
+	val, err := tag.Int(0)
+	return val, err == nil
+}
+
+func exifFloat(x *exif.Exif, field exif.FieldName) (float64, bool) {
+	tag, err := x.Get(field)
+	if err != nil {
+		return 0, false
+	}
+	num, den, err := tag.Rat2(0)
+	if err != nil || den == 0 {
+		return 0, false
+	}
+	return float64(num) / float64(den), true
+}
+
+// Size of the file header searched for embedded XMP and IPTC metadata. The
+// segments follow EXIF at the start of the file, so this is fetched with a
+// ranged read rather than downloading the whole upload.
+const embeddedMetadataSearchSize = 256 << 10
+
+// applyEmbeddedMetadata fills descriptive fields from XMP, falling back to
+// IPTC for anything the XMP packet doesn't set
+func applyEmbeddedMetadata(metadata *PhotoMetadata, header []byte) {
+	if packet := findXMP(header); packet != nil {
+		if xmp, err := parseXMP(packet); err != nil {
+			log.Printf("Error parsing XMP for %s: %v", metadata.PhotoID, err)
+		} else {
+			metadata.Rating = xmp.Rating
+			metadata.Title = xmp.Title
+			metadata.Description = xmp.Description
+			metadata.Keywords = xmp.Keywords
+			// EXIF is decoded afterwards and replaces this when it has a date
+			if dt, source, ok := parseXMPDate(xmp.CreateDate, eventSettings(metadata.EventID).Location()); ok {
+				setCaptureTime(metadata, dt, dateFromXMP, source)
+			}
+		}
+	}
+
+	if block := findIPTC(header); block != nil {
+		iptc := parseIPTC(block)
+		if metadata.Title == "" {
+			metadata.Title = iptc.Title
+		}
+		if metadata.Description == "" {
+			metadata.Description = iptc.Caption
+		}
+		if metadata.Artist == "" {
+			metadata.Artist = iptc.Byline
+		}
+		if metadata.Copyright == "" {
+			metadata.Copyright = iptc.Copyright
+		}
+		metadata.City = iptc.City
+		metadata.Country = iptc.Country
+		metadata.Keywords = mergeKeywords(metadata.Keywords, iptc.Keywords)
+	}
+}
+
+func mergeKeywords(a, b []string) []string {
+	seen := make(map[string]bool)
+	var merged []string
+	for _, keyword := range append(a, b...) {
+		if !seen[strings.ToLower(keyword)] {
+			seen[strings.ToLower(keyword)] = true
+			merged = append(merged, keyword)
+		}
+	}
+	return merged
+}
+
+// indexFaces adds the faces in a photo to the collection, returning them and
+// the face model version they were indexed with. Faces a crashed run indexed
+// for the photo are deleted first; stored are the faces its item still
+// points at, which stay until the caller replaces them.
+func indexFaces(client *rekognition.Rekognition, bucket, key, collectionID string, stored []FaceDetail) ([]FaceDetail, string, error) {
+	externalID := externalImageID(key)
+	if err := deleteStrayFaces(client, collectionID, externalID, stored); err != nil {
+		return nil, "", err
+	}
+
 	// Call Rekognition IndexFaces to add faces to collection
 	input := &rekognition.IndexFacesInput{
-		CollectionId: aws.String(collectionID),
+		CollectionId:    aws.String(collectionID),
+		ExternalImageId: aws.String(externalID),
 		Image: &rekognition.Image{
 			S3Object: &rekognition.S3Object{
 				Bucket: aws.String(bucket),
@@ -246,13 +624,13 @@ func indexFaces(client *rekognition.Rekognition, bucket, key, collectionID strin
 		DetectionAttributes: []*string{
 			aws.String("ALL"), // Include age, gender, emotions, etc.
 		},
-		MaxFaces:       aws.Int64(10), // Max faces to index per photo
-		QualityFilter:  aws.String("AUTO"),
+		MaxFaces:      aws.Int64(10), // Max faces to index per photo
+		QualityFilter: aws.String("AUTO"),
 	}
 
 	result, err := client.IndexFaces(input)
 	if err != nil {
-		return nil, fmt.Errorf("failed to index faces: %w", err)
+		return nil, "", fmt.Errorf("failed to index faces: %w", err)
 	}
 
 	var faces []FaceDetail
@@ -304,9 +682,16 @@ func indexFaces(client *rekognition.Rekognition, bucket, key, collectionID strin
 		faces = append(faces, face)
 	}
 
-	return faces, nil
+	return faces, aws.StringValue(result.FaceModelVersion), nil
 }
 
 func main() {
+	// The Lambda runtime starts the binary without arguments
+	if len(os.Args) > 1 {
+		if err := runCommand(os.Args[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 	lambda.Start(handler)
 }
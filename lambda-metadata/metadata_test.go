@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files from the current output")
+
+// Most samples stand in for what each maker's cameras write: the same EXIF
+// byte order, tags and offset conventions, XMP and IPTC segments and HEIF
+// boxes, around a tiny image so they can live in the repository. The real-
+// ones are files from actual phones and cameras. testdata/samples/README.md
+// describes each one.
+func TestExtractMetadataGolden(t *testing.T) {
+	t.Setenv("EVENT_TIMEZONE", "America/New_York")
+	t.Setenv("EVENTS_TABLE", "")
+	lastModified := time.Date(2024, 6, 20, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		sample string
+		key    string
+	}{
+		{"apple-iphone-15-pro.jpg", "uploads/1718491327-IMG_4821.JPG"},
+		{"apple-iphone-15-pro.heic", "uploads/1718491327-IMG_4821.HEIC"},
+		{"samsung-galaxy-s23.jpg", "uploads/1718500000-20240615_210533.jpg"},
+		{"google-pixel-8.jpg", "uploads/1718530000-PXL_20240616_092045123.jpg"},
+		{"canon-eos-r5.jpg", "uploads/1718490000-IMG_0042.JPG"},
+		{"nikon-z6ii.jpg", "uploads/1718350000-DSC_1234.JPG"},
+		{"sony-a7iv.jpg", "uploads/1718492000-DSC01234.JPG"},
+		{"fujifilm-x-t5-lightroom.jpg", "uploads/1718488000-first-dance.jpg"},
+		{"whatsapp.jpg", "uploads/1718500000-IMG-20240615-WA0012.jpg"},
+		// Real files, stripped down to a few kilobytes
+		{"real-apple-iphone-4s.jpg", "uploads/1409576627-IMG_0412.JPG"},
+		{"real-htc-one-m8.jpg", "uploads/1398532159-IMG_20140426_190919.jpg"},
+		{"real-htc-thunderbolt.jpg", "uploads/1355978320-IMG_20121219_213840.jpg"},
+		{"real-canon-eos-5d-mark-ii.jpg", "uploads/1319824218-IMG_3012.JPG"},
+		{"real-nikon-d80.jpg", "uploads/1319826343-DSC_0417.JPG"},
+		{"real-fujifilm-finepix-e550.jpg", "uploads/1249474291-DSCF0093.JPG"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.sample, func(t *testing.T) {
+			data, err := os.ReadFile(filepath.Join("testdata", "samples", tt.sample))
+			if err != nil {
+				t.Fatal(err)
+			}
+			metadata, err := extractMetadata(bytes.NewReader(data), tt.key, lastModified)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := json.MarshalIndent(metadata, "", "  ")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, '\n')
+
+			golden := filepath.Join("testdata", "golden", tt.sample+".json")
+			if *update {
+				if err := os.WriteFile(golden, got, 0o644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("%v (run go test -update to create it)", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("metadata for %s differs from %s\ngot:\n%s\nwant:\n%s", tt.sample, golden, got, want)
+			}
+		})
+	}
+}
+
+// failingReader stands in for an upload whose download drops
+type failingReader struct {
+	*bytes.Reader
+}
+
+func (failingReader) ReadAt(p []byte, off int64) (int, error) {
+	return 0, errors.New("connection reset by peer")
+}
+
+func TestExtractMetadataReadError(t *testing.T) {
+	_, err := extractMetadata(failingReader{bytes.NewReader(make([]byte, 1024))}, "uploads/1718491327-IMG_4821.JPG", time.Time{})
+	if err == nil || !isRetryable(err) {
+		t.Fatalf("got error %v, want a retryable one", err)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"maps"
+	"reflect"
+	"strconv"
+
+	"github.com/Andrew-Wichmann/wedding-photos-app/internal/event"
+	"github.com/Andrew-Wichmann/wedding-photos-app/internal/schema"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// upgradeItem migrates an item read from the table to the current schema
+// in place. The stored item is only rewritten by the migrate command or
+// the next time the photo is processed.
+func upgradeItem(item map[string]*dynamodb.AttributeValue) {
+	if _, err := schema.Upgrade(item, schema.Env{EventLocation: eventSettings(event.Default).Location()}); err != nil {
+		log.Printf("Error upgrading metadata item: %v", err)
+	}
+}
+
+// runMigrateCommand upgrades every item below the current schema version
+func runMigrateCommand(args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "count the items that would be upgraded without writing")
+	flags.Parse(args)
+
+	p := newProcessor()
+	env := schema.Env{EventLocation: eventSettings(event.Default).Location()}
+	byVersion := make(map[int]int)
+	scanned, upgraded, failed := 0, 0, 0
+
+	err := p.dynamoClient.ScanPages(&dynamodb.ScanInput{
+		TableName: aws.String(p.tableName),
+	}, func(page *dynamodb.ScanOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			scanned++
+			version := schema.Version(item)
+			byVersion[version]++
+			original := maps.Clone(item)
+			changed, err := schema.Upgrade(item, env)
+			if err != nil {
+				failed++
+				log.Printf("Error upgrading %s: %v", aws.StringValue(item["photoId"].S), err)
+				continue
+			}
+			if !changed {
+				continue
+			}
+			if *dryRun {
+				upgraded++
+				continue
+			}
+
+			// Only the attributes the migrations touched are written, so
+			// counters the app updates meanwhile aren't overwritten
+			set := make(map[string]*dynamodb.AttributeValue)
+			for name, value := range item {
+				if !reflect.DeepEqual(original[name], value) {
+					set[name] = value
+				}
+			}
+			var remove []string
+			for name := range original {
+				if _, ok := item[name]; !ok {
+					remove = append(remove, name)
+				}
+			}
+			input := updateItemInput(p.tableName, map[string]*dynamodb.AttributeValue{
+				"photoId":    item["photoId"],
+				"uploadedAt": item["uploadedAt"],
+			}, set, remove)
+
+			// Skip items rewritten since the scan, e.g. by a new upload event
+			input.ExpressionAttributeNames["#version"] = aws.String(schema.VersionAttribute)
+			if version > 1 {
+				input.ConditionExpression = aws.String("#version = :version")
+				if input.ExpressionAttributeValues == nil {
+					input.ExpressionAttributeValues = make(map[string]*dynamodb.AttributeValue)
+				}
+				input.ExpressionAttributeValues[":version"] = &dynamodb.AttributeValue{N: aws.String(strconv.Itoa(version))}
+			} else {
+				input.ConditionExpression = aws.String("attribute_exists(photoId) AND attribute_not_exists(#version)")
+			}
+			_, err = p.dynamoClient.UpdateItem(input)
+			if err != nil && !isConditionFailed(err) {
+				failed++
+				log.Printf("Error writing %s: %v", aws.StringValue(item["photoId"].S), err)
+				continue
+			}
+			if err == nil {
+				upgraded++
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return fmt.Errorf("failed to scan metadata: %w", err)
+	}
+
+	for version := 1; version <= schema.CurrentVersion; version++ {
+		if byVersion[version] > 0 {
+			fmt.Printf("  version %d: %d items\n", version, byVersion[version])
+		}
+	}
+	verb := "upgraded"
+	if *dryRun {
+		verb = "would upgrade"
+	}
+	fmt.Printf("Scanned %d items, %s %d to version %d, %d failed\n", scanned, verb, upgraded, schema.CurrentVersion, failed)
+	return nil
+}
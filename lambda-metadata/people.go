@@ -0,0 +1,443 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"maps"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Andrew-Wichmann/wedding-photos-app/internal/event"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/rekognition"
+)
+
+// IndexFaces mints a new FaceId every time a guest appears, so faces are
+// grouped into people: each face is compared with the collection through
+// SearchFaces and joins the person its closest matches belong to. A face
+// with no assigned match starts a new person, whose ID is the lowest face ID
+// among it and its matches.
+const (
+	personMatchThreshold  = 90 // minimum similarity, in percent
+	personMatchCandidates = 20
+
+	// Minimum bounding box overlap for a reindexed face to count as the same face
+	faceInheritOverlap = 0.5
+)
+
+// FaceAssignment maps an indexed face to the person it belongs to. The
+// bounding box lets the app show the face without loading the photo's metadata.
+type FaceAssignment struct {
+	FaceID      string      `json:"faceId"`
+	PersonID    string      `json:"personId"`
+	PhotoID     string      `json:"photoId"`
+	BoundingBox BoundingBox `json:"boundingBox"`
+	CropKey     string      `json:"cropKey,omitempty"`
+}
+
+// assignPeople clusters the photo's faces that don't have a person yet,
+// setting PersonID on each
+func (p *processor) assignPeople(ctx context.Context, photoID string, faces []FaceDetail, inherited map[string]string) error {
+	if p.peopleTable == "" || p.assignmentsTable == "" {
+		return nil
+	}
+	for i := range faces {
+		if faces[i].PersonID != "" {
+			continue
+		}
+		var personID string
+		err := withRetry(ctx, "cluster face "+faces[i].FaceID, func() error {
+			var err error
+			if inheritedID := inherited[faces[i].FaceID]; inheritedID != "" {
+				personID, err = p.assignFace(FaceAssignment{FaceID: faces[i].FaceID, PersonID: inheritedID, PhotoID: photoID,
+					BoundingBox: faces[i].BoundingBox, CropKey: faces[i].CropKey})
+				return err
+			}
+			personID, err = p.clusterFace(photoID, faces[i])
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		faces[i].PersonID = personID
+	}
+	return nil
+}
+
+// setAssignmentCrops records the crop keys of faces that already have a
+// person on their assignments. Faces without an assignment get theirs when
+// they are clustered.
+func (p *processor) setAssignmentCrops(faces []FaceDetail) error {
+	if p.assignmentsTable == "" {
+		return nil
+	}
+	for _, face := range faces {
+		if face.PersonID == "" {
+			continue
+		}
+		input := &dynamodb.UpdateItemInput{
+			TableName:           aws.String(p.assignmentsTable),
+			Key:                 map[string]*dynamodb.AttributeValue{"faceId": {S: aws.String(face.FaceID)}},
+			UpdateExpression:    aws.String("REMOVE cropKey"),
+			ConditionExpression: aws.String("attribute_exists(faceId)"),
+		}
+		if face.CropKey != "" {
+			input.UpdateExpression = aws.String("SET cropKey = :cropKey")
+			input.ExpressionAttributeValues = map[string]*dynamodb.AttributeValue{":cropKey": {S: aws.String(face.CropKey)}}
+		}
+		_, err := p.dynamoClient.UpdateItem(input)
+		if err != nil && !isConditionFailed(err) {
+			return fmt.Errorf("failed to update crop of face %s: %w", face.FaceID, err)
+		}
+	}
+	return nil
+}
+
+// clusterFace picks the person with the highest total similarity among the
+// face's matches, then records the assignment
+func (p *processor) clusterFace(photoID string, face FaceDetail) (string, error) {
+	faceID := face.FaceID
+	eventID := event.FromKey(photoID)
+	result, err := p.rekognitionClient.SearchFaces(&rekognition.SearchFacesInput{
+		CollectionId:       aws.String(p.collectionFor(eventID)),
+		FaceId:             aws.String(faceID),
+		FaceMatchThreshold: aws.Float64(personMatchThreshold),
+		MaxFaces:           aws.Int64(personMatchCandidates),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to search faces: %w", err)
+	}
+
+	similarity := make(map[string]float64)
+	for _, match := range result.FaceMatches {
+		// Two faces in one photo are never the same guest
+		if aws.StringValue(match.Face.ExternalImageId) == externalImageID(photoID) {
+			continue
+		}
+		similarity[aws.StringValue(match.Face.FaceId)] = aws.Float64Value(match.Similarity)
+	}
+	assignments, err := p.faceAssignments(keysOf(similarity))
+	if err != nil {
+		return "", err
+	}
+
+	personID := pickPerson(faceID, photoID, similarity, assignments)
+	personID, err = p.assignFace(FaceAssignment{FaceID: faceID, PersonID: personID, PhotoID: photoID, BoundingBox: face.BoundingBox, CropKey: face.CropKey})
+	if err != nil {
+		return "", err
+	}
+	log.Printf("Assigned face %s in %s to person %s", faceID, photoID, personID)
+	return personID, nil
+}
+
+// pickPerson chooses the person for a face given the similarity of its
+// matches and the assignments of the matched faces: the person of the
+// event with the highest total similarity, or a new one
+func pickPerson(faceID, photoID string, similarity map[string]float64, assignments []FaceAssignment) string {
+	eventID := event.FromKey(photoID)
+	scores := make(map[string]float64)
+	unassigned := maps.Clone(similarity)
+	for _, assignment := range assignments {
+		delete(unassigned, assignment.FaceID)
+		// Events never share people, even if their collections are shared
+		if assignment.PhotoID == photoID || event.FromKey(assignment.PhotoID) != eventID {
+			continue
+		}
+		scores[assignment.PersonID] += similarity[assignment.FaceID]
+	}
+	personID := faceID
+	best := 0.0
+	for candidate, score := range scores {
+		if score > best || (score == best && candidate < personID) {
+			personID, best = candidate, score
+		}
+	}
+	if best == 0 {
+		// Matches without a person yet are being clustered by other workers
+		// right now. Every one of them starts the person named after the
+		// lowest face ID among them, so they end up as one person.
+		for candidate := range unassigned {
+			personID = min(personID, candidate)
+		}
+	}
+	return personID
+}
+
+// faceAssignments looks up the people the given faces belong to
+func (p *processor) faceAssignments(faceIDs []string) ([]FaceAssignment, error) {
+	var assignments []FaceAssignment
+	// BatchGetItem reads at most 100 keys per call
+	for start := 0; start < len(faceIDs); start += 100 {
+		var keys []map[string]*dynamodb.AttributeValue
+		for _, faceID := range faceIDs[start:min(start+100, len(faceIDs))] {
+			keys = append(keys, map[string]*dynamodb.AttributeValue{"faceId": {S: aws.String(faceID)}})
+		}
+		var parseErr error
+		err := p.dynamoClient.BatchGetItemPages(&dynamodb.BatchGetItemInput{
+			RequestItems: map[string]*dynamodb.KeysAndAttributes{p.assignmentsTable: {Keys: keys}},
+		}, func(page *dynamodb.BatchGetItemOutput, lastPage bool) bool {
+			var pageAssignments []FaceAssignment
+			if parseErr = dynamodbattribute.UnmarshalListOfMaps(page.Responses[p.assignmentsTable], &pageAssignments); parseErr != nil {
+				return false
+			}
+			assignments = append(assignments, pageAssignments...)
+			return true
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to read face assignments: %w", err)
+		}
+		if parseErr != nil {
+			return nil, fmt.Errorf("failed to parse face assignments: %w", parseErr)
+		}
+	}
+	return assignments, nil
+}
+
+// assignFace stores the assignment and adds the face and its photo to the
+// person, creating the person on its first face. A face already assigned,
+// e.g. by a concurrent delivery of the same upload, keeps its person, which
+// is returned.
+func (p *processor) assignFace(assignment FaceAssignment) (string, error) {
+	av, err := dynamodbattribute.MarshalMap(assignment)
+	if err != nil {
+		return "", err
+	}
+	_, err = p.dynamoClient.PutItem(&dynamodb.PutItemInput{
+		TableName:                 aws.String(p.assignmentsTable),
+		Item:                      av,
+		ConditionExpression:       aws.String("attribute_not_exists(faceId) OR personId = :personId"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":personId": {S: aws.String(assignment.PersonID)}},
+	})
+	if isConditionFailed(err) {
+		existing, err := p.faceAssignments([]string{assignment.FaceID})
+		if err != nil {
+			return "", err
+		}
+		if len(existing) == 0 {
+			return "", transient(fmt.Errorf("assignment of face %s changed while storing it", assignment.FaceID))
+		}
+		assignment.PersonID = existing[0].PersonID
+	} else if err != nil {
+		return "", fmt.Errorf("failed to store face assignment: %w", err)
+	}
+
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	_, err = p.dynamoClient.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName: aws.String(p.peopleTable),
+		Key:       map[string]*dynamodb.AttributeValue{"personId": {S: aws.String(assignment.PersonID)}},
+		UpdateExpression: aws.String("SET representativeFaceId = if_not_exists(representativeFaceId, :faceId), " +
+			"representativePhotoId = if_not_exists(representativePhotoId, :photoId), " +
+			"eventId = if_not_exists(eventId, :eventId), " +
+			"createdAt = if_not_exists(createdAt, :now), updatedAt = :now " +
+			"ADD faceIds :faceIds, photoIds :photoIds"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":faceId":   {S: aws.String(assignment.FaceID)},
+			":photoId":  {S: aws.String(assignment.PhotoID)},
+			":eventId":  {S: aws.String(event.FromKey(assignment.PhotoID))},
+			":faceIds":  {SS: aws.StringSlice([]string{assignment.FaceID})},
+			":photoIds": {SS: aws.StringSlice([]string{assignment.PhotoID})},
+			":now":      {N: aws.String(now)},
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to update person: %w", err)
+	}
+	return assignment.PersonID, nil
+}
+
+// unassignPhoto removes a photo's faces from their people, once its faces
+// are reindexed or after the photo is deleted, returning the assignments removed
+func (p *processor) unassignPhoto(photoID string) ([]FaceAssignment, error) {
+	if p.peopleTable == "" || p.assignmentsTable == "" {
+		return nil, nil
+	}
+
+	var assignments []FaceAssignment
+	err := p.dynamoClient.QueryPages(&dynamodb.QueryInput{
+		TableName:                 aws.String(p.assignmentsTable),
+		IndexName:                 aws.String("photoId-index"),
+		KeyConditionExpression:    aws.String("photoId = :photoId"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":photoId": {S: aws.String(photoID)}},
+	}, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			var assignment FaceAssignment
+			if err := dynamodbattribute.UnmarshalMap(item, &assignment); err != nil {
+				log.Printf("Skipping unreadable face assignment %s of %s: %v", aws.StringValue(item["faceId"].S), photoID, err)
+				continue
+			}
+			assignments = append(assignments, assignment)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up face assignments: %w", err)
+	}
+
+	return p.unassign(assignments)
+}
+
+// unassignFaces removes the given faces from their people
+func (p *processor) unassignFaces(faceIDs []string) error {
+	if p.peopleTable == "" || p.assignmentsTable == "" {
+		return nil
+	}
+	assignments, err := p.faceAssignments(faceIDs)
+	if err != nil {
+		return err
+	}
+	_, err = p.unassign(assignments)
+	return err
+}
+
+// unassign takes faces out of their people and deletes their assignments,
+// returning the ones removed
+func (p *processor) unassign(assignments []FaceAssignment) ([]FaceAssignment, error) {
+	return p.unassignKeeping(assignments, nil)
+}
+
+// unassignKeeping is unassign for faces replaced by others in the same
+// photo: the people in keepPhoto still have a face in it, so the photo stays
+// with them
+func (p *processor) unassignKeeping(assignments []FaceAssignment, keepPhoto map[string]bool) ([]FaceAssignment, error) {
+	var removed []FaceAssignment
+	for _, assignment := range assignments {
+		expression := "DELETE faceIds :faceIds, photoIds :photoIds"
+		values := map[string]*dynamodb.AttributeValue{
+			":faceIds":  {SS: aws.StringSlice([]string{assignment.FaceID})},
+			":photoIds": {SS: aws.StringSlice([]string{assignment.PhotoID})},
+		}
+		if keepPhoto[assignment.PersonID] {
+			expression = "DELETE faceIds :faceIds"
+			delete(values, ":photoIds")
+		}
+		result, err := p.dynamoClient.UpdateItem(&dynamodb.UpdateItemInput{
+			TableName:                 aws.String(p.peopleTable),
+			Key:                       map[string]*dynamodb.AttributeValue{"personId": {S: aws.String(assignment.PersonID)}},
+			UpdateExpression:          aws.String(expression),
+			ConditionExpression:       aws.String("attribute_exists(personId)"),
+			ExpressionAttributeValues: values,
+			ReturnValues:              aws.String(dynamodb.ReturnValueAllNew),
+		})
+		if err != nil && !isConditionFailed(err) {
+			return removed, fmt.Errorf("failed to update person: %w", err)
+		}
+		if err == nil {
+			if err := p.tidyPerson(assignment.PersonID, result.Attributes, assignment.FaceID); err != nil {
+				return removed, err
+			}
+		}
+		if _, err := p.dynamoClient.DeleteItem(&dynamodb.DeleteItemInput{
+			TableName: aws.String(p.assignmentsTable),
+			Key:       map[string]*dynamodb.AttributeValue{"faceId": {S: aws.String(assignment.FaceID)}},
+		}); err != nil {
+			return removed, fmt.Errorf("failed to delete face assignment: %w", err)
+		}
+		removed = append(removed, assignment)
+	}
+	return removed, nil
+}
+
+// tidyPerson follows up on a face leaving a person: a person left without
+// faces is deleted, and one whose representative face left gets another.
+// People merged into others have no faces but are kept as redirects.
+func (p *processor) tidyPerson(personID string, person map[string]*dynamodb.AttributeValue, removedFaceID string) error {
+	var faceIDs []string
+	if faces, ok := person["faceIds"]; ok {
+		faceIDs = aws.StringValueSlice(faces.SS)
+	}
+	if len(faceIDs) == 0 {
+		_, err := p.dynamoClient.DeleteItem(&dynamodb.DeleteItemInput{
+			TableName:           aws.String(p.peopleTable),
+			Key:                 map[string]*dynamodb.AttributeValue{"personId": {S: aws.String(personID)}},
+			ConditionExpression: aws.String("attribute_not_exists(faceIds) AND attribute_not_exists(mergedInto)"),
+		})
+		if err != nil && !isConditionFailed(err) {
+			return fmt.Errorf("failed to delete empty person: %w", err)
+		}
+		return nil
+	}
+
+	if representative, ok := person["representativeFaceId"]; !ok || aws.StringValue(representative.S) != removedFaceID {
+		return nil
+	}
+	assignments, err := p.faceAssignments(faceIDs)
+	if err != nil {
+		return err
+	}
+	if len(assignments) == 0 {
+		return nil
+	}
+	// Any remaining face will do; the lowest ID keeps the choice stable
+	next := slices.MinFunc(assignments, func(a, b FaceAssignment) int { return strings.Compare(a.FaceID, b.FaceID) })
+	_, err = p.dynamoClient.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:           aws.String(p.peopleTable),
+		Key:                 map[string]*dynamodb.AttributeValue{"personId": {S: aws.String(personID)}},
+		UpdateExpression:    aws.String("SET representativeFaceId = :faceId, representativePhotoId = :photoId"),
+		ConditionExpression: aws.String("representativeFaceId = :removed"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":faceId":  {S: aws.String(next.FaceID)},
+			":photoId": {S: aws.String(next.PhotoID)},
+			":removed": {S: aws.String(removedFaceID)},
+		},
+	})
+	if err != nil && !isConditionFailed(err) {
+		return fmt.Errorf("failed to replace representative face: %w", err)
+	}
+	return nil
+}
+
+// inheritPeople matches newly indexed faces to the photo's previous faces by
+// bounding box, so reindexing a photo (for example into a rebuilt collection)
+// keeps each face with the person an admin may have named, merged or split.
+// It returns the person for each matched new face ID.
+func inheritPeople(previous []FaceDetail, unassigned []FaceAssignment, faces []FaceDetail) map[string]string {
+	// The assignments are current; a face's PersonID may predate a merge or split
+	personOf := make(map[string]string, len(unassigned))
+	for _, assignment := range unassigned {
+		personOf[assignment.FaceID] = assignment.PersonID
+	}
+
+	inherited := make(map[string]string)
+	used := make(map[string]bool)
+	for _, face := range faces {
+		best, bestOverlap := "", faceInheritOverlap
+		for _, old := range previous {
+			if used[old.FaceID] || personOf[old.FaceID] == "" {
+				continue
+			}
+			if overlap := boxOverlap(face.BoundingBox, old.BoundingBox); overlap >= bestOverlap {
+				best, bestOverlap = old.FaceID, overlap
+			}
+		}
+		if best != "" {
+			used[best] = true
+			inherited[face.FaceID] = personOf[best]
+		}
+	}
+	return inherited
+}
+
+// boxOverlap is the intersection over union of two bounding boxes
+func boxOverlap(a, b BoundingBox) float64 {
+	width := math.Min(a.Left+a.Width, b.Left+b.Width) - math.Max(a.Left, b.Left)
+	height := math.Min(a.Top+a.Height, b.Top+b.Height) - math.Max(a.Top, b.Top)
+	if width <= 0 || height <= 0 {
+		return 0
+	}
+	intersection := width * height
+	return intersection / (a.Width*a.Height + b.Width*b.Height - intersection)
+}
+
+func keysOf(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	return keys
+}
@@ -0,0 +1,58 @@
+package main
+
+import "testing"
+
+// A face only joins people of its own event, however similar a face in
+// another event's photo is
+func TestPickPersonStaysInEvent(t *testing.T) {
+	const photoID = "uploads/reunion/1718491327-IMG_4821.JPG"
+	tests := []struct {
+		name        string
+		similarity  map[string]float64
+		assignments []FaceAssignment
+		want        string
+	}{
+		{
+			name:       "other event's person ignored",
+			similarity: map[string]float64{"face-a": 99, "face-b": 90},
+			assignments: []FaceAssignment{
+				{FaceID: "face-a", PersonID: "wedding-guest", PhotoID: "uploads/1718400000-IMG_0001.JPG"},
+				{FaceID: "face-b", PersonID: "reunion-guest", PhotoID: "uploads/reunion/1718400000-IMG_0002.JPG"},
+			},
+			want: "reunion-guest",
+		},
+		{
+			name:       "only other events' people",
+			similarity: map[string]float64{"face-a": 99},
+			assignments: []FaceAssignment{
+				{FaceID: "face-a", PersonID: "wedding-guest", PhotoID: "uploads/1718400000-IMG_0001.JPG"},
+			},
+			want: "face-z",
+		},
+		{
+			name:       "event whose ID is a prefix",
+			similarity: map[string]float64{"face-a": 99},
+			assignments: []FaceAssignment{
+				{FaceID: "face-a", PersonID: "other-guest", PhotoID: "uploads/reunion-2024/1718400000-IMG_0001.JPG"},
+			},
+			want: "face-z",
+		},
+		{
+			name:       "highest total similarity",
+			similarity: map[string]float64{"face-a": 99, "face-b": 80, "face-c": 80},
+			assignments: []FaceAssignment{
+				{FaceID: "face-a", PersonID: "first", PhotoID: "uploads/reunion/1718400000-IMG_0001.JPG"},
+				{FaceID: "face-b", PersonID: "second", PhotoID: "uploads/reunion/1718400000-IMG_0002.JPG"},
+				{FaceID: "face-c", PersonID: "second", PhotoID: "uploads/reunion/1718400000-IMG_0003.JPG"},
+			},
+			want: "second",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := pickPerson("face-z", photoID, tt.similarity, tt.assignments); got != tt.want {
+				t.Errorf("pickPerson = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
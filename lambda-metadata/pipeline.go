@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/Andrew-Wichmann/wedding-photos-app/internal/event"
+)
+
+// openUpload reads an upload's size and headers through ranged requests
+// rather than downloading the whole object; videos in particular only need
+// a few atoms
+func (p *processor) openUpload(ctx context.Context, bucket, key string) (*rangeReader, error) {
+	var reader *rangeReader
+	err := withRetry(ctx, "open "+key, func() error {
+		var err error
+		reader, err = openRangeReader(p.s3Client, bucket, key)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("open: %w", err)
+	}
+	return reader, nil
+}
+
+// stageSet selects which processing stages to run
+type stageSet map[string]bool
+
+func allStages() stageSet {
+	set := make(stageSet, len(stages))
+	for _, stage := range stages {
+		set[stage] = true
+	}
+	return set
+}
+
+// parseStages reads a comma-separated stage list such as "metadata,faces"
+func parseStages(value string) (stageSet, error) {
+	set := make(stageSet)
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if name == "all" {
+			return allStages(), nil
+		}
+		valid := false
+		for _, stage := range stages {
+			valid = valid || stage == name
+		}
+		if !valid {
+			return nil, fmt.Errorf("unknown stage %q (available: %s, all)", name, strings.Join(stages, ", "))
+		}
+		set[name] = true
+	}
+	if len(set) == 0 {
+		return nil, fmt.Errorf("no stages selected")
+	}
+	return set, nil
+}
+
+// buildMetadata runs the selected stages for an upload. Stages that aren't
+// run keep the values from previous, the stored item, so a backfill can
+// redo one stage without touching the others. A dry run extracts metadata
+// but doesn't write renditions, index faces or report status.
+func (p *processor) buildMetadata(ctx context.Context, reader *rangeReader, previous *PhotoMetadata, run stageSet, dryRun bool) (PhotoMetadata, error) {
+	bucket, key := reader.bucket, reader.key
+	if previous == nil {
+		// Nothing to keep, so every stage has to run
+		run = allStages()
+	}
+	setStage := func(stage, outcome string, cause error) {
+		if !dryRun {
+			p.setStage(key, stage, outcome, cause)
+		}
+	}
+
+	// Extract EXIF metadata
+	var metadata PhotoMetadata
+	if run[stageMetadata] {
+		var err error
+		metadata, err = extractMetadata(reader, key, reader.lastModified)
+		if err != nil {
+			setStage(stageMetadata, stageFailed, err)
+			return metadata, fmt.Errorf("metadata: %w", err)
+		}
+		log.Printf("Read metadata for %s from %d of %d bytes", key, reader.fetched, reader.Size())
+		setStage(stageMetadata, stageDone, nil)
+	} else {
+		metadata = *previous
+		// Items written before events existed don't record one, and items
+		// written before the key was derived from the upload used another
+		metadata.EventID = event.FromKey(key)
+		metadata.UploadedAt = uploadedAtFor(key, reader.lastModified)
+	}
+	if previous != nil {
+		metadata.Sequencer = previous.Sequencer
+		metadata.Renditions = previous.Renditions
+		metadata.Faces = append([]FaceDetail(nil), previous.Faces...)
+		metadata.FaceCount = previous.FaceCount
+		metadata.FaceModel = previous.FaceModel
+		metadata.Rebuild = previous.Rebuild
+	}
+
+	// Write resized JPEG renditions for the gallery, the one stage that needs
+	// every pixel. Formats Go can't decode (videos, HEIC) keep serving the original.
+	if run[stageRenditions] {
+		if metadata.MediaType == "photo" && decodableImage(reader) {
+			if dryRun {
+				log.Printf("Would regenerate renditions for %s", key)
+			} else {
+				previousRenditions := metadata.Renditions
+				err := withRetry(ctx, "renditions for "+key, func() error {
+					renditions, err := p.renditionsFromObject(bucket, key, metadata.Orientation)
+					metadata.Renditions = renditions
+					return err
+				})
+				// Renditions of an earlier version go once the item is stored
+				metadata.replacedRenditions = replacedRenditions(previousRenditions, metadata.Renditions)
+				if err != nil {
+					setStage(stageRenditions, stageFailed, err)
+				} else {
+					setStage(stageRenditions, stageDone, nil)
+				}
+				if isRetryable(err) {
+					return metadata, fmt.Errorf("renditions: %w", err)
+				}
+				if err != nil {
+					log.Printf("Error generating renditions for %s: %v", key, err)
+				}
+			}
+		} else {
+			metadata.Renditions = nil
+			setStage(stageRenditions, stageSkipped, nil)
+		}
+	}
+
+	// Index faces with Rekognition (IndexFaces only accepts still images)
+	var inherited map[string]string
+	indexed := false
+	// A retried upload indexes again, so faces from a failed run are dropped
+	discardIndexed := func() {
+		if !indexed {
+			return
+		}
+		if err := p.discardFaces(bucket, p.collectionFor(metadata.EventID), metadata.Faces); err != nil {
+			log.Printf("Error discarding faces indexed for %s: %v", key, err)
+		}
+	}
+	if run[stageFaces] {
+		if metadata.MediaType == "photo" {
+			if dryRun {
+				log.Printf("Would reindex faces for %s", key)
+			} else {
+				collectionID := p.collectionFor(metadata.EventID)
+				var faces []FaceDetail
+				var modelVersion string
+				err := withRetry(ctx, "index faces for "+key, func() error {
+					if _, err := p.ensureCollection(collectionID); err != nil {
+						return err
+					}
+					var err error
+					faces, modelVersion, err = indexFaces(p.rekognitionClient, bucket, key, collectionID, metadata.Faces)
+					return err
+				})
+				// The old faces stay in the collection and with their people
+				// until the new ones are indexed, so a run that fails here
+				// leaves the photo as it was for the retry to inherit
+				var unassigned []FaceAssignment
+				if err == nil {
+					err = withRetry(ctx, "unassign faces for "+key, func() error {
+						removed, err := p.unassignPhoto(key)
+						unassigned = append(unassigned, removed...)
+						return err
+					})
+					if err != nil {
+						if err := p.discardFaces(bucket, collectionID, faces); err != nil {
+							log.Printf("Error discarding faces indexed for %s: %v", key, err)
+						}
+						setStage(stageFaces, stageFailed, err)
+						return metadata, fmt.Errorf("unassign faces: %w", err)
+					}
+				}
+				if isRetryable(err) {
+					setStage(stageFaces, stageFailed, err)
+					return metadata, fmt.Errorf("index faces: %w", err)
+				}
+				if err != nil {
+					// e.g. an image Rekognition rejects; the rest of the metadata is still useful
+					log.Printf("Error indexing faces for %s: %v", key, err)
+					setStage(stageFaces, stageFailed, err)
+				} else {
+					// The replaced faces and their crops go once the item is
+					// stored without them, see discardReplaced
+					metadata.replacedFaces = append(metadata.replacedFaces, metadata.Faces...)
+					// Reindexing the same photo keeps its faces with the people they were in
+					inherited = inheritPeople(metadata.Faces, unassigned, faces)
+					metadata.Faces = faces
+					metadata.FaceCount = len(faces)
+					metadata.FaceModel = modelVersion
+					indexed = true
+					log.Printf("Indexed %d faces for %s", len(faces), key)
+					setStage(stageFaces, stageDone, nil)
+				}
+			}
+		} else {
+			setStage(stageFaces, stageSkipped, nil)
+		}
+	}
+
+	// Cut a square crop around each face; freshly indexed faces always need them
+	if run[stageFaceCrops] || run[stageFaces] {
+		if len(metadata.Faces) == 0 {
+			setStage(stageFaceCrops, stageSkipped, nil)
+		} else if dryRun {
+			log.Printf("Would crop %d faces for %s", len(metadata.Faces), key)
+		} else {
+			err := withRetry(ctx, "face crops for "+key, func() error {
+				return p.generateFaceCrops(bucket, key, &metadata)
+			})
+			if err == nil {
+				// Faces clustered earlier keep their assignment, which shows the crop too
+				err = withRetry(ctx, "face crop assignments for "+key, func() error {
+					return p.setAssignmentCrops(metadata.Faces)
+				})
+			}
+			if err != nil {
+				setStage(stageFaceCrops, stageFailed, err)
+			} else {
+				setStage(stageFaceCrops, stageDone, nil)
+			}
+			if isRetryable(err) {
+				discardIndexed()
+				return metadata, fmt.Errorf("face crops: %w", err)
+			}
+			if err != nil {
+				log.Printf("Error cropping faces for %s: %v", key, err)
+			}
+		}
+	}
+
+	// Group the faces into people; freshly indexed faces always need it
+	if run[stagePeople] || run[stageFaces] {
+		if len(metadata.Faces) == 0 {
+			setStage(stagePeople, stageSkipped, nil)
+		} else if dryRun {
+			log.Printf("Would cluster %d faces for %s", len(metadata.Faces), key)
+		} else {
+			err := p.assignPeople(ctx, key, metadata.Faces, inherited)
+			if err != nil {
+				setStage(stagePeople, stageFailed, err)
+			} else {
+				setStage(stagePeople, stageDone, nil)
+			}
+			if isRetryable(err) {
+				discardIndexed()
+				return metadata, fmt.Errorf("people: %w", err)
+			}
+			if err != nil {
+				log.Printf("Error clustering faces for %s: %v", key, err)
+			}
+		}
+	}
+
+	return metadata, nil
+}
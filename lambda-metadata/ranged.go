@@ -0,0 +1,184 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// objectReader is what metadata extraction needs from an upload: random
+// access for container atoms and a stream for EXIF and image headers
+type objectReader interface {
+	io.ReaderAt
+	io.ReadSeeker
+	Size() int64
+}
+
+// Ranged reads start small and double while the reader keeps asking for
+// the bytes right after the last fetch, e.g. EXIF parsing walking JPEG segments
+const (
+	initialRangeSize = 64 << 10
+	maxRangeSize     = 4 << 20
+)
+
+// objectGetter is the S3 call rangeReader fetches through
+type objectGetter interface {
+	GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error)
+}
+
+// rangeReader reads an S3 object through ranged GETs, keeping what it has
+// fetched so header parsing only downloads the bytes it touches
+type rangeReader struct {
+	client       objectGetter
+	bucket       string
+	key          string
+	size         int64
+	lastModified time.Time
+
+	chunks    []chunk // fetched ranges, in fetch order
+	nextRange int64   // size of the next fetch
+	lastEnd   int64   // end offset of the last fetch
+	fetched   int64   // bytes downloaded so far
+	pos       int64   // offset for Read and Seek
+}
+
+type chunk struct {
+	offset int64
+	data   []byte
+}
+
+// openRangeReader looks up the object's size without downloading it
+func openRangeReader(client *s3.S3, bucket, key string) (*rangeReader, error) {
+	head, err := client.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &rangeReader{
+		client:       client,
+		bucket:       bucket,
+		key:          key,
+		size:         aws.Int64Value(head.ContentLength),
+		lastModified: aws.TimeValue(head.LastModified),
+		nextRange:    initialRangeSize,
+	}, nil
+}
+
+func (r *rangeReader) Size() int64 { return r.size }
+
+// ReadAt serves p from fetched chunks, fetching whatever is missing
+func (r *rangeReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("rangeReader: negative offset")
+	}
+	if off >= r.size {
+		return 0, io.EOF
+	}
+
+	n := 0
+	for n < len(p) && off+int64(n) < r.size {
+		pos := off + int64(n)
+		if c, ok := r.chunkAt(pos); ok {
+			n += copy(p[n:], c.data[pos-c.offset:])
+			continue
+		}
+		if err := r.fetch(pos, int64(len(p)-n)); err != nil {
+			return n, err
+		}
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (r *rangeReader) chunkAt(pos int64) (chunk, bool) {
+	for _, c := range r.chunks {
+		if pos >= c.offset && pos < c.offset+int64(len(c.data)) {
+			return c, true
+		}
+	}
+	return chunk{}, false
+}
+
+// fetch downloads at least want bytes starting at pos, growing the range
+// for sequential reads
+func (r *rangeReader) fetch(pos, want int64) error {
+	if pos == r.lastEnd && r.fetched > 0 {
+		r.nextRange = min(r.nextRange*2, maxRangeSize)
+	} else {
+		r.nextRange = initialRangeSize
+	}
+	length := max(want, r.nextRange)
+	end := min(pos+length, r.size) // exclusive
+
+	result, err := r.client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(r.bucket),
+		Key:    aws.String(r.key),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", pos, end-1)),
+	})
+	if err != nil {
+		return err
+	}
+	defer result.Body.Close()
+
+	data, err := io.ReadAll(result.Body)
+	if err != nil {
+		return transient(fmt.Errorf("failed to read range: %w", err))
+	}
+	if len(data) == 0 {
+		return io.ErrUnexpectedEOF
+	}
+
+	r.chunks = append(r.chunks, chunk{offset: pos, data: data})
+	r.lastEnd = pos + int64(len(data))
+	r.fetched += int64(len(data))
+	return nil
+}
+
+func (r *rangeReader) Read(p []byte) (int, error) {
+	n, err := r.ReadAt(p, r.pos)
+	r.pos += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (r *rangeReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("rangeReader: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("rangeReader: negative position")
+	}
+	r.pos = offset
+	return offset, nil
+}
+
+// readErrorTracker remembers read errors from a streamed body, so a decode
+// failure caused by a dropped connection isn't mistaken for a corrupt file
+type readErrorTracker struct {
+	r   io.Reader
+	err error
+}
+
+func (t *readErrorTracker) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	if err != nil && err != io.EOF {
+		t.err = err
+	}
+	return n, err
+}
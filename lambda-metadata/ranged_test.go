@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// fakeGetter serves ranged GETs from memory and records what was asked for
+type fakeGetter struct {
+	data        []byte
+	maxResponse int   // caps each response body, 0 for no cap
+	err         error // returned instead of a response
+	bodyErr     error // returned after the body's bytes
+	ranges      [][2]int64
+}
+
+func (g *fakeGetter) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	var start, end int64
+	if _, err := fmt.Sscanf(aws.StringValue(input.Range), "bytes=%d-%d", &start, &end); err != nil {
+		return nil, err
+	}
+	g.ranges = append(g.ranges, [2]int64{start, end})
+	if g.err != nil {
+		return nil, g.err
+	}
+
+	end = min(end+1, int64(len(g.data)))
+	start = min(start, end)
+	if g.maxResponse > 0 {
+		end = min(end, start+int64(g.maxResponse))
+	}
+	var body io.Reader = bytes.NewReader(g.data[start:end])
+	if g.bodyErr != nil {
+		body = io.MultiReader(body, &errReader{err: g.bodyErr})
+	}
+	return &s3.GetObjectOutput{Body: io.NopCloser(body)}, nil
+}
+
+type errReader struct{ err error }
+
+func (f *errReader) Read([]byte) (int, error) { return 0, f.err }
+
+func testObject(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	return data
+}
+
+func newTestRangeReader(getter *fakeGetter, size int) *rangeReader {
+	return &rangeReader{client: getter, bucket: "bucket", key: "uploads/a.jpg", size: int64(size), nextRange: initialRangeSize}
+}
+
+func TestRangeReaderSequentialGrowth(t *testing.T) {
+	const size = 16 << 20
+	getter := &fakeGetter{data: testObject(size)}
+	r := newTestRangeReader(getter, size)
+
+	// Small reads, like a parser walking segments
+	var got []byte
+	buf := make([]byte, 4<<10)
+	for {
+		n, err := r.Read(buf)
+		got = append(got, buf[:n]...)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+	}
+	if !bytes.Equal(got, getter.data) {
+		t.Fatal("read bytes differ from the object")
+	}
+
+	const kb, mb = 1 << 10, 1 << 20
+	want := []int64{64 * kb, 128 * kb, 256 * kb, 512 * kb, 1 * mb, 2 * mb, 4 * mb, 4 * mb, 4 * mb, 64 * kb}
+	if len(getter.ranges) != len(want) {
+		t.Fatalf("fetched %d ranges %v, want %d", len(getter.ranges), getter.ranges, len(want))
+	}
+	offset := int64(0)
+	for i, rng := range getter.ranges {
+		if rng[0] != offset || rng[1]-rng[0]+1 != want[i] {
+			t.Errorf("range %d = %d-%d, want %d bytes from %d", i, rng[0], rng[1], want[i], offset)
+		}
+		offset = rng[1] + 1
+	}
+	if r.fetched != size {
+		t.Errorf("fetched = %d, want %d", r.fetched, size)
+	}
+}
+
+func TestRangeReaderReadAt(t *testing.T) {
+	const kb, mb = 1 << 10, 1 << 20
+	type read struct{ off, n int64 }
+	tests := []struct {
+		name  string
+		size  int
+		reads []read
+		want  [][2]int64 // requested ranges, end inclusive
+	}{
+		{
+			name:  "cached bytes aren't fetched again",
+			size:  mb,
+			reads: []read{{0, 10}, {100, 10}, {64*kb - 10, 10}},
+			want:  [][2]int64{{0, 64*kb - 1}},
+		},
+		{
+			name:  "read crossing a fetched range continues sequentially",
+			size:  mb,
+			reads: []read{{0, 10}, {64*kb - 5, 10}},
+			want:  [][2]int64{{0, 64*kb - 1}, {64 * kb, 192*kb - 1}},
+		},
+		{
+			name:  "read larger than the range fetches all of it",
+			size:  mb,
+			reads: []read{{0, 100 * kb}, {100 * kb, 10}},
+			want:  [][2]int64{{0, 100*kb - 1}, {100 * kb, 228*kb - 1}},
+		},
+		{
+			name:  "random access starts over at 64KB",
+			size:  4 * mb,
+			reads: []read{{0, 10}, {mb, 10}, {mb + 64*kb, 10}, {3 * mb, 10}},
+			want:  [][2]int64{{0, 64*kb - 1}, {mb, mb + 64*kb - 1}, {mb + 64*kb, mb + 192*kb - 1}, {3 * mb, 3*mb + 64*kb - 1}},
+		},
+		{
+			name:  "last range stops at the end of the object",
+			size:  100 * kb,
+			reads: []read{{0, 10}, {64 * kb, 10}},
+			want:  [][2]int64{{0, 64*kb - 1}, {64 * kb, 100*kb - 1}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			getter := &fakeGetter{data: testObject(tt.size)}
+			r := newTestRangeReader(getter, tt.size)
+			for _, rd := range tt.reads {
+				p := make([]byte, rd.n)
+				n, err := r.ReadAt(p, rd.off)
+				if err != nil || n != len(p) {
+					t.Fatalf("ReadAt(%d bytes, %d) = %d, %v", rd.n, rd.off, n, err)
+				}
+				if !bytes.Equal(p, getter.data[rd.off:rd.off+rd.n]) {
+					t.Errorf("ReadAt(%d bytes, %d) returned the wrong bytes", rd.n, rd.off)
+				}
+			}
+			if fmt.Sprint(getter.ranges) != fmt.Sprint(tt.want) {
+				t.Errorf("ranges = %v, want %v", getter.ranges, tt.want)
+			}
+		})
+	}
+}
+
+func TestRangeReaderShortResponses(t *testing.T) {
+	const size = 10000
+	errAccessDenied := errors.New("AccessDenied")
+	tests := []struct {
+		name      string
+		getter    *fakeGetter
+		objSize   int // size from HeadObject, if different from the data
+		readSize  int
+		wantN     int
+		wantErr   error
+		retryable bool
+		requests  int
+	}{
+		{
+			name:     "responses shorter than asked are stitched together",
+			getter:   &fakeGetter{data: testObject(size), maxResponse: 1000},
+			readSize: 5000,
+			wantN:    5000,
+			requests: 5,
+		},
+		{
+			name:     "read past the end returns what there is",
+			getter:   &fakeGetter{data: testObject(size)},
+			readSize: size + 10,
+			wantN:    size,
+			wantErr:  io.EOF,
+			requests: 1,
+		},
+		{
+			name:     "object shorter than its size",
+			getter:   &fakeGetter{data: testObject(size / 2)},
+			objSize:  size,
+			readSize: size,
+			wantN:    size / 2,
+			wantErr:  io.ErrUnexpectedEOF,
+			requests: 2,
+		},
+		{
+			name:     "request error is returned",
+			getter:   &fakeGetter{data: testObject(size), err: errAccessDenied},
+			readSize: 10,
+			wantErr:  errAccessDenied,
+			requests: 1,
+		},
+		{
+			name:      "dropped body is retryable",
+			getter:    &fakeGetter{data: testObject(size), maxResponse: 100, bodyErr: io.ErrUnexpectedEOF},
+			readSize:  10,
+			wantErr:   io.ErrUnexpectedEOF,
+			retryable: true,
+			requests:  1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			objSize := tt.objSize
+			if objSize == 0 {
+				objSize = len(tt.getter.data)
+			}
+			r := newTestRangeReader(tt.getter, objSize)
+			p := make([]byte, tt.readSize)
+			n, err := r.ReadAt(p, 0)
+			if n != tt.wantN || !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ReadAt = %d, %v, want %d, %v", n, err, tt.wantN, tt.wantErr)
+			}
+			if !bytes.Equal(p[:n], tt.getter.data[:n]) {
+				t.Error("ReadAt returned the wrong bytes")
+			}
+			if isRetryable(err) != tt.retryable {
+				t.Errorf("isRetryable(%v) = %t, want %t", err, !tt.retryable, tt.retryable)
+			}
+			if len(tt.getter.ranges) != tt.requests {
+				t.Errorf("made %d requests %v, want %d", len(tt.getter.ranges), tt.getter.ranges, tt.requests)
+			}
+			for i := 1; i < len(tt.getter.ranges); i++ {
+				if prev, cur := tt.getter.ranges[i-1], tt.getter.ranges[i]; cur[0] <= prev[0] {
+					t.Errorf("request %d starts at %d, before the previous one at %d", i, cur[0], prev[0])
+				}
+			}
+		})
+	}
+}
+
+func TestRangeReaderSeek(t *testing.T) {
+	const size = 1000
+	tests := []struct {
+		name     string
+		offset   int64
+		whence   int
+		wantPos  int64
+		wantErr  bool
+		wantRead int // bytes a 10-byte Read returns afterwards
+	}{
+		{name: "start", offset: 100, whence: io.SeekStart, wantPos: 100, wantRead: 10},
+		{name: "current", offset: -5, whence: io.SeekCurrent, wantPos: 5, wantRead: 10},
+		{name: "end", offset: 0, whence: io.SeekEnd, wantPos: size},
+		{name: "just before the end", offset: -4, whence: io.SeekEnd, wantPos: size - 4, wantRead: 4},
+		{name: "past the end", offset: size + 10, whence: io.SeekStart, wantPos: size + 10},
+		{name: "negative position", offset: -11, whence: io.SeekCurrent, wantErr: true},
+		{name: "invalid whence", offset: 0, whence: 3, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			getter := &fakeGetter{data: testObject(size)}
+			r := newTestRangeReader(getter, size)
+			r.pos = 10
+
+			pos, err := r.Seek(tt.offset, tt.whence)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("Seek(%d, %d) = %d, want an error", tt.offset, tt.whence, pos)
+				}
+				if r.pos != 10 {
+					t.Errorf("failed Seek moved the position to %d", r.pos)
+				}
+				return
+			}
+			if err != nil || pos != tt.wantPos {
+				t.Fatalf("Seek(%d, %d) = %d, %v, want %d", tt.offset, tt.whence, pos, err, tt.wantPos)
+			}
+
+			p := make([]byte, 10)
+			n, err := r.Read(p)
+			if n != tt.wantRead {
+				t.Fatalf("Read after Seek = %d, %v, want %d bytes", n, err, tt.wantRead)
+			}
+			if n > 0 && (err != nil || !bytes.Equal(p[:n], getter.data[pos:pos+int64(n)])) {
+				t.Errorf("Read after Seek = %v, %v, want the bytes at %d", p[:n], err, pos)
+			}
+			if n == 0 && err != io.EOF {
+				t.Errorf("Read at the end = %v, want io.EOF", err)
+			}
+			if n, err := r.Read(p); tt.wantRead < 10 && (n != 0 || err != io.EOF) {
+				t.Errorf("second Read at the end = %d, %v, want 0, io.EOF", n, err)
+			}
+			if pos >= size && len(getter.ranges) > 0 {
+				t.Errorf("read at the end fetched %v", getter.ranges)
+			}
+		})
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/rekognition"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// removePhoto cleans up after an upload is deleted: its faces in the
+// collection, their crops, its renditions, the app's resized copies, the
+// guests' likes and comments on it and its metadata items. Anything already
+// gone is skipped, so the same ObjectRemoved event can be handled more than
+// once.
+func removePhoto(s3Client *s3.S3, dynamoClient *dynamodb.DynamoDB, rekognitionClient *rekognition.Rekognition,
+	bucket, key, tableName, likesTable, commentsTable, collectionID, sequencer string) error {
+	items, err := metadataItems(dynamoClient, tableName, key)
+	if err != nil {
+		return err
+	}
+
+	// The key may have been uploaded again after this delete happened
+	for _, item := range items {
+		if sequencer != "" && item.Sequencer > sequencer {
+			log.Printf("Skipping stale delete for %s: a newer upload has been processed", key)
+			return nil
+		}
+	}
+
+	var faces []FaceDetail
+	for _, item := range items {
+		faces = append(faces, item.Faces...)
+	}
+	if err := deleteFaces(rekognitionClient, collectionID, faces); err != nil {
+		return err
+	}
+
+	for _, item := range items {
+		if err := deleteFaceCrops(s3Client, bucket, item.Faces); err != nil {
+			return err
+		}
+		// Faces staged by an unfinished rebuild-collection
+		if item.Rebuild != nil {
+			if err := deleteFaces(rekognitionClient, item.Rebuild.CollectionID, item.Rebuild.Faces); err != nil {
+				return err
+			}
+			if err := deleteFaceCrops(s3Client, bucket, item.Rebuild.Faces); err != nil {
+				return err
+			}
+		}
+	}
+
+	// The items list the current renditions; ones written before rendition
+	// keys were versioned are derived from the upload key. Deleting a
+	// missing key succeeds.
+	var renditions []string
+	for _, spec := range renditionSpecs {
+		renditions = append(renditions, renditionKey(key, spec.Name, ""))
+	}
+	for _, item := range items {
+		renditions = append(renditions, replacedRenditions(item.Renditions, nil)...)
+	}
+	if err := deleteRenditions(s3Client, bucket, renditions); err != nil {
+		return err
+	}
+
+	if err := deleteDerivatives(s3Client, bucket, key); err != nil {
+		return err
+	}
+
+	// The metadata items go last: they hold the counts of these
+	if err := deleteReactions(dynamoClient, likesTable, "guestId", key); err != nil {
+		return err
+	}
+	if err := deleteReactions(dynamoClient, commentsTable, "commentId", key); err != nil {
+		return err
+	}
+
+	for _, item := range items {
+		_, err := dynamoClient.DeleteItem(&dynamodb.DeleteItemInput{
+			TableName: aws.String(tableName),
+			Key: map[string]*dynamodb.AttributeValue{
+				"photoId":    {S: aws.String(item.PhotoID)},
+				"uploadedAt": {N: aws.String(fmt.Sprint(item.UploadedAt))},
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to delete metadata: %w", err)
+		}
+	}
+
+	log.Printf("Removed %d metadata items and %d faces for %s", len(items), len(faces), key)
+	return nil
+}
+
+// deleteRenditions removes rendition objects by key
+func deleteRenditions(client *s3.S3, bucket string, keys []string) error {
+	for _, key := range keys {
+		if _, err := client.DeleteObject(&s3.DeleteObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		}); err != nil {
+			return fmt.Errorf("failed to delete rendition %s: %w", key, err)
+		}
+	}
+	return nil
+}
+
+// deleteReactions removes a photo's likes or comments. Both tables are keyed
+// by photoId and rangeKey. A table left unconfigured is skipped.
+func deleteReactions(client *dynamodb.DynamoDB, tableName, rangeKey, photoID string) error {
+	if tableName == "" {
+		return nil
+	}
+	var keys []map[string]*dynamodb.AttributeValue
+	err := client.QueryPages(&dynamodb.QueryInput{
+		TableName:                 aws.String(tableName),
+		KeyConditionExpression:    aws.String("photoId = :photoId"),
+		ProjectionExpression:      aws.String("photoId, #rangeKey"),
+		ExpressionAttributeNames:  map[string]*string{"#rangeKey": aws.String(rangeKey)},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":photoId": {S: aws.String(photoID)}},
+	}, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+		keys = append(keys, page.Items...)
+		return true
+	})
+	if err != nil {
+		return fmt.Errorf("failed to look up %s: %w", tableName, err)
+	}
+	for _, key := range keys {
+		_, err := client.DeleteItem(&dynamodb.DeleteItemInput{
+			TableName: aws.String(tableName),
+			Key:       key,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to delete from %s: %w", tableName, err)
+		}
+	}
+	return nil
+}
+
+// The app caches resized copies served by /img under
+// derivatives/{size}-{fit}-q{quality}/{id}.jpg, where id is the upload key
+// without its uploads/ prefix (see derivativeKey in the app)
+const derivativesPrefix = "derivatives/"
+
+// deleteDerivatives removes the app's cached resized copies of an upload.
+// There is one folder per size and quality requested so far, and each holds
+// at most one copy of the upload.
+func deleteDerivatives(client *s3.S3, bucket, key string) error {
+	name := strings.TrimPrefix(key, "uploads/") + ".jpg"
+	var objects []*s3.ObjectIdentifier
+	err := client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket:    aws.String(bucket),
+		Prefix:    aws.String(derivativesPrefix),
+		Delimiter: aws.String("/"),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, folder := range page.CommonPrefixes {
+			objects = append(objects, &s3.ObjectIdentifier{Key: aws.String(aws.StringValue(folder.Prefix) + name)})
+		}
+		return true
+	})
+	if err != nil {
+		return fmt.Errorf("failed to list derivatives: %w", err)
+	}
+
+	// DeleteObjects accepts at most 1000 keys per call; missing keys succeed
+	for start := 0; start < len(objects); start += 1000 {
+		result, err := client.DeleteObjects(&s3.DeleteObjectsInput{
+			Bucket: aws.String(bucket),
+			Delete: &s3.Delete{Objects: objects[start:min(start+1000, len(objects))], Quiet: aws.Bool(true)},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to delete derivatives: %w", err)
+		}
+		if len(result.Errors) > 0 {
+			return fmt.Errorf("failed to delete derivative %s: %s", aws.StringValue(result.Errors[0].Key), aws.StringValue(result.Errors[0].Message))
+		}
+	}
+	return nil
+}
+
+// isNotFound reports whether a Rekognition error means the collection or
+// face is already gone
+func isNotFound(err error) bool {
+	var aerr awserr.Error
+	return errors.As(err, &aerr) && aerr.Code() == rekognition.ErrCodeResourceNotFoundException
+}
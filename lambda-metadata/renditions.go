@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"log"
+	"path"
+	"strings"
+
+	"github.com/Andrew-Wichmann/wedding-photos-app/internal/imaging"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+type Rendition struct {
+	Key    string `json:"key"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+}
+
+type renditionSpec struct {
+	Name    string
+	MaxEdge int
+	Quality int
+}
+
+// Ordered largest first so each size can be scaled down from the previous one
+var renditionSpecs = []renditionSpec{
+	{Name: "large", MaxEdge: 2048, Quality: 85},
+	{Name: "medium", MaxEdge: 1024, Quality: 82},
+	{Name: "thumbnail", MaxEdge: 320, Quality: 75},
+}
+
+// renditionKey maps an upload key to the key of one of its renditions. The
+// version of the upload is part of the key, since renditions are served as
+// immutable and an overwritten upload must not show the old image, e.g.
+// uploads/1700000000-IMG_1234.HEIC -> renditions/medium/1700000000-IMG_1234.HEIC.{version}.jpg
+// Renditions written before versions were added have none.
+func renditionKey(key, name, version string) string {
+	base := strings.TrimPrefix(key, "uploads/")
+	if version != "" {
+		base += "." + version
+	} else if ext := strings.ToLower(path.Ext(base)); ext == ".jpg" || ext == ".jpeg" {
+		return "renditions/" + name + "/" + base
+	}
+	return "renditions/" + name + "/" + base + ".jpg"
+}
+
+// renditionVersion identifies the content of an upload from its ETag, which
+// changes whenever the object is overwritten
+func renditionVersion(etag string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-':
+			return r
+		}
+		return -1
+	}, etag)
+}
+
+// replacedRenditions lists the keys in old that new no longer uses
+func replacedRenditions(old, new map[string]Rendition) []string {
+	current := make(map[string]bool, len(new))
+	for _, rendition := range new {
+		current[rendition.Key] = true
+	}
+	var keys []string
+	for _, rendition := range old {
+		if !current[rendition.Key] {
+			keys = append(keys, rendition.Key)
+		}
+	}
+	return keys
+}
+
+func generateRenditions(client *s3.S3, bucket, key, version string, r io.Reader, orientation int) (map[string]Rendition, error) {
+	src, format, err := imaging.Decode(r)
+	if err == image.ErrFormat {
+		// Videos and formats we can't decode (e.g. HEIC) keep serving the original
+		log.Printf("Skipping renditions for %s: unsupported format", key)
+		return nil, nil
+	}
+	if errors.Is(err, imaging.ErrTooLarge) {
+		log.Printf("Skipping renditions for %s: %v", key, err)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %s image: %w", format, err)
+	}
+
+	renditions := make(map[string]Rendition)
+	current := src
+	for _, spec := range renditionSpecs {
+		// Scale before orienting so the pixel shuffle only touches the small image
+		resized := imaging.Resize(current, spec.MaxEdge)
+		current = resized
+		oriented := imaging.ApplyOrientation(resized, orientation)
+
+		data, err := imaging.EncodeJPEG(oriented, spec.Quality)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode %s rendition: %w", spec.Name, err)
+		}
+
+		dstKey := renditionKey(key, spec.Name, version)
+		_, err = client.PutObject(&s3.PutObjectInput{
+			Bucket:       aws.String(bucket),
+			Key:          aws.String(dstKey),
+			Body:         bytes.NewReader(data),
+			ContentType:  aws.String("image/jpeg"),
+			CacheControl: aws.String("public, max-age=31536000, immutable"),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to upload %s rendition: %w", spec.Name, err)
+		}
+
+		renditions[spec.Name] = Rendition{
+			Key:    dstKey,
+			Width:  oriented.Bounds().Dx(),
+			Height: oriented.Bounds().Dy(),
+		}
+	}
+
+	return renditions, nil
+}
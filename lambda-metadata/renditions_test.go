@@ -0,0 +1,48 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestRenditionKey(t *testing.T) {
+	tests := []struct {
+		key, version, want string
+	}{
+		{"uploads/1700000000-IMG_1234.HEIC", "", "renditions/medium/1700000000-IMG_1234.HEIC.jpg"},
+		{"uploads/1700000000-IMG_1234.jpg", "", "renditions/medium/1700000000-IMG_1234.jpg"},
+		{"uploads/1700000000-IMG_1234.jpg", "9b2cf535f27731c9", "renditions/medium/1700000000-IMG_1234.jpg.9b2cf535f27731c9.jpg"},
+		{"uploads/reunion/1700000000-IMG_1234.PNG", "d41d8cd9-2", "renditions/medium/reunion/1700000000-IMG_1234.PNG.d41d8cd9-2.jpg"},
+	}
+	for _, tt := range tests {
+		if got := renditionKey(tt.key, "medium", tt.version); got != tt.want {
+			t.Errorf("renditionKey(%q, %q) = %q, want %q", tt.key, tt.version, got, tt.want)
+		}
+	}
+}
+
+func TestRenditionVersion(t *testing.T) {
+	// S3 quotes ETags, and multipart uploads append the part count
+	if got := renditionVersion(`"d41d8cd98f00b204e9800998ecf8427e-3"`); got != "d41d8cd98f00b204e9800998ecf8427e-3" {
+		t.Errorf("renditionVersion = %q", got)
+	}
+}
+
+// An overwritten upload's renditions are replaced, a rerun of the same
+// version's are not
+func TestReplacedRenditions(t *testing.T) {
+	old := map[string]Rendition{
+		"large":  {Key: "renditions/large/a.jpg.v1.jpg"},
+		"medium": {Key: "renditions/medium/a.jpg.v1.jpg"},
+	}
+	got := replacedRenditions(old, map[string]Rendition{
+		"large":  {Key: "renditions/large/a.jpg.v2.jpg"},
+		"medium": {Key: "renditions/medium/a.jpg.v1.jpg"},
+	})
+	if !slices.Equal(got, []string{"renditions/large/a.jpg.v1.jpg"}) {
+		t.Errorf("replacedRenditions = %v", got)
+	}
+	if got := replacedRenditions(old, old); len(got) != 0 {
+		t.Errorf("replacedRenditions of the same renditions = %v", got)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// Backoff between attempts at a single AWS call. The SDK already retries
+// transport errors a few times, so these cover longer throttling spells.
+const (
+	maxAttempts    = 4
+	initialBackoff = 250 * time.Millisecond
+	maxBackoff     = 4 * time.Second
+)
+
+// Error codes worth retrying that the SDK's own checks don't cover
+var retryableCodes = map[string]bool{
+	"InternalServerError":                    true, // Rekognition
+	"ServiceUnavailable":                     true,
+	"ProvisionedThroughputExceededException": true,
+	"ThrottlingException":                    true,
+	"LimitExceededException":                 true,
+	"RequestLimitExceeded":                   true,
+	"SlowDown":                               true, // S3
+	"TransactionConflictException":           true, // DynamoDB
+}
+
+// transientError marks a non-AWS failure, such as a dropped download
+// stream, that is expected to succeed when tried again
+type transientError struct {
+	err error
+}
+
+func (e transientError) Error() string { return e.err.Error() }
+func (e transientError) Unwrap() error { return e.err }
+
+func transient(err error) error {
+	if err == nil {
+		return nil
+	}
+	return transientError{err: err}
+}
+
+// isRetryable classifies an error as worth retrying (throttling, timeouts,
+// 5xx responses, interrupted transfers). Everything else, such as a corrupt
+// file or a missing object, is permanent and retrying won't help.
+func isRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var transientErr transientError
+	if errors.As(err, &transientErr) {
+		return true
+	}
+	var aerr awserr.Error
+	if !errors.As(err, &aerr) {
+		return false
+	}
+	if retryableCodes[aerr.Code()] || request.IsErrorThrottle(aerr) || request.IsErrorRetryable(aerr) {
+		return true
+	}
+	var reqErr awserr.RequestFailure
+	return errors.As(err, &reqErr) && reqErr.StatusCode() >= 500
+}
+
+// withRetry runs fn until it succeeds, fails permanently or runs out of
+// attempts, backing off exponentially with full jitter between attempts
+func withRetry(ctx context.Context, operation string, fn func() error) error {
+	backoff := initialBackoff
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || !isRetryable(err) || attempt == maxAttempts {
+			return err
+		}
+
+		wait := time.Duration(rand.Int63n(int64(backoff)))
+		log.Printf("Retrying %s after %v (attempt %d/%d): %v", operation, wait, attempt, maxAttempts, err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"plain error", errors.New("image: unknown format"), false},
+		{"context deadline", context.DeadlineExceeded, true},
+		{"wrapped context deadline", fmt.Errorf("index faces: %w", context.DeadlineExceeded), true},
+		{"context canceled", context.Canceled, false},
+		{"transient", transient(errors.New("connection reset")), true},
+		{"wrapped transient", fmt.Errorf("read upload: %w", transient(errors.New("connection reset"))), true},
+		{"deadline skip", errDeadline, true},
+		{"throttling", awserr.New("ThrottlingException", "Rate exceeded", nil), true},
+		{"provisioned throughput", awserr.New("ProvisionedThroughputExceededException", "", nil), true},
+		{"S3 slow down", awserr.New("SlowDown", "", nil), true},
+		{"transaction conflict", awserr.New("TransactionConflictException", "", nil), true},
+		{"SDK request error", awserr.New(request.ErrCodeRequestError, "send request failed", errors.New("connection reset")), true},
+		{"5xx response", awserr.NewRequestFailure(awserr.New("InternalError", "", nil), 503, "req"), true},
+		{"missing object", awserr.NewRequestFailure(awserr.New("NoSuchKey", "", nil), 404, "req"), false},
+		{"access denied", awserr.NewRequestFailure(awserr.New("AccessDenied", "", nil), 403, "req"), false},
+		{"invalid image", awserr.New("InvalidImageFormatException", "", nil), false},
+		{"conditional check", awserr.New("ConditionalCheckFailedException", "", nil), false},
+		{"wrapped AWS error", fmt.Errorf("store metadata: %w", awserr.New("ThrottlingException", "", nil)), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isRetryable(tt.err); got != tt.want {
+				t.Errorf("isRetryable(%v) = %t, want %t", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWithRetry(t *testing.T) {
+	permanent := errors.New("image: unknown format")
+	throttled := awserr.New("ThrottlingException", "Rate exceeded", nil)
+	tests := []struct {
+		name      string
+		errs      []error // returned by successive attempts, then nil
+		canceled  bool
+		wantCalls int
+		wantErr   error
+	}{
+		{name: "first attempt succeeds", wantCalls: 1},
+		{name: "permanent error isn't retried", errs: []error{permanent}, wantCalls: 1, wantErr: permanent},
+		{name: "retryable error then success", errs: []error{throttled, throttled}, wantCalls: 3},
+		{name: "retryable then permanent", errs: []error{throttled, permanent}, wantCalls: 2, wantErr: permanent},
+		{name: "gives up after maxAttempts", errs: []error{throttled, throttled, throttled, throttled, throttled}, wantCalls: maxAttempts, wantErr: throttled},
+		{name: "canceled context stops retrying", errs: []error{throttled, throttled}, canceled: true, wantCalls: 1, wantErr: throttled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tt.canceled {
+				cancel()
+			}
+
+			calls := 0
+			err := withRetry(ctx, "test", func() error {
+				calls++
+				if calls <= len(tt.errs) {
+					return tt.errs[calls-1]
+				}
+				return nil
+			})
+			if err != tt.wantErr {
+				t.Errorf("withRetry = %v, want %v", err, tt.wantErr)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("made %d attempts, want %d", calls, tt.wantCalls)
+			}
+		})
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+// Overall processing status of a photo. "uploaded" is never written here:
+// the app reports it for objects that have no status item yet.
+const (
+	statusProcessing = "processing"
+	statusProcessed  = "processed"
+	statusFailed     = "failed"
+)
+
+// Processing stages and their outcomes
+const (
+	stageMetadata   = "metadata"
+	stageRenditions = "renditions"
+	stageFaces      = "faces"
+	stageFaceCrops  = "faceCrops"
+	stagePeople     = "people" // clustering faces into people
+
+	stagePending = "pending"
+	stageDone    = "done"
+	stageSkipped = "skipped" // not applicable, e.g. renditions for a video
+	stageFailed  = "failed"
+)
+
+var stages = []string{stageMetadata, stageRenditions, stageFaces, stageFaceCrops, stagePeople}
+
+type StageStatus struct {
+	Status    string `json:"status"`
+	Error     string `json:"error,omitempty"`
+	UpdatedAt int64  `json:"updatedAt"`
+}
+
+// PhotoStatus is kept in its own table so it can be written before the
+// metadata item exists and read cheaply by the app while uploads process
+type PhotoStatus struct {
+	PhotoID   string                 `json:"photoId"`
+	Status    string                 `json:"status"`
+	Error     string                 `json:"error,omitempty"`
+	Stages    map[string]StageStatus `json:"stages"`
+	UpdatedAt int64                  `json:"updatedAt"`
+}
+
+// Status writes are best effort: a photo shouldn't fail to process because
+// its progress couldn't be reported
+func (p *processor) startStatus(key string) {
+	if p.statusTable == "" {
+		return
+	}
+	now := time.Now().Unix()
+	status := PhotoStatus{
+		PhotoID:   key,
+		Status:    statusProcessing,
+		Stages:    make(map[string]StageStatus, len(stages)),
+		UpdatedAt: now,
+	}
+	for _, stage := range stages {
+		status.Stages[stage] = StageStatus{Status: stagePending, UpdatedAt: now}
+	}
+
+	av, err := dynamodbattribute.MarshalMap(status)
+	if err != nil {
+		log.Printf("Error marshaling status for %s: %v", key, err)
+		return
+	}
+	if _, err := p.dynamoClient.PutItem(&dynamodb.PutItemInput{
+		TableName: aws.String(p.statusTable),
+		Item:      av,
+	}); err != nil {
+		log.Printf("Error writing status for %s: %v", key, err)
+	}
+}
+
+func (p *processor) setStage(key, stage, outcome string, cause error) {
+	if p.statusTable == "" {
+		return
+	}
+	detail := StageStatus{Status: outcome, UpdatedAt: time.Now().Unix()}
+	if cause != nil {
+		detail.Error = cause.Error()
+	}
+	av, err := dynamodbattribute.Marshal(detail)
+	if err != nil {
+		log.Printf("Error marshaling %s stage for %s: %v", stage, key, err)
+		return
+	}
+
+	if _, err := p.dynamoClient.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:                aws.String(p.statusTable),
+		Key:                      map[string]*dynamodb.AttributeValue{"photoId": {S: aws.String(key)}},
+		UpdateExpression:         aws.String("SET stages.#stage = :detail, updatedAt = :now"),
+		ConditionExpression:      aws.String("attribute_exists(stages)"),
+		ExpressionAttributeNames: map[string]*string{"#stage": aws.String(stage)},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":detail": av,
+			":now":    {N: aws.String(strconv.FormatInt(detail.UpdatedAt, 10))},
+		},
+	}); err != nil && !isConditionFailed(err) {
+		// A photo processed before status tracking has no stages to update
+		log.Printf("Error writing %s stage for %s: %v", stage, key, err)
+	}
+}
+
+func (p *processor) finishStatus(key, status string, cause error) {
+	if p.statusTable == "" {
+		return
+	}
+	input := &dynamodb.UpdateItemInput{
+		TableName:                aws.String(p.statusTable),
+		Key:                      map[string]*dynamodb.AttributeValue{"photoId": {S: aws.String(key)}},
+		UpdateExpression:         aws.String("SET #status = :status, updatedAt = :now REMOVE #error"),
+		ExpressionAttributeNames: map[string]*string{"#status": aws.String("status"), "#error": aws.String("error")},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":status": {S: aws.String(status)},
+			":now":    {N: aws.String(strconv.FormatInt(time.Now().Unix(), 10))},
+		},
+	}
+	if cause != nil {
+		input.UpdateExpression = aws.String("SET #status = :status, updatedAt = :now, #error = :error")
+		input.ExpressionAttributeValues[":error"] = &dynamodb.AttributeValue{S: aws.String(cause.Error())}
+	}
+	if _, err := p.dynamoClient.UpdateItem(input); err != nil {
+		log.Printf("Error writing status for %s: %v", key, err)
+	}
+}
+
+func (p *processor) deleteStatus(key string) {
+	if p.statusTable == "" {
+		return
+	}
+	if _, err := p.dynamoClient.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName: aws.String(p.statusTable),
+		Key:       map[string]*dynamodb.AttributeValue{"photoId": {S: aws.String(key)}},
+	}); err != nil {
+		log.Printf("Error deleting status for %s: %v", key, err)
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata" // the provided.al2023 runtime ships without zoneinfo
+
+	"github.com/rwcarlsen/goexif/exif"
+	"github.com/rwcarlsen/goexif/tiff"
+)
+
+// EXIF 2.31 offset tags, which goexif doesn't load on its own
+const (
+	OffsetTime          exif.FieldName = "OffsetTime"
+	OffsetTimeOriginal  exif.FieldName = "OffsetTimeOriginal"
+	OffsetTimeDigitized exif.FieldName = "OffsetTimeDigitized"
+)
+
+var offsetTimeFields = map[uint16]exif.FieldName{
+	0x9010: OffsetTime,
+	0x9011: OffsetTimeOriginal,
+	0x9012: OffsetTimeDigitized,
+}
+
+// Where the UTC offset of DateTaken came from
+const (
+	timezoneFromOffset = "offset" // OffsetTimeOriginal or a container date with an offset
+	timezoneFromGPS    = "gps"    // difference between local time and the GPS UTC timestamp
+	timezoneFromEvent  = "event"  // assumed to be the configured event timezone
+)
+
+// Where DateTaken came from, in order of preference. Filename and upload
+// times are approximate and flagged as such in the gallery.
+const (
+	dateFromEXIF     = "exif"
+	dateFromVideo    = "video"
+	dateFromXMP      = "xmp"
+	dateFromFilename = "filename"
+	dateFromUpload   = "upload"
+)
+
+const exifTimeLayout = "2006:01:02 15:04:05"
+
+func init() {
+	exif.RegisterParsers(offsetTimeParser{})
+}
+
+// offsetTimeParser loads the offset tags from the Exif sub-IFD
+type offsetTimeParser struct{}
+
+func (offsetTimeParser) Parse(x *exif.Exif) error {
+	// Failing here would fail the whole decode, so missing offsets are ignored
+	tag, err := x.Get(exif.ExifIFDPointer)
+	if err != nil {
+		return nil
+	}
+	offset, err := tag.Int64(0)
+	if err != nil {
+		return nil
+	}
+	r := bytes.NewReader(x.Raw)
+	if _, err := r.Seek(offset, 0); err != nil {
+		return nil
+	}
+	dir, _, err := tiff.DecodeDir(r, x.Tiff.Order)
+	if err != nil {
+		return nil
+	}
+	x.LoadTags(dir, offsetTimeFields, false)
+	return nil
+}
+
+// exifCaptureTime resolves DateTimeOriginal, which EXIF stores as a local
+// wall-clock time without a zone, to an instant. The offset comes from
+// OffsetTimeOriginal if present, then from comparing against the GPS UTC
+// timestamp, and finally from the event timezone.
+func exifCaptureTime(x *exif.Exif, eventLoc *time.Location) (time.Time, string, bool) {
+	raw := exifString(x, exif.DateTimeOriginal)
+	offsetField := OffsetTimeOriginal
+	if raw == "" {
+		raw = exifString(x, exif.DateTime)
+		offsetField = OffsetTime
+	}
+	wallClock, err := time.Parse(exifTimeLayout, raw)
+	if err != nil {
+		return time.Time{}, "", false
+	}
+
+	if offset := exifString(x, offsetField); offset != "" {
+		if zone, err := time.Parse("-07:00", offset); err == nil {
+			_, seconds := zone.Zone()
+			return inZone(wallClock, time.FixedZone("", seconds)), timezoneFromOffset, true
+		}
+	}
+
+	if gpsTime, ok := exifGPSTime(x); ok {
+		// Cameras write the GPS fix time, which can lag the shutter, so round to 15 minutes
+		seconds := int(wallClock.Sub(gpsTime).Round(15 * time.Minute).Seconds())
+		if seconds >= -12*3600 && seconds <= 14*3600 {
+			return inZone(wallClock, time.FixedZone("", seconds)), timezoneFromGPS, true
+		}
+	}
+
+	return inZone(wallClock, eventLoc), timezoneFromEvent, true
+}
+
+// exifGPSTime combines GPSDateStamp and GPSTimeStamp into a UTC instant
+func exifGPSTime(x *exif.Exif) (time.Time, bool) {
+	date, err := time.Parse("2006:01:02", exifString(x, exif.GPSDateStamp))
+	if err != nil {
+		return time.Time{}, false
+	}
+	tag, err := x.Get(exif.GPSTimeStamp)
+	if err != nil || tag.Count < 3 {
+		return time.Time{}, false
+	}
+
+	var parts [3]float64
+	for i := range parts {
+		num, den, err := tag.Rat2(i)
+		if err != nil || den == 0 {
+			return time.Time{}, false
+		}
+		parts[i] = float64(num) / float64(den)
+	}
+	elapsed := time.Duration((parts[0]*3600 + parts[1]*60 + parts[2]) * float64(time.Second))
+	return date.Add(elapsed), true
+}
+
+// inZone reinterprets a wall-clock time (parsed as UTC) in loc
+func inZone(wallClock time.Time, loc *time.Location) time.Time {
+	return time.Date(wallClock.Year(), wallClock.Month(), wallClock.Day(),
+		wallClock.Hour(), wallClock.Minute(), wallClock.Second(), wallClock.Nanosecond(), loc)
+}
+
+// setCaptureTime stores the local capture time with its offset alongside the
+// UTC epoch, noting where the time and its offset came from
+func setCaptureTime(metadata *PhotoMetadata, t time.Time, dateSource, timezoneSource string) {
+	metadata.DateTaken = t.Format(time.RFC3339)
+	metadata.TakenAt = t.Unix()
+	metadata.DateTakenSource = dateSource
+	metadata.TimezoneSource = timezoneSource
+}
+
+// parseXMPDate parses an XMP date, which may omit the offset, the seconds
+// or the whole time of day
+func parseXMPDate(value string, eventLoc *time.Location) (time.Time, string, bool) {
+	if value == "" {
+		return time.Time{}, "", false
+	}
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04Z07:00"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, timezoneFromOffset, true
+		}
+	}
+	for _, layout := range []string{"2006-01-02T15:04:05.999999999", "2006-01-02T15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, value, eventLoc); err == nil {
+			return t, timezoneFromEvent, true
+		}
+	}
+	return time.Time{}, "", false
+}
+
+// Camera and app naming conventions that embed the capture time
+var filenameTimePatterns = []*regexp.Regexp{
+	// IMG_20251011_183000.jpg, PXL_20251011_183000123.jpg, VID_..., Screenshot_20251011-183000.png
+	regexp.MustCompile(`(?:IMG|VID|PXL|MVIMG|PANO|BURST|Screenshot)[_-](\d{4})(\d{2})(\d{2})[_-](\d{2})(\d{2})(\d{2})`),
+	// WhatsApp Image 2025-10-11 at 18.30.00.jpeg, Screenshot 2025-10-11 at 6.30.00 PM.png
+	regexp.MustCompile(`(?:WhatsApp (?:Image|Video)|Screenshot|Screen Shot) (\d{4})-(\d{2})-(\d{2}) at (\d{1,2})\.(\d{2})\.(\d{2})(?:\s?([AP]M))?`),
+	// Bare timestamps such as Samsung's 20251011_183000.jpg
+	regexp.MustCompile(`(?:^|[^\d])(\d{4})(\d{2})(\d{2})[_-](\d{2})(\d{2})(\d{2})(?:[^\d]|$)`),
+}
+
+// WhatsApp downloads (IMG-20251011-WA0001.jpg) only carry the date
+var filenameDatePattern = regexp.MustCompile(`(?:IMG|VID)-(\d{4})(\d{2})(\d{2})-WA\d+`)
+
+// filenameCaptureTime recognizes capture times in the original filename.
+// Filenames never carry an offset, so times are in the event timezone.
+func filenameCaptureTime(filename string, eventLoc *time.Location) (time.Time, bool) {
+	for _, pattern := range filenameTimePatterns {
+		m := pattern.FindStringSubmatch(filename)
+		if m == nil {
+			continue
+		}
+		var parts [6]int
+		for i := range parts {
+			parts[i], _ = strconv.Atoi(m[i+1])
+		}
+		if len(m) > 7 && m[7] != "" {
+			parts[3] %= 12
+			if m[7] == "PM" {
+				parts[3] += 12
+			}
+		}
+		if t, ok := validDate(parts[0], parts[1], parts[2], parts[3], parts[4], parts[5], eventLoc); ok {
+			return t, true
+		}
+	}
+
+	if m := filenameDatePattern.FindStringSubmatch(filename); m != nil {
+		year, _ := strconv.Atoi(m[1])
+		month, _ := strconv.Atoi(m[2])
+		day, _ := strconv.Atoi(m[3])
+		// Midday keeps the date stable whatever offset it is later viewed in
+		return validDate(year, month, day, 12, 0, 0, eventLoc)
+	}
+
+	return time.Time{}, false
+}
+
+// validDate builds a time, rejecting out-of-range fields instead of letting
+// time.Date normalize them, since digit runs in filenames are often not dates
+func validDate(year, month, day, hour, min, sec int, loc *time.Location) (time.Time, bool) {
+	t := time.Date(year, time.Month(month), day, hour, min, sec, 0, loc)
+	if year < 1990 || t.Month() != time.Month(month) || t.Day() != day || t.Hour() != hour || t.Minute() != min || t.Second() != sec {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// uploadTime reads the timestamp the app prefixes to each upload key,
+// e.g. uploads/1760225400-IMG_1234.jpg
+func uploadTime(key string) (time.Time, bool) {
+	base := path.Base(key)
+	prefix, _, found := strings.Cut(base, "-")
+	if !found {
+		return time.Time{}, false
+	}
+	seconds, err := strconv.ParseInt(prefix, 10, 64)
+	if err != nil || seconds <= 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(seconds, 0), true
+}
+
+// fallbackCaptureTime fills DateTaken for files without embedded dates, first
+// from the original filename, then from when the file was uploaded
+func fallbackCaptureTime(metadata *PhotoMetadata, key string) {
+	eventLoc := eventSettings(metadata.EventID).Location()
+	base := path.Base(key)
+	if _, filename, found := strings.Cut(base, "-"); found {
+		base = filename
+	}
+
+	if t, ok := filenameCaptureTime(base, eventLoc); ok {
+		setCaptureTime(metadata, t, dateFromFilename, timezoneFromEvent)
+		return
+	}
+	if t, ok := uploadTime(key); ok {
+		setCaptureTime(metadata, t.In(eventLoc), dateFromUpload, timezoneFromEvent)
+	}
+}
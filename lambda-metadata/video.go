@@ -0,0 +1,403 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MP4 and QuickTime files are a tree of "atoms" (boxes): a 32-bit size and a
+// four character type, followed by either data or more atoms. Only the small
+// subset needed for capture metadata is understood here.
+
+// QuickTime timestamps count seconds from 1904-01-01 UTC
+var quickTimeEpoch = time.Date(1904, 1, 1, 0, 0, 0, 0, time.UTC)
+
+var iso6709Pattern = regexp.MustCompile(`^([+-]\d+(?:\.\d+)?)([+-]\d+(?:\.\d+)?)([+-]\d+(?:\.\d+)?)?`)
+
+type atom struct {
+	Type   string
+	Offset int64 // start of the atom's payload
+	Size   int64 // payload size, excluding the header
+}
+
+type VideoInfo struct {
+	Duration     float64
+	CreationTime time.Time
+	Width        int
+	Height       int
+	Rotation     int
+	Codec        string
+	Make         string
+	Model        string
+	Software     string
+	Location     string // ISO 6709, e.g. +37.3349-122.0090+010.000/
+}
+
+// isQuickTime sniffs the first atom header for the types that can open an
+// MP4 or MOV file. HEIF photos open with an ftyp box too, so its brands are
+// checked, see heif.go.
+func isQuickTime(r io.ReaderAt) bool {
+	header := make([]byte, 8)
+	if _, err := r.ReadAt(header, 0); err != nil {
+		return false
+	}
+	switch string(header[4:8]) {
+	case "ftyp":
+		kind, _ := ftypKind(r)
+		return kind == kindVideo
+	case "moov", "mdat", "wide", "free", "skip", "pnot":
+		return true
+	}
+	return false
+}
+
+// readAtoms lists the atoms in the byte range [offset, offset+size)
+func readAtoms(r io.ReaderAt, offset, size int64) ([]atom, error) {
+	var atoms []atom
+	end := offset + size
+	header := make([]byte, 16)
+
+	for offset+8 <= end {
+		if _, err := r.ReadAt(header[:8], offset); err != nil {
+			return atoms, err
+		}
+		atomSize := int64(binary.BigEndian.Uint32(header[:4]))
+		atomType := string(header[4:8])
+		headerSize := int64(8)
+
+		switch atomSize {
+		case 0: // extends to the end of the enclosing range
+			atomSize = end - offset
+		case 1: // 64-bit size follows the type
+			if _, err := r.ReadAt(header[8:16], offset+8); err != nil {
+				return atoms, err
+			}
+			atomSize = int64(binary.BigEndian.Uint64(header[8:16]))
+			headerSize = 16
+		}
+		// Compared against the room left so a huge 64-bit size can't overflow
+		if atomSize < headerSize || atomSize > end-offset {
+			return atoms, fmt.Errorf("malformed %q atom at offset %d", atomType, offset)
+		}
+
+		atoms = append(atoms, atom{Type: atomType, Offset: offset + headerSize, Size: atomSize - headerSize})
+		offset += atomSize
+	}
+
+	return atoms, nil
+}
+
+func findAtom(atoms []atom, atomType string) (atom, bool) {
+	for _, a := range atoms {
+		if a.Type == atomType {
+			return a, true
+		}
+	}
+	return atom{}, false
+}
+
+func readAtomData(r io.ReaderAt, a atom, limit int64) ([]byte, error) {
+	size := max(min(a.Size, limit), 0)
+	data := make([]byte, size)
+	if _, err := r.ReadAt(data, a.Offset); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func parseQuickTime(r io.ReaderAt, size int64) (*VideoInfo, error) {
+	top, err := readAtoms(r, 0, size)
+	if err != nil && len(top) == 0 {
+		return nil, err
+	}
+	moov, ok := findAtom(top, "moov")
+	if !ok {
+		return nil, fmt.Errorf("no moov atom found")
+	}
+	children, err := readAtoms(r, moov.Offset, moov.Size)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &VideoInfo{}
+	for _, child := range children {
+		switch child.Type {
+		case "mvhd":
+			parseMovieHeader(r, child, info)
+		case "trak":
+			parseTrack(r, child, info)
+		case "udta":
+			parseUserData(r, child, info)
+		case "meta":
+			parseMetadataKeys(r, child, info)
+		}
+	}
+
+	return info, nil
+}
+
+func parseMovieHeader(r io.ReaderAt, mvhd atom, info *VideoInfo) {
+	data, err := readAtomData(r, mvhd, 32)
+	if err != nil || len(data) < 20 {
+		return
+	}
+
+	var created, timescale, duration uint64
+	if data[0] == 1 {
+		if len(data) < 32 {
+			return
+		}
+		created = binary.BigEndian.Uint64(data[4:12])
+		timescale = uint64(binary.BigEndian.Uint32(data[20:24]))
+		duration = binary.BigEndian.Uint64(data[24:32])
+	} else {
+		created = uint64(binary.BigEndian.Uint32(data[4:8]))
+		timescale = uint64(binary.BigEndian.Uint32(data[12:16]))
+		duration = uint64(binary.BigEndian.Uint32(data[16:20]))
+	}
+
+	// The Apple creationdate key is preferred since it carries the local offset
+	if created > 0 && info.CreationTime.IsZero() {
+		info.CreationTime = quickTimeEpoch.Add(time.Duration(created) * time.Second)
+	}
+	if timescale > 0 {
+		info.Duration = math.Round(float64(duration)/float64(timescale)*1000) / 1000
+	}
+}
+
+func parseTrack(r io.ReaderAt, trak atom, info *VideoInfo) {
+	children, _ := readAtoms(r, trak.Offset, trak.Size)
+
+	// Only the video track carries the dimensions, rotation and codec
+	mdia, ok := findAtom(children, "mdia")
+	if !ok {
+		return
+	}
+	mdiaChildren, _ := readAtoms(r, mdia.Offset, mdia.Size)
+	hdlr, ok := findAtom(mdiaChildren, "hdlr")
+	if !ok {
+		return
+	}
+	if data, err := readAtomData(r, hdlr, 12); err != nil || len(data) < 12 || string(data[8:12]) != "vide" {
+		return
+	}
+
+	if tkhd, ok := findAtom(children, "tkhd"); ok {
+		parseTrackHeader(r, tkhd, info)
+	}
+
+	// mdia/minf/stbl/stsd holds the sample entry whose type is the codec
+	minf, ok := findAtom(mdiaChildren, "minf")
+	if !ok {
+		return
+	}
+	minfChildren, _ := readAtoms(r, minf.Offset, minf.Size)
+	stbl, ok := findAtom(minfChildren, "stbl")
+	if !ok {
+		return
+	}
+	stblChildren, _ := readAtoms(r, stbl.Offset, stbl.Size)
+	if stsd, ok := findAtom(stblChildren, "stsd"); ok {
+		if data, err := readAtomData(r, stsd, 16); err == nil && len(data) >= 16 {
+			info.Codec = strings.TrimSpace(string(data[12:16]))
+		}
+	}
+}
+
+func parseTrackHeader(r io.ReaderAt, tkhd atom, info *VideoInfo) {
+	data, err := readAtomData(r, tkhd, 96)
+	if err != nil || len(data) < 84 {
+		return
+	}
+
+	// Version 1 headers use 64-bit times and duration, shifting the rest by 12 bytes
+	offset := 40
+	if data[0] == 1 {
+		offset = 52
+	}
+	if len(data) < offset+44 {
+		return
+	}
+
+	// 3x3 transformation matrix of 16.16 fixed-point values; a and b give the rotation
+	matrix := data[offset : offset+36]
+	a := float64(int32(binary.BigEndian.Uint32(matrix[0:4]))) / 65536
+	b := float64(int32(binary.BigEndian.Uint32(matrix[4:8]))) / 65536
+	rotation := int(math.Round(math.Atan2(b, a)*180/math.Pi)) % 360
+	if rotation < 0 {
+		rotation += 360
+	}
+	info.Rotation = rotation
+
+	info.Width = int(binary.BigEndian.Uint32(data[offset+36:offset+40]) >> 16)
+	info.Height = int(binary.BigEndian.Uint32(data[offset+40:offset+44]) >> 16)
+}
+
+// parseUserData reads QuickTime user data text atoms such as ©xyz
+func parseUserData(r io.ReaderAt, udta atom, info *VideoInfo) {
+	children, _ := readAtoms(r, udta.Offset, udta.Size)
+	for _, child := range children {
+		switch child.Type {
+		case "\xa9xyz":
+			if value := readUserDataText(r, child); value != "" && info.Location == "" {
+				info.Location = value
+			}
+		case "\xa9mak":
+			if value := readUserDataText(r, child); value != "" && info.Make == "" {
+				info.Make = value
+			}
+		case "\xa9mod":
+			if value := readUserDataText(r, child); value != "" && info.Model == "" {
+				info.Model = value
+			}
+		case "meta":
+			if child.Size < 4 {
+				continue
+			}
+			// ISO style meta is a full atom with 4 bytes of version and flags
+			parseMetadataKeys(r, atom{Type: "meta", Offset: child.Offset + 4, Size: child.Size - 4}, info)
+		}
+	}
+}
+
+// readUserDataText decodes an international text atom: 16-bit length,
+// 16-bit language code, then the string
+func readUserDataText(r io.ReaderAt, a atom) string {
+	data, err := readAtomData(r, a, 1024)
+	if err != nil || len(data) < 4 {
+		return ""
+	}
+	length := int(binary.BigEndian.Uint16(data[0:2]))
+	if 4+length > len(data) {
+		length = len(data) - 4
+	}
+	return strings.TrimRight(string(data[4:4+length]), "\x00")
+}
+
+// parseMetadataKeys reads the Apple mdta key/value metadata: a keys atom
+// naming each entry and an ilst atom whose children are 1-based key indexes
+func parseMetadataKeys(r io.ReaderAt, meta atom, info *VideoInfo) {
+	children, _ := readAtoms(r, meta.Offset, meta.Size)
+	keysAtom, ok := findAtom(children, "keys")
+	if !ok {
+		return
+	}
+	ilst, ok := findAtom(children, "ilst")
+	if !ok {
+		return
+	}
+
+	data, err := readAtomData(r, keysAtom, 64*1024)
+	if err != nil || len(data) < 8 {
+		return
+	}
+	// Each key takes at least 8 bytes, which bounds a corrupt count
+	count := int(min(binary.BigEndian.Uint32(data[4:8]), uint32(len(data)/8)))
+	keys := make([]string, 0, count)
+	for pos := 8; len(keys) < count && pos+8 <= len(data); {
+		keySize := int(binary.BigEndian.Uint32(data[pos : pos+4]))
+		if keySize < 8 || pos+keySize > len(data) {
+			break
+		}
+		keys = append(keys, string(data[pos+8:pos+keySize]))
+		pos += keySize
+	}
+
+	items, _ := readAtoms(r, ilst.Offset, ilst.Size)
+	for _, item := range items {
+		index := int(binary.BigEndian.Uint32([]byte(item.Type))) - 1
+		if index < 0 || index >= len(keys) {
+			continue
+		}
+		value := readMetadataValue(r, item)
+		if value == "" {
+			continue
+		}
+
+		switch keys[index] {
+		case "com.apple.quicktime.make":
+			info.Make = value
+		case "com.apple.quicktime.model":
+			info.Model = value
+		case "com.apple.quicktime.software":
+			info.Software = value
+		case "com.apple.quicktime.location.ISO6709":
+			info.Location = value
+		case "com.apple.quicktime.creationdate":
+			// Unlike mvhd this carries the local offset, e.g. 2025-10-11T18:30:00-0500
+			for _, layout := range []string{"2006-01-02T15:04:05-0700", time.RFC3339} {
+				if t, err := time.Parse(layout, value); err == nil {
+					info.CreationTime = t
+					break
+				}
+			}
+		}
+	}
+}
+
+// readMetadataValue returns the UTF-8 payload of an ilst item's data atom
+func readMetadataValue(r io.ReaderAt, item atom) string {
+	children, _ := readAtoms(r, item.Offset, item.Size)
+	dataAtom, ok := findAtom(children, "data")
+	if !ok {
+		return ""
+	}
+	data, err := readAtomData(r, dataAtom, 1024)
+	if err != nil || len(data) < 8 {
+		return ""
+	}
+	// Type indicator 1 is UTF-8; other types (numbers, images) aren't needed
+	if binary.BigEndian.Uint32(data[0:4])&0xFFFFFF != 1 {
+		return ""
+	}
+	return strings.TrimRight(string(data[8:]), "\x00")
+}
+
+// parseISO6709 parses a location like +37.3349-122.0090+010.000/
+func parseISO6709(value string) (lat, lon, alt float64, ok bool) {
+	m := iso6709Pattern.FindStringSubmatch(value)
+	if m == nil {
+		return 0, 0, 0, false
+	}
+	lat, err1 := strconv.ParseFloat(m[1], 64)
+	lon, err2 := strconv.ParseFloat(m[2], 64)
+	if err1 != nil || err2 != nil {
+		return 0, 0, 0, false
+	}
+	if m[3] != "" {
+		alt, _ = strconv.ParseFloat(m[3], 64)
+	}
+	return lat, lon, alt, true
+}
+
+// applyVideoInfo copies parsed container metadata onto the photo record
+func applyVideoInfo(metadata *PhotoMetadata, info *VideoInfo) {
+	metadata.Duration = info.Duration
+	metadata.Width = info.Width
+	metadata.Height = info.Height
+	metadata.Rotation = info.Rotation
+	metadata.VideoCodec = info.Codec
+	metadata.Make = info.Make
+	metadata.Model = info.Model
+	metadata.Software = info.Software
+
+	if !info.CreationTime.IsZero() {
+		// mvhd times are UTC with no local offset, so show them in the event timezone
+		if info.CreationTime.Location() == time.UTC {
+			setCaptureTime(metadata, info.CreationTime.In(eventSettings(metadata.EventID).Location()), dateFromVideo, timezoneFromEvent)
+		} else {
+			setCaptureTime(metadata, info.CreationTime, dateFromVideo, timezoneFromOffset)
+		}
+	}
+	if lat, lon, alt, ok := parseISO6709(info.Location); ok {
+		metadata.Latitude = lat
+		metadata.Longitude = lon
+		metadata.Altitude = alt
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+// box builds an atom from its type and payload parts
+func box(atomType string, parts ...[]byte) []byte {
+	payload := bytes.Join(parts, nil)
+	out := binary.BigEndian.AppendUint32(nil, uint32(8+len(payload)))
+	return append(append(out, atomType...), payload...)
+}
+
+func u16(v uint16) []byte { return binary.BigEndian.AppendUint16(nil, v) }
+func u32(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+func u64(v uint64) []byte { return binary.BigEndian.AppendUint64(nil, v) }
+
+func quickTimeSeconds(t time.Time) uint64 {
+	return uint64(t.Sub(quickTimeEpoch) / time.Second)
+}
+
+func mvhd0(created time.Time, timescale, duration uint32) []byte {
+	return box("mvhd", u32(0), u32(uint32(quickTimeSeconds(created))), u32(0), u32(timescale), u32(duration), make([]byte, 80))
+}
+
+func mvhd1(created time.Time, timescale uint32, duration uint64) []byte {
+	return box("mvhd", u32(1<<24), u64(quickTimeSeconds(created)), u64(0), u32(timescale), u64(duration), make([]byte, 80))
+}
+
+// matrix returns a tkhd transformation matrix rotating by a multiple of 90
+// degrees, as 16.16 fixed-point values
+func matrix(degrees int) []byte {
+	cosSin := map[int][2]int32{0: {1, 0}, 90: {0, 1}, 180: {-1, 0}, 270: {0, -1}}[degrees]
+	a, b := cosSin[0], cosSin[1]
+	fixed := func(v int32) []byte { return u32(uint32(v << 16)) }
+	return bytes.Join([][]byte{fixed(a), fixed(b), u32(0), fixed(-b), fixed(a), u32(0), u32(0), u32(0), u32(1 << 30)}, nil)
+}
+
+func tkhd(version byte, rotation, width, height int) []byte {
+	times := make([]byte, 20) // creation, modification, track ID, reserved, duration
+	if version == 1 {
+		times = make([]byte, 32)
+	}
+	return box("tkhd", u32(uint32(version)<<24), times, make([]byte, 16), matrix(rotation), u32(uint32(width)<<16), u32(uint32(height)<<16))
+}
+
+func hdlr(handler string) []byte {
+	return box("hdlr", u32(0), u32(0), []byte(handler), make([]byte, 12))
+}
+
+func track(handler, codec string, header []byte) []byte {
+	stsd := box("stsd", u32(0), u32(1), u32(86), []byte(codec), make([]byte, 70))
+	return box("trak", header, box("mdia", hdlr(handler), box("minf", box("stbl", stsd))))
+}
+
+// udtaText builds a QuickTime international text atom such as ©xyz
+func udtaText(atomType, value string) []byte {
+	return box(atomType, u16(uint16(len(value))), u16(0x15c7), []byte(value))
+}
+
+// mdtaMeta builds Apple key/value metadata from alternating keys and values
+func mdtaMeta(pairs ...string) []byte {
+	var keys, items [][]byte
+	for i := 0; i+1 < len(pairs); i += 2 {
+		keys = append(keys, u32(uint32(8+len(pairs[i]))), []byte("mdta"), []byte(pairs[i]))
+		items = append(items, box(string(u32(uint32(i/2+1))), box("data", u32(1), u32(0), []byte(pairs[i+1]))))
+	}
+	return box("meta", hdlr("mdta"), box("keys", u32(0), u32(uint32(len(pairs)/2)), bytes.Join(keys, nil)), box("ilst", items...))
+}
+
+func movie(children ...[]byte) []byte {
+	return append(box("ftyp", []byte("qt  "), u32(0), []byte("qt  ")), box("moov", children...)...)
+}
+
+func TestParseQuickTime(t *testing.T) {
+	created := time.Date(2024, 6, 15, 21, 5, 33, 0, time.UTC)
+	tests := []struct {
+		name string
+		file []byte
+		want VideoInfo
+	}{
+		{
+			name: "iPhone MOV with mdta keys",
+			file: movie(
+				mvhd0(created, 600, 7425),
+				track("soun", "mp4a", tkhd(0, 0, 0, 0)),
+				track("vide", "hvc1", tkhd(0, 90, 1920, 1080)),
+				mdtaMeta(
+					"com.apple.quicktime.make", "Apple",
+					"com.apple.quicktime.model", "iPhone 15 Pro",
+					"com.apple.quicktime.software", "17.5.1",
+					"com.apple.quicktime.location.ISO6709", "+40.7580-073.9855+012.345/",
+					"com.apple.quicktime.creationdate", "2024-06-15T17:05:33-0400",
+				),
+			),
+			want: VideoInfo{
+				Duration:     12.375,
+				CreationTime: time.Date(2024, 6, 15, 17, 5, 33, 0, time.FixedZone("", -4*3600)),
+				Width:        1920, Height: 1080, Rotation: 90, Codec: "hvc1",
+				Make: "Apple", Model: "iPhone 15 Pro", Software: "17.5.1",
+				Location: "+40.7580-073.9855+012.345/",
+			},
+		},
+		{
+			name: "Android MP4 with version 1 headers and udta text",
+			file: movie(
+				mvhd1(created, 90000, 900000),
+				track("vide", "avc1", tkhd(1, 270, 3840, 2160)),
+				box("udta", udtaText("\xa9xyz", "+51.5007-000.1246/"), udtaText("\xa9mak", "Google"), udtaText("\xa9mod", "Pixel 8")),
+			),
+			want: VideoInfo{
+				Duration: 10, CreationTime: created,
+				Width: 3840, Height: 2160, Rotation: 270, Codec: "avc1",
+				Make: "Google", Model: "Pixel 8",
+				Location: "+51.5007-000.1246/",
+			},
+		},
+		{
+			name: "ISO meta inside udta",
+			file: movie(
+				mvhd0(created, 1000, 1500),
+				track("vide", "mp4v", tkhd(0, 180, 640, 480)),
+				box("udta", box("meta", u32(0), mdtaMeta("com.apple.quicktime.make", "Apple")[8:])),
+			),
+			want: VideoInfo{
+				Duration: 1.5, CreationTime: created,
+				Width: 640, Height: 480, Rotation: 180, Codec: "mp4v",
+				Make: "Apple",
+			},
+		},
+		{
+			name: "moov after mdat",
+			file: append(append(box("ftyp", []byte("isom"), u32(0)), box("mdat", make([]byte, 64))...),
+				box("moov", mvhd0(created, 1000, 2000))...),
+			want: VideoInfo{Duration: 2, CreationTime: created},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bytes.NewReader(tt.file)
+			if !isQuickTime(r) {
+				t.Fatal("not recognized as QuickTime")
+			}
+			info, err := parseQuickTime(r, int64(len(tt.file)))
+			if err != nil {
+				t.Fatalf("parseQuickTime: %v", err)
+			}
+			if !info.CreationTime.Equal(tt.want.CreationTime) {
+				t.Errorf("CreationTime = %v, want %v", info.CreationTime, tt.want.CreationTime)
+			}
+			_, gotOffset := info.CreationTime.Zone()
+			_, wantOffset := tt.want.CreationTime.Zone()
+			if gotOffset != wantOffset {
+				t.Errorf("CreationTime offset = %d, want %d", gotOffset, wantOffset)
+			}
+			info.CreationTime, tt.want.CreationTime = time.Time{}, time.Time{}
+			if *info != tt.want {
+				t.Errorf("parseQuickTime = %+v, want %+v", *info, tt.want)
+			}
+		})
+	}
+}
+
+// Hostile or truncated files must neither panic nor loop, and anything
+// readable before the damage is still used
+func TestParseQuickTimeMalformed(t *testing.T) {
+	created := time.Date(2024, 6, 15, 21, 5, 33, 0, time.UTC)
+	valid := movie(mvhd0(created, 600, 600), track("vide", "hvc1", tkhd(0, 0, 1920, 1080)))
+
+	// withSize overwrites the 32-bit size of the atom starting at offset
+	withSize := func(file []byte, offset int, size uint32) []byte {
+		out := append([]byte(nil), file...)
+		binary.BigEndian.PutUint32(out[offset:], size)
+		return out
+	}
+	moovAt := bytes.Index(valid, []byte("moov")) - 4
+	mvhdAt := bytes.Index(valid, []byte("mvhd")) - 4
+
+	tests := []struct {
+		name    string
+		file    []byte
+		wantErr bool
+	}{
+		{"empty", nil, true},
+		{"header only", []byte{0, 0, 0, 8}, true},
+		{"truncated moov", valid[:len(valid)-40], true},
+		{"atom smaller than its header", withSize(valid, moovAt, 4), true},
+		{"atom past the end", withSize(valid, moovAt, 1<<31), true},
+		{"child smaller than its header", withSize(valid, mvhdAt, 7), true},
+		{"child past its parent", withSize(valid, mvhdAt, 4096), true},
+		{"zero size extends to the end", withSize(valid, moovAt, 0), false},
+		{
+			// A 64-bit size that would overflow offset+size
+			name:    "huge 64-bit size",
+			file:    append(valid[:moovAt:moovAt], append(append(u32(1), "moov"...), u64(1<<63-1)...)...),
+			wantErr: true,
+		},
+		{
+			name:    "64-bit size smaller than its header",
+			file:    append(valid[:moovAt:moovAt], append(append(u32(1), "moov"...), u64(12)...)...),
+			wantErr: true,
+		},
+		{"short mvhd", movie(box("mvhd", u32(0), u32(1))), false},
+		{"short tkhd and stsd", movie(box("trak", box("tkhd", u32(0)), box("mdia", hdlr("vide"), box("minf", box("stbl", box("stsd", u32(0))))))), false},
+		{"short hdlr", movie(box("trak", box("mdia", box("hdlr", u32(0))))), false},
+		{"key count far beyond the keys", movie(box("meta", box("keys", u32(0), u32(0xFFFFFFFF)), box("ilst"))), false},
+		{"key size past the keys", movie(box("meta", box("keys", u32(0), u32(1), u32(4096), []byte("mdta")), box("ilst", box(string(u32(1)), box("data", u32(1), u32(0), []byte("x")))))), false},
+		{"ilst index without a key", movie(box("meta", box("keys", u32(0), u32(0)), box("ilst", box(string(u32(7)), box("data", u32(1), u32(0), []byte("x")))))), false},
+		{"udta meta without version", movie(box("udta", box("meta", []byte{0, 0}))), false},
+		{"udta text length past the atom", movie(box("udta", box("\xa9xyz", u16(0xFFFF), u16(0), []byte("+1+2/")))), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			done := make(chan error, 1)
+			go func() {
+				_, err := parseQuickTime(bytes.NewReader(tt.file), int64(len(tt.file)))
+				done <- err
+			}()
+			select {
+			case err := <-done:
+				if (err != nil) != tt.wantErr {
+					t.Errorf("parseQuickTime error = %v, want error %t", err, tt.wantErr)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("parseQuickTime did not return")
+			}
+		})
+	}
+}
+
+func TestParseISO6709(t *testing.T) {
+	tests := []struct {
+		value         string
+		lat, lon, alt float64
+		ok            bool
+	}{
+		{"+37.3349-122.0090+010.000/", 37.3349, -122.009, 10, true},
+		{"+40.7580-073.9855/", 40.758, -73.9855, 0, true},
+		{"-33.8568+151.2153-005.5/", -33.8568, 151.2153, -5.5, true},
+		{"+48+002/", 48, 2, 0, true},
+		{"", 0, 0, 0, false},
+		{"37.3349,-122.0090", 0, 0, 0, false},
+		{"+37.3349/", 0, 0, 0, false},
+	}
+	for _, tt := range tests {
+		lat, lon, alt, ok := parseISO6709(tt.value)
+		if ok != tt.ok || lat != tt.lat || lon != tt.lon || alt != tt.alt {
+			t.Errorf("parseISO6709(%q) = %v, %v, %v, %t, want %v, %v, %v, %t", tt.value, lat, lon, alt, ok, tt.lat, tt.lon, tt.alt, tt.ok)
+		}
+	}
+}
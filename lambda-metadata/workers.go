@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// Records are processed by a small pool of workers. Each one mostly waits on
+// S3, Rekognition and DynamoDB, but decoding for renditions needs memory, so
+// the default stays modest.
+const defaultConcurrency = 4
+
+// A record isn't started with less than this left before the invocation
+// times out, and retries inside a record give up this much before it
+const (
+	startMargin  = 15 * time.Second
+	finishMargin = 2 * time.Second
+)
+
+// errDeadline marks records left unstarted because the invocation was about
+// to time out. It is retryable so Lambda redelivers the event.
+var errDeadline = transient(errors.New("not started: invocation deadline too close"))
+
+// recordResult is the outcome of processing one event record
+type recordResult struct {
+	Record   events.S3EventRecord
+	Err      error
+	Skipped  bool // never started because of the deadline
+	Duration time.Duration
+}
+
+// concurrency reads METADATA_CONCURRENCY, falling back to the default
+func concurrency() int {
+	if value := os.Getenv("METADATA_CONCURRENCY"); value != "" {
+		if n, err := strconv.Atoi(value); err == nil && n > 0 {
+			return n
+		}
+		log.Printf("Invalid METADATA_CONCURRENCY %q, using %d", value, defaultConcurrency)
+	}
+	return defaultConcurrency
+}
+
+// processRecords runs records through process on a bounded worker pool,
+// returning one result per record in the original order
+func processRecords(ctx context.Context, records []events.S3EventRecord, workers int, process func(context.Context, events.S3EventRecord) error) []recordResult {
+	results := make([]recordResult, len(records))
+	jobs := make(chan int)
+
+	// Work in flight stops retrying shortly before the invocation times out
+	workCtx := ctx
+	if deadline, ok := ctx.Deadline(); ok {
+		var cancel context.CancelFunc
+		workCtx, cancel = context.WithDeadline(ctx, deadline.Add(-finishMargin))
+		defer cancel()
+	}
+
+	var wg sync.WaitGroup
+	for range min(workers, len(records)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				results[i] = runRecord(ctx, workCtx, records[i], process)
+			}
+		}()
+	}
+
+	for i := range records {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	return results
+}
+
+func runRecord(ctx, workCtx context.Context, record events.S3EventRecord, process func(context.Context, events.S3EventRecord) error) recordResult {
+	result := recordResult{Record: record}
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < startMargin {
+		result.Err = errDeadline
+		result.Skipped = true
+		return result
+	}
+
+	start := time.Now()
+	result.Err = process(workCtx, record)
+	result.Duration = time.Since(start)
+	return result
+}
+
+// retryError picks the error that makes Lambda retry the event: a record
+// skipped near the deadline or one that failed with a retryable error.
+// Permanent failures are recorded and dropped, so they don't count.
+func retryError(results []recordResult) error {
+	var err error
+	for _, result := range results {
+		if result.Skipped || isRetryable(result.Err) {
+			err = result.Err
+		}
+	}
+	return err
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+func testRecords(n int) []events.S3EventRecord {
+	records := make([]events.S3EventRecord, n)
+	for i := range records {
+		records[i].S3.Object.URLDecodedKey = fmt.Sprintf("uploads/%d.jpg", i)
+	}
+	return records
+}
+
+func TestProcessRecordsDeadline(t *testing.T) {
+	tests := []struct {
+		name        string
+		timeLeft    time.Duration // 0 for no deadline
+		wantSkipped bool
+	}{
+		{name: "no deadline", timeLeft: 0},
+		{name: "plenty of time", timeLeft: time.Minute},
+		{name: "inside the start margin", timeLeft: startMargin - time.Second, wantSkipped: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			var deadline time.Time
+			if tt.timeLeft > 0 {
+				var cancel context.CancelFunc
+				deadline = time.Now().Add(tt.timeLeft)
+				ctx, cancel = context.WithDeadline(ctx, deadline)
+				defer cancel()
+			}
+
+			var mu sync.Mutex
+			var workDeadlines []time.Time
+			results := processRecords(ctx, testRecords(3), 2, func(ctx context.Context, _ events.S3EventRecord) error {
+				d, _ := ctx.Deadline()
+				mu.Lock()
+				workDeadlines = append(workDeadlines, d)
+				mu.Unlock()
+				return nil
+			})
+
+			for i, result := range results {
+				if result.Skipped != tt.wantSkipped {
+					t.Errorf("record %d Skipped = %t, want %t", i, result.Skipped, tt.wantSkipped)
+				}
+				if tt.wantSkipped && !errors.Is(result.Err, errDeadline) {
+					t.Errorf("record %d Err = %v, want errDeadline", i, result.Err)
+				}
+				if !tt.wantSkipped && result.Err != nil {
+					t.Errorf("record %d Err = %v", i, result.Err)
+				}
+			}
+			if tt.wantSkipped {
+				if len(workDeadlines) != 0 {
+					t.Errorf("processed %d records inside the start margin", len(workDeadlines))
+				}
+				return
+			}
+
+			// Work stops retrying finishMargin before the invocation does
+			want := time.Time{}
+			if !deadline.IsZero() {
+				want = deadline.Add(-finishMargin)
+			}
+			for _, d := range workDeadlines {
+				if !d.Equal(want) {
+					t.Errorf("work deadline = %v, want %v", d, want)
+				}
+			}
+		})
+	}
+}
+
+func TestProcessRecordsStopsStartingNearDeadline(t *testing.T) {
+	// Room for the first record only: by the time it finishes, less than
+	// startMargin is left
+	ctx, cancel := context.WithTimeout(context.Background(), startMargin+300*time.Millisecond)
+	defer cancel()
+
+	var calls atomic.Int32
+	results := processRecords(ctx, testRecords(3), 1, func(context.Context, events.S3EventRecord) error {
+		calls.Add(1)
+		time.Sleep(600 * time.Millisecond)
+		return nil
+	})
+
+	if calls.Load() != 1 {
+		t.Errorf("processed %d records, want 1", calls.Load())
+	}
+	for i, result := range results {
+		wantSkipped := i > 0
+		if result.Skipped != wantSkipped {
+			t.Errorf("record %d Skipped = %t, want %t", i, result.Skipped, wantSkipped)
+		}
+	}
+	if !errors.Is(retryError(results), errDeadline) {
+		t.Errorf("retryError = %v, want errDeadline", retryError(results))
+	}
+}
+
+func TestProcessRecordsConcurrency(t *testing.T) {
+	tests := []struct {
+		records, workers, wantMax int
+	}{
+		{records: 10, workers: 3, wantMax: 3},
+		{records: 2, workers: 8, wantMax: 2},
+		{records: 5, workers: 1, wantMax: 1},
+		{records: 0, workers: 4, wantMax: 0},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d records on %d workers", tt.records, tt.workers), func(t *testing.T) {
+			var active, maxActive atomic.Int32
+			records := testRecords(tt.records)
+			results := processRecords(context.Background(), records, tt.workers, func(_ context.Context, record events.S3EventRecord) error {
+				n := active.Add(1)
+				defer active.Add(-1)
+				for {
+					m := maxActive.Load()
+					if n <= m || maxActive.CompareAndSwap(m, n) {
+						break
+					}
+				}
+				time.Sleep(20 * time.Millisecond)
+				return errors.New(record.S3.Object.URLDecodedKey)
+			})
+
+			if int(maxActive.Load()) != tt.wantMax {
+				t.Errorf("max concurrent records = %d, want %d", maxActive.Load(), tt.wantMax)
+			}
+			if len(results) != len(records) {
+				t.Fatalf("got %d results, want %d", len(results), len(records))
+			}
+			// Results line up with their records whatever order they ran in
+			for i, result := range results {
+				key := records[i].S3.Object.URLDecodedKey
+				if result.Record.S3.Object.URLDecodedKey != key || result.Err == nil || result.Err.Error() != key {
+					t.Errorf("result %d = %s, %v, want %s", i, result.Record.S3.Object.URLDecodedKey, result.Err, key)
+				}
+			}
+		})
+	}
+}
+
+func TestRetryError(t *testing.T) {
+	permanent := errors.New("image: unknown format")
+	throttled := awserr.New("ThrottlingException", "Rate exceeded", nil)
+	tests := []struct {
+		name    string
+		results []recordResult
+		want    error
+	}{
+		{name: "no records", want: nil},
+		{name: "all succeeded", results: []recordResult{{}, {}}, want: nil},
+		{name: "permanent failures are dropped", results: []recordResult{{Err: permanent}, {}}, want: nil},
+		{name: "retryable failure", results: []recordResult{{Err: permanent}, {Err: throttled}, {}}, want: throttled},
+		{name: "skipped near the deadline", results: []recordResult{{}, {Err: errDeadline, Skipped: true}}, want: errDeadline},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := retryError(tt.results); got != tt.want {
+				t.Errorf("retryError = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// XMP namespaces we read properties from
+const (
+	xmpNS       = "http://ns.adobe.com/xap/1.0/"
+	dcNS        = "http://purl.org/dc/elements/1.1/"
+	rdfNS       = "http://www.w3.org/1999/02/22-rdf-syntax-ns#"
+	exifNS      = "http://ns.adobe.com/exif/1.0/"
+	photoshopNS = "http://ns.adobe.com/photoshop/1.0/"
+)
+
+type XMPData struct {
+	Rating      int
+	Keywords    []string
+	Title       string
+	Description string
+	CreateDate  string // ISO 8601, possibly without an offset or time
+}
+
+// findXMP returns the XMP packet embedded in a file's header bytes. Searching
+// for the packet itself works the same for JPEG APP1, PNG iTXt and WebP
+// chunks, so the container doesn't need to be parsed.
+func findXMP(data []byte) []byte {
+	start := bytes.Index(data, []byte("<x:xmpmeta"))
+	if start < 0 {
+		return nil
+	}
+	end := bytes.Index(data[start:], []byte("</x:xmpmeta>"))
+	if end < 0 {
+		return nil
+	}
+	return data[start : start+end+len("</x:xmpmeta>")]
+}
+
+// parseXMP collects RDF property values, whether written as attributes of
+// rdf:Description or as child elements (including rdf:Bag/Seq/Alt lists)
+func parseXMP(packet []byte) (*XMPData, error) {
+	values := make(map[xml.Name][]string)
+	decoder := xml.NewDecoder(bytes.NewReader(packet))
+	var stack []xml.Name
+
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			stack = append(stack, t.Name)
+			if t.Name.Space == rdfNS && t.Name.Local == "Description" {
+				for _, attr := range t.Attr {
+					if attr.Name.Space != rdfNS && attr.Name.Space != "xmlns" && attr.Name.Space != "" {
+						values[attr.Name] = append(values[attr.Name], attr.Value)
+					}
+				}
+			}
+		case xml.EndElement:
+			stack = stack[:len(stack)-1]
+		case xml.CharData:
+			text := strings.TrimSpace(string(t))
+			if text == "" {
+				continue
+			}
+			// The property is the element directly inside the nearest rdf:Description
+			for i := len(stack) - 2; i >= 0; i-- {
+				if stack[i].Space == rdfNS && stack[i].Local == "Description" {
+					values[stack[i+1]] = append(values[stack[i+1]], text)
+					break
+				}
+			}
+		}
+	}
+
+	first := func(space, local string) string {
+		if v := values[xml.Name{Space: space, Local: local}]; len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	}
+
+	data := &XMPData{
+		Keywords:    values[xml.Name{Space: dcNS, Local: "subject"}],
+		Title:       first(dcNS, "title"),
+		Description: first(dcNS, "description"),
+	}
+	// Prefer the capture time over the time the file was created on a computer
+	for _, name := range []xml.Name{
+		{Space: exifNS, Local: "DateTimeOriginal"},
+		{Space: photoshopNS, Local: "DateCreated"},
+		{Space: xmpNS, Local: "CreateDate"},
+	} {
+		if date := first(name.Space, name.Local); date != "" {
+			data.CreateDate = date
+			break
+		}
+	}
+	if rating, err := strconv.Atoi(first(xmpNS, "Rating")); err == nil {
+		data.Rating = rating
+	}
+
+	return data, nil
+}
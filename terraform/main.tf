@@ -20,10 +20,59 @@ provider "aws" {
   region = "us-east-1"
 }
 
+variable "metadata_concurrency" {
+  description = "Number of S3 event records the metadata lambda processes at once"
+  type        = number
+  default     = 4
+}
+
+variable "event_timezone" {
+  description = "IANA timezone assumed for capture times that carry no UTC offset, for events that don't set their own"
+  type        = string
+  default     = "UTC"
+}
+
+variable "face_collection_id" {
+  description = "Rekognition collection faces are indexed into. The metadata lambda creates it if missing; see `make rebuild-collection` for moving to a newer face model"
+  type        = string
+  default     = "wedding-faces"
+}
+
+variable "admin_token" {
+  description = "Bearer token for the admin APIs (events, albums, people naming, merging and moderation). Admin routes are disabled when empty"
+  type        = string
+  default     = ""
+  sensitive   = true
+}
+
+# Signs guest session cookies, which likes and comments are keyed on
+resource "random_password" "session_secret" {
+  length  = 48
+  special = false
+}
+
 resource "aws_s3_bucket" "photos" {
   bucket = "wedding-photos-${random_string.bucket_suffix.result}"
 }
 
+# Selfies are deleted after each search; this catches abandoned uploads
+resource "aws_s3_bucket_lifecycle_configuration" "photos" {
+  bucket = aws_s3_bucket.photos.id
+
+  rule {
+    id     = "expire-selfies"
+    status = "Enabled"
+
+    filter {
+      prefix = "selfies/"
+    }
+
+    expiration {
+      days = 1
+    }
+  }
+}
+
 resource "aws_s3_bucket_cors_configuration" "photos" {
   bucket = aws_s3_bucket.photos.id
 
@@ -95,12 +144,51 @@ resource "aws_iam_role_policy" "lambda_s3_policy" {
         Action = [
           "dynamodb:Scan",
           "dynamodb:Query",
-          "dynamodb:GetItem"
+          "dynamodb:GetItem",
+          "dynamodb:BatchGetItem"
         ]
         Resource = [
           aws_dynamodb_table.photo_metadata.arn,
-          "${aws_dynamodb_table.photo_metadata.arn}/index/*"
+          "${aws_dynamodb_table.photo_metadata.arn}/index/*",
+          aws_dynamodb_table.photo_status.arn,
+          aws_dynamodb_table.people.arn,
+          aws_dynamodb_table.face_assignments.arn,
+          aws_dynamodb_table.events.arn,
+          aws_dynamodb_table.albums.arn,
+          aws_dynamodb_table.likes.arn,
+          "${aws_dynamodb_table.likes.arn}/index/*",
+          aws_dynamodb_table.comments.arn
+        ]
+      },
+      {
+        Effect = "Allow"
+        Action = [
+          "dynamodb:PutItem",
+          "dynamodb:UpdateItem"
         ]
+        Resource = [
+          aws_dynamodb_table.photo_metadata.arn, # counts and face people
+          aws_dynamodb_table.people.arn,
+          aws_dynamodb_table.face_assignments.arn,
+          aws_dynamodb_table.events.arn,
+          aws_dynamodb_table.albums.arn,
+          aws_dynamodb_table.likes.arn,
+          aws_dynamodb_table.comments.arn
+        ]
+      },
+      {
+        Effect = "Allow"
+        Action = ["dynamodb:DeleteItem"]
+        Resource = [
+          aws_dynamodb_table.albums.arn,
+          aws_dynamodb_table.likes.arn,
+          aws_dynamodb_table.comments.arn
+        ]
+      },
+      {
+        Effect   = "Allow"
+        Action   = ["rekognition:SearchFacesByImage"]
+        Resource = "*"
       }
     ]
   })
@@ -143,13 +231,26 @@ resource "aws_lambda_function" "wedding_app" {
   role            = aws_iam_role.lambda_role.arn
   handler         = "bootstrap"
   runtime         = "provided.al2023"
+  timeout          = 30
+  memory_size      = 1024 # on-demand resizing in /img
 
   source_code_hash = filebase64sha256("../lambda-app/main.zip")
 
   environment {
     variables = {
-      S3_BUCKET      = aws_s3_bucket.photos.bucket
-      DYNAMODB_TABLE = aws_dynamodb_table.photo_metadata.name
+      S3_BUCKET              = aws_s3_bucket.photos.bucket
+      DYNAMODB_TABLE         = aws_dynamodb_table.photo_metadata.name
+      STATUS_TABLE           = aws_dynamodb_table.photo_status.name
+      PEOPLE_TABLE           = aws_dynamodb_table.people.name
+      FACE_ASSIGNMENTS_TABLE = aws_dynamodb_table.face_assignments.name
+      EVENTS_TABLE           = aws_dynamodb_table.events.name
+      ALBUMS_TABLE           = aws_dynamodb_table.albums.name
+      LIKES_TABLE            = aws_dynamodb_table.likes.name
+      COMMENTS_TABLE         = aws_dynamodb_table.comments.name
+      SESSION_SECRET         = random_password.session_secret.result
+      EVENT_TIMEZONE         = var.event_timezone
+      FACE_COLLECTION_ID     = var.face_collection_id
+      ADMIN_TOKEN            = var.admin_token
     }
   }
 }
@@ -187,23 +288,54 @@ resource "aws_iam_role_policy" "metadata_lambda_policy" {
       {
         Effect = "Allow"
         Action = [
-          "s3:GetObject"
+          "s3:GetObject",
+          "s3:PutObject",
+          "s3:DeleteObject"
         ]
         Resource = "${aws_s3_bucket.photos.arn}/*"
       },
+      {
+        # Listing the derivative folders of a deleted upload
+        Effect   = "Allow"
+        Action   = ["s3:ListBucket"]
+        Resource = aws_s3_bucket.photos.arn
+      },
       {
         Effect = "Allow"
         Action = [
           "dynamodb:PutItem",
-          "dynamodb:UpdateItem"
+          "dynamodb:UpdateItem",
+          "dynamodb:GetItem",
+          "dynamodb:Query",
+          "dynamodb:DeleteItem",
+          "dynamodb:BatchGetItem"
+        ]
+        Resource = [
+          aws_dynamodb_table.photo_metadata.arn,
+          aws_dynamodb_table.photo_failures.arn,
+          aws_dynamodb_table.photo_status.arn,
+          aws_dynamodb_table.people.arn,
+          aws_dynamodb_table.face_assignments.arn,
+          "${aws_dynamodb_table.face_assignments.arn}/index/*",
+          aws_dynamodb_table.events.arn,
+          aws_dynamodb_table.likes.arn, # removed with their photo
+          aws_dynamodb_table.comments.arn
         ]
-        Resource = aws_dynamodb_table.photo_metadata.arn
+      },
+      {
+        Effect   = "Allow"
+        Action   = ["sqs:SendMessage"]
+        Resource = aws_sqs_queue.metadata_dlq.arn
       },
       {
         Effect = "Allow"
         Action = [
+          "rekognition:CreateCollection",
+          "rekognition:DescribeCollection",
           "rekognition:IndexFaces",
-          "rekognition:SearchFacesByImage"
+          "rekognition:DeleteFaces",
+          "rekognition:ListFaces", # faces left by an unfinished run
+          "rekognition:SearchFaces"
         ]
         Resource = "*"
       }
@@ -211,6 +343,165 @@ resource "aws_iam_role_policy" "metadata_lambda_policy" {
   })
 }
 
+# Objects the metadata lambda failed to process, kept until replayed
+resource "aws_dynamodb_table" "photo_failures" {
+  name         = "wedding-photo-failures"
+  billing_mode = "PAY_PER_REQUEST"
+  hash_key     = "photoId"
+
+  attribute {
+    name = "photoId"
+    type = "S"
+  }
+}
+
+# Processing status of each upload, written as the metadata lambda works
+resource "aws_dynamodb_table" "photo_status" {
+  name         = "wedding-photo-status"
+  billing_mode = "PAY_PER_REQUEST"
+  hash_key     = "photoId"
+
+  attribute {
+    name = "photoId"
+    type = "S"
+  }
+}
+
+# Guests recognised across photos: clusters of Rekognition face IDs
+resource "aws_dynamodb_table" "people" {
+  name         = "wedding-people"
+  billing_mode = "PAY_PER_REQUEST"
+  hash_key     = "personId"
+
+  attribute {
+    name = "personId"
+    type = "S"
+  }
+}
+
+# Which person each indexed face belongs to
+resource "aws_dynamodb_table" "face_assignments" {
+  name         = "wedding-face-assignments"
+  billing_mode = "PAY_PER_REQUEST"
+  hash_key     = "faceId"
+
+  attribute {
+    name = "faceId"
+    type = "S"
+  }
+
+  attribute {
+    name = "photoId"
+    type = "S"
+  }
+
+  global_secondary_index {
+    name            = "photoId-index"
+    hash_key        = "photoId"
+    projection_type = "ALL"
+  }
+}
+
+# Curated photo collections, each an ordered list of one event's photos
+resource "aws_dynamodb_table" "albums" {
+  name         = "wedding-albums"
+  billing_mode = "PAY_PER_REQUEST"
+  hash_key     = "albumId"
+
+  attribute {
+    name = "albumId"
+    type = "S"
+  }
+}
+
+# Guests' likes, one item per photo and guest session. Each photo's count is
+# kept on its metadata item; the index lists a guest's favorites.
+resource "aws_dynamodb_table" "likes" {
+  name         = "wedding-likes"
+  billing_mode = "PAY_PER_REQUEST"
+  hash_key     = "photoId"
+  range_key    = "guestId"
+
+  attribute {
+    name = "photoId"
+    type = "S"
+  }
+
+  attribute {
+    name = "guestId"
+    type = "S"
+  }
+
+  attribute {
+    name = "likedAt"
+    type = "N"
+  }
+
+  global_secondary_index {
+    name            = "guestId-index"
+    hash_key        = "guestId"
+    range_key       = "likedAt"
+    projection_type = "ALL"
+  }
+}
+
+# Guests' comments on photos, oldest first: comment IDs start with the time
+# they were posted. Each photo's count of visible comments is kept on its
+# metadata item.
+resource "aws_dynamodb_table" "comments" {
+  name         = "wedding-comments"
+  billing_mode = "PAY_PER_REQUEST"
+  hash_key     = "photoId"
+  range_key    = "commentId"
+
+  attribute {
+    name = "photoId"
+    type = "S"
+  }
+
+  attribute {
+    name = "commentId"
+    type = "S"
+  }
+}
+
+# Settings of each event beyond the default one: name, timezone, face collection
+resource "aws_dynamodb_table" "events" {
+  name         = "wedding-events"
+  billing_mode = "PAY_PER_REQUEST"
+  hash_key     = "eventId"
+
+  attribute {
+    name = "eventId"
+    type = "S"
+  }
+}
+
+# Events Lambda gave up on after its own retries (timeouts, crashes)
+resource "aws_sqs_queue" "metadata_dlq" {
+  name                      = "wedding-metadata-dlq"
+  message_retention_seconds = 1209600 # 14 days, the maximum
+}
+
+resource "aws_lambda_function_event_invoke_config" "metadata_extractor" {
+  function_name          = aws_lambda_function.metadata_extractor.function_name
+  maximum_retry_attempts = 2
+
+  destination_config {
+    on_failure {
+      destination = aws_sqs_queue.metadata_dlq.arn
+    }
+  }
+}
+
+output "metadata_dlq_url" {
+  value = aws_sqs_queue.metadata_dlq.url
+}
+
+output "photos_bucket" {
+  value = aws_s3_bucket.photos.bucket
+}
+
 # Lambda function - Metadata Extraction
 resource "aws_lambda_function" "metadata_extractor" {
   filename         = "../lambda-metadata/main.zip"
@@ -219,13 +510,23 @@ resource "aws_lambda_function" "metadata_extractor" {
   handler         = "bootstrap"
   runtime         = "provided.al2023"
   timeout          = 60
-  memory_size      = 512
+  memory_size      = 1024 # decoding full-resolution images for renditions
 
   source_code_hash = filebase64sha256("../lambda-metadata/main.zip")
 
   environment {
     variables = {
-      DYNAMODB_TABLE = aws_dynamodb_table.photo_metadata.name
+      DYNAMODB_TABLE         = aws_dynamodb_table.photo_metadata.name
+      FAILURES_TABLE         = aws_dynamodb_table.photo_failures.name
+      STATUS_TABLE           = aws_dynamodb_table.photo_status.name
+      PEOPLE_TABLE           = aws_dynamodb_table.people.name
+      FACE_ASSIGNMENTS_TABLE = aws_dynamodb_table.face_assignments.name
+      EVENTS_TABLE           = aws_dynamodb_table.events.name
+      LIKES_TABLE            = aws_dynamodb_table.likes.name
+      COMMENTS_TABLE         = aws_dynamodb_table.comments.name
+      FACE_COLLECTION_ID     = var.face_collection_id
+      EVENT_TIMEZONE         = var.event_timezone
+      METADATA_CONCURRENCY   = var.metadata_concurrency
     }
   }
 }
@@ -244,7 +545,7 @@ resource "aws_s3_bucket_notification" "photo_upload" {
 
   lambda_function {
     lambda_function_arn = aws_lambda_function.metadata_extractor.arn
-    events              = ["s3:ObjectCreated:*"]
+    events              = ["s3:ObjectCreated:*", "s3:ObjectRemoved:*"]
     filter_prefix       = "uploads/"
   }
 
@@ -260,8 +561,8 @@ resource "aws_lambda_function_url" "wedding_app" {
     allow_credentials = false
     allow_origins     = ["*"]
     allow_methods     = ["*"]
-    allow_headers     = ["date", "keep-alive", "content-type"]
-    expose_headers    = ["date", "keep-alive"]
+    allow_headers     = ["date", "keep-alive", "content-type", "authorization"]
+    expose_headers    = ["date", "keep-alive", "x-next-cursor"]
     max_age          = 86400
   }
 }